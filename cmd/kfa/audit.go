@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rophy/kube-federated-auth/internal/audit"
+)
+
+func runAuditVerify(args []string) error {
+	fs := flag.NewFlagSet("audit-verify", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: kfa audit-verify <audit.log>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := audit.VerifyChain(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w (after %d intact events)", fs.Arg(0), err, n)
+	}
+	fmt.Printf("%s: hash chain intact (%d events)\n", fs.Arg(0), n)
+	return nil
+}
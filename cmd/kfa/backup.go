@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+)
+
+// runBackup saves a running server's stored credentials as an encrypted
+// bundle, for kfa restore on a fresh install
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	adminURL := fs.String("admin", "", "running server's admin listener, e.g. http://localhost:8081 (required)")
+	output := fs.String("o", "", "write the bundle to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *adminURL == "" || fs.NArg() != 0 {
+		return fmt.Errorf("usage: kfa backup -admin <url> [-o <file>]")
+	}
+
+	data, err := fetchAdmin(strings.TrimSuffix(*adminURL, "/") + "/admin/backup")
+	if err != nil {
+		return err
+	}
+	var bundle credentials.Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return fmt.Errorf("parsing backup: %w", err)
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	// Replace the file atomically, so an interrupted backup never leaves a
+	// partial bundle behind
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".kfa-backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), *output); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Backed up credentials of %d clusters to %s (key %s)\n", len(bundle.Clusters), *output, bundle.KeyID)
+	return nil
+}
+
+// runRestore imports a bundle written by kfa backup into a running server,
+// which must hold the key it was sealed with
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	adminURL := fs.String("admin", "", "running server's admin listener, e.g. http://localhost:8081 (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *adminURL == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: kfa restore -admin <url> <bundle>")
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(*adminURL, "/") + "/admin/backup"
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d: %s", url, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var result struct {
+		Restored []string `json:"restored"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("parsing response: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Restored credentials of %d clusters: %s\n", len(result.Restored), strings.Join(result.Restored, ", "))
+	return nil
+}
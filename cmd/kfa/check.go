@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+// checkOnboard is kfa onboard --check: it connects to the spoke, the hub and
+// the server and reports what onboarding would write, without writing
+// anything. Every check runs; the error counts the failed ones.
+func checkOnboard(ctx context.Context, o onboardOptions, client *http.Client) error {
+	failed := 0
+	report := func(what string, err error, format string, args ...any) {
+		if err != nil {
+			failed++
+			fmt.Printf("  FAIL  %s: %v\n", what, err)
+			return
+		}
+		fmt.Printf("  ok    %s: %s\n", what, fmt.Sprintf(format, args...))
+	}
+
+	spokeCfg, contextName, err := loadRESTConfig(o.kubeconfig, o.kubeContext)
+	if err != nil {
+		return fmt.Errorf("spoke: %w", err)
+	}
+	if o.name == "" {
+		o.name = contextName
+	}
+	spoke, err := kubernetes.NewForConfig(spokeCfg)
+	if err != nil {
+		return fmt.Errorf("spoke: creating client: %w", err)
+	}
+
+	fmt.Printf("==> Checking spoke %s (%s)\n", o.name, spokeCfg.Host)
+	version, err := spoke.Discovery().ServerVersion()
+	if err == nil {
+		report("API server", nil, "reachable, Kubernetes %s", version.GitVersion)
+	} else {
+		report("API server", err, "")
+	}
+	issuer, err := discoverIssuer(ctx, spoke)
+	report("issuer", err, "%s", issuer)
+	ca, err := spokeCA(ctx, spoke, spokeCfg, o)
+	report("CA certificate", err, "%d bytes", len(ca))
+	_, err = spoke.CoreV1().ServiceAccounts(o.namespace).Get(ctx, o.serviceAccount, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		report("ServiceAccount", nil, "%s/%s would be created", o.namespace, o.serviceAccount)
+	default:
+		report("ServiceAccount", err, "%s/%s exists", o.namespace, o.serviceAccount)
+	}
+
+	fmt.Printf("==> Checking hub Secret %s/%s\n", o.hubNamespace, o.secretName)
+	if hubCfg, _, err := loadRESTConfig(o.hubKubeconfig, o.hubContext); err != nil {
+		report("hub", err, "")
+	} else if hub, err := kubernetes.NewForConfig(hubCfg); err != nil {
+		report("hub", err, "")
+	} else {
+		secret, err := hub.CoreV1().Secrets(o.hubNamespace).Get(ctx, o.secretName, metav1.GetOptions{})
+		switch {
+		case errors.IsNotFound(err):
+			report("credentials Secret", nil, "would be created")
+		case err != nil:
+			report("credentials Secret", err, "")
+		default:
+			token := string(secret.Data[credentialKeys(o.name)[0]])
+			if token == "" {
+				report("stored token", nil, "none yet, would be added")
+			} else {
+				report("stored token", checkStoredToken(token, issuer), "%s", describeToken(token))
+			}
+		}
+	}
+
+	if client != nil {
+		fmt.Printf("==> Checking server %s\n", o.server.url)
+		report("server", checkServer(ctx, client, o.server), "reachable")
+	}
+
+	fmt.Printf("\nWould store a %s bootstrap token of %s/%s for %s and the entry:\n\n", o.duration, o.namespace, o.serviceAccount, o.name)
+	fmt.Printf("  %s:\n    issuer: %q\n    api_server: %q\n\n", o.name, issuer, spokeCfg.Host)
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// checkStoredToken decodes a stored token without verifying it, and fails if
+// it has expired or was issued by another issuer than the spoke's
+func checkStoredToken(token, issuer string) error {
+	iss, err := oidc.UnverifiedIssuer(token)
+	if err != nil {
+		return fmt.Errorf("undecodable token: %w", err)
+	}
+	if issuer != "" && iss != issuer {
+		return fmt.Errorf("issued by %s, not the spoke's issuer %s", iss, issuer)
+	}
+	r := credentials.NewRotation(&credentials.Credentials{Token: token}, "", "", time.Now())
+	if !r.ExpiresAt.IsZero() && r.ExpiresAt.Before(time.Now()) {
+		return fmt.Errorf("%s, expired at %s", describeToken(token), r.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// describeToken returns a token's subject and expiry
+func describeToken(token string) string {
+	r := credentials.NewRotation(&credentials.Credentials{Token: token}, "", "", time.Now())
+	if r.ExpiresAt.IsZero() {
+		return r.Subject
+	}
+	return fmt.Sprintf("%s, expires %s", r.Subject, r.ExpiresAt.Format(time.RFC3339))
+}
+
+// checkServer resolves the server's host, unless --resolve or a proxy takes
+// its place, and calls /health through the TLS handshake
+func checkServer(ctx context.Context, client *http.Client, server *serverFlags) error {
+	u, err := url.Parse(server.url)
+	if err != nil {
+		return err
+	}
+	if server.resolve == "" && server.proxy == "" && net.ParseIP(u.Hostname()) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+			return fmt.Errorf("resolving %s: %w", u.Hostname(), err)
+		}
+	}
+	healthURL := strings.TrimSuffix(server.url, "/") + "/health"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{url: healthURL, code: resp.StatusCode, msg: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
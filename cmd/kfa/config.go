@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rophy/kube-federated-auth/internal/claims"
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func runSchema(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(config.Schema())
+}
+
+// runValidate performs the same checks the server runs at startup
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	allowInsecure := fs.Bool("allow-insecure", false, "accept insecure_skip_tls_verify, as the server does with --allow-insecure")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: kfa validate [-allow-insecure] <clusters.yaml>")
+	}
+
+	cfg, err := config.LoadWithOptions(fs.Arg(0), config.LoadOptions{AllowInsecure: *allowInsecure})
+	if err != nil {
+		return err
+	}
+	if _, err := claims.Compile(cfg); err != nil {
+		return fmt.Errorf("compiling claim rules: %w", err)
+	}
+	fmt.Printf("%s: valid (%d clusters)\n", fs.Arg(0), len(cfg.Clusters))
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// removeClusterFromConfig deletes clusters.<name> from a clusters.yaml document,
+// preserving comments and ordering of the remaining entries.
+// Returns false if the cluster was not present.
+func removeClusterFromConfig(data []byte, name string) ([]byte, bool, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, false, fmt.Errorf("parsing config: %w", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, false, fmt.Errorf("config is not a YAML mapping")
+	}
+
+	clusters := mappingValue(doc.Content[0], "clusters")
+	if clusters == nil || clusters.Kind != yaml.MappingNode {
+		return data, false, nil
+	}
+
+	removed := false
+	for i := 0; i+1 < len(clusters.Content); i += 2 {
+		if clusters.Content[i].Value == name {
+			clusters.Content = append(clusters.Content[:i], clusters.Content[i+2:]...)
+			removed = true
+			break
+		}
+	}
+	if !removed {
+		return data, false, nil
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, false, fmt.Errorf("encoding config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, false, fmt.Errorf("encoding config: %w", err)
+	}
+	return buf.Bytes(), true, nil
+}
+
+// addClusterToConfig adds clusters.<name> with the given fields, in order,
+// to a clusters.yaml document, preserving comments and the other entries.
+// Returns false, leaving the document unchanged, if the cluster is already
+// configured.
+func addClusterToConfig(data []byte, name string, fields [][2]string) ([]byte, bool, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, false, fmt.Errorf("parsing config: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, false, fmt.Errorf("config is not a YAML mapping")
+	}
+
+	clusters := mappingValue(root, "clusters")
+	if clusters == nil || clusters.Kind == yaml.ScalarNode && clusters.Tag == "!!null" {
+		if clusters == nil {
+			clusters = &yaml.Node{}
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "clusters"}, clusters)
+		}
+		*clusters = yaml.Node{Kind: yaml.MappingNode}
+	}
+	if clusters.Kind != yaml.MappingNode {
+		return nil, false, fmt.Errorf("clusters is not a YAML mapping")
+	}
+	if mappingValue(clusters, name) != nil {
+		return data, false, nil
+	}
+
+	entry := &yaml.Node{Kind: yaml.MappingNode}
+	for _, field := range fields {
+		entry.Content = append(entry.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: field[0]},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: field[1], Style: yaml.DoubleQuotedStyle})
+	}
+	clusters.Content = append(clusters.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, entry)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, false, fmt.Errorf("encoding config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, false, fmt.Errorf("encoding config: %w", err)
+	}
+	return buf.Bytes(), true, nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// runExport prints the effective configuration of a clusters.yaml file, or of
+// a running server through its admin listener
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	adminURL := fs.String("admin", "", "fetch from a running server's admin listener, e.g. http://localhost:8081")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var data []byte
+	switch {
+	case *adminURL != "" && fs.NArg() == 0:
+		var err error
+		data, err = fetchAdmin(strings.TrimSuffix(*adminURL, "/") + "/admin/effective-config")
+		if err != nil {
+			return err
+		}
+	case *adminURL == "" && fs.NArg() == 1:
+		cfg, err := config.LoadWithOptions(fs.Arg(0), config.LoadOptions{AllowInsecure: true}) // no connections are made
+		if err != nil {
+			return err
+		}
+		data, err = cfg.EffectiveYAML()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("usage: kfa export <clusters.yaml> | kfa export -admin <url>")
+	}
+	_, err := os.Stdout.Write(data)
+	return err
+}
+
+func fetchAdmin(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d: %s", url, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+// runExportKeys saves the current keys of a running server's clusters as a
+// snapshot for clusters configured with key_snapshot
+func runExportKeys(args []string) error {
+	fs := flag.NewFlagSet("export-keys", flag.ContinueOnError)
+	adminURL := fs.String("admin", "", "running server's admin listener, e.g. http://localhost:8081 (required)")
+	output := fs.String("o", "", "write the snapshot to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *adminURL == "" || fs.NArg() != 0 {
+		return fmt.Errorf("usage: kfa export-keys -admin <url> [-o <file>]")
+	}
+
+	data, err := fetchAdmin(strings.TrimSuffix(*adminURL, "/") + "/admin/keys")
+	if err != nil {
+		return err
+	}
+	var snapshot oidc.KeySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("parsing key snapshot: %w", err)
+	}
+	failed := make([]string, 0, len(snapshot.Errors))
+	for cluster := range snapshot.Errors {
+		failed = append(failed, cluster)
+	}
+	sort.Strings(failed)
+	for _, cluster := range failed {
+		fmt.Fprintf(os.Stderr, "warning: cluster %s not exported: %s\n", cluster, snapshot.Errors[cluster])
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	// Replace the file atomically, so a server reading it never sees a partial snapshot
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".kfa-keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), *output); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported keys of %d clusters to %s\n", len(snapshot.Clusters), *output)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// inClusterTokenPath is the ServiceAccount token mounted into pods
+const inClusterTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// runHeartbeat posts a heartbeat of the cluster it runs in to the server,
+// once from a CronJob on a spoke cluster, or every --interval from a
+// Deployment, so the server can flag clusters that have gone silent
+func runHeartbeat(args []string) error {
+	fs := flag.NewFlagSet("heartbeat", flag.ContinueOnError)
+	server := addServerFlags(fs, "kube-federated-auth URL (required)")
+	tokenPath := fs.String("token-path", inClusterTokenPath, "ServiceAccount token of the spoke cluster presented to the server")
+	interval := fs.Duration("interval", 0, "keep running and post a heartbeat this often (default: post once and exit)")
+	serverConfig := fs.Bool("server-config", false, "keep running at the interval the server asks for (GET /heartbeat/config), reread before every heartbeat; --interval is the fallback")
+	healthAddr := fs.String("health-addr", "", "when kept running, serve /healthz/ready on this address, failing while the server cannot be reached")
+	policy := addRetryFlags(fs, "retry a failed heartbeat this many times (-1: until it succeeds)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if server.url == "" || fs.NArg() != 0 {
+		return fmt.Errorf("usage: kfa heartbeat --server <url> [--token-path <file>] [--interval <duration>]")
+	}
+	client, err := server.client()
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(server.url, "/") + "/heartbeat"
+
+	policy.delay()
+	if *interval <= 0 && !*serverConfig {
+		return policy.run(func() error {
+			return sendHeartbeat(context.Background(), client, url, *tokenPath)
+		})
+	}
+
+	// Run as a long-lived process: an outage of the server only fails
+	// readiness, and the next heartbeat goes out as soon as it is back
+	var ready atomic.Bool
+	if *healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz/ready", func(w http.ResponseWriter, r *http.Request) {
+			if !ready.Load() {
+				http.Error(w, "server unreachable", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(*healthAddr, mux))
+		}()
+	}
+	for {
+		err := policy.run(func() error {
+			err := sendHeartbeat(context.Background(), client, url, *tokenPath)
+			ready.Store(err == nil)
+			return err
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Heartbeat failed: %v\n", err)
+		}
+		wait := *interval
+		if *serverConfig {
+			if d, err := fetchHeartbeatInterval(context.Background(), client, url+"/config", *tokenPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Reading heartbeat config failed: %v\n", err)
+			} else {
+				wait = d
+			}
+		}
+		if wait <= 0 {
+			wait = time.Minute
+		}
+		time.Sleep(wait)
+	}
+}
+
+// fetchHeartbeatInterval reads the heartbeat interval the server wants
+// clients of this cluster to follow
+func fetchHeartbeatInterval(ctx context.Context, client *http.Client, url, tokenPath string) (time.Duration, error) {
+	token, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, &statusError{url: url, code: resp.StatusCode, msg: strings.TrimSpace(string(body))}
+	}
+	var cfg struct {
+		Interval string `json:"interval"`
+	}
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return 0, fmt.Errorf("parsing response: %w", err)
+	}
+	d, err := time.ParseDuration(cfg.Interval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid interval %q", cfg.Interval)
+	}
+	return d, nil
+}
+
+// sendHeartbeat posts one heartbeat. The token is reread every time, as
+// projected tokens are rotated in place.
+func sendHeartbeat(ctx context.Context, client *http.Client, url, tokenPath string) error {
+	token, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{url: url, code: resp.StatusCode, msg: strings.TrimSpace(string(body))}
+	}
+	var result struct {
+		Cluster string `json:"cluster"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("parsing response: %w", err)
+	}
+	fmt.Printf("Heartbeat recorded for cluster %s\n", result.Cluster)
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fakeServer is an in-process stand-in for the kube-federated-auth server's
+// POST /heartbeat. It records the bearer token of every request and answers
+// with the queued failure statuses before succeeding.
+type fakeServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	tokens   []string
+	failures []int
+}
+
+func newFakeServer(t *testing.T, failures ...int) *fakeServer {
+	f := &fakeServer{failures: failures}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.Method != http.MethodPost || r.URL.Path != "/heartbeat" {
+			http.NotFound(w, r)
+			return
+		}
+		f.tokens = append(f.tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if len(f.failures) > 0 {
+			status := f.failures[0]
+			f.failures = f.failures[1:]
+			http.Error(w, `{"error":"injected"}`, status)
+			return
+		}
+		w.Write([]byte(`{"cluster":"cluster-b","last_seen":"2026-01-01T00:00:00Z"}`))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeServer) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.tokens...)
+}
+
+func writeToken(t *testing.T, path, token string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeartbeat_OneShot(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	writeToken(t, tokenPath, "spoke-token")
+
+	tests := []struct {
+		name         string
+		failures     []int
+		wantErr      bool
+		wantRequests int
+	}{
+		{"success", nil, false, 1},
+		{"5xx retried", []int{http.StatusInternalServerError, http.StatusServiceUnavailable}, false, 3},
+		{"429 retried", []int{http.StatusTooManyRequests}, false, 2},
+		{"retries exhausted", []int{500, 500, 500, 500}, true, 4},
+		{"401 not retried", []int{http.StatusUnauthorized}, true, 1},
+		{"403 not retried", []int{http.StatusForbidden}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeServer(t, tt.failures...)
+			err := runHeartbeat([]string{"--server", srv.URL, "--token-path", tokenPath,
+				"--retries", "3", "--retry-wait", "1ms"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			got := srv.requests()
+			if len(got) != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", len(got), tt.wantRequests)
+			}
+			if len(got) > 0 && got[0] != "spoke-token" {
+				t.Errorf("bearer token = %q, want spoke-token", got[0])
+			}
+		})
+	}
+}
+
+func TestHeartbeat_TokenRotation(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	srv := newFakeServer(t)
+	client := srv.Client()
+	url := srv.URL + "/heartbeat"
+
+	// Projected tokens are rotated in place; each heartbeat rereads the file
+	for _, token := range []string{"first", "rotated"} {
+		writeToken(t, tokenPath, token)
+		if err := sendHeartbeat(t.Context(), client, url, tokenPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.requests(); len(got) != 2 || got[0] != "first" || got[1] != "rotated" {
+		t.Errorf("tokens = %v, want [first rotated]", got)
+	}
+}
+
+func TestFetchHeartbeatInterval(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	writeToken(t, tokenPath, "spoke-token")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer spoke-token" {
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"cluster":"cluster-b","interval":"2m30s","stale_after":"15m"}`))
+	}))
+	defer srv.Close()
+
+	got, err := fetchHeartbeatInterval(t.Context(), srv.Client(), srv.URL+"/heartbeat/config", tokenPath)
+	if err != nil || got != 150*time.Second {
+		t.Errorf("interval = %v, %v, want 2m30s", got, err)
+	}
+	writeToken(t, tokenPath, "other")
+	if _, err := fetchHeartbeatInterval(t.Context(), srv.Client(), srv.URL+"/heartbeat/config", tokenPath); err == nil {
+		t.Error("expected error for a rejected token")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := &retryPolicy{retries: -1, wait: time.Millisecond, maxWait: 2 * time.Millisecond}
+	attempts := 0
+	err := p.run(func() error {
+		attempts++
+		if attempts < 5 {
+			return &statusError{code: http.StatusBadGateway}
+		}
+		return nil
+	})
+	if err != nil || attempts != 5 {
+		t.Errorf("unlimited retries: err = %v after %d attempts, want success after 5", err, attempts)
+	}
+
+	for code, want := range map[int]bool{
+		http.StatusBadRequest: false, http.StatusNotFound: false,
+		http.StatusRequestTimeout: true, http.StatusConflict: true, http.StatusInternalServerError: true,
+	} {
+		if got := retryable(&statusError{code: code}); got != want {
+			t.Errorf("retryable(%d) = %v, want %v", code, got, want)
+		}
+	}
+	// Kubernetes API errors of onboarding, wrapped
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "kube-federated-auth", errors.New("no RBAC"))
+	if retryable(fmt.Errorf("hub: %w", forbidden)) {
+		t.Error("forbidden Kubernetes API error is retryable")
+	}
+	if !retryable(fmt.Errorf("hub: %w", apierrors.NewServiceUnavailable("overloaded"))) {
+		t.Error("unavailable Kubernetes API error is not retryable")
+	}
+}
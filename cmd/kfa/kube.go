@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	authv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+)
+
+const (
+	defaultNamespace      = "kube-federated-auth"
+	defaultServiceAccount = "kube-federated-auth-reader"
+	defaultSecretName     = "kube-federated-auth"
+	defaultCertsDir       = "/etc/kube-federated-auth/certs"
+)
+
+// loadRESTConfig builds a REST config from a kubeconfig path and context.
+// An empty path uses the default loading rules (KUBECONFIG, ~/.kube/config).
+func loadRESTConfig(kubeconfig, kubeContext string) (*rest.Config, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+	raw, err := loader.RawConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("loading kubeconfig: %w", err)
+	}
+	contextName := kubeContext
+	if contextName == "" {
+		contextName = raw.CurrentContext
+	}
+
+	cfg, err := loader.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("loading kubeconfig: %w", err)
+	}
+	return cfg, contextName, nil
+}
+
+// kubeContexts returns the sorted context names of a kubeconfig
+func kubeContexts(kubeconfig string) ([]string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	}
+	raw, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, nil).RawConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading kubeconfig: %w", err)
+	}
+	names := make([]string, 0, len(raw.Contexts))
+	for name := range raw.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// caData returns the CA bundle used by a REST config
+func caData(cfg *rest.Config) ([]byte, error) {
+	if len(cfg.CAData) > 0 {
+		return cfg.CAData, nil
+	}
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("kubeconfig has no certificate-authority data")
+}
+
+// configMapCA reads the CA bundle from the ca.crt key of a spoke ConfigMap,
+// e.g. kube-root-ca.crt, given as name or namespace/name
+func configMapCA(ctx context.Context, client kubernetes.Interface, namespace, configMap string) ([]byte, error) {
+	if ns, name, ok := strings.Cut(configMap, "/"); ok {
+		namespace, configMap = ns, name
+	}
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, configMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("reading CA ConfigMap: %w", err)
+	}
+	ca := []byte(cm.Data["ca.crt"])
+	if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("ConfigMap %s/%s has no PEM certificates in ca.crt", namespace, configMap)
+	}
+	return ca, nil
+}
+
+// discoverIssuer reads the service account issuer from the cluster's OIDC discovery document
+func discoverIssuer(ctx context.Context, client kubernetes.Interface) (string, error) {
+	data, err := client.CoreV1().RESTClient().Get().AbsPath("/.well-known/openid-configuration").DoRaw(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetching OIDC discovery: %w", err)
+	}
+	var discovery struct {
+		Issuer string `json:"issuer"`
+	}
+	if err := json.Unmarshal(data, &discovery); err != nil {
+		return "", fmt.Errorf("decoding OIDC discovery: %w", err)
+	}
+	return discovery.Issuer, nil
+}
+
+// createToken requests a ServiceAccount token via the TokenRequest API
+func createToken(ctx context.Context, client kubernetes.Interface, namespace, serviceAccount string, seconds int64) (string, error) {
+	tr, err := client.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, serviceAccount, &authv1.TokenRequest{
+		Spec: authv1.TokenRequestSpec{ExpirationSeconds: &seconds},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("requesting token for %s/%s: %w", namespace, serviceAccount, err)
+	}
+	return tr.Status.Token, nil
+}
+
+// updateCredentialSecret applies fn to the data of the server's credentials Secret,
+// creating the Secret if it does not exist and retrying when another writer
+// changed it in between.
+func updateCredentialSecret(ctx context.Context, client kubernetes.Interface, namespace, name string, fn func(data map[string][]byte)) error {
+	secrets := client.CoreV1().Secrets(namespace)
+	conflict := func(err error) bool { return errors.IsConflict(err) || errors.IsAlreadyExists(err) }
+	return retry.OnError(retry.DefaultRetry, conflict, func() error {
+		secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Data:       map[string][]byte{},
+			}
+			fn(secret.Data)
+			_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		fn(secret.Data)
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// credentialKeys returns the Secret data keys holding a cluster's credentials:
+// token, CA certificate, then the client certificate, key, rotation history
+// and cluster metadata
+func credentialKeys(cluster string) []string {
+	return []string{
+		credentials.TokenKey(cluster), credentials.CACertKey(cluster),
+		credentials.ClientCertKey(cluster), credentials.ClientKeyKey(cluster), credentials.HistoryKey(cluster),
+		credentials.ClusterMetadataKey(cluster),
+	}
+}
+
+// reviewToken sends a TokenReview for token to the kube-federated-auth server
+func reviewToken(ctx context.Context, client *http.Client, serverURL, token string) (*authv1.TokenReview, error) {
+	body, err := json.Marshal(&authv1.TokenReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"},
+		Spec:     authv1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimSuffix(serverURL, "/") + "/apis/authentication.k8s.io/v1/tokenreviews"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading TokenReview response: %w", err)
+	}
+	var result authv1.TokenReview
+	if resp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &result) == nil && result.Status.Error != "" {
+			msg = result.Status.Error
+		}
+		return nil, &statusError{url: url, code: resp.StatusCode, msg: msg}
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("decoding TokenReview response: %w", err)
+	}
+	return &result, nil
+}
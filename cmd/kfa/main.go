@@ -0,0 +1,71 @@
+// Command kfa is the kube-federated-auth operator CLI.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rophy/kube-federated-auth/internal/version"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"verify", "Verify a token offline against local key material", runVerify},
+	{"onboard", "Onboard a spoke cluster from its kubeconfig", runOnboard},
+	{"offboard", "Remove a cluster and its credentials", runOffboard},
+	{"heartbeat", "Report the cluster it runs in as alive to the server", runHeartbeat},
+	{"validate", "Validate a clusters.yaml file", runValidate},
+	{"schema", "Print the JSON Schema of clusters.yaml", runSchema},
+	{"audit-verify", "Check the hash chain of an audit log", runAuditVerify},
+	{"replay", "Replay recorded decisions against a proposed clusters.yaml", runReplay},
+	{"export", "Print the effective, defaulted configuration as YAML", runExport},
+	{"export-keys", "Save a running server's cluster keys for key_snapshot", runExportKeys},
+	{"backup", "Save a running server's credentials as an encrypted bundle", runBackup},
+	{"restore", "Import a credentials bundle into a running server", runRestore},
+	{"migrate-store", "Copy stored credentials to another backend and verify them", runMigrateStore},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "-h" || name == "--help" || name == "help" {
+		usage()
+		return
+	}
+	if name == "-version" || name == "--version" || name == "version" {
+		fmt.Println("kfa", version.Get())
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "kfa %s: %v\n", name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "kfa: unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: kfa <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "  %-12s %s\n", "version", "Print version information")
+	fmt.Fprintf(os.Stderr, "\nRun 'kfa <command> -h' for command flags.\n")
+}
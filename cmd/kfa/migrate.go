@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+)
+
+// storeBackends are the backends credentials can be migrated between
+var storeBackends = []string{credentials.BackendSecret, credentials.BackendSecrets, credentials.BackendFile}
+
+// storeFlags select one side of a credential store migration
+type storeFlags struct {
+	kind          string
+	dir           string
+	secretName    string
+	encryptionKey string
+}
+
+func addStoreFlags(fs *flag.FlagSet, side string) *storeFlags {
+	s := &storeFlags{}
+	fs.StringVar(&s.kind, side, "", fmt.Sprintf("%s credential backend: %s (required)", side, strings.Join(storeBackends, ", ")))
+	fs.StringVar(&s.dir, side+"-dir", "", "directory of the "+side+" file backend")
+	fs.StringVar(&s.secretName, side+"-secret-name", defaultSecretName, "Secret (secret) or Secret name prefix (secrets) of the "+side+" backend")
+	fs.StringVar(&s.encryptionKey, side+"-encryption-key", "", "file with the AES-256 key the "+side+" backend's tokens are encrypted with")
+	return s
+}
+
+// backend opens the selected backend, connecting to the hub for the Secret
+// backends. Unlike the server's, it fails rather than fall back to memory.
+func (s *storeFlags) backend(hub func() (kubernetes.Interface, error), namespace string) (credentials.Backend, error) {
+	var b credentials.Backend
+	switch s.kind {
+	case credentials.BackendSecret, credentials.BackendSecrets:
+		client, err := hub()
+		if err != nil {
+			return nil, err
+		}
+		if s.kind == credentials.BackendSecrets {
+			b = credentials.NewSecretsBackend(client, namespace, s.secretName)
+		} else {
+			b = credentials.NewSecretBackend(client, namespace, s.secretName)
+		}
+	case credentials.BackendFile:
+		if s.dir == "" {
+			return nil, fmt.Errorf("the file backend requires a directory")
+		}
+		fb, err := credentials.NewFileBackend(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		b = fb
+	default:
+		return nil, fmt.Errorf("unknown credential backend %q (valid: %s)", s.kind, strings.Join(storeBackends, ", "))
+	}
+	if s.encryptionKey == "" {
+		return b, nil
+	}
+	key, err := credentials.LoadEncryptionKey(s.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewEncryptingBackend(b, key)
+}
+
+// runMigrateStore copies every cluster's stored credentials from one backend
+// to another and verifies each copy. Reads switch over by rolling the servers
+// to the target's --credential-backend; a rerun afterwards copies what was
+// renewed in the source during the rollout, keeping what the rolled servers
+// renewed in the target.
+func runMigrateStore(args []string) error {
+	fs := flag.NewFlagSet("migrate-store", flag.ContinueOnError)
+	from := addStoreFlags(fs, "from")
+	to := addStoreFlags(fs, "to")
+	hubKubeconfig := fs.String("hub-kubeconfig", "", "kubeconfig of the cluster running kube-federated-auth, for the Secret backends")
+	hubContext := fs.String("hub-context", "", "kubeconfig context of the cluster running kube-federated-auth")
+	hubNamespace := fs.String("hub-namespace", defaultNamespace, "namespace of the credentials Secrets")
+	dryRun := fs.Bool("dry-run", false, "list the clusters of the source without writing the target")
+	force := fs.Bool("force", false, "overwrite target credentials issued after the source's")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if from.kind == "" || to.kind == "" || fs.NArg() != 0 {
+		return fmt.Errorf("usage: kfa migrate-store -from <backend> -to <backend> [flags]")
+	}
+	if from.kind == to.kind && from.dir == to.dir && from.secretName == to.secretName {
+		return fmt.Errorf("source and target are the same store")
+	}
+
+	var hub kubernetes.Interface
+	hubClient := func() (kubernetes.Interface, error) {
+		if hub != nil {
+			return hub, nil
+		}
+		cfg, _, err := loadRESTConfig(*hubKubeconfig, *hubContext)
+		if err != nil {
+			return nil, fmt.Errorf("hub: %w", err)
+		}
+		if hub, err = kubernetes.NewForConfig(cfg); err != nil {
+			return nil, fmt.Errorf("hub: creating client: %w", err)
+		}
+		return hub, nil
+	}
+	source, err := from.backend(hubClient, *hubNamespace)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	ctx := context.Background()
+
+	if *dryRun {
+		stored, err := source.List(ctx)
+		if err != nil {
+			return fmt.Errorf("listing source credentials: %w", err)
+		}
+		fmt.Printf("[dry-run] Would copy the credentials of %d clusters from the %s backend to the %s backend\n", len(stored), from.kind, to.kind)
+		return nil
+	}
+	target, err := to.backend(hubClient, *hubNamespace)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+	copied, newer, err := credentials.Migrate(ctx, source, target, *force)
+	for _, cluster := range copied {
+		fmt.Printf("Copied and verified the credentials of %s\n", cluster)
+	}
+	for _, cluster := range newer {
+		fmt.Printf("Skipped %s: the target holds newer credentials (-force overwrites them)\n", cluster)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d clusters copied. Switch the servers to --credential-backend %s, then rerun to copy credentials renewed meanwhile.\n", len(copied), to.kind)
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+func runOffboard(args []string) error {
+	fs := flag.NewFlagSet("offboard", flag.ContinueOnError)
+	kubeconfig := fs.String("kubeconfig", "", "kubeconfig of the spoke cluster; deletes spoke-side resources when set")
+	kubeContext := fs.String("context", "", "kubeconfig context of the spoke cluster")
+	namespace := fs.String("namespace", defaultNamespace, "namespace of the ServiceAccount on the spoke cluster")
+	serviceAccount := fs.String("service-account", defaultServiceAccount, "ServiceAccount used by kube-federated-auth on the spoke cluster")
+	hubKubeconfig := fs.String("hub-kubeconfig", "", "kubeconfig of the cluster running kube-federated-auth")
+	hubContext := fs.String("hub-context", "", "kubeconfig context of the cluster running kube-federated-auth")
+	hubNamespace := fs.String("hub-namespace", defaultNamespace, "namespace of the kube-federated-auth Secret and ConfigMap")
+	secretName := fs.String("secret-name", defaultSecretName, "name of the kube-federated-auth credentials Secret")
+	configPath := fs.String("config", "", "clusters.yaml file to remove the cluster from")
+	configMap := fs.String("configmap", "", "ConfigMap (key clusters.yaml) in the hub namespace to remove the cluster from")
+	server := addServerFlags(fs, "kube-federated-auth URL to confirm the cluster's tokens are rejected (requires --kubeconfig)")
+	dryRun := fs.Bool("dry-run", false, "print what would be done without changing anything")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: kfa offboard [flags] <cluster>")
+	}
+	name := fs.Arg(0)
+	if server.url != "" && *kubeconfig == "" {
+		return fmt.Errorf("--server requires --kubeconfig to mint a probe token")
+	}
+	var client *http.Client
+	if server.url != "" {
+		var err error
+		if client, err = server.client(); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	prefix := ""
+	if *dryRun {
+		prefix = "[dry-run] "
+	}
+
+	var spoke kubernetes.Interface
+	var probe string
+	if *kubeconfig != "" {
+		spokeCfg, _, err := loadRESTConfig(*kubeconfig, *kubeContext)
+		if err != nil {
+			return fmt.Errorf("spoke: %w", err)
+		}
+		if spoke, err = kubernetes.NewForConfig(spokeCfg); err != nil {
+			return fmt.Errorf("spoke: creating client: %w", err)
+		}
+		// Mint the probe before the ServiceAccount is deleted
+		if server.url != "" && !*dryRun {
+			if probe, err = createToken(ctx, spoke, *namespace, *serviceAccount, 600); err != nil {
+				return fmt.Errorf("spoke: %w", err)
+			}
+		}
+	}
+
+	hubCfg, _, err := loadRESTConfig(*hubKubeconfig, *hubContext)
+	if err != nil {
+		return fmt.Errorf("hub: %w", err)
+	}
+	hub, err := kubernetes.NewForConfig(hubCfg)
+	if err != nil {
+		return fmt.Errorf("hub: creating client: %w", err)
+	}
+
+	// Step 1: Unregister credentials
+	fmt.Printf("==> %sRemoving %v from Secret %s/%s\n", prefix, credentialKeys(name), *hubNamespace, *secretName)
+	if !*dryRun {
+		err := updateCredentialSecret(ctx, hub, *hubNamespace, *secretName, func(data map[string][]byte) {
+			for _, key := range credentialKeys(name) {
+				delete(data, key)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("hub: updating credentials secret: %w", err)
+		}
+	}
+
+	// Step 2: Remove the cluster from configuration
+	if *configPath != "" {
+		if err := removeFromConfigFile(*configPath, name, *dryRun, prefix); err != nil {
+			return err
+		}
+	}
+	if *configMap != "" {
+		if err := removeFromConfigMap(ctx, hub, *hubNamespace, *configMap, name, *dryRun, prefix); err != nil {
+			return fmt.Errorf("hub: %w", err)
+		}
+	}
+
+	// Step 3: Delete spoke-side resources
+	if spoke != nil {
+		if err := deleteSpokeResources(ctx, spoke, *namespace, *serviceAccount, *dryRun, prefix); err != nil {
+			return fmt.Errorf("spoke: %w", err)
+		}
+	}
+
+	// Step 4: Confirm tokens from the cluster are rejected
+	if server.url == "" || *dryRun {
+		return nil
+	}
+	fmt.Printf("==> Confirming tokens from %s are rejected by %s\n", name, server.url)
+	result, err := reviewToken(ctx, client, server.url, probe)
+	if err != nil {
+		return err
+	}
+	if result.Status.Authenticated {
+		return fmt.Errorf("token from %s is still accepted as %s", name, result.Status.User.Username)
+	}
+	fmt.Printf("Token rejected: %s\n", result.Status.Error)
+	return nil
+}
+
+func removeFromConfigFile(path, name string, dryRun bool, prefix string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	updated, removed, err := removeClusterFromConfig(data, name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if !removed {
+		fmt.Printf("==> Cluster %s not found in %s\n", name, path)
+		return nil
+	}
+	fmt.Printf("==> %sRemoving %s from %s\n", prefix, name, path)
+	if dryRun {
+		return nil
+	}
+	return os.WriteFile(path, updated, 0644)
+}
+
+func removeFromConfigMap(ctx context.Context, client kubernetes.Interface, namespace, name, cluster string, dryRun bool, prefix string) error {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting configmap: %w", err)
+	}
+	updated, removed, err := removeClusterFromConfig([]byte(cm.Data["clusters.yaml"]), cluster)
+	if err != nil {
+		return fmt.Errorf("configmap %s/%s: %w", namespace, name, err)
+	}
+	if !removed {
+		fmt.Printf("==> Cluster %s not found in ConfigMap %s/%s\n", cluster, namespace, name)
+		return nil
+	}
+	fmt.Printf("==> %sRemoving %s from ConfigMap %s/%s\n", prefix, cluster, namespace, name)
+	if dryRun {
+		return nil
+	}
+	cm.Data["clusters.yaml"] = string(updated)
+	if _, err := client.CoreV1().ConfigMaps(namespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating configmap: %w", err)
+	}
+	return nil
+}
+
+// deleteSpokeResources removes the bindings and ServiceAccount created by
+// applySpokeResources. The roles and the namespace may be shared and are kept.
+func deleteSpokeResources(ctx context.Context, client kubernetes.Interface, namespace, serviceAccount string, dryRun bool, prefix string) error {
+	steps := []struct {
+		kind, name string
+		del        func() error
+	}{
+		{"ClusterRoleBinding", serviceAccount + "-tokenreview-creator", func() error {
+			return client.RbacV1().ClusterRoleBindings().Delete(ctx, serviceAccount+"-tokenreview-creator", metav1.DeleteOptions{})
+		}},
+		{"RoleBinding", namespace + "/" + serviceAccount + "-token-creator", func() error {
+			return client.RbacV1().RoleBindings(namespace).Delete(ctx, serviceAccount+"-token-creator", metav1.DeleteOptions{})
+		}},
+		{"ServiceAccount", namespace + "/" + serviceAccount, func() error {
+			return client.CoreV1().ServiceAccounts(namespace).Delete(ctx, serviceAccount, metav1.DeleteOptions{})
+		}},
+	}
+
+	for _, step := range steps {
+		fmt.Printf("==> %sDeleting %s %s on spoke\n", prefix, step.kind, step.name)
+		if dryRun {
+			continue
+		}
+		if err := step.del(); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("deleting %s %s: %w", step.kind, step.name, err)
+		}
+	}
+	return nil
+}
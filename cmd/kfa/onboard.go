@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/version"
+)
+
+// onboardOptions are the flags of kfa onboard
+type onboardOptions struct {
+	kubeconfig, kubeContext string
+	name                    string
+	namespace               string
+	serviceAccount          string
+	duration                time.Duration
+	hubKubeconfig           string
+	hubContext              string
+	hubNamespace            string
+	secretName              string
+	server                  *serverFlags
+	// configPath and configMap receive the discovered clusters.yaml entry
+	configPath string
+	configMap  string
+	// region and labels are reported with the cluster's metadata
+	region string
+	labels map[string]string
+	// caConfigMap is read for the spoke's CA instead of the kubeconfig
+	caConfigMap string
+	// check only reports what onboarding would do
+	check bool
+}
+
+func runOnboard(args []string) error {
+	var o onboardOptions
+	fs := flag.NewFlagSet("onboard", flag.ContinueOnError)
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "kubeconfig of the spoke cluster to onboard")
+	fs.StringVar(&o.kubeContext, "context", "", "kubeconfig context of the spoke cluster")
+	fs.StringVar(&o.name, "name", "", "cluster name in kube-federated-auth (defaults to the context name)")
+	fs.StringVar(&o.namespace, "namespace", defaultNamespace, "namespace for the ServiceAccount on the spoke cluster")
+	fs.StringVar(&o.serviceAccount, "service-account", defaultServiceAccount, "ServiceAccount used by kube-federated-auth on the spoke cluster")
+	fs.DurationVar(&o.duration, "duration", 168*time.Hour, "lifetime of the bootstrap token")
+	fs.StringVar(&o.hubKubeconfig, "hub-kubeconfig", "", "kubeconfig of the cluster running kube-federated-auth")
+	fs.StringVar(&o.hubContext, "hub-context", "", "kubeconfig context of the cluster running kube-federated-auth")
+	fs.StringVar(&o.hubNamespace, "hub-namespace", defaultNamespace, "namespace of the kube-federated-auth credentials Secret")
+	fs.StringVar(&o.secretName, "secret-name", defaultSecretName, "name of the kube-federated-auth credentials Secret")
+	o.server = addServerFlags(fs, "kube-federated-auth URL for a round-trip TokenReview check (skipped if empty)")
+	fs.StringVar(&o.configPath, "config", "", "clusters.yaml file to add the discovered cluster entry to (default: only print it)")
+	fs.StringVar(&o.configMap, "configmap", "", "ConfigMap (key clusters.yaml) in the hub namespace to add the discovered cluster entry to")
+	fs.StringVar(&o.region, "region", "", "region reported in the cluster's metadata, shown on /clusters")
+	labels := fs.String("labels", "", "comma-separated key=value labels reported in the cluster's metadata, e.g. env=prod,team=payments")
+	fs.StringVar(&o.caConfigMap, "ca-configmap", "", "read the spoke's CA from the ca.crt key of this ConfigMap ([namespace/]name, default namespace: --namespace), e.g. kube-root-ca.crt, instead of the kubeconfig")
+	fs.BoolVar(&o.check, "check", false, "check connectivity to the spoke, hub and server and report what would be onboarded, without writing anything")
+	contexts := fs.String("contexts", "", "comma-separated kubeconfig contexts to onboard, each as a cluster named after it (\"*\": all contexts)")
+	policy := addRetryFlags(fs, "retry a failed onboarding this many times, e.g. when run as a CronJob to refresh the bootstrap token")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if o.kubeconfig == "" {
+		return fmt.Errorf("--kubeconfig is required")
+	}
+	var err error
+	if o.labels, err = credentials.ParseAnnotations(*labels); err != nil {
+		return fmt.Errorf("--labels: %w", err)
+	}
+	var client *http.Client
+	if o.server.url != "" {
+		if client, err = o.server.client(); err != nil {
+			return err
+		}
+	}
+
+	policy.delay()
+	if *contexts == "" {
+		return policy.run(func() error {
+			return onboard(context.Background(), o, client)
+		})
+	}
+	if o.kubeContext != "" || o.name != "" {
+		return fmt.Errorf("--contexts cannot be combined with --context or --name")
+	}
+
+	names := strings.Split(*contexts, ",")
+	if *contexts == "*" {
+		var err error
+		if names, err = kubeContexts(o.kubeconfig); err != nil {
+			return fmt.Errorf("spoke: %w", err)
+		}
+	}
+	// Onboard every context even if some fail, then report each one
+	failed := make(map[string]error)
+	for _, name := range names {
+		spoke := o
+		spoke.kubeContext = strings.TrimSpace(name)
+		fmt.Printf("\n=== Onboarding context %s\n", spoke.kubeContext)
+		if err := policy.run(func() error {
+			return onboard(context.Background(), spoke, client)
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "Onboarding %s failed: %v\n", spoke.kubeContext, err)
+			failed[spoke.kubeContext] = err
+		}
+	}
+
+	fmt.Printf("\n=== Summary\n")
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if err, ok := failed[name]; ok {
+			fmt.Printf("  %-30s FAILED: %v\n", name, err)
+		} else {
+			fmt.Printf("  %-30s ok\n", name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d clusters failed to onboard", len(failed), len(names))
+	}
+	return nil
+}
+
+// onboard runs one onboarding attempt; every step is idempotent, so a failed
+// attempt can be retried from the start
+func onboard(ctx context.Context, o onboardOptions, client *http.Client) error {
+	if o.check {
+		return checkOnboard(ctx, o, client)
+	}
+	spokeCfg, contextName, err := loadRESTConfig(o.kubeconfig, o.kubeContext)
+	if err != nil {
+		return fmt.Errorf("spoke: %w", err)
+	}
+	if o.name == "" {
+		o.name = contextName
+	}
+	spoke, err := kubernetes.NewForConfig(spokeCfg)
+	if err != nil {
+		return fmt.Errorf("spoke: creating client: %w", err)
+	}
+
+	// Step 1: ServiceAccount and RBAC on the spoke
+	fmt.Printf("==> Creating ServiceAccount %s/%s and RBAC on %s\n", o.namespace, o.serviceAccount, spokeCfg.Host)
+	if err := applySpokeResources(ctx, spoke, o.namespace, o.serviceAccount); err != nil {
+		return fmt.Errorf("spoke: %w", err)
+	}
+
+	issuer, err := discoverIssuer(ctx, spoke)
+	if err != nil {
+		return fmt.Errorf("spoke: %w", err)
+	}
+	ca, err := spokeCA(ctx, spoke, spokeCfg, o)
+	if err != nil {
+		return fmt.Errorf("spoke: %w", err)
+	}
+	token, err := createToken(ctx, spoke, o.namespace, o.serviceAccount, int64(o.duration.Seconds()))
+	if err != nil {
+		return fmt.Errorf("spoke: %w", err)
+	}
+	// The API server may cap the lifetime (--service-account-max-token-expiration)
+	if exp := credentials.NewRotation(&credentials.Credentials{Token: token}, "", "", time.Now()).ExpiresAt; !exp.IsZero() {
+		fmt.Printf("Bootstrap token expires %s\n", exp.Format(time.RFC3339))
+		if lifetime := time.Until(exp); lifetime < o.duration*9/10 {
+			fmt.Fprintf(os.Stderr, "Warning: requested --duration %s but the spoke issued a token valid for %s\n", o.duration, lifetime.Round(time.Minute))
+		}
+	}
+	metadata := &credentials.ClusterMetadata{
+		Region:     o.region,
+		Labels:     o.labels,
+		ReportedBy: "kfa/" + version.Version,
+		ReportedAt: time.Now().UTC(),
+	}
+	if v, err := spoke.Discovery().ServerVersion(); err == nil {
+		metadata.KubernetesVersion = v.GitVersion
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: could not read the spoke's Kubernetes version: %v\n", err)
+	}
+
+	// Step 2: Store bootstrap credentials where the server loads them
+	hubCfg, _, err := loadRESTConfig(o.hubKubeconfig, o.hubContext)
+	if err != nil {
+		return fmt.Errorf("hub: %w", err)
+	}
+	hub, err := kubernetes.NewForConfig(hubCfg)
+	if err != nil {
+		return fmt.Errorf("hub: creating client: %w", err)
+	}
+
+	fmt.Printf("==> Registering credentials for %s in Secret %s/%s\n", o.name, o.hubNamespace, o.secretName)
+	err = updateCredentialSecret(ctx, hub, o.hubNamespace, o.secretName, func(data map[string][]byte) {
+		keys := credentialKeys(o.name)
+		data[keys[0]] = []byte(token)
+		data[keys[1]] = ca
+		recordRotation(data, o.name, &credentials.Credentials{Token: token, CACert: ca})
+		if encoded, err := json.Marshal(metadata); err == nil {
+			data[credentials.ClusterMetadataKey(o.name)] = encoded
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("hub: updating credentials secret: %w", err)
+	}
+
+	entry := [][2]string{
+		{"issuer", issuer},
+		{"api_server", spokeCfg.Host},
+		{"ca_cert", defaultCertsDir + "/" + credentialKeys(o.name)[1]},
+		{"token_path", defaultCertsDir + "/" + credentialKeys(o.name)[0]},
+	}
+	if o.configPath == "" && o.configMap == "" {
+		fmt.Printf("\nAdd the cluster to clusters.yaml if it is not configured yet:\n\n")
+		fmt.Printf("  %s:\n", o.name)
+		for _, field := range entry {
+			fmt.Printf("    %s: %q\n", field[0], field[1])
+		}
+		fmt.Println()
+	}
+	if o.configPath != "" {
+		if err := addToConfigFile(o.configPath, o.name, entry); err != nil {
+			return err
+		}
+	}
+	if o.configMap != "" {
+		if err := addToConfigMap(ctx, hub, o.hubNamespace, o.configMap, o.name, entry); err != nil {
+			return fmt.Errorf("hub: %w", err)
+		}
+	}
+
+	// Step 3: Optional round-trip validation through the server
+	if client == nil {
+		return nil
+	}
+
+	fmt.Printf("==> Verifying round-trip TokenReview via %s\n", o.server.url)
+	probe, err := createToken(ctx, spoke, o.namespace, o.serviceAccount, 600)
+	if err != nil {
+		return fmt.Errorf("spoke: %w", err)
+	}
+	result, err := reviewToken(ctx, client, o.server.url, probe)
+	if err != nil {
+		return err
+	}
+	if !result.Status.Authenticated {
+		fmt.Fprintf(os.Stderr, "Hint: the server loads new clusters from its config at startup; restart it after updating clusters.yaml.\n")
+		return fmt.Errorf("round-trip validation failed: %s", result.Status.Error)
+	}
+	fmt.Printf("Round-trip validation succeeded: authenticated as %s\n", result.Status.User.Username)
+	return nil
+}
+
+// spokeCA returns the CA bundle stored for the spoke: that of --ca-configmap,
+// or of the kubeconfig
+func spokeCA(ctx context.Context, spoke kubernetes.Interface, spokeCfg *rest.Config, o onboardOptions) ([]byte, error) {
+	if o.caConfigMap != "" {
+		return configMapCA(ctx, spoke, o.namespace, o.caConfigMap)
+	}
+	return caData(spokeCfg)
+}
+
+// addToConfigFile adds the discovered entry of a cluster to a clusters.yaml
+// file, keeping an existing entry
+func addToConfigFile(path, name string, entry [][2]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	updated, added, err := addClusterToConfig(data, name, entry)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if !added {
+		fmt.Printf("==> Cluster %s is already configured in %s, keeping its entry\n", name, path)
+		return nil
+	}
+	fmt.Printf("==> Adding %s to %s\n", name, path)
+	return os.WriteFile(path, updated, 0644)
+}
+
+// addToConfigMap adds the discovered entry of a cluster to the clusters.yaml
+// of a ConfigMap, keeping an existing entry
+func addToConfigMap(ctx context.Context, client kubernetes.Interface, namespace, name, cluster string, entry [][2]string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("getting configmap: %w", err)
+		}
+		updated, added, err := addClusterToConfig([]byte(cm.Data["clusters.yaml"]), cluster, entry)
+		if err != nil {
+			return fmt.Errorf("configmap %s/%s: %w", namespace, name, err)
+		}
+		if !added {
+			fmt.Printf("==> Cluster %s is already configured in ConfigMap %s/%s, keeping its entry\n", cluster, namespace, name)
+			return nil
+		}
+		fmt.Printf("==> Adding %s to ConfigMap %s/%s\n", cluster, namespace, name)
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data["clusters.yaml"] = string(updated)
+		_, err = client.CoreV1().ConfigMaps(namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// recordRotation appends the onboarding to the cluster's rotation history in
+// the credentials Secret
+func recordRotation(data map[string][]byte, cluster string, creds *credentials.Credentials) {
+	by := "kfa onboard"
+	if u, err := user.Current(); err == nil {
+		host, _ := os.Hostname()
+		by += "/" + u.Username + "@" + host
+	}
+	key := credentials.HistoryKey(cluster)
+	history := credentials.AppendHistory(credentials.DecodeHistory(cluster, data[key]),
+		credentials.NewRotation(creds, by, credentials.SourceOnboard, time.Now()))
+	if encoded, err := json.Marshal(history); err == nil {
+		data[key] = encoded
+	}
+}
+
+// applySpokeResources creates the ServiceAccount and RBAC kube-federated-auth
+// needs on a spoke cluster, mirroring the k8s/cluster-b chart.
+func applySpokeResources(ctx context.Context, client kubernetes.Interface, namespace, serviceAccount string) error {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+	if _, err := client.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating namespace: %w", err)
+	}
+
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: serviceAccount, Namespace: namespace}}
+	if _, err := client.CoreV1().ServiceAccounts(namespace).Create(ctx, sa, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating service account: %w", err)
+	}
+
+	subjects := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount, Namespace: namespace}}
+
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "token-creator", Namespace: namespace},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"serviceaccounts/token"},
+			Verbs:     []string{"create"},
+		}},
+	}
+	if err := createOrUpdate("role", func() error {
+		_, err := client.RbacV1().Roles(namespace).Create(ctx, role, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		_, err := client.RbacV1().Roles(namespace).Update(ctx, role, metav1.UpdateOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+
+	roleBinding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: serviceAccount + "-token-creator", Namespace: namespace},
+		Subjects:   subjects,
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: role.Name},
+	}
+	if err := createOrUpdate("role binding", func() error {
+		_, err := client.RbacV1().RoleBindings(namespace).Create(ctx, roleBinding, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		_, err := client.RbacV1().RoleBindings(namespace).Update(ctx, roleBinding, metav1.UpdateOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+
+	clusterRole := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "tokenreview-creator"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{"authentication.k8s.io"},
+			Resources: []string{"tokenreviews"},
+			Verbs:     []string{"create"},
+		}},
+	}
+	if err := createOrUpdate("cluster role", func() error {
+		_, err := client.RbacV1().ClusterRoles().Create(ctx, clusterRole, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		_, err := client.RbacV1().ClusterRoles().Update(ctx, clusterRole, metav1.UpdateOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+
+	clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: serviceAccount + "-tokenreview-creator"},
+		Subjects:   subjects,
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: clusterRole.Name},
+	}
+	return createOrUpdate("cluster role binding", func() error {
+		_, err := client.RbacV1().ClusterRoleBindings().Create(ctx, clusterRoleBinding, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		_, err := client.RbacV1().ClusterRoleBindings().Update(ctx, clusterRoleBinding, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func createOrUpdate(kind string, create, update func() error) error {
+	err := create()
+	if errors.IsAlreadyExists(err) {
+		err = update()
+	}
+	if err != nil {
+		return fmt.Errorf("applying %s: %w", kind, err)
+	}
+	return nil
+}
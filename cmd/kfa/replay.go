@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/replay"
+)
+
+// runReplay re-evaluates recorded decisions against a proposed config
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	recordsPath := fs.String("records", "", "replay file written by the server (replay.path)")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *recordsPath == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: kfa replay -records <replay.jsonl> <proposed-clusters.yaml>")
+	}
+
+	cfg, err := config.LoadWithOptions(fs.Arg(0), config.LoadOptions{AllowInsecure: true}) // no connections are made
+	if err != nil {
+		return err
+	}
+	policy, err := replay.NewPolicy(cfg)
+	if err != nil {
+		return fmt.Errorf("compiling claim rules: %w", err)
+	}
+	records, err := replay.Load(*recordsPath)
+	if err != nil {
+		return err
+	}
+
+	report := policy.Run(records)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	fmt.Printf("%d decisions replayed (%d allowed)\n", report.Records, report.Allowed)
+	fmt.Printf("  would be denied:        %d (%d distinct tokens)\n", report.NewlyDenied, report.UniqueDenials)
+	fmt.Printf("  would be allowed:       %d\n", report.NewlyAllowed)
+	fmt.Printf("  passes policy, unknown: %d (never forwarded to the remote cluster)\n", report.Undetermined)
+	fmt.Println()
+	fmt.Printf("%-24s %8s %8s %8s %8s\n", "CLUSTER", "RECORDS", "ALLOWED", "DENIED+", "ALLOWED+")
+	for _, name := range report.ClusterNames() {
+		c := report.Clusters[name]
+		fmt.Printf("%-24s %8d %8d %8d %8d\n", name, c.Records, c.Allowed, c.NewlyDenied, c.NewlyAllowed)
+	}
+
+	if len(report.DenialReasons) > 0 {
+		reasons := make([]string, 0, len(report.DenialReasons))
+		for reason := range report.DenialReasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Slice(reasons, func(i, j int) bool { return report.DenialReasons[reasons[i]] > report.DenialReasons[reasons[j]] })
+		fmt.Println("\nNew denial reasons:")
+		for _, reason := range reasons {
+			fmt.Printf("  %6d  %s\n", report.DenialReasons[reason], reason)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// retryPolicy configures how a command run from a CronJob retries failed
+// attempts. Many CronJobs tend to fire at the same minute, e.g. right after
+// an upgrade, so the first attempt can be delayed by a random jitter and
+// every retry wait is randomized.
+type retryPolicy struct {
+	retries int
+	wait    time.Duration
+	maxWait time.Duration
+	jitter  time.Duration
+}
+
+func addRetryFlags(fs *flag.FlagSet, usage string) *retryPolicy {
+	p := &retryPolicy{}
+	fs.IntVar(&p.retries, "retries", 0, usage)
+	fs.DurationVar(&p.wait, "retry-wait", 10*time.Second, "wait before the first retry, doubled for each further one")
+	fs.DurationVar(&p.maxWait, "retry-max-wait", 5*time.Minute, "upper bound of the wait between retries")
+	fs.DurationVar(&p.jitter, "jitter", 0, "delay the first attempt by a random duration up to this, to spread out CronJobs starting together")
+	return p
+}
+
+// statusError is an HTTP error response from the kube-federated-auth server
+type statusError struct {
+	url  string
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned status %d: %s", e.url, e.code, e.msg)
+}
+
+// delay sleeps for a random duration up to p.jitter before a run's first
+// attempt
+func (p *retryPolicy) delay() {
+	if p.jitter > 0 {
+		time.Sleep(rand.N(p.jitter))
+	}
+}
+
+// run runs fn until it succeeds, fails permanently or has been retried
+// p.retries times (forever if negative), and returns the last error. Waits double from p.wait up to
+// p.maxWait, each randomized to between half and all of it.
+func (p *retryPolicy) run(fn func() error) error {
+	wait := p.wait
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || p.retries >= 0 && attempt > p.retries {
+			return err
+		}
+		if !retryable(err) {
+			fmt.Fprintf(os.Stderr, "Attempt %d failed: %v; not retrying\n", attempt, err)
+			return err
+		}
+		if p.maxWait > 0 && wait > p.maxWait {
+			wait = p.maxWait
+		}
+		sleep := wait
+		if wait > 1 {
+			sleep = wait/2 + rand.N(wait/2)
+		}
+		fmt.Fprintf(os.Stderr, "Attempt %d failed: %v; retrying in %s\n", attempt, err, sleep.Round(time.Second))
+		time.Sleep(sleep)
+		wait *= 2
+	}
+}
+
+// retryable reports whether a failed attempt may succeed when retried.
+// Client errors (4xx) of the Kubernetes API or the server, e.g. a forbidden
+// request or a bad token, are misconfigurations that retrying does not fix;
+// timeouts, conflicts and rate limiting are retried like 5xx and network
+// errors.
+func retryable(err error) bool {
+	code := 0
+	var status apierrors.APIStatus
+	var server *statusError
+	switch {
+	case errors.As(err, &status):
+		code = int(status.Status().Code)
+	case errors.As(err, &server):
+		code = server.code
+	}
+	if code < 400 || code >= 500 {
+		return true
+	}
+	switch code {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// serverFlags configure the connection of commands calling the
+// kube-federated-auth server's webhook port (--server)
+type serverFlags struct {
+	url      string
+	caPath   string
+	certPath string
+	keyPath  string
+	insecure bool
+	// proxy overrides HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	proxy string
+	// resolve maps host:port to an IP address, bypassing DNS
+	resolve string
+}
+
+func addServerFlags(fs *flag.FlagSet, usage string) *serverFlags {
+	f := &serverFlags{}
+	fs.StringVar(&f.url, "server", "", usage)
+	fs.StringVar(&f.caPath, "server-ca", "", "PEM CA bundle verifying the server's certificate (default: system roots)")
+	fs.StringVar(&f.certPath, "client-cert", "", "PEM client certificate presented to the server, e.g. to an mTLS ingress")
+	fs.StringVar(&f.keyPath, "client-key", "", "PEM key of --client-cert")
+	fs.BoolVar(&f.insecure, "insecure", false, "allow a plaintext http:// --server other than localhost")
+	fs.StringVar(&f.proxy, "proxy", "", "HTTP proxy URL for the server, overriding HTTPS_PROXY/HTTP_PROXY and NO_PROXY (\"none\": connect directly)")
+	fs.StringVar(&f.resolve, "resolve", "", "connect to the server at a fixed address instead of resolving its host, as host:port:ip")
+	return f
+}
+
+// client returns an HTTP client for the server. Plaintext URLs are refused
+// unless they are loopback, e.g. through kubectl port-forward, or --insecure
+// is set.
+func (f *serverFlags) client() (*http.Client, error) {
+	u, err := url.Parse(f.url)
+	if err != nil {
+		return nil, fmt.Errorf("--server: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !f.insecure && !isLoopback(u.Hostname()) {
+			return nil, fmt.Errorf("--server %s is plaintext; use https or pass --insecure", f.url)
+		}
+	default:
+		return nil, fmt.Errorf("--server %s must be an http or https URL", f.url)
+	}
+	if (f.certPath == "") != (f.keyPath == "") {
+		return nil, fmt.Errorf("--client-cert and --client-key must be set together")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if f.caPath != "" {
+		pem, err := os.ReadFile(f.caPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading --server-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("--server-ca %s contains no PEM certificates", f.caPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if f.certPath != "" {
+		cert, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	switch f.proxy {
+	case "":
+		// http.ProxyFromEnvironment, honoring NO_PROXY
+	case "none":
+		transport.Proxy = nil
+	default:
+		proxyURL, err := url.Parse(f.proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("--proxy %s must be a URL, e.g. http://proxy.example.com:3128", f.proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if f.resolve != "" {
+		parts := strings.SplitN(f.resolve, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || net.ParseIP(strings.Trim(parts[2], "[]")) == nil {
+			return nil, fmt.Errorf("--resolve %s must be host:port:ip", f.resolve)
+		}
+		// Only the dialed address changes; TLS still verifies the host
+		addr := net.JoinHostPort(parts[0], parts[1])
+		target := net.JoinHostPort(strings.Trim(parts[2], "[]"), parts[1])
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = func(ctx context.Context, network, dialAddr string) (net.Conn, error) {
+			if dialAddr == addr {
+				dialAddr = target
+			}
+			return dialer.DialContext(ctx, network, dialAddr)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	token := fs.String("token", "", "token to verify (use - to read from stdin)")
+	tokenFile := fs.String("token-file", "", "path to a file containing the token")
+	jwksFile := fs.String("jwks-file", "", "path to a JWKS JSON document or PEM public keys/certificates")
+	issuer := fs.String("issuer", "", "expected issuer (skipped if empty)")
+	audience := fs.String("audience", "", "expected audience (skipped if empty)")
+	skipExpiry := fs.Bool("skip-expiry", false, "accept expired tokens")
+	raw := fs.Bool("raw", false, "print all token claims instead of the normalized set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *jwksFile == "" {
+		return fmt.Errorf("--jwks-file is required")
+	}
+
+	rawToken, err := readToken(*token, *tokenFile)
+	if err != nil {
+		return err
+	}
+
+	keys, err := oidc.LoadKeySetFile(*jwksFile)
+	if err != nil {
+		return err
+	}
+
+	claims, err := oidc.VerifyOffline(context.Background(), rawToken, keys, oidc.OfflineOptions{
+		Issuer:     *issuer,
+		Audience:   *audience,
+		SkipExpiry: *skipExpiry,
+	})
+	if err != nil {
+		return err
+	}
+
+	var out any = claims
+	if *raw {
+		out = claims.Raw
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// readToken returns the token from --token, stdin or --token-file
+func readToken(token, tokenFile string) (string, error) {
+	switch {
+	case token != "" && tokenFile != "":
+		return "", fmt.Errorf("--token and --token-file are mutually exclusive")
+	case token == "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("reading token from stdin: %w", err)
+		}
+		token = string(data)
+	case tokenFile != "":
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("reading token file: %w", err)
+		}
+		token = string(data)
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("--token or --token-file is required")
+	}
+	return token, nil
+}
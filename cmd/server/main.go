@@ -3,56 +3,201 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/rophy/kube-federated-auth/internal/canary"
 	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/credcheck"
 	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/errreport"
+	"github.com/rophy/kube-federated-auth/internal/events"
+	"github.com/rophy/kube-federated-auth/internal/expiry"
+	"github.com/rophy/kube-federated-auth/internal/logging"
+	"github.com/rophy/kube-federated-auth/internal/notify"
+	"github.com/rophy/kube-federated-auth/internal/redact"
 	"github.com/rophy/kube-federated-auth/internal/server"
+	"github.com/rophy/kube-federated-auth/internal/tracing"
+	"github.com/rophy/kube-federated-auth/internal/version"
 )
 
-// Version is set at build time via -ldflags "-X main.Version=..."
-var Version = "dev"
-
 func main() {
 	configPath := flag.String("config", getEnv("CONFIG_PATH", "config/clusters.yaml"), "path to cluster config file")
 	port := flag.String("port", getEnv("PORT", "8080"), "server port")
 	namespace := flag.String("namespace", getEnv("NAMESPACE", "kube-federated-auth"), "namespace for credential secret")
 	secretName := flag.String("secret-name", getEnv("SECRET_NAME", "kube-federated-auth"), "name of credential secret")
+	credentialBackend := flag.String("credential-backend", getEnv("CREDENTIAL_BACKEND", credentials.BackendSecret), "where renewed credentials are persisted: "+strings.Join(credentials.BackendKinds, ", "))
+	readOnlyCredentials := flag.Bool("read-only-credentials", getEnv("READ_ONLY_CREDENTIALS", "") == "true", "load and watch stored credentials but never write them, e.g. on canary replicas")
+	secretOwner := flag.String("secret-owner", getEnv("SECRET_OWNER", ""), "Deployment/name or ConfigMap/name owning the credential secrets, which are garbage-collected with it")
+	secretAnnotations := flag.String("secret-annotations", getEnv("SECRET_ANNOTATIONS", ""), "comma-separated key=value annotations of the credential secrets")
+	credentialDir := flag.String("credential-dir", getEnv("CREDENTIAL_DIR", getEnv("CREDENTIAL_PATH", "")), "directory of the file credential backend")
+	flag.StringVar(credentialDir, "credential-path", *credentialDir, "alias of -credential-dir")
+	encryptionKey := flag.String("credential-encryption-key", getEnv("CREDENTIAL_ENCRYPTION_KEY", ""), "file with the AES-256 key encrypting persisted tokens (empty stores them unencrypted)")
+	decryptionKeys := flag.String("credential-decryption-keys", getEnv("CREDENTIAL_DECRYPTION_KEYS", ""), "comma-separated files with previous encryption keys, still accepted when reading")
+	backupKeyPath := flag.String("backup-key", getEnv("BACKUP_KEY", ""), "file with the AES-256 key sealing credential backups of /admin/backup (default: the credential encryption key)")
+	adminAddr := flag.String("admin-addr", getEnv("ADMIN_ADDR", "localhost:8081"), "listen address for admin endpoints such as /debug/state (empty disables)")
+	enablePprof := flag.Bool("enable-pprof", getEnv("ENABLE_PPROF", "") == "true", "serve net/http/pprof under /debug/pprof/ on the admin listener")
+	allowEmpty := flag.Bool("allow-empty-config", getEnv("ALLOW_EMPTY_CONFIG", "") == "true", "start with an empty cluster inventory if the config file is missing or has no clusters")
+	allowInsecure := flag.Bool("allow-insecure", getEnv("ALLOW_INSECURE", "") == "true", "accept clusters with insecure_skip_tls_verify (development only)")
+	pruneCredentials := flag.Bool("prune-credentials", getEnv("PRUNE_CREDENTIALS", "") == "true", "delete stored credentials of clusters that are not in the config at startup")
+	warmUp := flag.Bool("warm-up", getEnv("WARM_UP", "") == "true", "create all clusters' verifiers and fetch their JWKS at startup")
+	logLevel := flag.String("log-level", getEnv("LOG_LEVEL", string(logging.LevelInfo)), "initial log level: info or debug (changed at runtime with /admin/loglevel or SIGUSR1)")
+	logFormat := flag.String("log-format", getEnv("LOG_FORMAT", string(logging.FormatText)), "log format: text, or json with one object per line")
+	showVersion := flag.Bool("version", false, "print version information and exit")
 	flag.Parse()
 
-	cfg, err := config.Load(*configPath)
+	// Scrub tokens from everything logged, including errors from dependencies
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if format == logging.FormatJSON {
+		log.SetFlags(0)
+		log.SetOutput(redact.NewWriter(logging.NewJSONWriter(os.Stderr)))
+	} else {
+		log.SetOutput(redact.NewWriter(os.Stderr))
+	}
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.SetLevel(level, 0)
+
+	if *showVersion {
+		fmt.Println("kube-federated-auth", version.Get())
+		return
+	}
+
+	cfg, err := config.LoadWithOptions(*configPath, config.LoadOptions{AllowEmpty: *allowEmpty, AllowInsecure: *allowInsecure})
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	for _, name := range cfg.ClusterNames() {
+		if cfg.Clusters[name].InsecureSkipTLSVerify {
+			log.Printf("WARNING: cluster %s: TLS certificate verification is disabled (insecure_skip_tls_verify); do not use in production", name)
+		}
+	}
+
+	if len(cfg.Clusters) == 0 {
+		log.Printf("Warning: no clusters configured, all TokenReviews will be rejected")
+	} else {
+		log.Printf("Loaded %d cluster(s): %v", len(cfg.Clusters), cfg.ClusterNames())
+	}
 
-	log.Printf("Loaded %d cluster(s): %v", len(cfg.Clusters), cfg.ClusterNames())
+	notifier, err := notify.New(cfg.Notifications)
+	if err != nil {
+		log.Fatalf("Failed to set up notifications: %v", err)
+	}
+
+	reporter, err := errreport.New(cfg.ErrorReporting, notifier)
+	if err != nil {
+		log.Fatalf("Failed to set up error reporting: %v", err)
+	}
 
 	// Only create credential store if there are remote clusters
 	var credStore *credentials.Store
 	remoteClusters := cfg.GetRemoteClusters()
 	if len(remoteClusters) > 0 {
-		var err error
-		credStore, err = credentials.NewStore(*namespace, *secretName)
+		annotations, err := credentials.ParseAnnotations(*secretAnnotations)
+		if err != nil {
+			log.Fatalf("Invalid secret annotations: %v", err)
+		}
+		if *secretOwner != "" {
+			if _, _, err := credentials.ParseOwner(*secretOwner); err != nil {
+				log.Fatalf("Invalid secret owner: %v", err)
+			}
+		}
+		backend, err := credentials.NewBackend(*credentialBackend, credentials.BackendOptions{
+			Namespace:  *namespace,
+			SecretName: *secretName,
+			Dir:        *credentialDir,
+			SecretMetadata: credentials.SecretMetadata{
+				Annotations: annotations,
+				Owner:       *secretOwner,
+			},
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up credential backend: %v", err)
+		}
+		if *credentialBackend == credentials.BackendFile && *encryptionKey == "" {
+			log.Printf("Warning: credentials are stored unencrypted in %s; set CREDENTIAL_ENCRYPTION_KEY to encrypt them", *credentialDir)
+		}
+		if backend != nil && *encryptionKey != "" {
+			backend, err = encryptBackend(backend, *encryptionKey, *decryptionKeys)
+			if err != nil {
+				log.Fatalf("Failed to set up credential encryption: %v", err)
+			}
+		}
+		credStore, err = credentials.NewStore(backend, reporter)
 		if err != nil {
 			log.Fatalf("Failed to create credential store: %v", err)
 		}
+		if *readOnlyCredentials {
+			credStore.SetReadOnly(true)
+			log.Printf("Credential store is read-only: renewed credentials are kept in memory only")
+		}
+
+		if *pruneCredentials {
+			pruned, err := credStore.Prune(context.Background(), cfg.Clusters)
+			if err != nil {
+				log.Printf("Warning: could not prune stored credentials: %v", err)
+			}
+			if len(pruned) > 0 {
+				log.Printf("Pruned stored credentials of clusters no longer configured: %v", pruned)
+			}
+		}
 
 		// Load bootstrap credentials from files for remote clusters
 		for clusterName, clusterCfg := range cfg.Clusters {
-			if clusterCfg.TokenPath != "" && clusterCfg.CACert != "" {
-				if err := credStore.LoadFromFiles(clusterName, clusterCfg.TokenPath, clusterCfg.CACert); err != nil {
+			if clusterCfg.HasBootstrapCredentials() {
+				if err := credStore.LoadBootstrap(clusterName, clusterCfg); err != nil {
 					log.Printf("Warning: could not load bootstrap credentials for %s: %v", clusterName, err)
 				}
 			}
 		}
 	}
 
-	log.Printf("kube-federated-auth version %s", Version)
-	srv := server.New(cfg, credStore, Version)
+	log.Printf("kube-federated-auth version %s", version.Get())
+
+	shutdownTracing, err := tracing.Setup(context.Background(), version.Version)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+	if tracing.Enabled() {
+		log.Printf("OpenTelemetry tracing enabled")
+	}
+
+	var backupKey []byte
+	if *backupKeyPath == "" {
+		*backupKeyPath = *encryptionKey
+	}
+	if *backupKeyPath != "" {
+		backupKey, err = credentials.LoadEncryptionKey(*backupKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load backup key: %v", err)
+		}
+	}
+
+	srv, err := server.New(cfg, credStore, server.Options{EnablePprof: *enablePprof, ErrorReporter: reporter, BackupKey: backupKey})
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+
+	// Requests arriving during warm-up share its in-flight verifier creation
+	if *warmUp {
+		go func() {
+			start := time.Now()
+			failed := srv.Verifier.WarmUp(context.Background())
+			log.Printf("Warmed up verifiers for %d/%d clusters in %s", len(cfg.Clusters)-failed, len(cfg.Clusters), time.Since(start).Round(time.Millisecond))
+		}()
+	}
 
 	// Start credential renewal for remote clusters
 	if len(remoteClusters) > 0 {
@@ -60,9 +205,34 @@ func main() {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
-		renewer := credentials.NewRenewer(cfg, credStore, srv.Verifier)
+		var webhookURL string
+		if cfg.Events != nil {
+			webhookURL = cfg.Events.WebhookURL
+		}
+		recorder := events.NewRecorder(*namespace, *secretName, webhookURL, notifier)
+
+		renewer := credentials.NewRenewer(cfg, credStore, srv.Verifier, recorder)
 		renewer.Start(ctx)
 
+		go func() {
+			if err := credStore.Watch(ctx, srv.Verifier); err != nil {
+				log.Printf("Failed to watch stored credentials: %v", err)
+			}
+		}()
+		go credStore.WatchBootstrap(ctx, cfg, srv.Verifier)
+
+		if cfg.Canary != nil {
+			canary.New(cfg, credStore, srv.Handler).Start(ctx)
+		}
+
+		if cfg.CredentialCheck != nil {
+			credcheck.New(cfg, srv.Verifier, recorder).Start(ctx)
+		}
+
+		if cfg.ExpiryAlerts != nil {
+			expiry.New(cfg, credStore, recorder).Start(ctx)
+		}
+
 		// Handle shutdown gracefully
 		go func() {
 			sigCh := make(chan os.Signal, 1)
@@ -73,6 +243,27 @@ func main() {
 		}()
 	}
 
+	// SIGUSR1 toggles debug logging
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGUSR1)
+		for range sigCh {
+			log.Printf("Received SIGUSR1, log level now %s", logging.ToggleLevel())
+		}
+	}()
+
+	if *enablePprof && *adminAddr == "" {
+		log.Printf("Warning: --enable-pprof has no effect without an admin listener")
+	}
+	if *adminAddr != "" {
+		go func() {
+			log.Printf("Starting admin server on %s", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, srv.Admin); err != nil {
+				log.Printf("Admin server failed: %v", err)
+			}
+		}()
+	}
+
 	addr := ":" + *port
 	log.Printf("Starting server on %s", addr)
 	if err := http.ListenAndServe(addr, srv.Handler); err != nil {
@@ -86,3 +277,25 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// encryptBackend wraps backend to encrypt tokens with the key in keyPath,
+// also decrypting with the comma-separated previous keys
+func encryptBackend(backend credentials.Backend, keyPath, oldPaths string) (credentials.Backend, error) {
+	current, err := credentials.LoadEncryptionKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	var old [][]byte
+	for _, path := range strings.Split(oldPaths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		key, err := credentials.LoadEncryptionKey(path)
+		if err != nil {
+			return nil, err
+		}
+		old = append(old, key)
+	}
+	log.Printf("Encrypting persisted tokens (%d previous keys accepted)", len(old))
+	return credentials.NewEncryptingBackend(backend, current, old...)
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func newTestEvent(t *testing.T, id string) *Event {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	return NewEvent(req, id)
+}
+
+func TestLogger_FileChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	logger, err := New(&config.AuditSettings{Path: path})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ev := newTestEvent(t, "1")
+	ev.Allow("cluster-a", authnv1.UserInfo{Username: "system:serviceaccount:default:app"})
+	logger.Log(ev)
+	ev = newTestEvent(t, "2")
+	ev.Deny("", "", "token not valid for any configured cluster", http.StatusOK)
+	logger.Log(ev)
+
+	// A new logger on the same file continues the chain
+	logger, err = New(&config.AuditSettings{Path: path})
+	if err != nil {
+		t.Fatalf("New (reopen): %v", err)
+	}
+	logger.Log(newTestEvent(t, "3"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := VerifyChain(bytes.NewReader(data))
+	if err != nil || n != 3 {
+		t.Fatalf("VerifyChain = %d, %v; want 3, nil", n, err)
+	}
+
+	var first Event
+	if err := json.Unmarshal(data[:bytes.IndexByte(data, '\n')], &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Annotations[AnnotationDecision] != DecisionAllow || first.Annotations[AnnotationCluster] != "cluster-a" {
+		t.Errorf("annotations = %v", first.Annotations)
+	}
+	if len(first.SourceIPs) != 1 || first.SourceIPs[0] != "10.0.0.1" {
+		t.Errorf("sourceIPs = %v, want [10.0.0.1]", first.SourceIPs)
+	}
+
+	// Dropping the middle event breaks the chain
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	tampered := lines[0] + "\n" + lines[2] + "\n"
+	if _, err := VerifyChain(strings.NewReader(tampered)); err == nil {
+		t.Error("VerifyChain: expected error for removed event")
+	}
+}
+
+func TestFileSink_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := New(&config.AuditSettings{Path: path})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		logger.Log(newTestEvent(t, id))
+	}
+
+	// A log within limits is left alone; expiring everything still leaves a
+	// chain that verifies as new events are appended
+	size, _ := logger.File().Size()
+	dropped, err := logger.File().Compact(config.RetentionSettings{MaxSizeMB: 1})
+	if err != nil || dropped != 0 {
+		t.Fatalf("Compact within limit = %d, %v; want 0, nil", dropped, err)
+	}
+	if size == 0 {
+		t.Fatal("Size = 0, want log size")
+	}
+	dropped, err = logger.File().Compact(config.RetentionSettings{MaxAge: time.Nanosecond})
+	if err != nil || dropped != 3 {
+		t.Fatalf("Compact by age = %d, %v; want 3, nil", dropped, err)
+	}
+	logger.Log(newTestEvent(t, "4"))
+	logger.Log(newTestEvent(t, "5"))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := VerifyChain(f); err != nil || n != 2 {
+		t.Errorf("VerifyChain after compaction = %d, %v; want 2, nil", n, err)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	}))
+	defer srv.Close()
+
+	logger := NewLogger("", NewWebhookSink(srv.URL))
+	logger.Log(newTestEvent(t, "abc"))
+
+	select {
+	case body := <-received:
+		var list struct {
+			Kind  string  `json:"kind"`
+			Items []Event `json:"items"`
+		}
+		if err := json.Unmarshal(body, &list); err != nil {
+			t.Fatalf("decoding EventList: %v", err)
+		}
+		if list.Kind != "EventList" || len(list.Items) != 1 || list.Items[0].AuditID != "abc" {
+			t.Errorf("unexpected payload: %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook did not receive event")
+	}
+}
+
+func TestLogger_Nil(t *testing.T) {
+	var logger *Logger
+	logger.Log(newTestEvent(t, "1")) // must not panic
+}
@@ -0,0 +1,179 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/retention"
+)
+
+// FileSink appends events as JSON lines to a file
+type FileSink struct {
+	mu   sync.Mutex
+	w    io.Writer
+	path string // empty for stdout
+}
+
+// NewFileSink opens path for appending ("-" for stdout). It also returns the
+// hash of the last event already in the file so the chain continues across restarts.
+func NewFileSink(path string) (*FileSink, string, error) {
+	if path == "-" {
+		return &FileSink{w: os.Stdout}, "", nil
+	}
+
+	last, err := lastLine(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	f, err := openLog(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var prevHash string
+	if len(last) > 0 {
+		prevHash = hash(last)
+	}
+	return &FileSink{w: f, path: path}, prevHash, nil
+}
+
+func openLog(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	return f, nil
+}
+
+// Compact drops the oldest events outside settings. The chain stays
+// verifiable because VerifyChain does not check the first event's prev-hash.
+func (s *FileSink) Compact(settings config.RetentionSettings) (int, error) {
+	if s.path == "" {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped, err := retention.CompactFile(s.path, settings, eventTime)
+	if err != nil || dropped == 0 {
+		return dropped, err
+	}
+	f, err := openLog(s.path)
+	if err != nil {
+		return dropped, err
+	}
+	if old, ok := s.w.(io.Closer); ok {
+		old.Close()
+	}
+	s.w = f
+	return dropped, nil
+}
+
+// Size returns the size of the log file
+func (s *FileSink) Size() (int64, error) {
+	if s.path == "" {
+		return 0, nil
+	}
+	return retention.FileSize(s.path)
+}
+
+func eventTime(line []byte) (time.Time, error) {
+	var e struct {
+		StageTimestamp time.Time `json:"stageTimestamp"`
+	}
+	if err := json.Unmarshal(line, &e); err != nil {
+		return time.Time{}, err
+	}
+	return e.StageTimestamp, nil
+}
+
+func (s *FileSink) Write(event []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(append(event, '\n'))
+	return err
+}
+
+// lastLine returns the last non-empty line of a file, or nil if the file is missing or empty
+func lastLine(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading audit log: %w", err)
+	}
+	data = bytes.TrimRight(data, "\n")
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	return data, nil
+}
+
+// webhookBuffer is how many events may queue for the webhook before new ones are dropped
+const webhookBuffer = 1000
+
+// WebhookSink POSTs events to a URL as audit.k8s.io/v1 EventList documents,
+// the format accepted by Kubernetes audit webhook backends. Delivery is
+// asynchronous so a slow receiver does not delay authentication.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+}
+
+// NewWebhookSink starts a background sender for url
+func NewWebhookSink(url string) *WebhookSink {
+	s := &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan []byte, webhookBuffer),
+	}
+	go s.run()
+	return s
+}
+
+func (s *WebhookSink) Write(event []byte) error {
+	select {
+	case s.queue <- bytes.Clone(event):
+		return nil
+	default:
+		return fmt.Errorf("webhook queue full, event dropped")
+	}
+}
+
+func (s *WebhookSink) run() {
+	for event := range s.queue {
+		if err := s.send(event); err != nil {
+			log.Printf("Audit: webhook delivery failed: %v", err)
+		}
+	}
+}
+
+func (s *WebhookSink) send(event []byte) error {
+	var body bytes.Buffer
+	body.WriteString(`{"apiVersion":"audit.k8s.io/v1","kind":"EventList","items":[`)
+	body.Write(event)
+	body.WriteString(`]}`)
+
+	resp, err := s.client.Post(s.url, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Package authz decides SubjectAccessReviews of the POST /sar authorization
+// webhook with a central policy keyed by the cluster that authenticated the
+// user, the user, and the verb and resource of the request.
+package authz
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	authzv1 "k8s.io/api/authorization/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// Decision of a policy. NoOpinion leaves the request to the next authorizer
+// of the consuming API server.
+type Decision int
+
+const (
+	NoOpinion Decision = iota
+	Allow
+	Deny
+)
+
+// Policy is a backend deciding SubjectAccessReviews for users authenticated
+// by cluster ("" for others). The reason is returned to the API server and
+// should say which rule decided.
+type Policy interface {
+	Authorize(ctx context.Context, cluster string, spec authzv1.SubjectAccessReviewSpec) (Decision, string, error)
+}
+
+// RulePolicy is the policy of the authorization rules of the config: the
+// first matching rule decides
+type RulePolicy struct {
+	rules []config.AuthorizationRule
+}
+
+// NewRulePolicy returns the policy of settings; nil settings have no opinion
+// on any request
+func NewRulePolicy(settings *config.AuthorizationSettings) *RulePolicy {
+	if settings == nil {
+		return &RulePolicy{}
+	}
+	return &RulePolicy{rules: settings.Rules}
+}
+
+// Authorize has no opinion on users no federated cluster authenticated, such
+// as the consuming API server's own administrators and control plane, so that
+// rules without clusters (or with "*") only cover federated users.
+func (p *RulePolicy) Authorize(_ context.Context, cluster string, spec authzv1.SubjectAccessReviewSpec) (Decision, string, error) {
+	if cluster == "" {
+		return NoOpinion, "user not authenticated by a federated cluster", nil
+	}
+	for i, rule := range p.rules {
+		if !matches(rule, cluster, spec) {
+			continue
+		}
+		if rule.Decision == config.AuthorizationDeny {
+			return Deny, fmt.Sprintf("denied by authorization rule %d", i), nil
+		}
+		return Allow, fmt.Sprintf("allowed by authorization rule %d", i), nil
+	}
+	return NoOpinion, "no authorization rule matches", nil
+}
+
+func matches(rule config.AuthorizationRule, cluster string, spec authzv1.SubjectAccessReviewSpec) bool {
+	if !matchList(rule.Clusters, cluster) || !matchSubject(rule, spec) {
+		return false
+	}
+	switch {
+	case spec.ResourceAttributes != nil:
+		ra := spec.ResourceAttributes
+		resource := ra.Resource
+		if ra.Subresource != "" {
+			resource += "/" + ra.Subresource
+		}
+		return len(rule.NonResourceURLs) == 0 &&
+			matchList(rule.Verbs, ra.Verb) &&
+			matchList(rule.APIGroups, ra.Group) &&
+			matchList(rule.Resources, resource) &&
+			matchList(rule.Namespaces, ra.Namespace)
+	case spec.NonResourceAttributes != nil:
+		na := spec.NonResourceAttributes
+		return len(rule.APIGroups) == 0 && len(rule.Resources) == 0 && len(rule.Namespaces) == 0 &&
+			matchList(rule.Verbs, na.Verb) &&
+			matchList(rule.NonResourceURLs, na.Path)
+	}
+	return false
+}
+
+// matchSubject matches the users (glob patterns) or groups of a rule
+func matchSubject(rule config.AuthorizationRule, spec authzv1.SubjectAccessReviewSpec) bool {
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Users {
+		if ok, _ := path.Match(pattern, spec.User); ok {
+			return true
+		}
+	}
+	for _, group := range rule.Groups {
+		if group == "*" || slices.Contains(spec.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchList matches a value against a rule field; empty matches anything.
+// Entries ending in "*" match by prefix, e.g. "/healthz*" or "pods/*".
+func matchList(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, entry := range list {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok && strings.HasPrefix(value, prefix) {
+			return true
+		}
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
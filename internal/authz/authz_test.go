@@ -0,0 +1,70 @@
+package authz
+
+import (
+	"context"
+	"testing"
+
+	authzv1 "k8s.io/api/authorization/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func TestRulePolicy(t *testing.T) {
+	p := NewRulePolicy(&config.AuthorizationSettings{Rules: []config.AuthorizationRule{
+		{Decision: config.AuthorizationDeny, Resources: []string{"secrets"}},
+		{Clusters: []string{"ci"}, Users: []string{"system:serviceaccount:ci:*"}, Verbs: []string{"get", "list"}, Resources: []string{"pods", "pods/*"}, Namespaces: []string{"builds"}},
+		{Groups: []string{"ops"}, Verbs: []string{"get"}, NonResourceURLs: []string{"/healthz*"}},
+	}})
+
+	resource := func(user, verb, resource, subresource, namespace string) authzv1.SubjectAccessReviewSpec {
+		return authzv1.SubjectAccessReviewSpec{User: user, ResourceAttributes: &authzv1.ResourceAttributes{
+			Verb: verb, Resource: resource, Subresource: subresource, Namespace: namespace,
+		}}
+	}
+	ciBot := "system:serviceaccount:ci:builder"
+	tests := []struct {
+		name    string
+		cluster string
+		spec    authzv1.SubjectAccessReviewSpec
+		want    Decision
+	}{
+		{"allowed", "ci", resource(ciBot, "list", "pods", "", "builds"), Allow},
+		{"subresource", "ci", resource(ciBot, "get", "pods", "log", "builds"), Allow},
+		{"other verb", "ci", resource(ciBot, "delete", "pods", "", "builds"), NoOpinion},
+		{"other namespace", "ci", resource(ciBot, "get", "pods", "", "default"), NoOpinion},
+		{"other cluster", "prod", resource(ciBot, "get", "pods", "", "builds"), NoOpinion},
+		{"not a webhook user", "", resource(ciBot, "get", "pods", "", "builds"), NoOpinion},
+		// Rules without clusters only cover federated users
+		{"not a webhook user, rule without clusters", "", resource("system:kube-controller-manager", "get", "secrets", "", "kube-system"), NoOpinion},
+		{"first rule denies", "ci", resource(ciBot, "get", "secrets", "", "builds"), Deny},
+		{"non-resource by group", "prod", authzv1.SubjectAccessReviewSpec{User: "alice", Groups: []string{"ops"},
+			NonResourceAttributes: &authzv1.NonResourceAttributes{Verb: "get", Path: "/healthz/ready"}}, Allow},
+		{"non-resource without group", "prod", authzv1.SubjectAccessReviewSpec{User: "alice",
+			NonResourceAttributes: &authzv1.NonResourceAttributes{Verb: "get", Path: "/healthz"}}, NoOpinion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason, err := p.Authorize(context.Background(), tt.cluster, tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("decision = %v (%s), want %v", got, reason, tt.want)
+			}
+		})
+	}
+
+	anyCluster := NewRulePolicy(&config.AuthorizationSettings{Rules: []config.AuthorizationRule{
+		{Decision: config.AuthorizationDeny, Clusters: []string{"*"}, Resources: []string{"secrets"}},
+	}})
+	if got, _, _ := anyCluster.Authorize(context.Background(), "ci", resource(ciBot, "get", "secrets", "", "builds")); got != Deny {
+		t.Errorf("any cluster: decision = %v, want deny", got)
+	}
+	if got, _, _ := anyCluster.Authorize(context.Background(), "", resource("system:kube-scheduler", "get", "secrets", "", "kube-system")); got != NoOpinion {
+		t.Errorf("any cluster, not a webhook user: decision = %v, want no opinion", got)
+	}
+
+	if got, _, _ := NewRulePolicy(nil).Authorize(context.Background(), "ci", resource(ciBot, "get", "pods", "", "")); got != NoOpinion {
+		t.Errorf("no rules: decision = %v, want no opinion", got)
+	}
+}
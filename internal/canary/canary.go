@@ -0,0 +1,142 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/handler"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+)
+
+const (
+	tokenReviewPath = "/apis/authentication.k8s.io/v1/tokenreviews"
+	// probeTokenSeconds is the minimum lifetime accepted by the TokenRequest API
+	probeTokenSeconds = 600
+)
+
+// Canary periodically mints a short-lived token on each remote cluster using
+// the stored credentials and submits it through the server's full
+// TokenReview path, so breakage is detected before real workloads fail.
+type Canary struct {
+	config    *config.Config
+	credStore *credentials.Store
+	handler   http.Handler
+}
+
+// New creates a canary that probes through handler
+func New(cfg *config.Config, store *credentials.Store, handler http.Handler) *Canary {
+	return &Canary{
+		config:    cfg,
+		credStore: store,
+		handler:   handler,
+	}
+}
+
+// Start begins the probe loops for all remote clusters
+func (c *Canary) Start(ctx context.Context) {
+	interval := c.config.Canary.GetInterval()
+	for clusterName, clusterCfg := range c.config.Clusters {
+		if clusterCfg.IsRemote() {
+			go c.probeLoop(ctx, clusterName, clusterCfg, interval)
+		}
+	}
+}
+
+func (c *Canary) probeLoop(ctx context.Context, cluster string, cfg config.ClusterConfig, interval time.Duration) {
+	log.Printf("Starting canary probes for cluster %s (interval: %s)", cluster, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.runProbe(ctx, cluster, cfg)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("Stopping canary probes for cluster %s", cluster)
+			return
+		}
+	}
+}
+
+func (c *Canary) runProbe(ctx context.Context, cluster string, cfg config.ClusterConfig) {
+	start := time.Now()
+	err := c.probe(ctx, cluster, cfg)
+	metrics.CanaryDuration.WithLabelValues(cluster).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		log.Printf("Canary probe failed for cluster %s: %v", cluster, err)
+		metrics.CanaryProbes.WithLabelValues(cluster, "failure").Inc()
+		metrics.CanarySuccess.WithLabelValues(cluster).Set(0)
+		return
+	}
+	metrics.CanaryProbes.WithLabelValues(cluster, "success").Inc()
+	metrics.CanarySuccess.WithLabelValues(cluster).Set(1)
+	metrics.CanaryLastSuccess.WithLabelValues(cluster).SetToCurrentTime()
+}
+
+func (c *Canary) probe(ctx context.Context, cluster string, cfg config.ClusterConfig) error {
+	creds, ok := c.credStore.Get(cluster)
+	if !ok {
+		return fmt.Errorf("no credentials available")
+	}
+
+	namespace, serviceAccount, err := credentials.ServiceAccountFromToken(creds.Token)
+	if err != nil {
+		return fmt.Errorf("parsing token subject: %w", err)
+	}
+
+	client, err := credentials.NewClient(cfg, creds)
+	if err != nil {
+		return fmt.Errorf("creating k8s client: %w", err)
+	}
+
+	seconds := int64(probeTokenSeconds)
+	token, err := client.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, serviceAccount, &authv1.TokenRequest{
+		Spec: authv1.TokenRequestSpec{ExpirationSeconds: &seconds, Audiences: cfg.Audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("minting probe token: %w", err)
+	}
+
+	body, err := json.Marshal(&authv1.TokenReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"},
+		Spec:     authv1.TokenReviewSpec{Token: token.Status.Token},
+	})
+	if err != nil {
+		return err
+	}
+
+	req := httptest.NewRequest(http.MethodPost, tokenReviewPath, bytes.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "canary"
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("TokenReview returned status %d", rec.Code)
+	}
+
+	var result authv1.TokenReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		return fmt.Errorf("decoding TokenReview response: %w", err)
+	}
+	if !result.Status.Authenticated {
+		return fmt.Errorf("token not authenticated: %s", result.Status.Error)
+	}
+	if got := result.Status.User.Extra[handler.ExtraKeyClusterName]; len(got) != 1 || got[0] != cluster {
+		return fmt.Errorf("token attributed to cluster %v", got)
+	}
+	return nil
+}
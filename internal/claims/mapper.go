@@ -0,0 +1,428 @@
+package claims
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// Mapper evaluates a cluster's claimValidationRules, claimMappings and
+// userValidationRules using the same CEL conventions as the kube-apiserver
+// JWT authenticator: claims are exposed as `claims`, the user as `user`.
+type Mapper struct {
+	claimRules []claimRule
+	username   *valueMapping
+	groups     *valueMapping
+	uid        *valueMapping
+	extra      []extraMapping
+	userRules  []userRule
+}
+
+type claimRule struct {
+	claim         string
+	requiredValue string
+	program       cel.Program
+	source        string
+	message       string
+}
+
+type valueMapping struct {
+	claim   string
+	prefix  string
+	program cel.Program
+}
+
+type extraMapping struct {
+	key     string
+	program cel.Program
+}
+
+type userRule struct {
+	program cel.Program
+	source  string
+	message string
+}
+
+// Compile builds mappers for all clusters that configure claim rules or mappings.
+// Clusters without any are omitted from the result.
+func Compile(cfg *config.Config) (map[string]*Mapper, error) {
+	mappers := make(map[string]*Mapper)
+	for name, cluster := range cfg.Clusters {
+		m, err := NewMapper(cluster)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+		if m != nil {
+			mappers[name] = m
+		}
+	}
+	return mappers, nil
+}
+
+// NewMapper compiles the CEL expressions of a cluster config. The
+// required_claims and default claim mappings of an oidc cluster are included.
+// Returns nil if the cluster has no rules or mappings configured.
+func NewMapper(cfg config.ClusterConfig) (*Mapper, error) {
+	if cfg.HasTokenReviewAPI() && len(cfg.ClaimValidationRules) == 0 && cfg.ClaimMappings == nil && len(cfg.UserValidationRules) == 0 {
+		return nil, nil
+	}
+
+	// String and set extensions match the libraries available to the upstream authenticator
+	claimsEnv, err := cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		ext.Strings(),
+		ext.Sets(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating CEL environment: %w", err)
+	}
+	userEnv, err := cel.NewEnv(
+		cel.Variable("user", cel.MapType(cel.StringType, cel.DynType)),
+		ext.Strings(),
+		ext.Sets(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating CEL environment: %w", err)
+	}
+
+	m := &Mapper{}
+
+	for i, rule := range cfg.ClaimValidationRules {
+		r := claimRule{
+			claim:         rule.Claim,
+			requiredValue: rule.RequiredValue,
+			source:        rule.Expression,
+			message:       rule.Message,
+		}
+		if rule.Expression != "" {
+			if r.program, err = compile(claimsEnv, rule.Expression); err != nil {
+				return nil, fmt.Errorf("claimValidationRules[%d]: %w", i, err)
+			}
+		}
+		m.claimRules = append(m.claimRules, r)
+	}
+	for _, claim := range slices.Sorted(maps.Keys(cfg.RequiredClaims)) {
+		m.claimRules = append(m.claimRules, claimRule{claim: claim, requiredValue: cfg.RequiredClaims[claim]})
+	}
+
+	mappings := cfg.ClaimMappings
+	if mappings == nil && cfg.IsOIDC() {
+		mappings = defaultOIDCMappings(cfg.Issuer)
+	}
+	if mappings == nil && !cfg.HasTokenReviewAPI() {
+		// Public and key_snapshot clusters issue ServiceAccount tokens
+		mappings = serviceAccountMappings()
+	}
+	if mappings != nil {
+		if m.username, err = compilePrefixed(claimsEnv, mappings.Username); err != nil {
+			return nil, fmt.Errorf("claimMappings.username: %w", err)
+		}
+		if m.groups, err = compilePrefixed(claimsEnv, mappings.Groups); err != nil {
+			return nil, fmt.Errorf("claimMappings.groups: %w", err)
+		}
+		uid := config.PrefixedClaimOrExpression{Claim: mappings.UID.Claim, Expression: mappings.UID.Expression}
+		if m.uid, err = compilePrefixed(claimsEnv, uid); err != nil {
+			return nil, fmt.Errorf("claimMappings.uid: %w", err)
+		}
+		for i, extra := range mappings.Extra {
+			program, err := compile(claimsEnv, extra.ValueExpression)
+			if err != nil {
+				return nil, fmt.Errorf("claimMappings.extra[%d]: %w", i, err)
+			}
+			m.extra = append(m.extra, extraMapping{key: extra.Key, program: program})
+		}
+	}
+
+	for i, rule := range cfg.UserValidationRules {
+		program, err := compile(userEnv, rule.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("userValidationRules[%d]: %w", i, err)
+		}
+		m.userRules = append(m.userRules, userRule{program: program, source: rule.Expression, message: rule.Message})
+	}
+
+	return m, nil
+}
+
+// defaultOIDCMappings follow the kube-apiserver --oidc-* flag defaults: the
+// username is sub, prefixed with the issuer so that it cannot collide with
+// other users, and groups come from the groups claim
+func defaultOIDCMappings(issuer string) *config.ClaimMappings {
+	prefix := issuer + "#"
+	noPrefix := ""
+	return &config.ClaimMappings{
+		Username: config.PrefixedClaimOrExpression{Claim: "sub", Prefix: &prefix},
+		Groups:   config.PrefixedClaimOrExpression{Claim: "groups", Prefix: &noPrefix},
+	}
+}
+
+// serviceAccountMappings map a ServiceAccount token's claims to the user the
+// API server's TokenReview would return for it
+func serviceAccountMappings() *config.ClaimMappings {
+	noPrefix := ""
+	return &config.ClaimMappings{
+		Username: config.PrefixedClaimOrExpression{Claim: "sub", Prefix: &noPrefix},
+		Groups: config.PrefixedClaimOrExpression{Expression: `["system:serviceaccounts", ` +
+			`"system:serviceaccounts:" + claims["kubernetes.io"].namespace, "system:authenticated"]`},
+		UID: config.ClaimOrExpression{Expression: `claims["kubernetes.io"].serviceaccount.uid`},
+		Extra: []config.ExtraMapping{
+			{Key: "authentication.kubernetes.io/pod-name", ValueExpression: `has(claims["kubernetes.io"].pod) ? [claims["kubernetes.io"].pod.name] : []`},
+			{Key: "authentication.kubernetes.io/pod-uid", ValueExpression: `has(claims["kubernetes.io"].pod) ? [claims["kubernetes.io"].pod.uid] : []`},
+			{Key: "authentication.kubernetes.io/node-name", ValueExpression: `has(claims["kubernetes.io"].node) ? [claims["kubernetes.io"].node.name] : []`},
+			{Key: "authentication.kubernetes.io/credential-id", ValueExpression: `has(claims.jti) ? ["JTI=" + claims.jti] : []`},
+		},
+	}
+}
+
+func compile(env *cel.Env, expr string) (cel.Program, error) {
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("compiling %q: %w", expr, issues.Err())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("building program for %q: %w", expr, err)
+	}
+	return program, nil
+}
+
+func compilePrefixed(env *cel.Env, cfg config.PrefixedClaimOrExpression) (*valueMapping, error) {
+	if cfg.Claim == "" && cfg.Expression == "" {
+		return nil, nil
+	}
+	v := &valueMapping{claim: cfg.Claim}
+	if cfg.Prefix != nil {
+		v.prefix = *cfg.Prefix
+	}
+	if cfg.Expression != "" {
+		program, err := compile(env, cfg.Expression)
+		if err != nil {
+			return nil, err
+		}
+		v.program = program
+	}
+	return v, nil
+}
+
+// HasMappings reports whether the mapper computes user info from claims
+func (m *Mapper) HasMappings() bool {
+	return m != nil && m.username != nil
+}
+
+// ValidateClaims evaluates claimValidationRules against the token claims
+func (m *Mapper) ValidateClaims(claims map[string]any) error {
+	if m == nil {
+		return nil
+	}
+	vars := map[string]any{"claims": claims}
+	for _, rule := range m.claimRules {
+		if rule.program == nil {
+			got, ok := claims[rule.claim].(string)
+			if !ok || got != rule.requiredValue {
+				return &policyError{fmt.Errorf("claim %q must be %q", rule.claim, rule.requiredValue)}
+			}
+			continue
+		}
+		if err := evalBool(rule.program, vars); err != nil {
+			return ruleError(rule.source, rule.message, err)
+		}
+	}
+	return nil
+}
+
+// MapUser computes user info from the token claims using claimMappings
+func (m *Mapper) MapUser(claims map[string]any) (*authv1.UserInfo, error) {
+	if !m.HasMappings() {
+		return nil, fmt.Errorf("no claim mappings configured")
+	}
+	vars := map[string]any{"claims": claims}
+
+	usernames, err := m.username.eval(claims, vars)
+	if err != nil {
+		return nil, fmt.Errorf("mapping username: %w", err)
+	}
+	if len(usernames) != 1 || usernames[0] == "" {
+		return nil, fmt.Errorf("mapping username: expected a non-empty string")
+	}
+	user := &authv1.UserInfo{Username: usernames[0]}
+
+	if m.groups != nil {
+		if user.Groups, err = m.groups.eval(claims, vars); err != nil {
+			return nil, fmt.Errorf("mapping groups: %w", err)
+		}
+	}
+
+	if m.uid != nil {
+		uids, err := m.uid.eval(claims, vars)
+		if err != nil {
+			return nil, fmt.Errorf("mapping uid: %w", err)
+		}
+		if len(uids) > 1 {
+			return nil, fmt.Errorf("mapping uid: expected a string")
+		}
+		if len(uids) == 1 {
+			user.UID = uids[0]
+		}
+	}
+
+	for _, extra := range m.extra {
+		out, _, err := extra.program.Eval(vars)
+		if err != nil {
+			return nil, fmt.Errorf("mapping extra %q: %w", extra.key, err)
+		}
+		values, err := toStrings(out)
+		if err != nil {
+			return nil, fmt.Errorf("mapping extra %q: %w", extra.key, err)
+		}
+		if len(values) == 0 {
+			continue
+		}
+		if user.Extra == nil {
+			user.Extra = make(map[string]authv1.ExtraValue)
+		}
+		user.Extra[extra.key] = values
+	}
+
+	return user, nil
+}
+
+// ValidateUser evaluates userValidationRules against the resulting user info
+func (m *Mapper) ValidateUser(user authv1.UserInfo) error {
+	if m == nil || len(m.userRules) == 0 {
+		return nil
+	}
+	extra := make(map[string]any, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = []string(v)
+	}
+	groups := user.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	vars := map[string]any{"user": map[string]any{
+		"username": user.Username,
+		"uid":      user.UID,
+		"groups":   groups,
+		"extra":    extra,
+	}}
+	for _, rule := range m.userRules {
+		if err := evalBool(rule.program, vars); err != nil {
+			return ruleError(rule.source, rule.message, err)
+		}
+	}
+	return nil
+}
+
+func (v *valueMapping) eval(claims map[string]any, vars map[string]any) ([]string, error) {
+	var values []string
+	if v.program != nil {
+		out, _, err := v.program.Eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		if values, err = toStrings(out); err != nil {
+			return nil, err
+		}
+	} else {
+		raw, ok := claims[v.claim]
+		if !ok {
+			return nil, nil
+		}
+		switch val := raw.(type) {
+		case string:
+			values = []string{val}
+		case []any:
+			for _, item := range val {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("claim %q must be a string or list of strings", v.claim)
+				}
+				values = append(values, s)
+			}
+		default:
+			return nil, fmt.Errorf("claim %q must be a string or list of strings", v.claim)
+		}
+	}
+
+	if v.prefix != "" {
+		for i := range values {
+			values[i] = v.prefix + values[i]
+		}
+	}
+	return values, nil
+}
+
+var stringSliceType = reflect.TypeOf([]string{})
+
+// toStrings converts a CEL result that is a string or list of strings
+func toStrings(val ref.Val) ([]string, error) {
+	switch val.Type() {
+	case types.StringType:
+		s := val.Value().(string)
+		if s == "" {
+			return nil, nil
+		}
+		return []string{s}, nil
+	case types.NullType:
+		return nil, nil
+	case types.ListType:
+		native, err := val.ConvertToNative(stringSliceType)
+		if err != nil {
+			return nil, fmt.Errorf("expected a list of strings: %w", err)
+		}
+		return native.([]string), nil
+	default:
+		return nil, fmt.Errorf("expected a string or list of strings, got %s", val.Type().TypeName())
+	}
+}
+
+func evalBool(program cel.Program, vars map[string]any) error {
+	out, _, err := program.Eval(vars)
+	if err != nil {
+		return err
+	}
+	ok, isBool := out.Value().(bool)
+	if !isBool {
+		return fmt.Errorf("expression must evaluate to a bool")
+	}
+	if !ok {
+		return errRuleFailed
+	}
+	return nil
+}
+
+var errRuleFailed = errors.New("rule evaluated to false")
+
+// ErrPolicyDenied matches, with errors.Is, the errors of claim and user
+// validation rules that rejected a token. A rule that fails to evaluate (e.g.
+// on a missing claim) rejects it too, as in the kube-apiserver.
+var ErrPolicyDenied = errors.New("policy_denied")
+
+// policyError keeps the message of a rule failure while matching ErrPolicyDenied
+type policyError struct {
+	err error
+}
+
+func (e *policyError) Error() string { return e.err.Error() }
+
+func (e *policyError) Unwrap() []error { return []error{ErrPolicyDenied, e.err} }
+
+func ruleError(source, message string, err error) error {
+	if err == errRuleFailed {
+		if message != "" {
+			return &policyError{fmt.Errorf("%s", message)}
+		}
+		return &policyError{fmt.Errorf("validation rule %q failed", source)}
+	}
+	return &policyError{fmt.Errorf("evaluating %q: %w", source, err)}
+}
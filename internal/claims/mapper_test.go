@@ -0,0 +1,261 @@
+package claims
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func testClaims() map[string]any {
+	return map[string]any{
+		"iss": "https://issuer.example.com",
+		"sub": "system:serviceaccount:default:app",
+		"hd":  "example.com",
+		"kubernetes.io": map[string]any{
+			"namespace": "default",
+		},
+		"roles": "admin,dev",
+	}
+}
+
+func TestMapper_ClaimValidationRules(t *testing.T) {
+	m, err := NewMapper(config.ClusterConfig{
+		ClaimValidationRules: []config.ClaimValidationRule{
+			{Claim: "hd", RequiredValue: "example.com"},
+			{Expression: `claims["kubernetes.io"].namespace == "default"`, Message: "namespace must be default"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewMapper: %v", err)
+	}
+
+	if err := m.ValidateClaims(testClaims()); err != nil {
+		t.Errorf("ValidateClaims: unexpected error: %v", err)
+	}
+
+	c := testClaims()
+	c["kubernetes.io"] = map[string]any{"namespace": "kube-system"}
+	err = m.ValidateClaims(c)
+	if err == nil || err.Error() != "namespace must be default" {
+		t.Errorf("ValidateClaims error = %v, want %q", err, "namespace must be default")
+	}
+}
+
+func TestMapper_MapUser(t *testing.T) {
+	prefix := "fed:"
+	m, err := NewMapper(config.ClusterConfig{
+		ClaimMappings: &config.ClaimMappings{
+			Username: config.PrefixedClaimOrExpression{Claim: "sub", Prefix: &prefix},
+			Groups:   config.PrefixedClaimOrExpression{Expression: `claims.roles.split(",")`},
+			UID:      config.ClaimOrExpression{Expression: `claims.iss + "/" + claims.sub`},
+			Extra: []config.ExtraMapping{
+				{Key: "example.com/domain", ValueExpression: "claims.hd"},
+			},
+		},
+		UserValidationRules: []config.UserValidationRule{
+			{Expression: `!user.username.startsWith("system:")`, Message: "reserved prefix"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewMapper: %v", err)
+	}
+
+	user, err := m.MapUser(testClaims())
+	if err != nil {
+		t.Fatalf("MapUser: %v", err)
+	}
+	if user.Username != "fed:system:serviceaccount:default:app" {
+		t.Errorf("username = %q", user.Username)
+	}
+	if !slices.Equal(user.Groups, []string{"admin", "dev"}) {
+		t.Errorf("groups = %v, want [admin dev]", user.Groups)
+	}
+	if user.UID != "https://issuer.example.com/system:serviceaccount:default:app" {
+		t.Errorf("uid = %q", user.UID)
+	}
+	if got := user.Extra["example.com/domain"]; len(got) != 1 || got[0] != "example.com" {
+		t.Errorf("extra = %v", user.Extra)
+	}
+
+	if err := m.ValidateUser(*user); err != nil {
+		t.Errorf("ValidateUser: unexpected error: %v", err)
+	}
+	user.Username = "system:admin"
+	if err := m.ValidateUser(*user); err == nil {
+		t.Error("ValidateUser: expected error for reserved prefix")
+	}
+}
+
+func TestMapper_CustomClaimLayout(t *testing.T) {
+	// A non-Kubernetes issuer with Keycloak's nested claim layout
+	m, err := NewMapper(config.ClusterConfig{
+		Type:     config.ClusterTypeOIDC,
+		Issuer:   "https://keycloak.example.com/realms/corp",
+		ClientID: "kube",
+		ClaimMappings: &config.ClaimMappings{
+			Username: config.PrefixedClaimOrExpression{Expression: `"corp:" + claims.preferred_username`},
+			Groups:   config.PrefixedClaimOrExpression{Expression: `claims.realm_access.roles.map(r, "corp:" + r)`},
+			UID:      config.ClaimOrExpression{Claim: "sub"},
+			Extra: []config.ExtraMapping{
+				{Key: "example.com/tenant", ValueExpression: `has(claims.tenant) ? claims.tenant : "default"`},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewMapper: %v", err)
+	}
+
+	user, err := m.MapUser(map[string]any{
+		"sub":                "f81d4fae",
+		"preferred_username": "alice",
+		"realm_access":       map[string]any{"roles": []any{"dev", "ops"}},
+	})
+	if err != nil {
+		t.Fatalf("MapUser: %v", err)
+	}
+	if user.Username != "corp:alice" || user.UID != "f81d4fae" {
+		t.Errorf("user = %+v", user)
+	}
+	if !slices.Equal(user.Groups, []string{"corp:dev", "corp:ops"}) {
+		t.Errorf("groups = %v", user.Groups)
+	}
+	if got := user.Extra["example.com/tenant"]; !slices.Equal(got, []string{"default"}) {
+		t.Errorf("extra = %v", user.Extra)
+	}
+}
+
+func TestNewMapper_InvalidExpression(t *testing.T) {
+	_, err := NewMapper(config.ClusterConfig{
+		ClaimValidationRules: []config.ClaimValidationRule{{Expression: "claims.sub =="}},
+	})
+	if err == nil {
+		t.Error("expected compile error, got nil")
+	}
+}
+
+func TestNewMapper_NothingConfigured(t *testing.T) {
+	m, err := NewMapper(config.ClusterConfig{Issuer: "https://issuer.example.com"})
+	if err != nil {
+		t.Fatalf("NewMapper: %v", err)
+	}
+	if m != nil {
+		t.Error("expected nil mapper when nothing is configured")
+	}
+	// nil mapper is safe to use
+	if err := m.ValidateClaims(testClaims()); err != nil {
+		t.Errorf("nil ValidateClaims: %v", err)
+	}
+}
+
+func TestNewMapper_OIDCDefaults(t *testing.T) {
+	m, err := NewMapper(config.ClusterConfig{
+		Type:           config.ClusterTypeOIDC,
+		Issuer:         "https://dex.example.com",
+		ClientID:       "kube",
+		RequiredClaims: map[string]string{"hd": "example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewMapper: %v", err)
+	}
+
+	c := map[string]any{"sub": "alice", "hd": "example.com", "groups": []any{"dev", "ops"}}
+	if err := m.ValidateClaims(c); err != nil {
+		t.Errorf("ValidateClaims: %v", err)
+	}
+	user, err := m.MapUser(c)
+	if err != nil {
+		t.Fatalf("MapUser: %v", err)
+	}
+	if user.Username != "https://dex.example.com#alice" {
+		t.Errorf("username = %q", user.Username)
+	}
+	if !slices.Equal(user.Groups, []string{"dev", "ops"}) {
+		t.Errorf("groups = %v", user.Groups)
+	}
+
+	c["hd"] = "other.com"
+	if err := m.ValidateClaims(c); err == nil {
+		t.Error("expected error for required claim mismatch")
+	}
+}
+
+func TestNewMapper_PublicDefaults(t *testing.T) {
+	m, err := NewMapper(config.ClusterConfig{Type: config.ClusterTypePublic, Issuer: "https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE"})
+	if err != nil {
+		t.Fatalf("NewMapper: %v", err)
+	}
+
+	c := map[string]any{
+		"sub": "system:serviceaccount:apps:api",
+		"jti": "4b2c",
+		"kubernetes.io": map[string]any{
+			"namespace":      "apps",
+			"serviceaccount": map[string]any{"name": "api", "uid": "sa-uid"},
+			"pod":            map[string]any{"name": "api-0", "uid": "pod-uid"},
+		},
+	}
+	user, err := m.MapUser(c)
+	if err != nil {
+		t.Fatalf("MapUser: %v", err)
+	}
+	if user.Username != "system:serviceaccount:apps:api" || user.UID != "sa-uid" {
+		t.Errorf("user = %+v", user)
+	}
+	if want := []string{"system:serviceaccounts", "system:serviceaccounts:apps", "system:authenticated"}; !slices.Equal(user.Groups, want) {
+		t.Errorf("groups = %v, want %v", user.Groups, want)
+	}
+	if got := user.Extra["authentication.kubernetes.io/pod-name"]; !slices.Equal(got, []string{"api-0"}) {
+		t.Errorf("pod-name = %v", got)
+	}
+	if got := user.Extra["authentication.kubernetes.io/credential-id"]; !slices.Equal(got, []string{"JTI=4b2c"}) {
+		t.Errorf("credential-id = %v", got)
+	}
+	if _, ok := user.Extra["authentication.kubernetes.io/node-name"]; ok {
+		t.Error("node-name set for a token without a node claim")
+	}
+}
+
+func TestMapper_PolicyDenied(t *testing.T) {
+	m, err := NewMapper(config.ClusterConfig{
+		ClaimValidationRules: []config.ClaimValidationRule{
+			{Expression: `claims["kubernetes.io"].namespace in ["default", "apps"]`, Message: "namespace not allowed"},
+			{Expression: `has(claims["kubernetes.io"].pod)`, Message: "token must be bound to a pod"},
+			{Expression: `claims.exp - claims.iat <= 3600`, Message: "token lifetime exceeds 1h"},
+		},
+		UserValidationRules: []config.UserValidationRule{
+			{Expression: `!user.username.startsWith("system:node:")`},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewMapper: %v", err)
+	}
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"iat":           int64(1_700_000_000),
+			"exp":           int64(1_700_003_600),
+			"kubernetes.io": map[string]any{"namespace": "apps", "pod": map[string]any{"name": "web-0"}},
+		}
+	}
+	if err := m.ValidateClaims(valid()); err != nil {
+		t.Fatalf("ValidateClaims: %v", err)
+	}
+
+	unbound := valid()
+	unbound["kubernetes.io"] = map[string]any{"namespace": "apps"}
+	longLived := valid()
+	longLived["exp"] = int64(1_700_086_400)
+	for name, c := range map[string]map[string]any{"unbound": unbound, "long-lived": longLived} {
+		if err := m.ValidateClaims(c); !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%s: err = %v, want ErrPolicyDenied", name, err)
+		}
+	}
+
+	if err := m.ValidateUser(authv1.UserInfo{Username: "system:node:n1"}); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("ValidateUser: err = %v, want ErrPolicyDenied", err)
+	}
+}
@@ -0,0 +1,50 @@
+package claims
+
+import (
+	"slices"
+	"strings"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// ApplyTemplates adds the groups of the group templates to a user
+// authenticated by cluster and applies the cluster's username template. It
+// runs before userValidationRules, so that they see the user as returned.
+//
+// The namespace and name of a ServiceAccount come from the verified
+// kubernetes.io claim of tokenClaims, which oidc clusters do not have, never
+// from a username the issuer may have chosen. tokenClaims is nil for a
+// fallback review, whose user the cluster's own TokenReview API returned.
+func ApplyTemplates(cfg *config.Config, cluster string, tokenClaims map[string]any, user *authv1.UserInfo) {
+	clusterCfg := cfg.Clusters[cluster]
+	var namespace, serviceAccount string
+	switch {
+	case tokenClaims == nil:
+		if rest, ok := strings.CutPrefix(user.Username, "system:serviceaccount:"); ok {
+			namespace, serviceAccount, _ = strings.Cut(rest, ":")
+		}
+	case !clusterCfg.IsOIDC():
+		namespace, serviceAccount = serviceAccountOf(tokenClaims)
+	}
+	for _, group := range cfg.FederatedGroups(cluster, namespace, serviceAccount) {
+		if !slices.Contains(user.Groups, group) {
+			user.Groups = append(user.Groups, group)
+		}
+	}
+	user.Username = clusterCfg.Username(cluster, user.Username)
+}
+
+// serviceAccountOf returns the namespace and name of the ServiceAccount of a
+// token's kubernetes.io claim, or empty strings if it has none
+func serviceAccountOf(tokenClaims map[string]any) (string, string) {
+	k8s, _ := tokenClaims["kubernetes.io"].(map[string]any)
+	namespace, _ := k8s["namespace"].(string)
+	sa, _ := k8s["serviceaccount"].(map[string]any)
+	name, _ := sa["name"].(string)
+	if namespace == "" || name == "" {
+		return "", ""
+	}
+	return namespace, name
+}
@@ -0,0 +1,56 @@
+package claims
+
+import (
+	"slices"
+	"testing"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func TestApplyTemplates(t *testing.T) {
+	cfg := &config.Config{
+		GroupTemplates: []string{"federated:cluster:{cluster}", "federated:sa:{namespace}:{serviceaccount}"},
+		Clusters: map[string]config.ClusterConfig{
+			"sa":  {Issuer: "https://sa.example.com", UsernameTemplate: "fed:{cluster}:{subject}"},
+			"idp": {Type: config.ClusterTypeOIDC, Issuer: "https://idp.example.com", ClientID: "kube"},
+		},
+	}
+	saClaims := map[string]any{"kubernetes.io": map[string]any{
+		"namespace":      "payments",
+		"serviceaccount": map[string]any{"name": "app"},
+	}}
+	tests := []struct {
+		name         string
+		cluster      string
+		tokenClaims  map[string]any
+		username     string
+		wantUsername string
+		wantGroups   []string
+	}{
+		{"service account claims", "sa", saClaims, "system:serviceaccount:payments:app",
+			"fed:sa:system:serviceaccount:payments:app", []string{"federated:cluster:sa", "federated:sa:payments:app"}},
+		// A mapped username is not a ServiceAccount without the claim
+		{"username only", "sa", map[string]any{"sub": "x"}, "system:serviceaccount:prod:deployer",
+			"fed:sa:system:serviceaccount:prod:deployer", []string{"federated:cluster:sa"}},
+		// An identity provider's username and kubernetes.io claim are not trusted
+		{"oidc", "idp", saClaims, "system:serviceaccount:prod:deployer",
+			"system:serviceaccount:prod:deployer", []string{"federated:cluster:idp"}},
+		// The user of a fallback review comes from the cluster's TokenReview API
+		{"fallback review", "sa", nil, "system:serviceaccount:payments:app",
+			"fed:sa:system:serviceaccount:payments:app", []string{"federated:cluster:sa", "federated:sa:payments:app"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := authv1.UserInfo{Username: tt.username, Groups: []string{"federated:cluster:" + tt.cluster}}
+			ApplyTemplates(cfg, tt.cluster, tt.tokenClaims, &user)
+			if user.Username != tt.wantUsername {
+				t.Errorf("username = %q, want %q", user.Username, tt.wantUsername)
+			}
+			if !slices.Equal(user.Groups, tt.wantGroups) {
+				t.Errorf("groups = %v, want %v", user.Groups, tt.wantGroups)
+			}
+		})
+	}
+}
@@ -1,8 +1,21 @@
 package config
 
 import (
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -64,7 +77,319 @@ type ClusterConfig struct {
 	Issuer    string `yaml:"issuer"`
 	APIServer string `yaml:"api_server,omitempty"` // Override URL for OIDC discovery
 	CACert    string `yaml:"ca_cert,omitempty"`
-	TokenPath string `yaml:"token_path,omitempty"`
+	// CACertData is the CA certificate inline, as PEM or base64-encoded PEM
+	// (as in a kubeconfig's certificate-authority-data). Exclusive with CACert.
+	CACertData string `yaml:"ca_cert_data,omitempty"`
+	TokenPath  string `yaml:"token_path,omitempty"`
+	// ClientCert and ClientKey are PEM files of a client certificate that
+	// authenticates to the API server instead of, or alongside, token_path.
+	// Certificate credentials are not renewed.
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+	// Exec runs a credential plugin (e.g. aws-iam-authenticator) for the
+	// bearer token of calls to the API server, instead of token_path
+	Exec *ExecSettings `yaml:"exec,omitempty"`
+	// Kubeconfig is a kubeconfig file (e.g. written by eksctl or downloaded
+	// from Rancher) that api_server, the CA certificate and the token or
+	// client certificate are taken from, unless set explicitly above
+	Kubeconfig string `yaml:"kubeconfig,omitempty"`
+	// KubeconfigContext selects the kubeconfig's context (default: its
+	// current context)
+	KubeconfigContext string `yaml:"kubeconfig_context,omitempty"`
+	// Inline credentials taken from Kubeconfig
+	token          string
+	clientCertData []byte
+	clientKeyData  []byte
+	// InsecureSkipTLSVerify disables verification of the cluster's serving
+	// certificate, for kind/minikube development only. Load refuses it unless
+	// LoadOptions.AllowInsecure is set (the server's --allow-insecure flag).
+	InsecureSkipTLSVerify bool `yaml:"insecure_skip_tls_verify,omitempty"`
+	// JWKSFile is a JWKS JSON or PEM file of the cluster's signing keys. When
+	// set, tokens are verified against it without OIDC discovery or JWKS
+	// fetches; the file is reread when the verifier is recreated.
+	JWKSFile string `yaml:"jwks_file,omitempty"`
+	// KeySnapshot verifies the cluster's tokens exclusively against a snapshot
+	// written by kfa export-keys, without contacting the cluster at all
+	KeySnapshot *KeySnapshotSettings `yaml:"key_snapshot,omitempty"`
+	// Audiences, if set, are the only token audiences accepted for the cluster,
+	// as the token's aud claim names them. TokenReview spec.audiences are
+	// intersected with them after the audience_rewrite map.
+	Audiences       []string         `yaml:"audiences,omitempty"`
+	AudienceRewrite *AudienceRewrite `yaml:"audience_rewrite,omitempty"`
+
+	// IssuerTemplate names an entry of Config.IssuerTemplates to build Issuer
+	// from, substituting {name} placeholders with Vars
+	IssuerTemplate string            `yaml:"issuer_template,omitempty"`
+	Vars           map[string]string `yaml:"vars,omitempty"`
+
+	// AdditionalIssuers are also accepted, e.g. while migrating the cluster's
+	// --service-account-issuer. They share the cluster's JWKS.
+	AdditionalIssuers []string `yaml:"additional_issuers,omitempty"`
+
+	// Type is ClusterTypeKubernetes (the default), ClusterTypeOIDC for a
+	// generic OIDC provider such as Dex or Keycloak, or ClusterTypePublic for
+	// a managed cluster with a public issuer
+	Type string `yaml:"type,omitempty"`
+	// ClientID must be in the aud of an oidc cluster's tokens
+	ClientID string `yaml:"client_id,omitempty"`
+	// RequiredClaims must be present in an oidc cluster's tokens with these
+	// exact string values
+	RequiredClaims map[string]string `yaml:"required_claims,omitempty"`
+
+	// Fallback, if FallbackTokenReview, sends tokens that no cluster can
+	// verify as a JWT (e.g. legacy Secret-based tokens) to this cluster's
+	// TokenReview API
+	Fallback string `yaml:"fallback,omitempty"`
+
+	// Egress constrains how outbound connections to this cluster are made
+	Egress *EgressSettings `yaml:"egress,omitempty"`
+
+	// UpstreamTimeout bounds each OIDC discovery and JWKS request to the
+	// cluster (default: 10s)
+	UpstreamTimeout time.Duration `yaml:"upstream_timeout,omitempty"`
+
+	// ClockSkew overrides the global clock_skew for this cluster
+	ClockSkew time.Duration `yaml:"clock_skew,omitempty"`
+
+	// MaxCredentialAge refuses stored credentials whose token was issued longer
+	// ago than this, even if not yet expired. Zero disables the check.
+	MaxCredentialAge time.Duration `yaml:"max_credential_age,omitempty"`
+
+	// RenewalServiceAccount is a <namespace>/<name> ServiceAccount that
+	// renewal requests tokens for, instead of the one the stored token
+	// belongs to. The bootstrap credentials, e.g. an agent's token or a
+	// client certificate, are exchanged for it on the first renewal and are
+	// then no longer needed.
+	RenewalServiceAccount string `yaml:"renewal_service_account,omitempty"`
+
+	// UsernameTemplate rewrites the username of authenticated reviews, with
+	// {cluster} and {subject} (the username the cluster authenticated), e.g.
+	// "fed:{cluster}:{subject}", so that identities of different clusters do
+	// not collide in the consuming cluster's RBAC
+	UsernameTemplate string `yaml:"username_template,omitempty"`
+
+	// Upstream AuthenticationConfiguration (apiserver.config.k8s.io) JWT
+	// authenticator fields, accepted verbatim so existing policies can be reused.
+	ClaimValidationRules []ClaimValidationRule `yaml:"claimValidationRules,omitempty"`
+	ClaimMappings        *ClaimMappings        `yaml:"claimMappings,omitempty"`
+	UserValidationRules  []UserValidationRule  `yaml:"userValidationRules,omitempty"`
+}
+
+// KeySnapshotSettings point a cluster at an exported key snapshot
+type KeySnapshotSettings struct {
+	// Path is the snapshot file; the cluster's keys are its entry by cluster name
+	Path string `yaml:"path" jsonschema:"required"`
+	// MaxAge, if set, fails verification once the snapshot was exported
+	// longer ago than this, so that revoked keys are not trusted forever
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+}
+
+func (k *KeySnapshotSettings) validate(c *ClusterConfig) error {
+	if k == nil {
+		return nil
+	}
+	if k.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if k.MaxAge < 0 {
+		return fmt.Errorf("max_age must not be negative")
+	}
+	if c.JWKSFile != "" {
+		return fmt.Errorf("cannot be used with jwks_file")
+	}
+	return nil
+}
+
+// DefaultExecAPIVersion is the ExecCredential version requested from exec plugins
+const DefaultExecAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+// ExecSettings run a client-go exec credential plugin, which prints an
+// ExecCredential with a token and optional expiry. The token is cached until
+// it expires, or until the API server rejects it.
+type ExecSettings struct {
+	Command string            `yaml:"command" jsonschema:"required"`
+	Args    []string          `yaml:"args,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	// APIVersion of the ExecCredential (default: client.authentication.k8s.io/v1beta1)
+	APIVersion string `yaml:"api_version,omitempty"`
+}
+
+// GetAPIVersion returns the configured ExecCredential version or default
+func (e *ExecSettings) GetAPIVersion() string {
+	if e != nil && e.APIVersion != "" {
+		return e.APIVersion
+	}
+	return DefaultExecAPIVersion
+}
+
+func (e *ExecSettings) validate(c *ClusterConfig) error {
+	if e == nil {
+		return nil
+	}
+	if e.Command == "" {
+		return fmt.Errorf("command is required")
+	}
+	switch e.GetAPIVersion() {
+	case "client.authentication.k8s.io/v1", "client.authentication.k8s.io/v1beta1":
+	default:
+		return fmt.Errorf("unsupported api_version %q", e.APIVersion)
+	}
+	if c.TokenPath != "" {
+		return fmt.Errorf("cannot be used with token_path")
+	}
+	if !c.IsRemote() {
+		return fmt.Errorf("requires api_server")
+	}
+	return nil
+}
+
+// EgressSettings selects the source of outbound connections to a cluster
+// (OIDC discovery, JWKS, TokenReview and TokenRequest calls)
+type EgressSettings struct {
+	// LocalAddress binds connections to this local IP
+	LocalAddress string `yaml:"local_address,omitempty"`
+	// Interface binds connections to the first address of this network interface
+	Interface string `yaml:"interface,omitempty"`
+	// ProxyURL sends connections through an HTTP(S) or SOCKS5 egress proxy
+	ProxyURL string `yaml:"proxy_url,omitempty"`
+}
+
+func (e *EgressSettings) validate() error {
+	if e == nil {
+		return nil
+	}
+	if e.LocalAddress != "" && e.Interface != "" {
+		return fmt.Errorf("local_address and interface are mutually exclusive")
+	}
+	if e.LocalAddress != "" {
+		if _, err := netip.ParseAddr(e.LocalAddress); err != nil {
+			return fmt.Errorf("invalid local_address %q", e.LocalAddress)
+		}
+	}
+	if e.ProxyURL != "" {
+		u, err := url.Parse(e.ProxyURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy_url %q", e.ProxyURL)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("proxy_url scheme must be http, https or socks5")
+		}
+	}
+	return nil
+}
+
+// ClaimValidationRule checks a token claim, either by required value or CEL expression
+type ClaimValidationRule struct {
+	Claim         string `yaml:"claim,omitempty"`
+	RequiredValue string `yaml:"requiredValue,omitempty"`
+	Expression    string `yaml:"expression,omitempty"`
+	Message       string `yaml:"message,omitempty"`
+}
+
+// ClaimMappings computes the authenticated user's attributes from token claims
+type ClaimMappings struct {
+	Username PrefixedClaimOrExpression `yaml:"username" jsonschema:"required"`
+	Groups   PrefixedClaimOrExpression `yaml:"groups,omitempty"`
+	UID      ClaimOrExpression         `yaml:"uid,omitempty"`
+	Extra    []ExtraMapping            `yaml:"extra,omitempty"`
+}
+
+// PrefixedClaimOrExpression maps a claim (with optional prefix) or a CEL expression
+type PrefixedClaimOrExpression struct {
+	Claim      string  `yaml:"claim,omitempty"`
+	Prefix     *string `yaml:"prefix,omitempty"`
+	Expression string  `yaml:"expression,omitempty"`
+}
+
+// ClaimOrExpression maps a claim or a CEL expression
+type ClaimOrExpression struct {
+	Claim      string `yaml:"claim,omitempty"`
+	Expression string `yaml:"expression,omitempty"`
+}
+
+// ExtraMapping maps a CEL expression to a user extra key
+type ExtraMapping struct {
+	Key             string `yaml:"key" jsonschema:"required"`
+	ValueExpression string `yaml:"valueExpression" jsonschema:"required"`
+}
+
+// UserValidationRule is a CEL expression over the mapped user that must evaluate to true
+type UserValidationRule struct {
+	Expression string `yaml:"expression" jsonschema:"required"`
+	Message    string `yaml:"message,omitempty"`
+}
+
+// AudienceRewrite controls how spec.audiences are translated when a
+// TokenReview is forwarded to the cluster's API server.
+type AudienceRewrite struct {
+	// PassThrough, if set, limits forwarded audiences to this list (plus mapped ones)
+	PassThrough []string `yaml:"pass_through,omitempty"`
+	// Strip lists audiences that are never forwarded upstream
+	Strip []string `yaml:"strip,omitempty"`
+	// Map translates local audience names to the remote cluster's names
+	Map map[string]string `yaml:"map,omitempty"`
+}
+
+func (c *ClusterConfig) validateClaimRules() error {
+	for i, rule := range c.ClaimValidationRules {
+		switch {
+		case rule.Claim != "" && rule.Expression != "":
+			return fmt.Errorf("claimValidationRules[%d]: claim and expression are mutually exclusive", i)
+		case rule.Claim == "" && rule.Expression == "":
+			return fmt.Errorf("claimValidationRules[%d]: claim or expression is required", i)
+		case rule.Expression != "" && rule.RequiredValue != "":
+			return fmt.Errorf("claimValidationRules[%d]: requiredValue cannot be used with expression", i)
+		}
+	}
+
+	if m := c.ClaimMappings; m != nil {
+		if (m.Username.Claim == "") == (m.Username.Expression == "") {
+			return fmt.Errorf("claimMappings.username: exactly one of claim or expression is required")
+		}
+		if m.Username.Expression != "" && m.Username.Prefix != nil {
+			return fmt.Errorf("claimMappings.username: prefix cannot be used with expression")
+		}
+		if m.Groups.Claim != "" && m.Groups.Expression != "" {
+			return fmt.Errorf("claimMappings.groups: claim and expression are mutually exclusive")
+		}
+		if m.Groups.Expression != "" && m.Groups.Prefix != nil {
+			return fmt.Errorf("claimMappings.groups: prefix cannot be used with expression")
+		}
+		if m.UID.Claim != "" && m.UID.Expression != "" {
+			return fmt.Errorf("claimMappings.uid: claim and expression are mutually exclusive")
+		}
+		for i, extra := range m.Extra {
+			if extra.Key == "" || extra.ValueExpression == "" {
+				return fmt.Errorf("claimMappings.extra[%d]: key and valueExpression are required", i)
+			}
+		}
+	}
+
+	for i, rule := range c.UserValidationRules {
+		if rule.Expression == "" {
+			return fmt.Errorf("userValidationRules[%d]: expression is required", i)
+		}
+	}
+	return nil
+}
+
+func (a *AudienceRewrite) validate() error {
+	if a == nil {
+		return nil
+	}
+	for _, aud := range a.Strip {
+		if _, ok := a.Map[aud]; ok {
+			return fmt.Errorf("audience %q is both stripped and mapped", aud)
+		}
+	}
+	for local, remote := range a.Map {
+		if remote == "" {
+			return fmt.Errorf("audience %q maps to an empty value", local)
+		}
+	}
+	return nil
 }
 
 // DiscoveryURL returns the URL to use for OIDC discovery.
@@ -76,14 +401,1010 @@ func (c *ClusterConfig) DiscoveryURL() string {
 	return c.Issuer
 }
 
+// Cluster types
+const (
+	// ClusterTypeKubernetes clusters issue ServiceAccount tokens, whose
+	// TokenReviews are forwarded to the cluster's API server
+	ClusterTypeKubernetes = "kubernetes"
+	// ClusterTypeOIDC issuers are generic OIDC providers: tokens are reviewed
+	// from their verified claims alone, with the user mapped from sub and groups
+	// unless claimMappings are set
+	ClusterTypeOIDC = "oidc"
+	// ClusterTypePublic clusters are managed clusters (EKS, GKE, AKS) whose
+	// issuer serves discovery and JWKS publicly. No credentials are stored:
+	// keys are fetched from the issuer trusting the system roots, and tokens
+	// are reviewed from their verified ServiceAccount claims.
+	ClusterTypePublic = "public"
+)
+
+// IsOIDC reports whether the cluster is a generic OIDC issuer
+func (c *ClusterConfig) IsOIDC() bool {
+	return c.Type == ClusterTypeOIDC
+}
+
+// IsPublic reports whether the cluster is a managed cluster with a public issuer
+func (c *ClusterConfig) IsPublic() bool {
+	return c.Type == ClusterTypePublic
+}
+
+// HasTokenReviewAPI reports whether TokenReviews are forwarded to the
+// cluster's API server, rather than answered from the verified claims
+func (c *ClusterConfig) HasTokenReviewAPI() bool {
+	return !c.IsOIDC() && !c.IsPublic() && c.KeySnapshot == nil
+}
+
+func (c *ClusterConfig) validateType() error {
+	switch c.Type {
+	case "", ClusterTypeKubernetes:
+		if c.ClientID != "" || len(c.RequiredClaims) > 0 {
+			return fmt.Errorf("client_id and required_claims require type %q", ClusterTypeOIDC)
+		}
+	case ClusterTypeOIDC:
+		if c.ClientID == "" {
+			return fmt.Errorf("client_id is required for type %q", ClusterTypeOIDC)
+		}
+		if c.APIServer != "" || c.TokenPath != "" {
+			return fmt.Errorf("api_server and token_path cannot be used with type %q", ClusterTypeOIDC)
+		}
+	case ClusterTypePublic:
+		if c.ClientID != "" || len(c.RequiredClaims) > 0 {
+			return fmt.Errorf("client_id and required_claims require type %q", ClusterTypeOIDC)
+		}
+		if c.APIServer != "" || c.TokenPath != "" || c.HasCACert() || c.InsecureSkipTLSVerify || c.JWKSFile != "" {
+			return fmt.Errorf("api_server, token_path, ca_cert, ca_cert_data, insecure_skip_tls_verify and jwks_file cannot be used with type %q", ClusterTypePublic)
+		}
+	default:
+		return fmt.Errorf("unknown type %q (want %q, %q or %q)", c.Type, ClusterTypeKubernetes, ClusterTypeOIDC, ClusterTypePublic)
+	}
+	return nil
+}
+
+// FallbackTokenReview reviews unverifiable tokens with the cluster's TokenReview API
+const FallbackTokenReview = "tokenreview"
+
+func (c *ClusterConfig) validateFallback() error {
+	switch {
+	case c.Fallback == "":
+		return nil
+	case c.Fallback != FallbackTokenReview:
+		return fmt.Errorf("unknown fallback %q (want %q)", c.Fallback, FallbackTokenReview)
+	case c.KeySnapshot != nil:
+		return fmt.Errorf("fallback cannot be used with key_snapshot")
+	case !c.HasTokenReviewAPI():
+		return fmt.Errorf("fallback cannot be used with type %q", c.Type)
+	}
+	return nil
+}
+
+// FallbackClusters returns the names of clusters with fallback: tokenreview, sorted
+func (c *Config) FallbackClusters() []string {
+	var names []string
+	for name, cluster := range c.Clusters {
+		if cluster.Fallback == FallbackTokenReview {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Issuers returns the primary issuer followed by any additional issuers
+func (c *ClusterConfig) Issuers() []string {
+	return append([]string{c.Issuer}, c.AdditionalIssuers...)
+}
+
+// HasCACert reports whether a CA certificate is configured, by path or inline
+func (c *ClusterConfig) HasCACert() bool {
+	return c.CACert != "" || c.CACertData != ""
+}
+
+// HasBootstrapCredentials reports whether credentials for the API server are
+// configured, as files or through a kubeconfig: a CA certificate plus a token
+// or client certificate
+func (c *ClusterConfig) HasBootstrapCredentials() bool {
+	hasCredentials := c.TokenPath != "" || c.ClientCert != "" || c.token != "" || c.clientCertData != nil
+	return hasCredentials && c.HasCACert()
+}
+
+// LoadToken reads the token_path file, or returns the kubeconfig's inline
+// token. It returns nil if there is neither.
+func (c *ClusterConfig) LoadToken() ([]byte, error) {
+	if c.TokenPath == "" {
+		if c.token != "" {
+			return []byte(c.token), nil
+		}
+		return nil, nil
+	}
+	token, err := os.ReadFile(c.TokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading token file: %w", err)
+	}
+	return token, nil
+}
+
+// LoadClientCert reads the client_cert and client_key files, or returns the
+// kubeconfig's inline client certificate. It returns nil if there is neither.
+func (c *ClusterConfig) LoadClientCert() (cert, key []byte, err error) {
+	if c.ClientCert == "" {
+		return c.clientCertData, c.clientKeyData, nil
+	}
+	if cert, err = os.ReadFile(c.ClientCert); err != nil {
+		return nil, nil, fmt.Errorf("reading client cert: %w", err)
+	}
+	if key, err = os.ReadFile(c.ClientKey); err != nil {
+		return nil, nil, fmt.Errorf("reading client key: %w", err)
+	}
+	return cert, key, nil
+}
+
+// RenewalServiceAccountRef splits renewal_service_account into namespace
+// and name; both are empty if it is not set
+func (c *ClusterConfig) RenewalServiceAccountRef() (namespace, name string) {
+	namespace, name, _ = strings.Cut(c.RenewalServiceAccount, "/")
+	return namespace, name
+}
+
+func (c *ClusterConfig) validateUsernameTemplate() error {
+	if c.UsernameTemplate == "" {
+		return nil
+	}
+	for _, m := range templateVarPattern.FindAllString(c.UsernameTemplate, -1) {
+		if m != "{cluster}" && m != "{subject}" {
+			return fmt.Errorf("username_template: unknown placeholder %s (valid: {cluster}, {subject})", m)
+		}
+	}
+	if !strings.Contains(c.UsernameTemplate, "{subject}") {
+		return fmt.Errorf("username_template %q must contain {subject}", c.UsernameTemplate)
+	}
+	if strings.ContainsAny(templateVarPattern.ReplaceAllString(c.UsernameTemplate, ""), "{}") {
+		return fmt.Errorf("username_template: malformed placeholder in %q", c.UsernameTemplate)
+	}
+	return nil
+}
+
+// validateGroupTemplates checks that group templates only use the known
+// placeholders
+func validateGroupTemplates(templates []string) error {
+	for _, tmpl := range templates {
+		for _, m := range templateVarPattern.FindAllString(tmpl, -1) {
+			if m != "{cluster}" && m != "{namespace}" && m != "{serviceaccount}" {
+				return fmt.Errorf("%q: unknown placeholder %s (valid: {cluster}, {namespace}, {serviceaccount})", tmpl, m)
+			}
+		}
+		if tmpl == "" || strings.ContainsAny(templateVarPattern.ReplaceAllString(tmpl, ""), "{}") {
+			return fmt.Errorf("malformed template %q", tmpl)
+		}
+	}
+	return nil
+}
+
+// FederatedGroups returns the groups of the group templates for a user
+// authenticated by a cluster. Templates with {namespace} or {serviceaccount}
+// only apply to ServiceAccounts, i.e. with namespace set.
+func (c *Config) FederatedGroups(cluster, namespace, serviceAccount string) []string {
+	var groups []string
+	for _, tmpl := range c.GroupTemplates {
+		if namespace == "" && (strings.Contains(tmpl, "{namespace}") || strings.Contains(tmpl, "{serviceaccount}")) {
+			continue
+		}
+		groups = append(groups, strings.NewReplacer("{cluster}", cluster, "{namespace}", namespace, "{serviceaccount}", serviceAccount).Replace(tmpl))
+	}
+	return groups
+}
+
+// Username applies the username template to the username of an authenticated
+// review of the cluster
+func (c *ClusterConfig) Username(cluster, username string) string {
+	if c.UsernameTemplate == "" {
+		return username
+	}
+	return strings.NewReplacer("{cluster}", cluster, "{subject}", username).Replace(c.UsernameTemplate)
+}
+
+func (c *ClusterConfig) validateRenewalServiceAccount() error {
+	if c.RenewalServiceAccount == "" {
+		return nil
+	}
+	namespace, name := c.RenewalServiceAccountRef()
+	if namespace == "" || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("renewal_service_account %q must be <namespace>/<name>", c.RenewalServiceAccount)
+	}
+	if !c.IsRemote() {
+		return fmt.Errorf("renewal_service_account requires api_server")
+	}
+	return nil
+}
+
+func (c *ClusterConfig) validateClientCert() error {
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return fmt.Errorf("client_cert and client_key must be set together")
+	}
+	if (c.ClientCert != "" || c.clientCertData != nil) && !c.IsRemote() {
+		return fmt.Errorf("client_cert requires api_server")
+	}
+	return nil
+}
+
+// LoadCACert returns the configured CA certificate PEM, reading ca_cert or
+// decoding ca_cert_data. It returns nil if neither is set.
+func (c *ClusterConfig) LoadCACert() ([]byte, error) {
+	if c.CACertData != "" {
+		return decodeCACertData(c.CACertData)
+	}
+	if c.CACert == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(c.CACert)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA cert: %w", err)
+	}
+	return data, nil
+}
+
+func decodeCACertData(data string) ([]byte, error) {
+	if strings.Contains(data, "-----BEGIN") {
+		return []byte(data), nil
+	}
+	// Base64 may be wrapped over several lines in YAML block scalars
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+	if err != nil {
+		return nil, fmt.Errorf("ca_cert_data is neither PEM nor base64: %w", err)
+	}
+	return decoded, nil
+}
+
+func (c *ClusterConfig) validateCACert() error {
+	if c.CACertData == "" {
+		return nil
+	}
+	if c.CACert != "" {
+		return fmt.Errorf("ca_cert and ca_cert_data are mutually exclusive")
+	}
+	data, err := decodeCACertData(c.CACertData)
+	if err != nil {
+		return err
+	}
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return fmt.Errorf("ca_cert_data contains no PEM certificate")
+		}
+		if block.Type == "CERTIFICATE" {
+			return nil
+		}
+	}
+}
+
+// DefaultUpstreamTimeout bounds a cluster's discovery and JWKS requests
+const DefaultUpstreamTimeout = 10 * time.Second
+
+// GetUpstreamTimeout returns the cluster's upstream timeout or default
+func (c *ClusterConfig) GetUpstreamTimeout() time.Duration {
+	if c.UpstreamTimeout > 0 {
+		return c.UpstreamTimeout
+	}
+	return DefaultUpstreamTimeout
+}
+
 // IsRemote returns true if this cluster requires remote access (has api_server set)
 func (c *ClusterConfig) IsRemote() bool {
 	return c.APIServer != ""
 }
 
+// DefaultJWKSRefreshInterval is how often JWKS are refetched in the background
+const DefaultJWKSRefreshInterval = 15 * time.Minute
+
+// JWKSSettings controls background refresh of cluster signing keys
+type JWKSSettings struct {
+	// RefreshInterval between background fetches; a negative value disables them
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+	// Jitter is the maximum random delay added to each interval (default: a tenth of it)
+	Jitter time.Duration `yaml:"jitter,omitempty"`
+}
+
+// GetJWKSRefreshInterval returns the background refresh interval, or 0 if disabled
+func (c *Config) GetJWKSRefreshInterval() time.Duration {
+	if c.JWKS == nil || c.JWKS.RefreshInterval == 0 {
+		return DefaultJWKSRefreshInterval
+	}
+	if c.JWKS.RefreshInterval < 0 {
+		return 0
+	}
+	return c.JWKS.RefreshInterval
+}
+
+// GetJWKSJitter returns the configured refresh jitter or default
+func (c *Config) GetJWKSJitter() time.Duration {
+	if c.JWKS != nil && c.JWKS.Jitter > 0 {
+		return c.JWKS.Jitter
+	}
+	return c.GetJWKSRefreshInterval() / 10
+}
+
+// Circuit breaker defaults
+const (
+	DefaultCircuitFailureThreshold = 5
+	DefaultCircuitOpenDuration     = 30 * time.Second
+)
+
+// CircuitBreakerSettings stops dialing a cluster's API server for discovery
+// and JWKS after consecutive failures, failing verification fast instead
+type CircuitBreakerSettings struct {
+	// FailureThreshold is the number of consecutive upstream failures that
+	// opens a cluster's circuit (default: 5)
+	FailureThreshold int `yaml:"failure_threshold,omitempty"`
+	// OpenDuration is how long an open circuit fails fast before a single
+	// probe request is let through (default: 30s)
+	OpenDuration time.Duration `yaml:"open_duration,omitempty"`
+}
+
+// GetFailureThreshold returns the configured threshold or default
+func (c *CircuitBreakerSettings) GetFailureThreshold() int {
+	if c.FailureThreshold > 0 {
+		return c.FailureThreshold
+	}
+	return DefaultCircuitFailureThreshold
+}
+
+// GetOpenDuration returns the configured open duration or default
+func (c *CircuitBreakerSettings) GetOpenDuration() time.Duration {
+	if c.OpenDuration > 0 {
+		return c.OpenDuration
+	}
+	return DefaultCircuitOpenDuration
+}
+
+// Negative cache defaults
+const (
+	DefaultNegativeCacheTTL        = 10 * time.Second
+	DefaultNegativeCacheMaxEntries = 10000
+)
+
+// NegativeCacheSettings remembers recently rejected tokens, so clients retrying
+// the same expired or malformed token are answered without verifying it again
+type NegativeCacheSettings struct {
+	// TTL is how long a rejection is remembered (default: 10s)
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// MaxEntries bounds the cache size (default: 10000)
+	MaxEntries int `yaml:"max_entries,omitempty"`
+}
+
+// GetTTL returns the configured TTL or default
+func (c *NegativeCacheSettings) GetTTL() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return DefaultNegativeCacheTTL
+}
+
+// GetMaxEntries returns the configured size or default
+func (c *NegativeCacheSettings) GetMaxEntries() int {
+	if c.MaxEntries > 0 {
+		return c.MaxEntries
+	}
+	return DefaultNegativeCacheMaxEntries
+}
+
+// DefaultHeartbeatStaleAfter is how long a cluster may go without a heartbeat
+// before /clusters flags it as silent
+const DefaultHeartbeatStaleAfter = 15 * time.Minute
+
+// HeartbeatSettings configures the tracking of POST /heartbeat calls from
+// remote clusters
+type HeartbeatSettings struct {
+	// StaleAfter flags a cluster as silent when its last heartbeat is older
+	// (default: 15m)
+	StaleAfter time.Duration `yaml:"stale_after,omitempty"`
+	// Interval is how often clients following GET /heartbeat/config send
+	// heartbeats (default: a third of stale_after)
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Features are flags passed as is to clients of GET /heartbeat/config,
+	// to tune them centrally
+	Features map[string]bool `yaml:"features,omitempty"`
+	// AllowedCallers lists token subjects allowed to send heartbeats and read
+	// GET /heartbeat/config, as glob patterns such as
+	// "system:serviceaccount:kube-federated-auth:*". Empty allows any token
+	// the cluster accepts.
+	AllowedCallers []string `yaml:"allowed_callers,omitempty"`
+}
+
+func (h *HeartbeatSettings) validate() error {
+	if h == nil {
+		return nil
+	}
+	for _, pattern := range h.AllowedCallers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid allowed_callers pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// IsAllowedCaller reports whether subject matches the heartbeat allowlist
+func (h *HeartbeatSettings) IsAllowedCaller(subject string) bool {
+	if h == nil || len(h.AllowedCallers) == 0 {
+		return true
+	}
+	for _, pattern := range h.AllowedCallers {
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultCanaryInterval is how often canary probes run when enabled
+const DefaultCanaryInterval = 5 * time.Minute
+
+// CanarySettings enables synthetic end-to-end authentication probes
+type CanarySettings struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// GetInterval returns the configured probe interval or default
+func (c *CanarySettings) GetInterval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return DefaultCanaryInterval
+}
+
+// DefaultCredentialCheckInterval is how often stored credentials are checked when enabled
+const DefaultCredentialCheckInterval = 5 * time.Minute
+
+// CredentialCheckSettings enables periodic checks of each remote cluster's
+// stored credentials against its discovery endpoint
+type CredentialCheckSettings struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// GetInterval returns the configured check interval or default
+func (c *CredentialCheckSettings) GetInterval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return DefaultCredentialCheckInterval
+}
+
+// Defaults for expiry alerts
+const (
+	DefaultExpiryAlertInterval   = 5 * time.Minute
+	DefaultExpiryAlertWarnBefore = 24 * time.Hour
+)
+
+// ExpiryAlertSettings enable alerts on remote clusters' stored credentials
+// nearing expiry, ahead of renewal failing for good
+type ExpiryAlertSettings struct {
+	// Interval between checks
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// WarnBefore alerts when a token expires within it
+	WarnBefore time.Duration `yaml:"warn_before,omitempty"`
+	// MaxUpdateAge alerts when credentials were not renewed or rewritten for
+	// longer, e.g. because whatever refreshes them out of band stopped. Zero
+	// disables the check.
+	MaxUpdateAge time.Duration `yaml:"max_update_age,omitempty"`
+}
+
+// GetInterval returns the configured check interval or default
+func (e *ExpiryAlertSettings) GetInterval() time.Duration {
+	if e.Interval > 0 {
+		return e.Interval
+	}
+	return DefaultExpiryAlertInterval
+}
+
+// GetWarnBefore returns the configured alert window or default
+func (e *ExpiryAlertSettings) GetWarnBefore() time.Duration {
+	if e.WarnBefore > 0 {
+		return e.WarnBefore
+	}
+	return DefaultExpiryAlertWarnBefore
+}
+
+// DefaultProbeTimeout bounds each per-cluster readiness probe
+const DefaultProbeTimeout = 5 * time.Second
+
+// ReadinessSettings controls /healthz/ready
+type ReadinessSettings struct {
+	// MinHealthyClusters is how many clusters must pass their probe for the
+	// server to report ready. Defaults to 1; 0 always reports ready.
+	MinHealthyClusters *int          `yaml:"min_healthy_clusters,omitempty"`
+	Timeout            time.Duration `yaml:"timeout,omitempty"`
+}
+
+// GetMinHealthyClusters returns the readiness threshold or default
+func (c *Config) GetMinHealthyClusters() int {
+	if c.Readiness != nil && c.Readiness.MinHealthyClusters != nil {
+		return *c.Readiness.MinHealthyClusters
+	}
+	return 1
+}
+
+// GetProbeTimeout returns the per-cluster readiness probe timeout or default
+func (c *Config) GetProbeTimeout() time.Duration {
+	if c.Readiness != nil && c.Readiness.Timeout > 0 {
+		return c.Readiness.Timeout
+	}
+	return DefaultProbeTimeout
+}
+
+// LimitEndpoints lists the endpoints that accept in-flight limits
+var LimitEndpoints = []string{"tokenreview", "clusters", "sar"}
+
+// LimitSettings bounds concurrent requests for an endpoint
+type LimitSettings struct {
+	MaxInFlight  int `yaml:"max_in_flight"`
+	RejectStatus int `yaml:"reject_status,omitempty"` // 429 (default) or 503
+}
+
+// ReadAuthSettings requires callers of read endpoints (/clusters) to present
+// a valid ServiceAccount token issued by one of the configured clusters.
+type ReadAuthSettings struct {
+	Cluster string `yaml:"cluster" jsonschema:"required"`
+	// AllowedCallers lists token subjects allowed to call; glob patterns such as
+	// "system:serviceaccount:monitoring:*" are supported. Empty allows any valid token.
+	AllowedCallers []string `yaml:"allowed_callers,omitempty"`
+}
+
+// Authorization decisions of a rule
+const (
+	AuthorizationAllow = "allow"
+	AuthorizationDeny  = "deny"
+)
+
+// AuthorizationSettings is the central policy behind the POST /sar
+// SubjectAccessReview webhook. The first matching rule decides; without one
+// the webhook has no opinion, leaving the decision to the next authorizer.
+type AuthorizationSettings struct {
+	Rules []AuthorizationRule `yaml:"rules"`
+}
+
+// AuthorizationRule matches SubjectAccessReviews. Empty fields match any
+// value, and entries ending in "*" match by prefix ("*" alone matches any).
+// Users are glob patterns such as "system:serviceaccount:ci:*"; a rule with
+// users and groups matches either.
+type AuthorizationRule struct {
+	// Decision is allow (default) or deny
+	Decision string `yaml:"decision,omitempty"`
+	// Clusters the user was authenticated by, from the cluster-name extra.
+	// Users without one are never matched, whatever the clusters.
+	Clusters []string `yaml:"clusters,omitempty"`
+	Users    []string `yaml:"users,omitempty"`
+	Groups   []string `yaml:"groups,omitempty"`
+	Verbs    []string `yaml:"verbs,omitempty"`
+	// APIGroups, Resources ("pods", or "pods/log" for a subresource) and
+	// Namespaces match resource requests
+	APIGroups  []string `yaml:"api_groups,omitempty"`
+	Resources  []string `yaml:"resources,omitempty"`
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	// NonResourceURLs match non-resource requests such as /healthz
+	NonResourceURLs []string `yaml:"non_resource_urls,omitempty"`
+}
+
+func (a *AuthorizationSettings) validate(clusters map[string]ClusterConfig) error {
+	if a == nil {
+		return nil
+	}
+	for i, rule := range a.Rules {
+		if rule.Decision != "" && rule.Decision != AuthorizationAllow && rule.Decision != AuthorizationDeny {
+			return fmt.Errorf("rules[%d]: unknown decision %q (valid: allow, deny)", i, rule.Decision)
+		}
+		for _, name := range rule.Clusters {
+			if _, ok := clusters[name]; !ok && name != "*" {
+				return fmt.Errorf("rules[%d]: cluster %q is not configured", i, name)
+			}
+		}
+		for _, pattern := range rule.Users {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rules[%d]: invalid users pattern %q: %w", i, pattern, err)
+			}
+		}
+		if len(rule.NonResourceURLs) > 0 && (len(rule.APIGroups) > 0 || len(rule.Resources) > 0 || len(rule.Namespaces) > 0) {
+			return fmt.Errorf("rules[%d]: non_resource_urls cannot be combined with api_groups, resources or namespaces", i)
+		}
+	}
+	return nil
+}
+
+// RetentionSettings bounds a persisted history; the oldest records are
+// dropped first. Unset fields do not limit it.
+type RetentionSettings struct {
+	MaxAge    time.Duration `yaml:"max_age,omitempty"`
+	MaxSizeMB int           `yaml:"max_size_mb,omitempty"`
+}
+
+// MaxBytes returns the size limit in bytes, or 0 if unlimited
+func (r RetentionSettings) MaxBytes() int64 {
+	return int64(r.MaxSizeMB) << 20
+}
+
+func (r *RetentionSettings) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.MaxAge < 0 || r.MaxSizeMB < 0 {
+		return fmt.Errorf("retention: max_age and max_size_mb must not be negative")
+	}
+	return nil
+}
+
+// AuditSettings enables audit logging of authentication decisions as
+// audit.k8s.io/v1 Event JSON lines
+type AuditSettings struct {
+	// Path is a file to append events to; "-" writes to stdout
+	Path string `yaml:"path,omitempty"`
+	// WebhookURL receives events as audit.k8s.io/v1 EventList POSTs
+	WebhookURL string `yaml:"webhook_url,omitempty"`
+	// Retention bounds the file at Path
+	Retention *RetentionSettings `yaml:"retention,omitempty"`
+}
+
+// EventsSettings configures delivery of credential lifecycle events beyond
+// Kubernetes Events on the credentials Secret
+type EventsSettings struct {
+	WebhookURL string `yaml:"webhook_url,omitempty"`
+}
+
+// DefaultMirrorTimeout bounds each mirrored TokenReview
+const DefaultMirrorTimeout = 5 * time.Second
+
+// MirrorSettings duplicates a share of TokenReview traffic to a shadow
+// instance, typically a new version, and compares its decisions
+type MirrorSettings struct {
+	// URL is the shadow instance's base URL, e.g. https://kfa-canary:8080
+	URL string `yaml:"url" jsonschema:"required"`
+	// Percent of TokenReviews mirrored, in (0, 100]
+	Percent float64       `yaml:"percent" jsonschema:"required"`
+	Timeout time.Duration `yaml:"timeout,omitempty"` // default 5s
+	// CACert verifies the shadow's serving certificate (file path)
+	CACert string `yaml:"ca_cert,omitempty"`
+}
+
+// GetTimeout returns the configured timeout or default
+func (m *MirrorSettings) GetTimeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return DefaultMirrorTimeout
+}
+
+// Notification event types that can be routed to channels
+const (
+	NotifyCredentialExpiring   = "credential_expiring"
+	NotifyVerifierDown         = "verifier_down"
+	NotifyRegistrationRejected = "registration_rejected"
+)
+
+// NotifyEventTypes lists the routable notification event types
+var NotifyEventTypes = []string{NotifyCredentialExpiring, NotifyVerifierDown, NotifyRegistrationRejected}
+
+// Notification channel types
+const (
+	ChannelSlack     = "slack"
+	ChannelHTTP      = "http"
+	ChannelPagerDuty = "pagerduty"
+	ChannelSMTP      = "smtp"
+)
+
+// NotificationSettings routes operational events to on-call tooling
+type NotificationSettings struct {
+	// Channels are named delivery targets
+	Channels map[string]ChannelSettings `yaml:"channels" jsonschema:"required"`
+	// Routes maps an event type to the names of the channels receiving it
+	Routes map[string][]string `yaml:"routes" jsonschema:"required"`
+}
+
+// ChannelSettings configures one notification channel
+type ChannelSettings struct {
+	// Type is slack, http, pagerduty or smtp
+	Type string `yaml:"type" jsonschema:"required"`
+	// URL is the Slack incoming webhook or HTTP endpoint
+	URL string `yaml:"url,omitempty"`
+	// RoutingKey is the PagerDuty Events v2 integration key
+	RoutingKey string        `yaml:"routing_key,omitempty"`
+	SMTP       *SMTPSettings `yaml:"smtp,omitempty"`
+}
+
+// DefaultSMTPPort is the submission port used when an SMTP channel sets none
+const DefaultSMTPPort = 587
+
+// SMTPSettings configures an email channel
+type SMTPSettings struct {
+	Host string `yaml:"host" jsonschema:"required"`
+	Port int    `yaml:"port,omitempty"` // default 587
+	// Username and PasswordFile enable PLAIN auth
+	Username     string   `yaml:"username,omitempty"`
+	PasswordFile string   `yaml:"password_file,omitempty"`
+	From         string   `yaml:"from" jsonschema:"required"`
+	To           []string `yaml:"to" jsonschema:"required"`
+}
+
+func (n *NotificationSettings) validate() error {
+	if n == nil {
+		return nil
+	}
+	for name, ch := range n.Channels {
+		switch ch.Type {
+		case ChannelSlack, ChannelHTTP:
+			if ch.URL == "" {
+				return fmt.Errorf("channel %q: url is required", name)
+			}
+		case ChannelPagerDuty:
+			if ch.RoutingKey == "" {
+				return fmt.Errorf("channel %q: routing_key is required", name)
+			}
+		case ChannelSMTP:
+			if ch.SMTP == nil || ch.SMTP.Host == "" || ch.SMTP.From == "" || len(ch.SMTP.To) == 0 {
+				return fmt.Errorf("channel %q: smtp host, from and to are required", name)
+			}
+		default:
+			return fmt.Errorf("channel %q: unknown type %q", name, ch.Type)
+		}
+	}
+	for event, channels := range n.Routes {
+		if !slices.Contains(NotifyEventTypes, event) {
+			return fmt.Errorf("route %q: unknown event type (valid: %s)", event, strings.Join(NotifyEventTypes, ", "))
+		}
+		for _, name := range channels {
+			if _, ok := n.Channels[name]; !ok {
+				return fmt.Errorf("route %q: unknown channel %q", event, name)
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultErrorReportingThreshold is how many consecutive failures trigger a report
+const DefaultErrorReportingThreshold = 3
+
+// ErrorReportingSettings pages an error tracker on repeated verifier-creation
+// and credential-persistence failures
+type ErrorReportingSettings struct {
+	WebhookURL string `yaml:"webhook_url,omitempty"`
+	// SentryDSN is a project DSN, https://<key>@<host>/<project>
+	SentryDSN string `yaml:"sentry_dsn,omitempty"`
+	// Threshold is the number of consecutive failures per cluster before reporting
+	Threshold int `yaml:"threshold,omitempty"`
+}
+
+// GetThreshold returns the configured threshold or default
+func (c *ErrorReportingSettings) GetThreshold() int {
+	if c.Threshold > 0 {
+		return c.Threshold
+	}
+	return DefaultErrorReportingThreshold
+}
+
+// DefaultReplayMaxRecords bounds the decision replay window when unset
+const DefaultReplayMaxRecords = 10000
+
+// ReplaySettings enables recording of decision inputs for replay against a
+// proposed policy with kfa replay
+type ReplaySettings struct {
+	// Path is the JSON lines file holding the rolling window of records
+	Path string `yaml:"path" jsonschema:"required"`
+	// MaxRecords is how many of the most recent decisions are kept
+	MaxRecords int `yaml:"max_records,omitempty"`
+	// Retention additionally bounds the window by age and size
+	Retention *RetentionSettings `yaml:"retention,omitempty"`
+}
+
+// GetMaxRecords returns the configured window size or default
+func (c *ReplaySettings) GetMaxRecords() int {
+	if c.MaxRecords > 0 {
+		return c.MaxRecords
+	}
+	return DefaultReplayMaxRecords
+}
+
 type Config struct {
-	Renewal  *RenewalSettings          `yaml:"renewal,omitempty"`
-	Clusters map[string]ClusterConfig `yaml:"clusters"`
+	Renewal  *RenewalSettings         `yaml:"renewal,omitempty"`
+	Limits   map[string]LimitSettings `yaml:"limits,omitempty"` // keyed by endpoint: tokenreview, clusters, sar
+	ReadAuth *ReadAuthSettings        `yaml:"read_auth,omitempty"`
+	Canary   *CanarySettings          `yaml:"canary,omitempty"`
+	Audit    *AuditSettings           `yaml:"audit,omitempty"`
+	Events   *EventsSettings          `yaml:"events,omitempty"`
+	Replay   *ReplaySettings          `yaml:"replay,omitempty"`
+	JWKS     *JWKSSettings            `yaml:"jwks,omitempty"`
+	Mirror   *MirrorSettings          `yaml:"mirror,omitempty"`
+	// ClockSkew is the leeway applied to exp, nbf and iat. When zero (and not
+	// set per cluster) go-oidc's checks apply: exact exp, 5m leeway on nbf.
+	ClockSkew time.Duration `yaml:"clock_skew,omitempty"`
+	// Notifications route operational events to Slack, PagerDuty, email or HTTP
+	Notifications *NotificationSettings `yaml:"notifications,omitempty"`
+	// ErrorReporting pages an error tracker on repeated subsystem failures
+	ErrorReporting *ErrorReportingSettings `yaml:"error_reporting,omitempty"`
+	// CredentialCheck periodically checks that remote clusters accept the stored credentials
+	CredentialCheck *CredentialCheckSettings `yaml:"credential_check,omitempty"`
+	// ExpiryAlerts alert on stored credentials nearing expiry or not updated in time
+	ExpiryAlerts *ExpiryAlertSettings `yaml:"expiry_alerts,omitempty"`
+	// CircuitBreaker fails verification fast for clusters whose API server keeps failing
+	CircuitBreaker *CircuitBreakerSettings `yaml:"circuit_breaker,omitempty"`
+	// NegativeCache answers repeated failed validations of a token from memory
+	NegativeCache *NegativeCacheSettings `yaml:"negative_cache,omitempty"`
+	// Heartbeat configures when clusters without recent heartbeats are flagged
+	Heartbeat *HeartbeatSettings `yaml:"heartbeat,omitempty"`
+	// Readiness configures the per-cluster checks behind /healthz/ready
+	Readiness *ReadinessSettings `yaml:"readiness,omitempty"`
+	// Authorization is the policy of the POST /sar authorization webhook
+	Authorization *AuthorizationSettings `yaml:"authorization,omitempty"`
+	// GroupTemplates are groups added to every authenticated user, with
+	// {cluster}, and {namespace} and {serviceaccount} for ServiceAccounts,
+	// e.g. "federated:cluster:{cluster}", so that consuming clusters can bind
+	// RBAC per source cluster or namespace
+	GroupTemplates []string `yaml:"group_templates,omitempty"`
+	// HostPattern is the Host of TokenReview requests naming their cluster,
+	// with {cluster} as one DNS label, e.g. api.{cluster}.kube-fed. Unset
+	// disables host-based routing.
+	HostPattern string `yaml:"host_pattern,omitempty"`
+	// TrustedProxies lists CIDRs (or IPs) of proxies whose X-Forwarded-For header is honored
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+	// IssuerTemplates maps template names to issuer URLs with {name} placeholders,
+	// e.g. "https://oidc.eks.{region}.amazonaws.com/id/{id}"
+	IssuerTemplates map[string]string        `yaml:"issuer_templates,omitempty"`
+	Clusters        map[string]ClusterConfig `yaml:"clusters" jsonschema:"required"`
+}
+
+var (
+	templateVarPattern   = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	templateValuePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// ExpandIssuerTemplate substitutes {name} placeholders in tmpl with vars.
+// Every placeholder must have a value, every var must be used, and values are
+// restricted to letters, digits, '.', '_' and '-' so they cannot alter the URL structure.
+func ExpandIssuerTemplate(tmpl string, vars map[string]string) (string, error) {
+	used := make(map[string]bool)
+	var missing []string
+	issuer := templateVarPattern.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		value, ok := vars[name]
+		if !ok {
+			missing = append(missing, name)
+			return m
+		}
+		used[name] = true
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing vars %v", missing)
+	}
+	for name, value := range vars {
+		if !used[name] {
+			return "", fmt.Errorf("var %q is not used by the template", name)
+		}
+		if !templateValuePattern.MatchString(value) {
+			return "", fmt.Errorf("var %q: invalid value %q", name, value)
+		}
+	}
+	if strings.ContainsAny(issuer, "{}") {
+		return "", fmt.Errorf("malformed placeholder in %q", tmpl)
+	}
+	return issuer, nil
+}
+
+// expandIssuer fills Issuer from IssuerTemplate when one is set
+func (c *ClusterConfig) expandIssuer(templates map[string]string) error {
+	if c.IssuerTemplate == "" {
+		if len(c.Vars) > 0 {
+			return fmt.Errorf("vars requires issuer_template")
+		}
+		return nil
+	}
+	if c.Issuer != "" {
+		return fmt.Errorf("issuer and issuer_template are mutually exclusive")
+	}
+	tmpl, ok := templates[c.IssuerTemplate]
+	if !ok {
+		return fmt.Errorf("unknown issuer_template %q", c.IssuerTemplate)
+	}
+	issuer, err := ExpandIssuerTemplate(tmpl, c.Vars)
+	if err != nil {
+		return fmt.Errorf("issuer_template %q: %w", c.IssuerTemplate, err)
+	}
+	c.Issuer = issuer
+	return nil
+}
+
+// LocalCluster is the cluster of the Host of the pattern without its
+// {cluster} label, e.g. api.kube-fed
+const LocalCluster = "local"
+
+// validateHostPattern checks that a host pattern has {cluster} exactly once,
+// as a whole DNS label
+func validateHostPattern(pattern string) error {
+	if strings.Count(pattern, "{cluster}") != 1 {
+		return fmt.Errorf("%q must contain {cluster} exactly once", pattern)
+	}
+	prefix, suffix, _ := strings.Cut(pattern, "{cluster}")
+	if (prefix != "" && !strings.HasSuffix(prefix, ".")) || (suffix != "" && !strings.HasPrefix(suffix, ".")) {
+		return fmt.Errorf("%q: {cluster} must be a whole DNS label", pattern)
+	}
+	return nil
+}
+
+// ClusterFromHost returns the cluster a request Host names by the host
+// pattern. The Host must match the whole pattern; the Host of the pattern
+// without its {cluster} label names the local cluster.
+func (c *Config) ClusterFromHost(host string) (string, bool) {
+	if c.HostPattern == "" {
+		return "", false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	prefix, suffix, _ := strings.Cut(strings.ToLower(c.HostPattern), "{cluster}")
+
+	local := strings.TrimSuffix(prefix, ".") + suffix
+	if prefix == "" {
+		local = strings.TrimPrefix(suffix, ".")
+	}
+	if local != "" && host == local {
+		return LocalCluster, true
+	}
+	if len(host) <= len(prefix)+len(suffix) || !strings.HasPrefix(host, prefix) || !strings.HasSuffix(host, suffix) {
+		return "", false
+	}
+	cluster := host[len(prefix) : len(host)-len(suffix)]
+	if strings.Contains(cluster, ".") {
+		return "", false
+	}
+	return cluster, true
+}
+
+// ParseTrustedProxies parses CIDRs or single IP addresses into prefixes
+func ParseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: must be a CIDR or IP address", entry)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// GetLimit returns the in-flight limit settings for an endpoint.
+// A zero MaxInFlight means the endpoint is unbounded.
+func (c *Config) GetLimit(endpoint string) LimitSettings {
+	limit := c.Limits[endpoint]
+	if limit.RejectStatus == 0 {
+		limit.RejectStatus = http.StatusTooManyRequests
+	}
+	return limit
+}
+
+// GetClockSkew returns the clock skew leeway for a cluster, falling back to
+// the global setting. Zero means go-oidc's default time checks apply.
+func (c *Config) GetClockSkew(cluster string) time.Duration {
+	if skew := c.Clusters[cluster].ClockSkew; skew > 0 {
+		return skew
+	}
+	return c.ClockSkew
+}
+
+// GetHeartbeatStaleAfter returns the configured heartbeat threshold or default
+func (c *Config) GetHeartbeatStaleAfter() time.Duration {
+	if c.Heartbeat != nil && c.Heartbeat.StaleAfter > 0 {
+		return c.Heartbeat.StaleAfter
+	}
+	return DefaultHeartbeatStaleAfter
+}
+
+// GetHeartbeatInterval returns the configured heartbeat interval, or a third
+// of the stale_after threshold
+func (c *Config) GetHeartbeatInterval() time.Duration {
+	if c.Heartbeat != nil && c.Heartbeat.Interval > 0 {
+		return c.Heartbeat.Interval
+	}
+	return c.GetHeartbeatStaleAfter() / 3
 }
 
 // GetRenewalInterval returns the configured renewal interval or default
@@ -110,30 +1431,241 @@ func (c *Config) GetRenewalRenewBefore() time.Duration {
 	return DefaultRenewalRenewBefore
 }
 
+// LoadOptions relaxes startup requirements of Load
+type LoadOptions struct {
+	// AllowEmpty accepts a missing config file or an empty clusters map,
+	// starting the server with an empty inventory instead of failing.
+	AllowEmpty bool
+	// AllowInsecure accepts clusters with insecure_skip_tls_verify
+	AllowInsecure bool
+}
+
 func Load(path string) (*Config, error) {
+	return LoadWithOptions(path, LoadOptions{})
+}
+
+// LoadWithOptions loads and validates the config file at path
+func LoadWithOptions(path string, opts LoadOptions) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("reading config file: %w", err)
+		if !opts.AllowEmpty || !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		data = nil
 	}
 
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("parsing config file: %w", err)
 	}
+	if cfg.Clusters == nil {
+		cfg.Clusters = make(map[string]ClusterConfig)
+	}
 
-	if len(cfg.Clusters) == 0 {
+	for endpoint, limit := range cfg.Limits {
+		if !slices.Contains(LimitEndpoints, endpoint) {
+			return nil, fmt.Errorf("limits: unknown endpoint %q (valid: %v)", endpoint, LimitEndpoints)
+		}
+		if limit.MaxInFlight < 0 {
+			return nil, fmt.Errorf("limits %q: max_in_flight must not be negative", endpoint)
+		}
+		switch limit.RejectStatus {
+		case 0, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		default:
+			return nil, fmt.Errorf("limits %q: reject_status must be 429 or 503", endpoint)
+		}
+	}
+
+	if len(cfg.Clusters) == 0 && !opts.AllowEmpty {
 		return nil, fmt.Errorf("no clusters configured")
 	}
 
 	for name, cluster := range cfg.Clusters {
+		if err := cluster.expandIssuer(cfg.IssuerTemplates); err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+		if err := cluster.applyKubeconfig(); err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+		cfg.Clusters[name] = cluster
 		if cluster.Issuer == "" {
 			return nil, fmt.Errorf("cluster %q: issuer is required", name)
 		}
+		for i, issuer := range cluster.AdditionalIssuers {
+			if issuer == "" || slices.Contains(cluster.Issuers()[:i+1], issuer) {
+				return nil, fmt.Errorf("cluster %q: additional_issuers[%d]: empty or duplicate issuer %q", name, i, issuer)
+			}
+		}
+		if err := cluster.validateType(); err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+		if err := cluster.validateFallback(); err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+		if err := cluster.KeySnapshot.validate(&cluster); err != nil {
+			return nil, fmt.Errorf("cluster %q: key_snapshot: %w", name, err)
+		}
+		if err := cluster.AudienceRewrite.validate(); err != nil {
+			return nil, fmt.Errorf("cluster %q: audience_rewrite: %w", name, err)
+		}
+		if cluster.ClockSkew < 0 {
+			return nil, fmt.Errorf("cluster %q: clock_skew must not be negative", name)
+		}
+		if cluster.UpstreamTimeout < 0 {
+			return nil, fmt.Errorf("cluster %q: upstream_timeout must not be negative", name)
+		}
+		if cluster.MaxCredentialAge < 0 {
+			return nil, fmt.Errorf("cluster %q: max_credential_age must not be negative", name)
+		}
+		if cluster.InsecureSkipTLSVerify && !opts.AllowInsecure {
+			return nil, fmt.Errorf("cluster %q: insecure_skip_tls_verify requires the --allow-insecure server flag", name)
+		}
+		if err := cluster.validateCACert(); err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+		if err := cluster.validateClientCert(); err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+		if err := cluster.validateRenewalServiceAccount(); err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+		if err := cluster.validateUsernameTemplate(); err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+		if err := cluster.Exec.validate(&cluster); err != nil {
+			return nil, fmt.Errorf("cluster %q: exec: %w", name, err)
+		}
+		if err := cluster.Egress.validate(); err != nil {
+			return nil, fmt.Errorf("cluster %q: egress: %w", name, err)
+		}
+		if err := cluster.validateClaimRules(); err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", name, err)
+		}
+	}
+
+	if err := validateGroupTemplates(cfg.GroupTemplates); err != nil {
+		return nil, fmt.Errorf("group_templates: %w", err)
+	}
+	if cfg.HostPattern != "" {
+		if err := validateHostPattern(cfg.HostPattern); err != nil {
+			return nil, fmt.Errorf("host_pattern: %w", err)
+		}
+	}
+
+	if _, err := ParseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+
+	if err := cfg.ReadAuth.validate(cfg.Clusters); err != nil {
+		return nil, fmt.Errorf("read_auth: %w", err)
+	}
+	if err := cfg.Authorization.validate(cfg.Clusters); err != nil {
+		return nil, fmt.Errorf("authorization: %w", err)
+	}
+
+	if cfg.Readiness != nil && cfg.Readiness.MinHealthyClusters != nil && *cfg.Readiness.MinHealthyClusters < 0 {
+		return nil, fmt.Errorf("readiness: min_healthy_clusters must not be negative")
+	}
+
+	if cfg.Audit != nil && cfg.Audit.Path == "" && cfg.Audit.WebhookURL == "" {
+		return nil, fmt.Errorf("audit: path or webhook_url is required")
+	}
+	if cfg.Audit != nil {
+		if err := cfg.Audit.Retention.validate(); err != nil {
+			return nil, fmt.Errorf("audit: %w", err)
+		}
+	}
+
+	if cfg.ClockSkew < 0 {
+		return nil, fmt.Errorf("clock_skew must not be negative")
+	}
+
+	if cfg.JWKS != nil && cfg.JWKS.Jitter < 0 {
+		return nil, fmt.Errorf("jwks: jitter must not be negative")
+	}
+
+	if cb := cfg.CircuitBreaker; cb != nil && (cb.FailureThreshold < 0 || cb.OpenDuration < 0) {
+		return nil, fmt.Errorf("circuit_breaker: failure_threshold and open_duration must not be negative")
+	}
+
+	if ea := cfg.ExpiryAlerts; ea != nil && (ea.Interval < 0 || ea.WarnBefore < 0 || ea.MaxUpdateAge < 0) {
+		return nil, fmt.Errorf("expiry_alerts: interval, warn_before and max_update_age must not be negative")
+	}
+
+	if hb := cfg.Heartbeat; hb != nil && (hb.StaleAfter < 0 || hb.Interval < 0) {
+		return nil, fmt.Errorf("heartbeat: stale_after and interval must not be negative")
+	}
+	if interval := cfg.GetHeartbeatInterval(); interval >= cfg.GetHeartbeatStaleAfter() {
+		return nil, fmt.Errorf("heartbeat: interval %s must be shorter than stale_after %s", interval, cfg.GetHeartbeatStaleAfter())
+	}
+	if err := cfg.Heartbeat.validate(); err != nil {
+		return nil, fmt.Errorf("heartbeat: %w", err)
+	}
+
+	if nc := cfg.NegativeCache; nc != nil && (nc.TTL < 0 || nc.MaxEntries < 0) {
+		return nil, fmt.Errorf("negative_cache: ttl and max_entries must not be negative")
+	}
+
+	if err := cfg.Notifications.validate(); err != nil {
+		return nil, fmt.Errorf("notifications: %w", err)
+	}
+
+	if cfg.ErrorReporting != nil && cfg.ErrorReporting.WebhookURL == "" && cfg.ErrorReporting.SentryDSN == "" {
+		return nil, fmt.Errorf("error_reporting: webhook_url or sentry_dsn is required")
+	}
+
+	if m := cfg.Mirror; m != nil {
+		if m.URL == "" {
+			return nil, fmt.Errorf("mirror: url is required")
+		}
+		if m.Percent <= 0 || m.Percent > 100 {
+			return nil, fmt.Errorf("mirror: percent must be in (0, 100], got %g", m.Percent)
+		}
+		if m.Timeout < 0 {
+			return nil, fmt.Errorf("mirror: timeout must not be negative")
+		}
+	}
+
+	if cfg.Replay != nil && cfg.Replay.Path == "" {
+		return nil, fmt.Errorf("replay: path is required")
+	}
+	if cfg.Replay != nil {
+		if err := cfg.Replay.Retention.validate(); err != nil {
+			return nil, fmt.Errorf("replay: %w", err)
+		}
 	}
 
 	return &cfg, nil
 }
 
+func (r *ReadAuthSettings) validate(clusters map[string]ClusterConfig) error {
+	if r == nil {
+		return nil
+	}
+	if _, ok := clusters[r.Cluster]; !ok {
+		return fmt.Errorf("cluster %q is not configured", r.Cluster)
+	}
+	for _, pattern := range r.AllowedCallers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid allowed_callers pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// IsAllowedCaller reports whether subject matches the read_auth allowlist
+func (r *ReadAuthSettings) IsAllowedCaller(subject string) bool {
+	if len(r.AllowedCallers) == 0 {
+		return true
+	}
+	for _, pattern := range r.AllowedCallers {
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Config) ClusterNames() []string {
 	names := make([]string, 0, len(c.Clusters))
 	for name := range c.Clusters {
@@ -142,6 +1674,20 @@ func (c *Config) ClusterNames() []string {
 	return names
 }
 
+// ClustersForIssuer returns the names of the clusters configured with
+// issuer, sorted. Several clusters may share one, e.g. the default
+// https://kubernetes.default.svc.cluster.local.
+func (c *Config) ClustersForIssuer(issuer string) []string {
+	var names []string
+	for name, cluster := range c.Clusters {
+		if slices.Contains(cluster.Issuers(), issuer) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 // GetRemoteClusters returns cluster names that are remote (have api_server set)
 func (c *Config) GetRemoteClusters() []string {
 	var names []string
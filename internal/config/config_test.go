@@ -1,9 +1,19 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoad_ValidConfig(t *testing.T) {
@@ -154,6 +164,40 @@ clusters:
 	}
 }
 
+func TestClustersForIssuer(t *testing.T) {
+	cfg := &Config{Clusters: map[string]ClusterConfig{
+		"local":     {Issuer: "https://kubernetes.default.svc.cluster.local"},
+		"cluster-b": {Issuer: "https://kubernetes.default.svc.cluster.local", APIServer: "https://b:6443"},
+		"eks":       {Issuer: "https://oidc.eks.example.com/id/X"},
+	}}
+	if got := cfg.ClustersForIssuer("https://kubernetes.default.svc.cluster.local"); !slices.Equal(got, []string{"cluster-b", "local"}) {
+		t.Errorf("shared issuer = %v, want [cluster-b local]", got)
+	}
+	if got := cfg.ClustersForIssuer("https://unknown.example.com"); len(got) != 0 {
+		t.Errorf("unknown issuer = %v, want none", got)
+	}
+
+	cfg.Clusters["cluster-b"] = ClusterConfig{
+		Issuer:            "https://b.example.com",
+		AdditionalIssuers: []string{"https://kubernetes.default.svc.cluster.local"},
+	}
+	if got := cfg.ClustersForIssuer("https://kubernetes.default.svc.cluster.local"); !slices.Equal(got, []string{"cluster-b", "local"}) {
+		t.Errorf("additional issuer = %v, want [cluster-b local]", got)
+	}
+}
+
+func TestLoad_AdditionalIssuersDuplicate(t *testing.T) {
+	_, err := loadFromStringErr(`
+clusters:
+  cluster-a:
+    issuer: "https://a.example.com"
+    additional_issuers: ["https://a.example.com"]
+`)
+	if err == nil {
+		t.Error("expected error for duplicate issuer, got nil")
+	}
+}
+
 func TestGetRemoteClusters(t *testing.T) {
 	content := `
 clusters:
@@ -193,6 +237,685 @@ clusters:
 	}
 }
 
+func TestLoad_AudienceRewrite(t *testing.T) {
+	content := `
+clusters:
+  cluster-b:
+    issuer: "https://kubernetes.default.svc.cluster.local"
+    api_server: "https://192.168.1.100:6443"
+    audience_rewrite:
+      pass_through: ["shared"]
+      strip: ["local-only"]
+      map:
+        kube-fed: "https://kubernetes.default.svc.cluster.local"
+`
+	cfg := loadFromString(t, content)
+
+	rw := cfg.Clusters["cluster-b"].AudienceRewrite
+	if rw == nil {
+		t.Fatal("audience_rewrite not parsed")
+	}
+	if len(rw.PassThrough) != 1 || rw.PassThrough[0] != "shared" {
+		t.Errorf("pass_through = %v, want [shared]", rw.PassThrough)
+	}
+	if rw.Map["kube-fed"] != "https://kubernetes.default.svc.cluster.local" {
+		t.Errorf("map[kube-fed] = %q", rw.Map["kube-fed"])
+	}
+}
+
+func TestLoad_AudienceRewriteConflict(t *testing.T) {
+	content := `
+clusters:
+  cluster-b:
+    issuer: "https://kubernetes.default.svc.cluster.local"
+    audience_rewrite:
+      strip: ["kube-fed"]
+      map:
+        kube-fed: "api"
+`
+	_, err := loadFromStringErr(content)
+	if err == nil {
+		t.Error("expected error for audience both stripped and mapped, got nil")
+	}
+}
+
+func TestLoad_ClaimMappings(t *testing.T) {
+	content := `
+clusters:
+  cluster-a:
+    issuer: "https://oidc.example.com"
+    claimValidationRules:
+    - claim: hd
+      requiredValue: example.com
+    - expression: 'claims.sub != ""'
+      message: sub is required
+    claimMappings:
+      username:
+        claim: sub
+        prefix: "oidc:"
+      groups:
+        expression: 'claims.roles.split(",")'
+      extra:
+      - key: example.com/tenant
+        valueExpression: claims.tenant
+    userValidationRules:
+    - expression: "!user.username.startsWith('system:')"
+`
+	cfg := loadFromString(t, content)
+
+	a := cfg.Clusters["cluster-a"]
+	if len(a.ClaimValidationRules) != 2 {
+		t.Fatalf("claimValidationRules count = %d, want 2", len(a.ClaimValidationRules))
+	}
+	if a.ClaimMappings == nil || a.ClaimMappings.Username.Claim != "sub" {
+		t.Fatalf("claimMappings.username not parsed: %+v", a.ClaimMappings)
+	}
+	if a.ClaimMappings.Username.Prefix == nil || *a.ClaimMappings.Username.Prefix != "oidc:" {
+		t.Errorf("claimMappings.username.prefix not parsed")
+	}
+	if len(a.ClaimMappings.Extra) != 1 || a.ClaimMappings.Extra[0].Key != "example.com/tenant" {
+		t.Errorf("claimMappings.extra = %+v", a.ClaimMappings.Extra)
+	}
+	if len(a.UserValidationRules) != 1 {
+		t.Errorf("userValidationRules count = %d, want 1", len(a.UserValidationRules))
+	}
+}
+
+func TestLoad_ClaimMappingsUsernameRequired(t *testing.T) {
+	content := `
+clusters:
+  cluster-a:
+    issuer: "https://oidc.example.com"
+    claimMappings:
+      groups:
+        claim: groups
+`
+	_, err := loadFromStringErr(content)
+	if err == nil {
+		t.Error("expected error for missing username mapping, got nil")
+	}
+}
+
+func TestLoad_Limits(t *testing.T) {
+	content := `
+limits:
+  tokenreview:
+    max_in_flight: 50
+    reject_status: 503
+  clusters:
+    max_in_flight: 5
+clusters:
+  cluster-a:
+    issuer: "https://oidc.example.com"
+`
+	cfg := loadFromString(t, content)
+
+	tr := cfg.GetLimit("tokenreview")
+	if tr.MaxInFlight != 50 || tr.RejectStatus != 503 {
+		t.Errorf("tokenreview limit = %+v, want {50 503}", tr)
+	}
+	if got := cfg.GetLimit("clusters").RejectStatus; got != 429 {
+		t.Errorf("clusters reject_status = %d, want default 429", got)
+	}
+	if got := cfg.GetLimit("health").MaxInFlight; got != 0 {
+		t.Errorf("unconfigured endpoint max_in_flight = %d, want 0", got)
+	}
+}
+
+func TestLoad_LimitsInvalid(t *testing.T) {
+	for name, limits := range map[string]string{
+		"bad status":       "tokenreview: {max_in_flight: 10, reject_status: 500}",
+		"unknown endpoint": "validate: {max_in_flight: 10}",
+		"negative":         "clusters: {max_in_flight: -1}",
+	} {
+		content := "limits:\n  " + limits + "\nclusters:\n  a:\n    issuer: https://a.example.com\n"
+		if _, err := loadFromStringErr(content); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
+
+func TestLoad_ReadAuth(t *testing.T) {
+	content := `
+read_auth:
+  cluster: cluster-a
+  allowed_callers:
+  - "system:serviceaccount:monitoring:*"
+  - "system:serviceaccount:ops:admin"
+clusters:
+  cluster-a:
+    issuer: "https://oidc.example.com"
+`
+	cfg := loadFromString(t, content)
+
+	if cfg.ReadAuth == nil || cfg.ReadAuth.Cluster != "cluster-a" {
+		t.Fatalf("read_auth not parsed: %+v", cfg.ReadAuth)
+	}
+
+	tests := map[string]bool{
+		"system:serviceaccount:monitoring:prometheus": true,
+		"system:serviceaccount:ops:admin":             true,
+		"system:serviceaccount:ops:other":             false,
+		"system:serviceaccount:default:app":           false,
+	}
+	for subject, want := range tests {
+		if got := cfg.ReadAuth.IsAllowedCaller(subject); got != want {
+			t.Errorf("IsAllowedCaller(%q) = %v, want %v", subject, got, want)
+		}
+	}
+}
+
+func TestLoad_ReadAuthUnknownCluster(t *testing.T) {
+	content := `
+read_auth:
+  cluster: missing
+clusters:
+  cluster-a:
+    issuer: "https://oidc.example.com"
+`
+	_, err := loadFromStringErr(content)
+	if err == nil {
+		t.Error("expected error for unknown read_auth cluster, got nil")
+	}
+}
+
+func TestLoad_TrustedProxiesInvalid(t *testing.T) {
+	content := `
+trusted_proxies: ["10.0.0.0/8", "not-a-cidr"]
+clusters:
+  cluster-a:
+    issuer: "https://oidc.example.com"
+`
+	_, err := loadFromStringErr(content)
+	if err == nil {
+		t.Error("expected error for invalid trusted proxy, got nil")
+	}
+}
+
+func TestLoad_CredentialCheck(t *testing.T) {
+	cfg := loadFromString(t, `
+credential_check:
+  interval: 2m
+clusters:
+  local:
+    issuer: "https://kubernetes.default.svc"
+`)
+	if cfg.CredentialCheck == nil {
+		t.Fatal("credential_check not parsed")
+	}
+	if got := cfg.CredentialCheck.GetInterval(); got != 2*time.Minute {
+		t.Errorf("credential check interval = %v, want 2m", got)
+	}
+	if got := (&CredentialCheckSettings{}).GetInterval(); got != DefaultCredentialCheckInterval {
+		t.Errorf("default credential check interval = %v, want %v", got, DefaultCredentialCheckInterval)
+	}
+}
+
+func TestLoad_ExpiryAlerts(t *testing.T) {
+	cfg := loadFromString(t, `
+expiry_alerts:
+  warn_before: 72h
+  max_update_age: 168h
+clusters:
+  local:
+    issuer: "https://kubernetes.default.svc"
+`)
+	if cfg.ExpiryAlerts == nil {
+		t.Fatal("expiry_alerts not parsed")
+	}
+	if got := cfg.ExpiryAlerts.GetWarnBefore(); got != 72*time.Hour {
+		t.Errorf("warn_before = %v, want 72h", got)
+	}
+	if got := cfg.ExpiryAlerts.GetInterval(); got != DefaultExpiryAlertInterval {
+		t.Errorf("interval = %v, want default %v", got, DefaultExpiryAlertInterval)
+	}
+	if cfg.ExpiryAlerts.MaxUpdateAge != 168*time.Hour {
+		t.Errorf("max_update_age = %v, want 168h", cfg.ExpiryAlerts.MaxUpdateAge)
+	}
+
+	if _, err := loadFromStringErr(`
+expiry_alerts:
+  warn_before: -1h
+clusters:
+  local:
+    issuer: "https://kubernetes.default.svc"
+`); err == nil {
+		t.Error("expected error for negative warn_before")
+	}
+}
+
+func TestLoad_Canary(t *testing.T) {
+	content := `
+canary:
+  interval: "90s"
+clusters:
+  cluster-a:
+    issuer: "https://oidc.example.com"
+`
+	cfg := loadFromString(t, content)
+
+	if cfg.Canary == nil {
+		t.Fatal("canary not parsed")
+	}
+	if got := cfg.Canary.GetInterval(); got != 90*time.Second {
+		t.Errorf("canary interval = %v, want 90s", got)
+	}
+
+	if got := (&CanarySettings{}).GetInterval(); got != DefaultCanaryInterval {
+		t.Errorf("default canary interval = %v, want %v", got, DefaultCanaryInterval)
+	}
+}
+
+func TestLoad_Audit(t *testing.T) {
+	content := `
+audit:
+  path: /var/log/kfa/audit.log
+  webhook_url: https://audit.example.com/events
+clusters:
+  cluster-a:
+    issuer: "https://oidc.example.com"
+`
+	cfg := loadFromString(t, content)
+	if cfg.Audit == nil || cfg.Audit.Path != "/var/log/kfa/audit.log" || cfg.Audit.WebhookURL != "https://audit.example.com/events" {
+		t.Errorf("audit = %+v", cfg.Audit)
+	}
+
+	_, err := loadFromStringErr(`
+audit: {}
+clusters:
+  cluster-a:
+    issuer: "https://oidc.example.com"
+`)
+	if err == nil {
+		t.Error("expected error for audit without a sink")
+	}
+}
+
+func TestLoad_IssuerTemplates(t *testing.T) {
+	content := `
+issuer_templates:
+  eks: "https://oidc.eks.{region}.amazonaws.com/id/{id}"
+clusters:
+  eks-prod:
+    issuer_template: eks
+    vars:
+      region: us-west-2
+      id: ABC123
+`
+	cfg := loadFromString(t, content)
+	if got := cfg.Clusters["eks-prod"].Issuer; got != "https://oidc.eks.us-west-2.amazonaws.com/id/ABC123" {
+		t.Errorf("issuer = %q", got)
+	}
+}
+
+func TestLoad_IssuerTemplatesInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		cluster string
+	}{
+		{"missing var", `
+    issuer_template: eks
+    vars: {region: us-west-2}`},
+		{"unused var", `
+    issuer_template: eks
+    vars: {region: us-west-2, id: ABC, zone: a}`},
+		{"invalid value", `
+    issuer_template: eks
+    vars: {region: "us-west-2/evil", id: ABC}`},
+		{"unknown template", `
+    issuer_template: gke
+    vars: {region: us-west-2, id: ABC}`},
+		{"both issuer and template", `
+    issuer: "https://oidc.example.com"
+    issuer_template: eks
+    vars: {region: us-west-2, id: ABC}`},
+		{"vars without template", `
+    issuer: "https://oidc.example.com"
+    vars: {region: us-west-2}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := `
+issuer_templates:
+  eks: "https://oidc.eks.{region}.amazonaws.com/id/{id}"
+clusters:
+  eks-prod:` + tt.cluster + "\n"
+			if _, err := loadFromStringErr(content); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestLoad_EgressInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		egress string
+	}{
+		{"both address and interface", `{local_address: "10.0.0.5", interface: eth1}`},
+		{"invalid address", `{local_address: "10.0.0"}`},
+		{"unsupported proxy scheme", `{proxy_url: "ftp://proxy:21"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := `
+clusters:
+  cluster-b:
+    issuer: "https://kubernetes.default.svc.cluster.local"
+    api_server: "https://10.1.0.10:6443"
+    egress: ` + tt.egress + "\n"
+			if _, err := loadFromStringErr(content); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestLoad_MaxCredentialAge(t *testing.T) {
+	cfg := loadFromString(t, `
+clusters:
+  cluster-b:
+    issuer: "https://kubernetes.default.svc.cluster.local"
+    api_server: "https://10.1.0.10:6443"
+    max_credential_age: 12h
+`)
+	if got := cfg.Clusters["cluster-b"].MaxCredentialAge; got != 12*time.Hour {
+		t.Errorf("max_credential_age = %s, want 12h", got)
+	}
+
+	if _, err := loadFromStringErr(`
+clusters:
+  cluster-b:
+    issuer: "https://kubernetes.default.svc.cluster.local"
+    api_server: "https://10.1.0.10:6443"
+    max_credential_age: -1h
+`); err == nil {
+		t.Error("negative max_credential_age: expected error, got nil")
+	}
+}
+
+func TestLoad_ClockSkew(t *testing.T) {
+	cfg := loadFromString(t, `
+clock_skew: 30s
+clusters:
+  cluster-a:
+    issuer: "https://a.example.com"
+  cluster-b:
+    issuer: "https://b.example.com"
+    clock_skew: 2m
+`)
+	if got := cfg.GetClockSkew("cluster-a"); got != 30*time.Second {
+		t.Errorf("cluster-a clock skew = %s, want 30s", got)
+	}
+	if got := cfg.GetClockSkew("cluster-b"); got != 2*time.Minute {
+		t.Errorf("cluster-b clock skew = %s, want 2m", got)
+	}
+
+	if _, err := loadFromStringErr(`
+clock_skew: -1s
+clusters:
+  cluster-a:
+    issuer: "https://a.example.com"
+`); err == nil {
+		t.Error("negative clock_skew: expected error, got nil")
+	}
+}
+
+func TestLoad_Notifications(t *testing.T) {
+	cfg := loadFromString(t, `
+notifications:
+  channels:
+    oncall:
+      type: pagerduty
+      routing_key: abc123
+    chat:
+      type: slack
+      url: "https://hooks.slack.example.com/x"
+  routes:
+    verifier_down: [oncall, chat]
+    credential_expiring: [chat]
+clusters:
+  cluster-a:
+    issuer: "https://a.example.com"
+`)
+	if got := cfg.Notifications.Routes[NotifyVerifierDown]; len(got) != 2 {
+		t.Errorf("verifier_down routes = %v, want 2 channels", got)
+	}
+
+	for name, notifications := range map[string]string{
+		"unknown event": `
+  channels:
+    chat: {type: slack, url: "https://hooks.slack.example.com/x"}
+  routes:
+    cluster_deleted: [chat]`,
+		"unknown channel": `
+  channels:
+    chat: {type: slack, url: "https://hooks.slack.example.com/x"}
+  routes:
+    verifier_down: [oncall]`,
+		"missing routing key": `
+  channels:
+    oncall: {type: pagerduty}
+  routes:
+    verifier_down: [oncall]`,
+		"smtp without recipients": `
+  channels:
+    mail: {type: smtp, smtp: {host: smtp.example.com, from: kfa@example.com}}
+  routes:
+    verifier_down: [mail]`,
+	} {
+		if _, err := loadFromStringErr("notifications:" + notifications + `
+clusters:
+  cluster-a:
+    issuer: "https://a.example.com"
+`); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
+
+func TestLoad_Mirror(t *testing.T) {
+	cfg := loadFromString(t, `
+mirror:
+  url: "https://kfa-shadow:8080"
+  percent: 5
+clusters:
+  cluster-a:
+    issuer: "https://a.example.com"
+`)
+	if cfg.Mirror.Percent != 5 || cfg.Mirror.GetTimeout() != DefaultMirrorTimeout {
+		t.Errorf("mirror = %+v, want percent 5 with default timeout", cfg.Mirror)
+	}
+
+	for _, percent := range []string{"0", "150"} {
+		if _, err := loadFromStringErr(`
+mirror:
+  url: "https://kfa-shadow:8080"
+  percent: ` + percent + `
+clusters:
+  cluster-a:
+    issuer: "https://a.example.com"
+`); err == nil {
+			t.Errorf("percent %s: expected error, got nil", percent)
+		}
+	}
+}
+
+func TestEffective(t *testing.T) {
+	cfg := loadFromString(t, `
+clock_skew: 30s
+issuer_templates:
+  eks: "https://oidc.eks.{region}.amazonaws.com/id/{id}"
+error_reporting:
+  sentry_dsn: "https://secret@sentry.example.com/42"
+limits:
+  tokenreview:
+    max_in_flight: 10
+clusters:
+  eks-prod:
+    issuer_template: eks
+    vars: {region: us-west-2, id: ABC}
+  cluster-b:
+    issuer: "https://b.example.com"
+    clock_skew: 2m
+  eks-exec:
+    issuer: "https://oidc.eks.example.com/id/X"
+    api_server: "https://X.eks.example.com"
+    exec: {command: aws, env: {AWS_SECRET_ACCESS_KEY: secret-key}}
+`)
+	data, err := cfg.EffectiveYAML()
+	if err != nil {
+		t.Fatalf("EffectiveYAML: %v", err)
+	}
+	if strings.Contains(string(data), "secret@") {
+		t.Errorf("sentry_dsn not redacted:\n%s", data)
+	}
+	if strings.Contains(string(data), "secret-key") {
+		t.Errorf("exec env not redacted:\n%s", data)
+	}
+
+	again, err := loadFromStringErr(string(data))
+	if err != nil {
+		t.Fatalf("re-importing effective config: %v\n%s", err, data)
+	}
+	if got := again.Clusters["eks-prod"].Issuer; got != "https://oidc.eks.us-west-2.amazonaws.com/id/ABC" {
+		t.Errorf("eks-prod issuer = %q", got)
+	}
+	if again.GetClockSkew("eks-prod") != 30*time.Second || again.GetClockSkew("cluster-b") != 2*time.Minute {
+		t.Errorf("clock skew = %s/%s, want 30s/2m", again.GetClockSkew("eks-prod"), again.GetClockSkew("cluster-b"))
+	}
+	if again.Renewal.RenewBefore != DefaultRenewalRenewBefore || again.Limits["tokenreview"].RejectStatus != 429 {
+		t.Errorf("defaults not filled in: renewal=%+v limits=%+v", again.Renewal, again.Limits)
+	}
+	if again.ErrorReporting.Threshold != DefaultErrorReportingThreshold {
+		t.Errorf("error_reporting threshold = %d", again.ErrorReporting.Threshold)
+	}
+
+	// Exporting the export is a fixed point
+	data2, err := again.EffectiveYAML()
+	if err != nil {
+		t.Fatalf("EffectiveYAML: %v", err)
+	}
+	if string(data2) != string(data) {
+		t.Errorf("export is not deterministic:\n%s\n---\n%s", data, data2)
+	}
+}
+
+func testCACertPEM(t *testing.T) string {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestLoad_CACertData(t *testing.T) {
+	caPEM := testCACertPEM(t)
+	indented := "      " + strings.ReplaceAll(strings.TrimSpace(caPEM), "\n", "\n      ")
+
+	cfg := loadFromString(t, `
+clusters:
+  inline-pem:
+    issuer: "https://a.example.com"
+    ca_cert_data: |
+`+indented+`
+  inline-base64:
+    issuer: "https://b.example.com"
+    ca_cert_data: "`+base64.StdEncoding.EncodeToString([]byte(caPEM))+`"
+`)
+	for _, name := range []string{"inline-pem", "inline-base64"} {
+		cluster := cfg.Clusters[name]
+		ca, err := cluster.LoadCACert()
+		if err != nil {
+			t.Fatalf("%s: LoadCACert: %v", name, err)
+		}
+		if strings.TrimSpace(string(ca)) != strings.TrimSpace(caPEM) {
+			t.Errorf("%s: CA = %q, want the test certificate", name, ca)
+		}
+	}
+
+	for name, cluster := range map[string]string{
+		"not a certificate": `ca_cert_data: "bm90IGEgY2VydA=="`,
+		"both":              `ca_cert: /etc/ca.crt` + "\n    " + `ca_cert_data: "` + base64.StdEncoding.EncodeToString([]byte(caPEM)) + `"`,
+	} {
+		if _, err := loadFromStringErr(`
+clusters:
+  cluster-a:
+    issuer: "https://a.example.com"
+    ` + cluster + `
+`); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
+
+func TestLoad_InsecureSkipTLSVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+clusters:
+  kind:
+    issuer: "https://kubernetes.default.svc.cluster.local"
+    api_server: "https://127.0.0.1:6443"
+    insecure_skip_tls_verify: true
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "--allow-insecure") {
+		t.Errorf("without AllowInsecure: err = %v, want --allow-insecure error", err)
+	}
+	cfg, err := LoadWithOptions(path, LoadOptions{AllowInsecure: true})
+	if err != nil {
+		t.Fatalf("with AllowInsecure: unexpected error: %v", err)
+	}
+	if !cfg.Clusters["kind"].InsecureSkipTLSVerify {
+		t.Error("insecure_skip_tls_verify not set")
+	}
+}
+
+func TestLoadWithOptions_AllowEmpty(t *testing.T) {
+	cfg, err := LoadWithOptions("/nonexistent/path/config.yaml", LoadOptions{AllowEmpty: true})
+	if err != nil {
+		t.Fatalf("missing file with AllowEmpty: unexpected error: %v", err)
+	}
+	if cfg.Clusters == nil || len(cfg.Clusters) != 0 {
+		t.Errorf("clusters = %v, want empty map", cfg.Clusters)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("clusters: {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadWithOptions(path, LoadOptions{AllowEmpty: true}); err != nil {
+		t.Errorf("empty clusters with AllowEmpty: unexpected error: %v", err)
+	}
+
+	// Invalid YAML is still an error
+	if err := os.WriteFile(path, []byte("not: valid: yaml: [[["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadWithOptions(path, LoadOptions{AllowEmpty: true}); err == nil {
+		t.Error("invalid YAML with AllowEmpty: expected error, got nil")
+	}
+}
+
 // Helper functions
 
 func loadFromString(t *testing.T, content string) *Config {
@@ -218,3 +941,563 @@ func loadFromStringErr(content string) (*Config, error) {
 
 	return Load(path)
 }
+
+func TestLoad_CircuitBreaker(t *testing.T) {
+	cfg := loadFromString(t, `
+circuit_breaker:
+  open_duration: 1m
+clusters:
+  a:
+    issuer: https://a.example.com
+`)
+	if got := cfg.CircuitBreaker.GetFailureThreshold(); got != DefaultCircuitFailureThreshold {
+		t.Errorf("failure threshold = %d, want default %d", got, DefaultCircuitFailureThreshold)
+	}
+	if got := cfg.CircuitBreaker.GetOpenDuration(); got != time.Minute {
+		t.Errorf("open duration = %v, want 1m", got)
+	}
+
+	if _, err := loadFromStringErr(`
+circuit_breaker:
+  failure_threshold: -1
+clusters:
+  a:
+    issuer: https://a.example.com
+`); err == nil {
+		t.Error("expected error for negative failure_threshold")
+	}
+}
+
+func TestLoad_Heartbeat(t *testing.T) {
+	cfg := loadFromString(t, `
+heartbeat:
+  stale_after: 30m
+clusters:
+  a:
+    issuer: https://a.example.com
+`)
+	if got := cfg.GetHeartbeatInterval(); got != 10*time.Minute {
+		t.Errorf("interval = %v, want a third of stale_after", got)
+	}
+
+	if _, err := loadFromStringErr(`
+heartbeat:
+  stale_after: 5m
+  interval: 10m
+clusters:
+  a:
+    issuer: https://a.example.com
+`); err == nil {
+		t.Error("expected error for an interval longer than stale_after")
+	}
+
+	if _, err := loadFromStringErr(`
+heartbeat:
+  allowed_callers: ["system:serviceaccount:["]
+clusters:
+  a:
+    issuer: https://a.example.com
+`); err == nil {
+		t.Error("expected error for an invalid allowed_callers pattern")
+	}
+}
+
+func TestClusterFromHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    string
+		ok      bool
+	}{
+		{"", "api.cluster-b.kube-fed", "", false},
+		{"api.{cluster}.kube-fed", "api.kube-fed", "local", true},
+		{"api.{cluster}.kube-fed", "api.cluster-b.kube-fed:8080", "cluster-b", true},
+		{"api.{cluster}.kube-fed", "API.Cluster-B.kube-fed.", "cluster-b", true},
+		{"api.{cluster}.kube-fed", "api.cluster-b.kube-fed.svc.cluster.local", "", false},
+		{"api.{cluster}.kube-fed", "api.kube-fed.svc.cluster.local", "", false},
+		{"api.{cluster}.kube-fed", "api.x.cluster-b.kube-fed", "", false},
+		{"api.{cluster}.kube-fed", "api.cluster-b.other.svc", "", false},
+		{"api.{cluster}.kube-fed", "example.com", "", false},
+		{"{cluster}.auth.example.com", "auth.example.com", "local", true},
+		{"{cluster}.auth.example.com", "prod.auth.example.com:443", "prod", true},
+		{"{cluster}.auth.example.com", "prod.auth.example.com.other.net", "", false},
+		{"{cluster}.auth.example.com", "prod.other.example.com", "", false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{HostPattern: tt.pattern}
+		got, ok := cfg.ClusterFromHost(tt.host)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("pattern %q: ClusterFromHost(%q) = %q, %v, want %q, %v", tt.pattern, tt.host, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	for _, pattern := range []string{"none", "auth.example.com", "x{cluster}.example.com", "{cluster}.{cluster}.example.com"} {
+		if _, err := loadFromStringErr("host_pattern: \"" + pattern + "\"\nclusters:\n  a:\n    issuer: https://a.example.com\n"); err == nil {
+			t.Errorf("expected error for host_pattern %q", pattern)
+		}
+	}
+}
+
+func TestLoad_UsernameTemplate(t *testing.T) {
+	cfg := loadFromString(t, `
+clusters:
+  a:
+    issuer: https://a.example.com
+    username_template: "fed:{cluster}:{subject}"
+  b:
+    issuer: https://b.example.com
+`)
+	a, b := cfg.Clusters["a"], cfg.Clusters["b"]
+	if got := a.Username("a", "system:serviceaccount:default:app"); got != "fed:a:system:serviceaccount:default:app" {
+		t.Errorf("templated username = %q", got)
+	}
+	if got := b.Username("b", "system:serviceaccount:default:app"); got != "system:serviceaccount:default:app" {
+		t.Errorf("untemplated username = %q", got)
+	}
+
+	for _, tmpl := range []string{"fed:{cluster}", "fed:{namespace}:{subject}", "fed:{subject"} {
+		if _, err := loadFromStringErr("clusters:\n  a:\n    issuer: https://a.example.com\n    username_template: \"" + tmpl + "\"\n"); err == nil {
+			t.Errorf("expected error for username_template %q", tmpl)
+		}
+	}
+}
+
+func TestFederatedGroups(t *testing.T) {
+	cfg := loadFromString(t, `
+group_templates:
+  - "federated:cluster:{cluster}"
+  - "federated:namespace:{cluster}:{namespace}"
+clusters:
+  a:
+    issuer: https://a.example.com
+`)
+	got := cfg.FederatedGroups("a", "payments", "app")
+	if want := []string{"federated:cluster:a", "federated:namespace:a:payments"}; !slices.Equal(got, want) {
+		t.Errorf("ServiceAccount groups = %v, want %v", got, want)
+	}
+	// Namespace templates do not apply to other users
+	got = cfg.FederatedGroups("a", "", "")
+	if want := []string{"federated:cluster:a"}; !slices.Equal(got, want) {
+		t.Errorf("user groups = %v, want %v", got, want)
+	}
+
+	if _, err := loadFromStringErr("group_templates: [\"federated:{pod}\"]\nclusters:\n  a:\n    issuer: https://a.example.com\n"); err == nil {
+		t.Error("expected error for an unknown placeholder")
+	}
+}
+
+func TestLoad_Authorization(t *testing.T) {
+	cfg := loadFromString(t, `
+authorization:
+  rules:
+  - decision: deny
+    resources: ["secrets"]
+  - clusters: ["a"]
+    users: ["system:serviceaccount:ci:*"]
+    verbs: ["get", "list"]
+    resources: ["pods"]
+clusters:
+  a:
+    issuer: https://a.example.com
+`)
+	if rules := cfg.Authorization.Rules; len(rules) != 2 || rules[0].Decision != AuthorizationDeny || rules[1].Clusters[0] != "a" {
+		t.Errorf("rules = %+v", cfg.Authorization.Rules)
+	}
+
+	for name, rule := range map[string]string{
+		"unknown decision":  `decision: maybe`,
+		"unknown cluster":   `clusters: ["b"]`,
+		"mixed rule kinds":  `{resources: ["pods"], non_resource_urls: ["/healthz"]}`,
+		"malformed pattern": `users: ["[ci"]`,
+	} {
+		if _, err := loadFromStringErr("authorization:\n  rules:\n  - " + rule + "\nclusters:\n  a:\n    issuer: https://a.example.com\n"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoad_OIDCType(t *testing.T) {
+	cfg := loadFromString(t, `
+clusters:
+  dex:
+    type: oidc
+    issuer: https://dex.example.com
+    client_id: kube
+    required_claims:
+      hd: example.com
+`)
+	dex := cfg.Clusters["dex"]
+	if !dex.IsOIDC() || dex.ClientID != "kube" || dex.RequiredClaims["hd"] != "example.com" {
+		t.Errorf("dex = %+v", dex)
+	}
+
+	for name, yaml := range map[string]string{
+		"missing client_id": `
+clusters:
+  dex:
+    type: oidc
+    issuer: https://dex.example.com
+`,
+		"api_server": `
+clusters:
+  dex:
+    type: oidc
+    issuer: https://dex.example.com
+    client_id: kube
+    api_server: https://dex.example.com
+`,
+		"client_id on kubernetes": `
+clusters:
+  a:
+    issuer: https://a.example.com
+    client_id: kube
+`,
+		"unknown type": `
+clusters:
+  a:
+    type: saml
+    issuer: https://a.example.com
+`,
+	} {
+		if _, err := loadFromStringErr(yaml); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoad_ClientCert(t *testing.T) {
+	cfg := loadFromString(t, `
+clusters:
+  cluster-b:
+    issuer: https://kubernetes.default.svc.cluster.local
+    api_server: https://cluster-b:6443
+    ca_cert: /etc/kfa/certs/cluster-b-ca.crt
+    client_cert: /etc/kfa/certs/cluster-b-client.crt
+    client_key: /etc/kfa/certs/cluster-b-client.key
+`)
+	if b := cfg.Clusters["cluster-b"]; !b.HasBootstrapCredentials() {
+		t.Errorf("cluster-b has no bootstrap credentials: %+v", b)
+	}
+
+	for name, yaml := range map[string]string{
+		"cert without key": `
+clusters:
+  cluster-b:
+    issuer: https://kubernetes.default.svc.cluster.local
+    api_server: https://cluster-b:6443
+    client_cert: /etc/kfa/certs/cluster-b-client.crt
+`,
+		"without api_server": `
+clusters:
+  local:
+    issuer: https://kubernetes.default.svc.cluster.local
+    client_cert: /etc/kfa/certs/client.crt
+    client_key: /etc/kfa/certs/client.key
+`,
+	} {
+		if _, err := loadFromStringErr(yaml); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoad_Kubeconfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	for name, data := range map[string]string{"client.crt": "cert", "client.key": "key"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	if err := os.WriteFile(kubeconfig, []byte(`
+apiVersion: v1
+kind: Config
+current-context: token
+clusters:
+- name: cluster-b
+  cluster:
+    server: https://cluster-b:6443
+    certificate-authority-data: `+base64.StdEncoding.EncodeToString([]byte(ca))+`
+contexts:
+- name: token
+  context: {cluster: cluster-b, user: token}
+- name: cert
+  context: {cluster: cluster-b, user: cert}
+- name: exec
+  context: {cluster: cluster-b, user: exec}
+users:
+- name: token
+  user: {token: kubeconfig-token}
+- name: cert
+  user: {client-certificate: client.crt, client-key: client.key}
+- name: exec
+  user:
+    exec: {apiVersion: client.authentication.k8s.io/v1beta1, command: aws}
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := loadFromString(t, `
+clusters:
+  cluster-b:
+    issuer: https://kubernetes.default.svc.cluster.local
+    kubeconfig: `+kubeconfig+`
+  cluster-c:
+    issuer: https://kubernetes.default.svc.cluster.local
+    kubeconfig: `+kubeconfig+`
+    kubeconfig_context: cert
+    api_server: https://cluster-c.example.com
+`)
+	b := cfg.Clusters["cluster-b"]
+	if b.APIServer != "https://cluster-b:6443" || !b.HasBootstrapCredentials() {
+		t.Errorf("cluster-b = %+v", b)
+	}
+	if data, err := b.LoadCACert(); err != nil || string(data) != ca {
+		t.Errorf("cluster-b CA = %q, %v", data, err)
+	}
+	if token, err := b.LoadToken(); err != nil || string(token) != "kubeconfig-token" {
+		t.Errorf("cluster-b token = %q, %v", token, err)
+	}
+
+	c := cfg.Clusters["cluster-c"]
+	if c.APIServer != "https://cluster-c.example.com" {
+		t.Errorf("cluster-c api_server = %q, want the configured one", c.APIServer)
+	}
+	if cert, key, err := c.LoadClientCert(); err != nil || string(cert) != "cert" || string(key) != "key" {
+		t.Errorf("cluster-c client certificate = %q, %q, %v", cert, key, err)
+	}
+	if token, _ := c.LoadToken(); token != nil {
+		t.Errorf("cluster-c token = %q, want none", token)
+	}
+
+	exec := loadFromString(t, `
+clusters:
+  cluster-b:
+    issuer: https://kubernetes.default.svc.cluster.local
+    kubeconfig: `+kubeconfig+`
+    kubeconfig_context: exec
+`).Clusters["cluster-b"]
+	if exec.Exec == nil || exec.Exec.Command != "aws" || exec.HasBootstrapCredentials() {
+		t.Errorf("exec cluster = %+v, want the kubeconfig's exec plugin", exec)
+	}
+
+	for name, yaml := range map[string]string{
+		"unknown context": `
+clusters:
+  cluster-b:
+    issuer: https://kubernetes.default.svc.cluster.local
+    kubeconfig: ` + kubeconfig + `
+    kubeconfig_context: missing
+`,
+		"context without kubeconfig": `
+clusters:
+  cluster-b:
+    issuer: https://kubernetes.default.svc.cluster.local
+    kubeconfig_context: token
+`,
+	} {
+		if _, err := loadFromStringErr(yaml); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoad_Exec(t *testing.T) {
+	cfg := loadFromString(t, `
+clusters:
+  eks:
+    issuer: https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE
+    api_server: https://EXAMPLE.gr7.us-east-1.eks.amazonaws.com
+    exec:
+      command: aws-iam-authenticator
+      args: [token, -i, prod]
+      env: {AWS_PROFILE: prod}
+`)
+	if exec := cfg.Clusters["eks"].Exec; exec.GetAPIVersion() != DefaultExecAPIVersion || exec.Env["AWS_PROFILE"] != "prod" {
+		t.Errorf("exec = %+v", exec)
+	}
+
+	for name, yaml := range map[string]string{
+		"without command": `
+clusters:
+  eks:
+    issuer: https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE
+    api_server: https://EXAMPLE.gr7.us-east-1.eks.amazonaws.com
+    exec: {args: [token]}
+`,
+		"with token_path": `
+clusters:
+  eks:
+    issuer: https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE
+    api_server: https://EXAMPLE.gr7.us-east-1.eks.amazonaws.com
+    token_path: /etc/kfa/token
+    exec: {command: aws-iam-authenticator}
+`,
+		"unsupported api_version": `
+clusters:
+  eks:
+    issuer: https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE
+    api_server: https://EXAMPLE.gr7.us-east-1.eks.amazonaws.com
+    exec: {command: aws-iam-authenticator, api_version: client.authentication.k8s.io/v1alpha1}
+`,
+		"without api_server": `
+clusters:
+  eks:
+    issuer: https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE
+    exec: {command: aws-iam-authenticator}
+`,
+	} {
+		if _, err := loadFromStringErr(yaml); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoad_RenewalServiceAccount(t *testing.T) {
+	cfg := loadFromString(t, `
+clusters:
+  cluster-b:
+    issuer: https://b.example.com
+    api_server: https://192.168.1.100:6443
+    renewal_service_account: kube-federated-auth/reader
+`)
+	b := cfg.Clusters["cluster-b"]
+	if namespace, name := b.RenewalServiceAccountRef(); namespace != "kube-federated-auth" || name != "reader" {
+		t.Errorf("RenewalServiceAccountRef = %q, %q", namespace, name)
+	}
+
+	for name, yaml := range map[string]string{
+		"without namespace": `
+clusters:
+  cluster-b:
+    issuer: https://b.example.com
+    api_server: https://192.168.1.100:6443
+    renewal_service_account: reader
+`,
+		"without api_server": `
+clusters:
+  cluster-b:
+    issuer: https://b.example.com
+    renewal_service_account: kube-federated-auth/reader
+`,
+	} {
+		if _, err := loadFromStringErr(yaml); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoad_PublicType(t *testing.T) {
+	cfg := loadFromString(t, `
+clusters:
+  eks-prod:
+    type: public
+    issuer: https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE
+`)
+	eks := cfg.Clusters["eks-prod"]
+	if !eks.IsPublic() || eks.HasTokenReviewAPI() || eks.IsRemote() {
+		t.Errorf("eks-prod = %+v", eks)
+	}
+
+	for name, yaml := range map[string]string{
+		"api_server": `
+clusters:
+  eks:
+    type: public
+    issuer: https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE
+    api_server: https://EXAMPLE.gr7.us-east-1.eks.amazonaws.com
+`,
+		"ca_cert": `
+clusters:
+  eks:
+    type: public
+    issuer: https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE
+    ca_cert: /etc/kfa/ca.crt
+`,
+		"fallback": `
+clusters:
+  eks:
+    type: public
+    issuer: https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE
+    fallback: tokenreview
+`,
+	} {
+		if _, err := loadFromStringErr(yaml); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoad_KeySnapshot(t *testing.T) {
+	cfg := loadFromString(t, `
+clusters:
+  prod:
+    issuer: https://prod.example.com
+    key_snapshot:
+      path: /etc/kfa/keys.json
+      max_age: 72h
+`)
+	prod := cfg.Clusters["prod"]
+	if prod.KeySnapshot == nil || prod.KeySnapshot.MaxAge != 72*time.Hour || prod.HasTokenReviewAPI() {
+		t.Errorf("prod = %+v", prod)
+	}
+
+	for name, yaml := range map[string]string{
+		"missing path": `
+clusters:
+  prod:
+    issuer: https://prod.example.com
+    key_snapshot:
+      max_age: 72h
+`,
+		"with jwks_file": `
+clusters:
+  prod:
+    issuer: https://prod.example.com
+    jwks_file: /etc/kfa/prod.jwks
+    key_snapshot:
+      path: /etc/kfa/keys.json
+`,
+		"with fallback": `
+clusters:
+  prod:
+    issuer: https://prod.example.com
+    fallback: tokenreview
+    key_snapshot:
+      path: /etc/kfa/keys.json
+`,
+	} {
+		if _, err := loadFromStringErr(yaml); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoad_Fallback(t *testing.T) {
+	cfg := loadFromString(t, `
+clusters:
+  b:
+    issuer: https://b.example.com
+    api_server: https://b.example.com:6443
+    fallback: tokenreview
+  a:
+    issuer: https://a.example.com
+    api_server: https://a.example.com:6443
+    fallback: tokenreview
+  c:
+    issuer: https://c.example.com
+`)
+	if got := cfg.FallbackClusters(); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("FallbackClusters() = %v, want [a b]", got)
+	}
+
+	if _, err := loadFromStringErr(`
+clusters:
+  a:
+    issuer: https://a.example.com
+    fallback: webhook
+`); err == nil {
+		t.Error("expected error for unknown fallback")
+	}
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rophy/kube-federated-auth/internal/redact"
+)
+
+// Effective returns a copy of c as it is applied at runtime: issuer templates
+// are expanded, the global clock skew is merged into each cluster, defaults
+// are filled in, and secrets (webhook URLs, Sentry DSN, PagerDuty routing
+// keys, exec plugin environment values) are replaced with redact.Placeholder. The result loads with Load and
+// behaves the same, except for the redacted destinations.
+func (c *Config) Effective() (*Config, error) {
+	// Round-trip through YAML for a deep copy
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var e Config
+	if err := yaml.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("copying config: %w", err)
+	}
+
+	e.Renewal = &RenewalSettings{
+		Interval:      c.GetRenewalInterval(),
+		TokenDuration: c.GetRenewalTokenDuration(),
+		RenewBefore:   c.GetRenewalRenewBefore(),
+	}
+	minHealthy := c.GetMinHealthyClusters()
+	e.Readiness = &ReadinessSettings{MinHealthyClusters: &minHealthy, Timeout: c.GetProbeTimeout()}
+	for endpoint := range e.Limits {
+		e.Limits[endpoint] = c.GetLimit(endpoint)
+	}
+	if interval := c.GetJWKSRefreshInterval(); interval > 0 {
+		e.JWKS = &JWKSSettings{RefreshInterval: interval, Jitter: c.GetJWKSJitter()}
+	}
+	if e.Canary != nil {
+		e.Canary.Interval = e.Canary.GetInterval()
+	}
+	if e.CredentialCheck != nil {
+		e.CredentialCheck.Interval = e.CredentialCheck.GetInterval()
+	}
+	if e.ExpiryAlerts != nil {
+		e.ExpiryAlerts.Interval = e.ExpiryAlerts.GetInterval()
+		e.ExpiryAlerts.WarnBefore = e.ExpiryAlerts.GetWarnBefore()
+	}
+	if e.CircuitBreaker != nil {
+		e.CircuitBreaker.FailureThreshold = e.CircuitBreaker.GetFailureThreshold()
+		e.CircuitBreaker.OpenDuration = e.CircuitBreaker.GetOpenDuration()
+	}
+	if e.NegativeCache != nil {
+		e.NegativeCache.TTL = e.NegativeCache.GetTTL()
+		e.NegativeCache.MaxEntries = e.NegativeCache.GetMaxEntries()
+	}
+	if e.Mirror != nil {
+		e.Mirror.Timeout = e.Mirror.GetTimeout()
+	}
+	if e.Replay != nil {
+		e.Replay.MaxRecords = e.Replay.GetMaxRecords()
+	}
+
+	// Templates are resolved into each cluster's issuer
+	e.IssuerTemplates = nil
+	for name, cluster := range e.Clusters {
+		cluster.IssuerTemplate = ""
+		cluster.Vars = nil
+		cluster.ClockSkew = c.GetClockSkew(name)
+		cluster.UpstreamTimeout = cluster.GetUpstreamTimeout()
+		if cluster.Exec != nil {
+			cluster.Exec.APIVersion = cluster.Exec.GetAPIVersion()
+			for key := range cluster.Exec.Env {
+				cluster.Exec.Env[key] = redact.Placeholder
+			}
+		}
+		e.Clusters[name] = cluster
+	}
+	e.ClockSkew = 0
+
+	if e.Audit != nil {
+		redactString(&e.Audit.WebhookURL)
+	}
+	if e.Events != nil {
+		redactString(&e.Events.WebhookURL)
+	}
+	if e.ErrorReporting != nil {
+		e.ErrorReporting.Threshold = e.ErrorReporting.GetThreshold()
+		redactString(&e.ErrorReporting.WebhookURL)
+		redactString(&e.ErrorReporting.SentryDSN)
+	}
+	if e.Notifications != nil {
+		for name, ch := range e.Notifications.Channels {
+			redactString(&ch.URL)
+			redactString(&ch.RoutingKey)
+			if ch.SMTP != nil && ch.SMTP.Port == 0 {
+				ch.SMTP.Port = DefaultSMTPPort
+			}
+			e.Notifications.Channels[name] = ch
+		}
+	}
+	return &e, nil
+}
+
+func redactString(s *string) {
+	if *s != "" {
+		*s = redact.Placeholder
+	}
+}
+
+// EffectiveYAML renders c.Effective() as YAML. Map keys are sorted, so the
+// output is deterministic for a given configuration.
+func (c *Config) EffectiveYAML() ([]byte, error) {
+	e, err := c.Effective()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(e); err != nil {
+		return nil, fmt.Errorf("encoding config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("encoding config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// applyKubeconfig fills the cluster's API server, CA certificate and
+// credentials (a token, client certificate or exec plugin) from its
+// kubeconfig. Fields set in the config file take precedence; the credentials
+// are only taken if none of token_path, client_cert and exec is set.
+func (c *ClusterConfig) applyKubeconfig() error {
+	if c.Kubeconfig == "" {
+		if c.KubeconfigContext != "" {
+			return fmt.Errorf("kubeconfig_context requires kubeconfig")
+		}
+		return nil
+	}
+
+	raw, err := clientcmd.LoadFromFile(c.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("kubeconfig: %w", err)
+	}
+	// Paths in the kubeconfig are relative to its own location
+	if err := clientcmd.ResolveLocalPaths(raw); err != nil {
+		return fmt.Errorf("kubeconfig: %w", err)
+	}
+	restConfig, err := clientcmd.NewNonInteractiveClientConfig(*raw, c.KubeconfigContext, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+	if err != nil {
+		return fmt.Errorf("kubeconfig: %w", err)
+	}
+	if err := rest.LoadTLSFiles(restConfig); err != nil {
+		return fmt.Errorf("kubeconfig: %w", err)
+	}
+
+	if c.APIServer == "" {
+		c.APIServer = restConfig.Host
+	}
+	if !c.HasCACert() && len(restConfig.CAData) > 0 {
+		c.CACertData = string(restConfig.CAData)
+	}
+	if restConfig.Insecure {
+		c.InsecureSkipTLSVerify = true
+	}
+
+	if c.TokenPath != "" || c.ClientCert != "" || c.Exec != nil {
+		return nil
+	}
+	if restConfig.AuthProvider != nil {
+		return fmt.Errorf("kubeconfig: auth-provider credentials are not supported")
+	}
+	if exec := restConfig.ExecProvider; exec != nil {
+		c.Exec = &ExecSettings{Command: exec.Command, Args: exec.Args, APIVersion: exec.APIVersion}
+		for _, env := range exec.Env {
+			if c.Exec.Env == nil {
+				c.Exec.Env = make(map[string]string)
+			}
+			c.Exec.Env[env.Name] = env.Value
+		}
+		return nil
+	}
+	if restConfig.BearerTokenFile != "" {
+		// Reread like token_path, so that rotations of the file apply
+		c.TokenPath = restConfig.BearerTokenFile
+	} else {
+		c.token = restConfig.BearerToken
+	}
+	c.clientCertData, c.clientKeyData = restConfig.CertData, restConfig.KeyData
+	return nil
+}
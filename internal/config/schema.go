@@ -0,0 +1,81 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SchemaID identifies the generated config schema
+const SchemaID = "https://github.com/rophy/kube-federated-auth/config.schema.json"
+
+// durationPattern matches strings accepted by time.ParseDuration
+const durationPattern = `^-?([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+// Schema returns a JSON Schema (draft 2020-12) for the config file, generated
+// from the Config struct and its yaml tags. Fields tagged jsonschema:"required"
+// are required; unknown keys are rejected so typos surface during validation.
+// Semantic checks (CEL compilation, cross-references) remain in Load.
+func Schema() map[string]any {
+	schema := schemaFor(reflect.TypeOf(Config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = SchemaID
+	schema["title"] = "kube-federated-auth configuration"
+	return schema
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func schemaFor(t reflect.Type) map[string]any {
+	if t == durationType {
+		return map[string]any{"type": "string", "pattern": durationPattern}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	return map[string]any{}
+}
+
+func structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		properties[name] = schemaFor(field.Type)
+		if field.Tag.Get("jsonschema") == "required" {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkSchema validates doc against the subset of JSON Schema emitted by Schema
+func checkSchema(schema map[string]any, doc any, path string) error {
+	switch schema["type"] {
+	case "object":
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected object", path)
+		}
+		if required, ok := schema["required"].([]string); ok {
+			for _, key := range required {
+				if _, ok := obj[key]; !ok {
+					return fmt.Errorf("%s: missing required %q", path, key)
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		for key, value := range obj {
+			sub, ok := props[key].(map[string]any)
+			if !ok {
+				extra, ok := schema["additionalProperties"].(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s: unknown key %q", path, key)
+				}
+				sub = extra
+			}
+			if err := checkSchema(sub, value, path+"."+key); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := doc.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected array", path)
+		}
+		for i, item := range items {
+			if err := checkSchema(schema["items"].(map[string]any), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := doc.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected string", path)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			return fmt.Errorf("%s: %q does not match %s", path, s, pattern)
+		}
+	case "integer":
+		if _, ok := doc.(int); !ok {
+			return fmt.Errorf("%s: expected integer", path)
+		}
+	}
+	return nil
+}
+
+func TestSchema_ExampleConfig(t *testing.T) {
+	data, err := os.ReadFile("../../config/clusters.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchema(Schema(), doc, "$"); err != nil {
+		t.Errorf("example config does not match schema: %v", err)
+	}
+}
+
+func TestSchema_Rejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown cluster key", `
+clusters:
+  a:
+    isuer: "https://a.example.com"`},
+		{"missing clusters", `
+renewal:
+  interval: "1h"`},
+		{"bad duration", `
+canary:
+  interval: "5 minutes"
+clusters: {}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc map[string]any
+			if err := yaml.Unmarshal([]byte(tt.content), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if err := checkSchema(Schema(), doc, "$"); err == nil {
+				t.Error("expected schema violation, got nil")
+			}
+		})
+	}
+
+	if required, _ := Schema()["required"].([]string); !slices.Contains(required, "clusters") {
+		t.Errorf("required = %v, want clusters", required)
+	}
+}
@@ -0,0 +1,118 @@
+// Package credcheck periodically exercises each remote cluster's stored
+// credentials against its discovery endpoint, so that revoked or expired
+// credentials are flagged and the verifier recreated instead of verification
+// silently failing until someone notices.
+package credcheck
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/events"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+// Verifier probes a cluster with its current credentials and drops its
+// cached verifier
+type Verifier interface {
+	Probe(ctx context.Context, clusterName string) error
+	InvalidateVerifier(clusterName string)
+}
+
+// Checker runs the credential checks
+type Checker struct {
+	config   *config.Config
+	verifier Verifier
+	recorder *events.Recorder
+
+	mu        sync.Mutex
+	unhealthy map[string]bool
+}
+
+// New creates a credential checker. recorder may be nil.
+func New(cfg *config.Config, verifier Verifier, recorder *events.Recorder) *Checker {
+	return &Checker{
+		config:    cfg,
+		verifier:  verifier,
+		recorder:  recorder,
+		unhealthy: make(map[string]bool),
+	}
+}
+
+// Start begins the check loops for all remote clusters
+func (c *Checker) Start(ctx context.Context) {
+	interval := c.config.CredentialCheck.GetInterval()
+	for clusterName, clusterCfg := range c.config.Clusters {
+		if clusterCfg.IsRemote() {
+			go c.checkLoop(ctx, clusterName, interval)
+		}
+	}
+}
+
+func (c *Checker) checkLoop(ctx context.Context, cluster string, interval time.Duration) {
+	log.Printf("Starting credential checks for cluster %s (interval: %s)", cluster, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.check(ctx, cluster)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("Stopping credential checks for cluster %s", cluster)
+			return
+		}
+	}
+}
+
+// check probes cluster once. Rejected credentials mark the cluster unhealthy
+// and invalidate its verifier; other failures (e.g. the API server being
+// unreachable) say nothing about the credentials and leave the state as is.
+func (c *Checker) check(ctx context.Context, cluster string) {
+	err := c.verifier.Probe(ctx, cluster)
+	switch {
+	case err == nil:
+		metrics.CredentialChecks.WithLabelValues(cluster, "ok").Inc()
+		metrics.CredentialsHealthy.WithLabelValues(cluster).Set(1)
+		if c.setUnhealthy(cluster, false) {
+			log.Printf("Credentials for cluster %s are accepted again", cluster)
+			c.recorder.Normal(cluster, events.ReasonCredentialsHealthy, "stored credentials accepted again")
+		}
+	case errors.Is(err, oidc.ErrCredentialsRejected):
+		metrics.CredentialChecks.WithLabelValues(cluster, "rejected").Inc()
+		metrics.CredentialsHealthy.WithLabelValues(cluster).Set(0)
+		if !c.setUnhealthy(cluster, true) {
+			log.Printf("Warning: cluster %s rejected its stored credentials: %v", cluster, err)
+			c.recorder.Warning(cluster, events.ReasonCredentialsRejected, "%v", err)
+			// Drop the verifier so that it is recreated with whatever
+			// credentials are current, rather than kept on cached keys
+			c.verifier.InvalidateVerifier(cluster)
+			c.recorder.Normal(cluster, events.ReasonVerifierInvalidated, "cached verifier dropped after credentials were rejected")
+		}
+	default:
+		metrics.CredentialChecks.WithLabelValues(cluster, "error").Inc()
+		log.Printf("Credential check failed for cluster %s: %v", cluster, err)
+	}
+}
+
+// setUnhealthy records the cluster's state and returns the previous one
+func (c *Checker) setUnhealthy(cluster string, unhealthy bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	was := c.unhealthy[cluster]
+	c.unhealthy[cluster] = unhealthy
+	return was
+}
+
+// Unhealthy reports whether cluster rejected its credentials at the last check
+func (c *Checker) Unhealthy(cluster string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.unhealthy[cluster]
+}
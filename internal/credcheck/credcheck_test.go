@@ -0,0 +1,51 @@
+package credcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+type fakeVerifier struct {
+	err         error
+	invalidated int
+}
+
+func (f *fakeVerifier) Probe(ctx context.Context, clusterName string) error { return f.err }
+
+func (f *fakeVerifier) InvalidateVerifier(clusterName string) { f.invalidated++ }
+
+func TestCheck(t *testing.T) {
+	verifier := &fakeVerifier{}
+	c := New(&config.Config{}, verifier, nil)
+	rejected := fmt.Errorf("fetching OIDC discovery: %w", fmt.Errorf("%w: discovery returned status 401", oidc.ErrCredentialsRejected))
+
+	steps := []struct {
+		name            string
+		err             error
+		wantUnhealthy   bool
+		wantInvalidated int
+	}{
+		{"ok", nil, false, 0},
+		{"unreachable", errors.New("connection refused"), false, 0},
+		{"rejected", rejected, true, 1},
+		{"still rejected", rejected, true, 1},
+		{"unreachable while rejected", errors.New("connection refused"), true, 1},
+		{"recovered", nil, false, 1},
+		{"rejected again", rejected, true, 2},
+	}
+	for _, step := range steps {
+		verifier.err = step.err
+		c.check(context.Background(), "remote")
+		if got := c.Unhealthy("remote"); got != step.wantUnhealthy {
+			t.Errorf("%s: Unhealthy = %v, want %v", step.name, got, step.wantUnhealthy)
+		}
+		if verifier.invalidated != step.wantInvalidated {
+			t.Errorf("%s: invalidations = %d, want %d", step.name, verifier.invalidated, step.wantInvalidated)
+		}
+	}
+}
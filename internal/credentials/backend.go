@@ -0,0 +1,160 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// ErrNotFound is returned by Backend.Get for a cluster without stored credentials
+var ErrNotFound = errors.New("credentials not found")
+
+// Backend persists cluster credentials outside the process. Implementations
+// must be safe for concurrent use.
+type Backend interface {
+	// Get returns a cluster's stored credentials, or ErrNotFound
+	Get(ctx context.Context, cluster string) (*Credentials, error)
+	// Set stores a cluster's credentials, leaving other clusters untouched
+	Set(ctx context.Context, cluster string, creds *Credentials) error
+	// Delete removes a cluster's credentials; deleting missing ones is not an error
+	Delete(ctx context.Context, cluster string) error
+	// List returns the credentials of all clusters
+	List(ctx context.Context) (map[string]*Credentials, error)
+	// Watch calls onChange with the credentials of all clusters whenever the
+	// stored credentials change, including through other writers, until ctx
+	// is done
+	Watch(ctx context.Context, onChange func(map[string]*Credentials)) error
+}
+
+// Backend kinds, selected with the server's --credential-backend flag
+const (
+	// BackendSecret stores all clusters in one Kubernetes Secret (the default)
+	BackendSecret = "secret"
+	// BackendSecrets stores each cluster in its own Kubernetes Secret
+	BackendSecrets = "secrets"
+	// BackendFile stores clusters as files in a directory, with the key
+	// layout of the Secret, e.g. a persistent volume
+	BackendFile = "file"
+	// BackendNone keeps credentials in memory only
+	BackendNone = "none"
+)
+
+// BackendKinds lists the valid --credential-backend values
+var BackendKinds = []string{BackendSecret, BackendSecrets, BackendFile, BackendNone}
+
+// BackendOptions configure the backend selected by kind
+type BackendOptions struct {
+	// Namespace and SecretName locate the Secret of BackendSecret; SecretName
+	// is also the name prefix of the Secrets of BackendSecrets
+	Namespace  string
+	SecretName string
+	// Dir is the directory of BackendFile
+	Dir string
+	// SecretMetadata is applied to the Secrets of the Secret backends
+	SecretMetadata SecretMetadata
+}
+
+// NewBackend creates the backend of the given kind. The Secret backends are
+// only available in-cluster; elsewhere NewBackend logs and returns a nil
+// Backend, and credentials are not persisted.
+func NewBackend(kind string, opts BackendOptions) (Backend, error) {
+	switch kind {
+	case BackendSecret, BackendSecrets, "":
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			log.Printf("Not running in cluster, credentials will not be persisted (use the %s backend outside Kubernetes): %v", BackendFile, err)
+			return nil, nil
+		}
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			log.Printf("Failed to create Kubernetes client, credentials will not be persisted: %v", err)
+			return nil, nil
+		}
+		if kind == BackendSecrets {
+			return NewSecretsBackend(client, opts.Namespace, opts.SecretName).WithMetadata(opts.SecretMetadata), nil
+		}
+		return NewSecretBackend(client, opts.Namespace, opts.SecretName).WithMetadata(opts.SecretMetadata), nil
+	case BackendFile:
+		if opts.Dir == "" {
+			return nil, fmt.Errorf("the file credential backend requires a directory")
+		}
+		return NewFileBackend(opts.Dir)
+	case BackendNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown credential backend %q (valid: %s)", kind, strings.Join(BackendKinds, ", "))
+}
+
+// credentialKeys returns all data keys that can hold a cluster's credentials
+func credentialKeys(cluster string) []string {
+	return []string{TokenKey(cluster), CACertKey(cluster), ClientCertKey(cluster), ClientKeyKey(cluster), HistoryKey(cluster), ClusterMetadataKey(cluster)}
+}
+
+// setCredentialData sets a cluster's keys in data, removing those of
+// credentials it does not have, e.g. the client certificate of a token-only
+// cluster
+func setCredentialData(data map[string][]byte, cluster string, creds *Credentials) {
+	for _, key := range credentialKeys(cluster) {
+		delete(data, key)
+	}
+	data[CACertKey(cluster)] = creds.CACert
+	if creds.Token != "" {
+		data[TokenKey(cluster)] = []byte(creds.Token)
+	}
+	if len(creds.ClientCert) > 0 {
+		data[ClientCertKey(cluster)] = creds.ClientCert
+		data[ClientKeyKey(cluster)] = creds.ClientKey
+	}
+	if len(creds.History) > 0 {
+		if history, err := json.Marshal(creds.History); err == nil {
+			data[HistoryKey(cluster)] = history
+		}
+	}
+	if creds.Metadata != nil {
+		if metadata, err := json.Marshal(creds.Metadata); err == nil {
+			data[ClusterMetadataKey(cluster)] = metadata
+		}
+	}
+}
+
+// parseCredentialData extracts clusters' credentials from data keyed by
+// TokenKey, CACertKey, ClientCertKey and ClientKeyKey, with their HistoryKey
+// and ClusterMetadataKey if any. Clusters without a CA
+// certificate, or with neither a token nor a client certificate and key, are
+// skipped.
+func parseCredentialData(data map[string][]byte, source string) map[string]*Credentials {
+	clusters := make(map[string]bool)
+	for key := range data {
+		for _, suffix := range []string{"-token", "-ca.crt", "-client.crt", "-client.key"} {
+			if cluster, ok := strings.CutSuffix(key, suffix); ok {
+				clusters[cluster] = true
+			}
+		}
+	}
+
+	result := make(map[string]*Credentials, len(clusters))
+	for cluster := range clusters {
+		token, hasToken := data[TokenKey(cluster)]
+		ca, hasCA := data[CACertKey(cluster)]
+		cert, hasCert := data[ClientCertKey(cluster)]
+		key, hasKey := data[ClientKeyKey(cluster)]
+		if hasCA && (hasToken || hasCert && hasKey) {
+			result[cluster] = &Credentials{
+				Token:      string(token),
+				CACert:     ca,
+				ClientCert: cert,
+				ClientKey:  key,
+				Source:     source,
+				History:    DecodeHistory(cluster, data[HistoryKey(cluster)]),
+				Metadata:   DecodeClusterMetadata(cluster, data[ClusterMetadataKey(cluster)]),
+			}
+		}
+	}
+	return result
+}
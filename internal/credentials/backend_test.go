@@ -0,0 +1,406 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testBackend(t *testing.T, b Backend) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := b.Get(ctx, "cluster-b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get before Set: err = %v, want ErrNotFound", err)
+	}
+	for _, cluster := range []string{"cluster-b", "cluster-c"} {
+		if err := b.Set(ctx, cluster, &Credentials{Token: cluster + "-token", CACert: []byte(cluster + "-ca")}); err != nil {
+			t.Fatalf("Set(%s): %v", cluster, err)
+		}
+	}
+
+	creds, err := b.Get(ctx, "cluster-b")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if creds.Token != "cluster-b-token" || string(creds.CACert) != "cluster-b-ca" {
+		t.Errorf("Get = %+v", creds)
+	}
+
+	if err := b.Delete(ctx, "cluster-b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := b.Delete(ctx, "cluster-b"); err != nil {
+		t.Errorf("Delete of missing credentials: %v", err)
+	}
+	all, err := b.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(all) != 1 || all["cluster-c"] == nil || all["cluster-c"].Token != "cluster-c-token" {
+		t.Errorf("List = %+v, want only cluster-c", all)
+	}
+
+	// Client certificate credentials, without a token
+	certOnly := &Credentials{CACert: []byte("ca"), ClientCert: []byte("cert"), ClientKey: []byte("key")}
+	if err := b.Set(ctx, "cluster-e", certOnly); err != nil {
+		t.Fatalf("Set client certificate: %v", err)
+	}
+	creds, err = b.Get(ctx, "cluster-e")
+	if err != nil {
+		t.Fatalf("Get client certificate: %v", err)
+	}
+	if creds.Token != "" || string(creds.ClientCert) != "cert" || string(creds.ClientKey) != "key" {
+		t.Errorf("Get client certificate = %+v", creds)
+	}
+	// Switching to a token drops the certificate
+	if err := b.Set(ctx, "cluster-e", &Credentials{Token: "t", CACert: []byte("ca")}); err != nil {
+		t.Fatal(err)
+	}
+	if creds, err = b.Get(ctx, "cluster-e"); err != nil || creds.ClientCert != nil || creds.ClientKey != nil {
+		t.Errorf("Get after switching to a token = %+v, %v", creds, err)
+	}
+	if err := b.Delete(ctx, "cluster-e"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecretBackend(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "kfa", Namespace: "kfa"},
+		Data:       map[string][]byte{"unrelated": []byte("kept")},
+	})
+	b := NewSecretBackend(client, "kfa", "kfa")
+	testBackend(t, b)
+
+	secret, err := client.CoreV1().Secrets("kfa").Get(context.Background(), "kfa", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["unrelated"]) != "kept" {
+		t.Errorf("unrelated key = %q, want it preserved", secret.Data["unrelated"])
+	}
+}
+
+func TestSecretBackend_CreatesSecret(t *testing.T) {
+	testBackend(t, NewSecretBackend(fake.NewSimpleClientset(), "kfa", "kfa"))
+}
+
+func TestSecretBackend_ConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	// Another replica creates the Secret after our first read, then updates
+	// it between our next read and write
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "kfa", Namespace: "kfa"},
+		Data:       map[string][]byte{TokenKey("cluster-d"): []byte("d"), CACertKey("cluster-d"): []byte("ca")},
+	})
+	b := NewSecretBackend(client, "kfa", "kfa")
+	read, updated := false, false
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !read {
+			read = true
+			return true, nil, apierrors.NewNotFound(corev1.Resource("secrets"), "kfa")
+		}
+		return false, nil, nil
+	})
+	client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !updated {
+			updated = true
+			return true, nil, apierrors.NewConflict(corev1.Resource("secrets"), "kfa", errors.New("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+
+	if err := b.Set(ctx, "cluster-b", &Credentials{Token: "b", CACert: []byte("ca")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	all, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all["cluster-b"] == nil || all["cluster-d"] == nil {
+		t.Errorf("List = %v, want both writers' clusters", all)
+	}
+	if !read || !updated {
+		t.Errorf("read = %t, updated = %t, want both conflicts hit", read, updated)
+	}
+}
+
+func TestSecretsBackend(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		// Another instance's credentials in the same namespace
+		ObjectMeta: metav1.ObjectMeta{Name: "other-cred-cluster-d", Namespace: "kfa", Labels: map[string]string{LabelCredentials: "other", LabelCluster: "cluster-d"}},
+		Data:       map[string][]byte{"token": []byte("t"), "ca.crt": []byte("c")},
+	})
+	b := NewSecretsBackend(client, "kfa", "kfa")
+	testBackend(t, b)
+
+	secret, err := client.CoreV1().Secrets("kfa").Get(context.Background(), "kfa-cred-cluster-c", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("per-cluster secret: %v", err)
+	}
+	if secret.Labels[LabelCluster] != "cluster-c" || secret.Labels[LabelCredentials] != "kfa" {
+		t.Errorf("labels = %v", secret.Labels)
+	}
+	if _, err := client.CoreV1().Secrets("kfa").Get(context.Background(), "kfa-cred-cluster-b", metav1.GetOptions{}); err == nil {
+		t.Error("secret of deleted cluster-b still exists")
+	}
+
+	if err := b.Set(context.Background(), "Cluster_E", &Credentials{Token: "t"}); err == nil {
+		t.Error("expected error for a cluster name that is not a valid Secret name")
+	}
+}
+
+func TestSecretMetadata(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-federated-auth", Namespace: "kfa", UID: "deployment-uid"},
+	})
+	meta := SecretMetadata{Annotations: map[string]string{"backup.example.com/exclude": "true"}, Owner: "Deployment/kube-federated-auth"}
+	for name, b := range map[string]Backend{
+		"kfa":                   NewSecretBackend(client, "kfa", "kfa").WithMetadata(meta),
+		"prefix-cred-cluster-b": NewSecretsBackend(client, "kfa", "prefix").WithMetadata(meta),
+	} {
+		// Set twice, creating then updating the Secret
+		for range 2 {
+			if err := b.Set(ctx, "cluster-b", &Credentials{Token: "t", CACert: []byte("ca")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		secret, err := client.CoreV1().Secrets("kfa").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret.Labels["app.kubernetes.io/managed-by"] != "kube-federated-auth" || secret.Labels["app.kubernetes.io/component"] != "credentials" {
+			t.Errorf("%s: labels = %v", name, secret.Labels)
+		}
+		if secret.Annotations["backup.example.com/exclude"] != "true" {
+			t.Errorf("%s: annotations = %v", name, secret.Annotations)
+		}
+		if refs := secret.OwnerReferences; len(refs) != 1 || refs[0].Kind != "Deployment" || refs[0].APIVersion != "apps/v1" || refs[0].UID != "deployment-uid" {
+			t.Errorf("%s: owner references = %+v", name, refs)
+		}
+	}
+
+	// An owner that does not exist is left out rather than failing writes
+	b := NewSecretBackend(client, "kfa", "orphan").WithMetadata(SecretMetadata{Owner: "ConfigMap/missing"})
+	if err := b.Set(ctx, "cluster-b", &Credentials{Token: "t", CACert: []byte("ca")}); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := client.CoreV1().Secrets("kfa").Get(ctx, "orphan", metav1.GetOptions{}); err != nil || len(secret.OwnerReferences) != 0 {
+		t.Errorf("secret with missing owner = %+v, %v", secret, err)
+	}
+}
+
+func TestParseSecretMetadata(t *testing.T) {
+	if kind, name, err := ParseOwner("configmap/kfa-config"); err != nil || kind != "ConfigMap" || name != "kfa-config" {
+		t.Errorf("ParseOwner = %q, %q, %v", kind, name, err)
+	}
+	for _, owner := range []string{"kfa", "Deployment/", "Pod/kfa"} {
+		if _, _, err := ParseOwner(owner); err == nil {
+			t.Errorf("ParseOwner(%q): expected error", owner)
+		}
+	}
+	annotations, err := ParseAnnotations("a=1, b.example.com/c=")
+	if err != nil || len(annotations) != 2 || annotations["a"] != "1" || annotations["b.example.com/c"] != "" {
+		t.Errorf("ParseAnnotations = %v, %v", annotations, err)
+	}
+	if _, err := ParseAnnotations("a"); err == nil {
+		t.Error("ParseAnnotations: expected error for a pair without =")
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	b, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+}
+
+func TestEncryptingBackend(t *testing.T) {
+	ctx := context.Background()
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	inner, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewEncryptingBackend(inner, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+
+	stored, err := inner.Get(ctx, "cluster-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored.Token, "cluster-c-token") || !strings.HasPrefix(stored.Token, encryptedPrefix) {
+		t.Errorf("stored token = %q, want it encrypted", stored.Token)
+	}
+	if err := b.Set(ctx, "cluster-e", &Credentials{CACert: []byte("ca"), ClientCert: []byte("cert"), ClientKey: []byte("client-key")}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := inner.Get(ctx, "cluster-e"); err != nil || !strings.HasPrefix(string(stored.ClientKey), encryptedPrefix) || string(stored.ClientCert) != "cert" {
+		t.Errorf("stored client certificate = %+v, %v, want only the key encrypted", stored, err)
+	}
+	if creds, err := b.Get(ctx, "cluster-e"); err != nil || string(creds.ClientKey) != "client-key" {
+		t.Errorf("Get client certificate = %+v, %v", creds, err)
+	}
+
+	// Tokens written before encryption was enabled are read as is
+	if err := inner.Set(ctx, "legacy", &Credentials{Token: "plain", CACert: []byte("ca")}); err != nil {
+		t.Fatal(err)
+	}
+	if creds, err := b.Get(ctx, "legacy"); err != nil || creds.Token != "plain" {
+		t.Errorf("legacy Get = %+v, %v", creds, err)
+	}
+
+	// Ciphertexts are bound to their cluster
+	if err := inner.Set(ctx, "swapped", stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(ctx, "swapped"); err == nil {
+		t.Error("expected error for a token moved to another cluster")
+	}
+	if all, err := b.List(ctx); err != nil || all["swapped"] != nil || all["cluster-c"] == nil {
+		t.Errorf("List = %v, %v, want cluster-c without swapped", all, err)
+	}
+
+	// Rotation: the new key writes, the old one is still read
+	rotated, err := NewEncryptingBackend(inner, newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds, err := rotated.Get(ctx, "cluster-c"); err != nil || creds.Token != "cluster-c-token" {
+		t.Errorf("Get with previous key = %+v, %v", creds, err)
+	}
+	if err := rotated.Set(ctx, "cluster-c", &Credentials{Token: "renewed", CACert: []byte("ca")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(ctx, "cluster-c"); err == nil {
+		t.Error("expected the old key alone to fail on a token written with the new key")
+	}
+
+	if _, err := NewEncryptingBackend(inner, []byte("short")); err == nil {
+		t.Error("expected error for a key that is not 32 bytes")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	from := NewSecretBackend(fake.NewSimpleClientset(), "kfa", "kfa")
+	for _, cluster := range []string{"cluster-b", "cluster-c"} {
+		if err := from.Set(ctx, cluster, &Credentials{Token: cluster + "-token", CACert: []byte(cluster + "-ca")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inner, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := NewEncryptingBackend(inner, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied, _, err := Migrate(ctx, from, to, false)
+	if err != nil || fmt.Sprint(copied) != "[cluster-b cluster-c]" {
+		t.Fatalf("Migrate = %v, %v", copied, err)
+	}
+	if creds, err := to.Get(ctx, "cluster-c"); err != nil || creds.Token != "cluster-c-token" {
+		t.Errorf("migrated cluster-c = %+v, %v", creds, err)
+	}
+
+	// A rerun only copies credentials renewed in the source meanwhile
+	if err := from.Set(ctx, "cluster-b", &Credentials{Token: "renewed", CACert: []byte("cluster-b-ca")}); err != nil {
+		t.Fatal(err)
+	}
+	copied, _, err = Migrate(ctx, from, to, false)
+	if err != nil || fmt.Sprint(copied) != "[cluster-b]" {
+		t.Fatalf("second Migrate = %v, %v", copied, err)
+	}
+	if creds, err := to.Get(ctx, "cluster-b"); err != nil || creds.Token != "renewed" {
+		t.Errorf("renewed cluster-b = %+v, %v", creds, err)
+	}
+
+	// Credentials renewed in the target by servers already rolled to it are
+	// kept, unless forced
+	now := time.Now()
+	if err := from.Set(ctx, "cluster-c", &Credentials{Token: tokenIssuedAt(now.Add(-time.Hour))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := to.Set(ctx, "cluster-c", &Credentials{Token: tokenIssuedAt(now)}); err != nil {
+		t.Fatal(err)
+	}
+	copied, newer, err := Migrate(ctx, from, to, false)
+	if err != nil || len(copied) != 0 || fmt.Sprint(newer) != "[cluster-c]" {
+		t.Fatalf("Migrate onto newer = %v, %v, %v", copied, newer, err)
+	}
+	if creds, _ := to.Get(ctx, "cluster-c"); creds.Token != tokenIssuedAt(now) {
+		t.Errorf("newer target credentials were overwritten")
+	}
+	if copied, _, err := Migrate(ctx, from, to, true); err != nil || fmt.Sprint(copied) != "[cluster-c]" {
+		t.Fatalf("forced Migrate = %v, %v", copied, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	saved := fileWatchInterval
+	fileWatchInterval = 10 * time.Millisecond
+	defer func() { fileWatchInterval = saved }()
+
+	fileBackend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := map[string]Backend{
+		"secret":  NewSecretBackend(fake.NewSimpleClientset(), "kfa", "kfa"),
+		"secrets": NewSecretsBackend(fake.NewSimpleClientset(), "kfa", "kfa"),
+		"file":    fileBackend,
+	}
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			changes := make(chan map[string]*Credentials, 10)
+			go b.Watch(ctx, func(all map[string]*Credentials) {
+				select {
+				case changes <- all:
+				default:
+				}
+			})
+
+			// Another writer, e.g. an operator rotating a token. Rewritten
+			// until seen, as the watch may start after the first write.
+			deadline := time.After(5 * time.Second)
+			for i := 0; ; i++ {
+				token := fmt.Sprintf("rotated-%d", i)
+				if err := b.Set(ctx, "cluster-b", &Credentials{Token: token, CACert: []byte("ca")}); err != nil {
+					t.Fatalf("Set: %v", err)
+				}
+				select {
+				case all := <-changes:
+					if creds := all["cluster-b"]; creds != nil && strings.HasPrefix(creds.Token, "rotated-") {
+						return
+					}
+				case <-time.After(50 * time.Millisecond):
+				case <-deadline:
+					t.Fatal("no change reported")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// BundleVersion is the format version of backup bundles
+const BundleVersion = 1
+
+// bundleAAD binds sealed bundle data to its purpose, so it cannot be passed
+// off as an encrypted token or vice versa
+const bundleAAD = "kube-federated-auth backup v1"
+
+// Bundle is an encrypted backup of all stored credentials, for restoring them
+// on a fresh install without onboarding every cluster again. Only Clusters
+// and the metadata are readable without the key.
+type Bundle struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Clusters   []string  `json:"clusters"`
+	// KeyID identifies the key Data is sealed with
+	KeyID string `json:"key_id"`
+	// Data is the credentials, keyed like the Secret, sealed with AES-256-GCM
+	Data []byte `json:"data"`
+}
+
+// SealBundle encrypts creds into a Bundle with the 32-byte key
+func SealBundle(creds map[string]*Credentials, key []byte, at time.Time) (*Bundle, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("backup key must be 32 bytes, got %d", len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &Bundle{Version: BundleVersion, ExportedAt: at.UTC(), Clusters: []string{}, KeyID: keyID(key)}
+	data := make(map[string][]byte)
+	for cluster, c := range creds {
+		setCredentialData(data, cluster, c)
+		bundle.Clusters = append(bundle.Clusters, cluster)
+	}
+	sort.Strings(bundle.Clusters)
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Data, err = seal(aead, plaintext, []byte(bundleAAD)); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// Open decrypts the bundle's credentials with the 32-byte key
+func (b *Bundle) Open(key []byte) (map[string]*Credentials, error) {
+	if b.Version != BundleVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", b.Version)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("backup key must be 32 bytes, got %d", len(key))
+	}
+	if id := keyID(key); id != b.KeyID {
+		return nil, fmt.Errorf("backup is sealed with key %s, not %s", b.KeyID, id)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := unseal(aead, b.Data, []byte(bundleAAD))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting backup: %w", err)
+	}
+	var data map[string][]byte
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		return nil, fmt.Errorf("parsing backup: %w", err)
+	}
+	return parseCredentialData(data, SourceRestored), nil
+}
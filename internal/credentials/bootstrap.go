@@ -0,0 +1,85 @@
+package credentials
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// bootstrapWatchInterval is how often WatchBootstrap rereads the files
+var bootstrapWatchInterval = 10 * time.Second
+
+// WatchBootstrap rereads the bootstrap files (token_path, ca_cert,
+// client_cert and client_key) of remote clusters every
+// bootstrapWatchInterval until ctx is done. When a file changes, e.g. a
+// rotated projected token or CA bundle, or a remounted Secret, its
+// credentials are loaded right away instead of at the next renewal, and the
+// cluster's verifier is invalidated. Credentials that fail the check of a
+// CredentialsValidator invalidator are not loaded.
+func (s *Store) WatchBootstrap(ctx context.Context, cfg *config.Config, invalidator VerifierInvalidator) {
+	last := make(map[string]*Credentials)
+	for cluster, clusterCfg := range cfg.Clusters {
+		if clusterCfg.IsRemote() && hasBootstrapFiles(clusterCfg) {
+			if creds, err := readBootstrap(clusterCfg); err == nil {
+				last[cluster] = creds
+			}
+		}
+	}
+	if len(last) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(bootstrapWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for cluster, prev := range last {
+			clusterCfg := cfg.Clusters[cluster]
+			creds, err := readBootstrap(clusterCfg)
+			if err != nil || sameCredentials(prev, creds) {
+				// Unreadable files are transient, e.g. during a rotation
+				continue
+			}
+			last[cluster] = creds
+			if validator, ok := invalidator.(CredentialsValidator); ok {
+				if err := validator.ProbeCredentials(ctx, cluster, creds); err != nil {
+					log.Printf("Ignoring changed bootstrap credentials for cluster %s: %v", cluster, err)
+					continue
+				}
+			}
+			s.setBootstrap(cluster, &Credentials{Token: creds.Token, CACert: creds.CACert,
+				ClientCert: creds.ClientCert, ClientKey: creds.ClientKey, Source: SourceFile})
+			log.Printf("Reloaded changed bootstrap credentials for cluster %s", cluster)
+			invalidator.InvalidateVerifier(cluster)
+		}
+	}
+}
+
+// hasBootstrapFiles reports whether a cluster's bootstrap credentials are
+// read from files, rather than only given inline
+func hasBootstrapFiles(cfg config.ClusterConfig) bool {
+	return cfg.TokenPath != "" || cfg.CACert != "" || cfg.ClientCert != ""
+}
+
+// readBootstrap reads a cluster's bootstrap credentials from its config
+func readBootstrap(cfg config.ClusterConfig) (*Credentials, error) {
+	token, err := cfg.LoadToken()
+	if err != nil {
+		return nil, err
+	}
+	cert, key, err := cfg.LoadClientCert()
+	if err != nil {
+		return nil, err
+	}
+	ca, err := cfg.LoadCACert()
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{Token: string(token), CACert: ca, ClientCert: cert, ClientKey: key, Source: SourceFile}, nil
+}
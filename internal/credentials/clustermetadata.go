@@ -0,0 +1,40 @@
+package credentials
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// ClusterMetadata describes a remote cluster as reported when it was
+// onboarded, persisted with its credentials so that the fleet's composition
+// can be listed from /clusters
+type ClusterMetadata struct {
+	KubernetesVersion string            `json:"kubernetes_version,omitempty"`
+	Region            string            `json:"region,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	// ReportedBy is the version of the tool that reported the metadata, e.g.
+	// kfa/v1.2.3
+	ReportedBy string    `json:"reported_by,omitempty"`
+	ReportedAt time.Time `json:"reported_at,omitzero"`
+}
+
+// ClusterMetadataKey returns the Secret data key holding a cluster's metadata
+func ClusterMetadataKey(cluster string) string {
+	return cluster + "-metadata.json"
+}
+
+// DecodeClusterMetadata parses a ClusterMetadataKey value. Unreadable
+// metadata is logged and dropped rather than hiding the credentials it
+// belongs to.
+func DecodeClusterMetadata(cluster string, data []byte) *ClusterMetadata {
+	if len(data) == 0 {
+		return nil
+	}
+	var metadata ClusterMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		log.Printf("Ignoring unreadable metadata of cluster %s: %v", cluster, err)
+		return nil
+	}
+	return &metadata
+}
@@ -0,0 +1,240 @@
+package credentials
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix marks an encrypted value:
+// enc:v1:<key id>:<wrapped data key>:<ciphertext>, all base64 but the key id.
+// Values without it are read as plaintext, so existing credentials keep
+// working after encryption is enabled and are encrypted when next renewed.
+const encryptedPrefix = "enc:v1:"
+
+// EncryptingBackend encrypts tokens and client keys before they reach a
+// Backend, so a dump of the Secret or directory does not yield usable cluster
+// credentials. Each value is sealed with its own random data key, which is
+// wrapped by the key encryption key (envelope encryption); certificates are
+// stored as is.
+//
+// Tokens are written with the current key and read with any of the keys, so
+// a key can be rotated by making the old one a decryption key until all
+// clusters have been renewed.
+type EncryptingBackend struct {
+	Backend
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewEncryptingBackend wraps backend, encrypting with current and decrypting
+// with current or any of old. Keys are 32 bytes for AES-256.
+func NewEncryptingBackend(backend Backend, current []byte, old ...[]byte) (*EncryptingBackend, error) {
+	b := &EncryptingBackend{Backend: backend, keys: make(map[string]cipher.AEAD)}
+	for i, key := range append([][]byte{current}, old...) {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		if i == 0 {
+			b.current = id
+		}
+		b.keys[id] = aead
+	}
+	return b, nil
+}
+
+// LoadEncryptionKey reads a key file holding 32 raw or base64-encoded bytes,
+// e.g. a data key provisioned by a KMS and mounted into the pod
+func LoadEncryptionKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption key: %w", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption key %s must be 32 raw or base64-encoded bytes", path)
+	}
+	return key, nil
+}
+
+// keyID identifies a key in ciphertexts without revealing it
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with aead, prepending the nonce
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// unseal reverses seal
+func unseal(aead cipher.AEAD, ciphertext, additional []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additional)
+}
+
+// encrypt seals a value, binding it to aad (the cluster, and which of its
+// values it is) so ciphertexts cannot be swapped between clusters
+func (b *EncryptingBackend) encrypt(aad, plaintext string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := seal(b.keys[b.current], dataKey, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(plaintext), []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return encryptedPrefix + b.current + ":" + enc.EncodeToString(wrapped) + ":" + enc.EncodeToString(ciphertext), nil
+}
+
+func (b *EncryptingBackend) decrypt(aad, stored string) (string, error) {
+	rest, ok := strings.CutPrefix(stored, encryptedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	kek, ok := b.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("value encrypted with unknown key %s", parts[0])
+	}
+	enc := base64.RawStdEncoding
+	wrapped, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	ciphertext, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	dataKey, err := unseal(kek, wrapped, []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("unwrapping data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := unseal(aead, ciphertext, []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("decrypting: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// decrypted returns a copy of creds with the token and client key decrypted
+func (b *EncryptingBackend) decrypted(cluster string, creds *Credentials) (*Credentials, error) {
+	token, err := b.decrypt(cluster, creds.Token)
+	if err != nil {
+		return nil, fmt.Errorf("cluster %s: %w", cluster, err)
+	}
+	out := *creds
+	out.Token = token
+	if len(creds.ClientKey) > 0 {
+		key, err := b.decrypt(ClientKeyKey(cluster), string(creds.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: client key: %w", cluster, err)
+		}
+		out.ClientKey = []byte(key)
+	}
+	return &out, nil
+}
+
+// decryptAll decrypts listed credentials, skipping clusters that cannot be
+// decrypted so that one bad entry does not hide the others
+func (b *EncryptingBackend) decryptAll(stored map[string]*Credentials) map[string]*Credentials {
+	result := make(map[string]*Credentials, len(stored))
+	for cluster, creds := range stored {
+		plain, err := b.decrypted(cluster, creds)
+		if err != nil {
+			log.Printf("Skipping stored credentials: %v", err)
+			continue
+		}
+		result[cluster] = plain
+	}
+	return result
+}
+
+func (b *EncryptingBackend) Get(ctx context.Context, cluster string) (*Credentials, error) {
+	creds, err := b.Backend.Get(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+	return b.decrypted(cluster, creds)
+}
+
+func (b *EncryptingBackend) List(ctx context.Context) (map[string]*Credentials, error) {
+	stored, err := b.Backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.decryptAll(stored), nil
+}
+
+func (b *EncryptingBackend) Set(ctx context.Context, cluster string, creds *Credentials) error {
+	sealed := *creds
+	if creds.Token != "" {
+		token, err := b.encrypt(cluster, creds.Token)
+		if err != nil {
+			return fmt.Errorf("encrypting token: %w", err)
+		}
+		sealed.Token = token
+	}
+	if len(creds.ClientKey) > 0 {
+		key, err := b.encrypt(ClientKeyKey(cluster), string(creds.ClientKey))
+		if err != nil {
+			return fmt.Errorf("encrypting client key: %w", err)
+		}
+		sealed.ClientKey = []byte(key)
+	}
+	return b.Backend.Set(ctx, cluster, &sealed)
+}
+
+func (b *EncryptingBackend) Watch(ctx context.Context, onChange func(map[string]*Credentials)) error {
+	return b.Backend.Watch(ctx, func(stored map[string]*Credentials) {
+		onChange(b.decryptAll(stored))
+	})
+}
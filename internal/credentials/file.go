@@ -0,0 +1,163 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileWatchInterval is how often FileBackend.Watch rereads the directory
+var fileWatchInterval = 10 * time.Second
+
+// FileBackend stores each cluster's credentials as two files in a directory,
+// named like the Secret keys (<cluster>-token, <cluster>-ca.crt), so a Secret
+// mounted as a volume can also be read
+type FileBackend struct {
+	dir string
+	// mu serializes writers of this process; files are replaced atomically
+	// so readers never see partial contents
+	mu sync.Mutex
+}
+
+// NewFileBackend creates a backend for dir, creating it if needed
+func NewFileBackend(dir string) (*FileBackend, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating credential directory: %w", err)
+	}
+	return &FileBackend{dir: dir}, nil
+}
+
+func (b *FileBackend) Get(ctx context.Context, cluster string) (*Credentials, error) {
+	data := make(map[string][]byte)
+	for _, key := range credentialKeys(cluster) {
+		content, err := os.ReadFile(filepath.Join(b.dir, key))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", key, err)
+		}
+		data[key] = content
+	}
+	creds, ok := parseCredentialData(data, SourceDirectory)[cluster]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return creds, nil
+}
+
+func (b *FileBackend) List(ctx context.Context) (map[string]*Credentials, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading credential directory: %w", err)
+	}
+	data := make(map[string][]byte)
+	for _, entry := range entries {
+		// Skip directories and the ..data links of mounted Secrets
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(b.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", entry.Name(), err)
+		}
+		data[entry.Name()] = content
+	}
+	return parseCredentialData(data, SourceDirectory), nil
+}
+
+func (b *FileBackend) Set(ctx context.Context, cluster string, creds *Credentials) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data := make(map[string][]byte)
+	setCredentialData(data, cluster, creds)
+	// The CA goes first and the token last, so that concurrent readers of a
+	// new cluster never see a token without its CA
+	for _, key := range []string{HistoryKey(cluster), ClusterMetadataKey(cluster), CACertKey(cluster), ClientCertKey(cluster), ClientKeyKey(cluster), TokenKey(cluster)} {
+		value, ok := data[key]
+		if !ok {
+			if err := b.remove(key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.write(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *FileBackend) Delete(ctx context.Context, cluster string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range credentialKeys(cluster) {
+		if err := b.remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *FileBackend) remove(name string) error {
+	if err := os.Remove(filepath.Join(b.dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing %s: %w", name, err)
+	}
+	return nil
+}
+
+// write replaces a file atomically, readable by the owner only
+func (b *FileBackend) write(name string, data []byte) error {
+	tmp, err := os.CreateTemp(b.dir, "."+name+"-*")
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(b.dir, name)); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	return nil
+}
+
+// Watch rereads the directory every fileWatchInterval and reports changed contents
+func (b *FileBackend) Watch(ctx context.Context, onChange func(map[string]*Credentials)) error {
+	last, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(fileWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		current, err := b.List(ctx)
+		if err != nil {
+			// Transient, e.g. a mounted Secret being updated
+			continue
+		}
+		if !maps.EqualFunc(last, current, sameCredentials) {
+			onChange(current)
+			last = current
+		}
+	}
+}
+
+func sameCredentials(a, b *Credentials) bool {
+	return a.Token == b.Token && string(a.CACert) == string(b.CACert) &&
+		string(a.ClientCert) == string(b.ClientCert) && string(a.ClientKey) == string(b.ClientKey)
+}
@@ -0,0 +1,88 @@
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// MaxHistory is the number of rotations kept per cluster
+const MaxHistory = 10
+
+// Rotation records one write of a cluster's credentials, persisted with them
+// so that it can be told when and by whom they were last rotated
+type Rotation struct {
+	At time.Time `json:"at"`
+	// By identifies the writer, e.g. kube-federated-auth/<pod> for renewals
+	// or kfa onboard/<user>@<host>
+	By     string `json:"by"`
+	Source string `json:"source"`
+	// Subject is the sub claim of the token, the identity it authenticates as
+	Subject   string    `json:"subject,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// HistoryKey returns the Secret data key holding a cluster's rotation history
+func HistoryKey(cluster string) string {
+	return cluster + "-history.json"
+}
+
+// NewRotation records creds being written by by at at
+func NewRotation(creds *Credentials, by, source string, at time.Time) Rotation {
+	return Rotation{At: at, By: by, Source: source, Subject: tokenSubject(creds.Token), ExpiresAt: expiresAt(creds)}
+}
+
+// AppendHistory appends r to history, keeping the MaxHistory most recent
+// rotations
+func AppendHistory(history []Rotation, r Rotation) []Rotation {
+	history = append(append([]Rotation(nil), history...), r)
+	if len(history) > MaxHistory {
+		history = history[len(history)-MaxHistory:]
+	}
+	return history
+}
+
+// DecodeHistory parses a HistoryKey value. Unreadable history is logged and
+// dropped rather than hiding the credentials it belongs to.
+func DecodeHistory(cluster string, data []byte) []Rotation {
+	if len(data) == 0 {
+		return nil
+	}
+	var history []Rotation
+	if err := json.Unmarshal(data, &history); err != nil {
+		log.Printf("Ignoring unreadable credential history of cluster %s: %v", cluster, err)
+		return nil
+	}
+	return history
+}
+
+// tokenSubject returns a JWT's sub claim, or "" if it has none
+func tokenSubject(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return ""
+	}
+	return claims.Sub
+}
+
+// writer identifies this process in the rotations it records
+var writer = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "kube-federated-auth"
+	}
+	return "kube-federated-auth/" + host
+}()
@@ -0,0 +1,140 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Standard labels of the credential Secrets, selectable with
+// app.kubernetes.io/managed-by=kube-federated-auth
+var secretLabels = map[string]string{
+	"app.kubernetes.io/name":       "kube-federated-auth",
+	"app.kubernetes.io/component":  "credentials",
+	"app.kubernetes.io/managed-by": "kube-federated-auth",
+}
+
+// SecretMetadata is applied to the credential Secrets on every write
+type SecretMetadata struct {
+	// Annotations are added to the Secrets, e.g. for backup or policy tooling
+	Annotations map[string]string
+	// Owner is a Deployment or ConfigMap in the Secrets' namespace, as
+	// Kind/name, made their owner so that they are garbage-collected with it
+	Owner string
+}
+
+// ParseOwner splits a Kind/name owner, accepting Deployment and ConfigMap
+// in any case
+func ParseOwner(owner string) (kind, name string, err error) {
+	kind, name, ok := strings.Cut(owner, "/")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("secret owner %q must be Kind/name", owner)
+	}
+	switch strings.ToLower(kind) {
+	case "deployment":
+		return "Deployment", name, nil
+	case "configmap":
+		return "ConfigMap", name, nil
+	}
+	return "", "", fmt.Errorf("secret owner kind %q must be Deployment or ConfigMap", kind)
+}
+
+// ParseAnnotations parses comma-separated key=value pairs
+func ParseAnnotations(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	annotations := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("annotation %q must be key=value", pair)
+		}
+		annotations[key] = value
+	}
+	return annotations, nil
+}
+
+// secretMetadata applies SecretMetadata to Secrets, looking the owner up
+// once
+type secretMetadata struct {
+	SecretMetadata
+	client    kubernetes.Interface
+	namespace string
+
+	once  sync.Once
+	owner *metav1.OwnerReference
+}
+
+func newSecretMetadata(client kubernetes.Interface, namespace string, meta SecretMetadata) *secretMetadata {
+	return &secretMetadata{SecretMetadata: meta, client: client, namespace: namespace}
+}
+
+// apply sets the standard labels, annotations and owner reference on secret.
+// An owner that cannot be looked up is logged and left out, so credentials
+// are persisted regardless.
+func (m *secretMetadata) apply(ctx context.Context, secret *corev1.Secret) {
+	if secret.Labels == nil {
+		secret.Labels = make(map[string]string)
+	}
+	maps.Copy(secret.Labels, secretLabels)
+	if len(m.Annotations) > 0 {
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
+		maps.Copy(secret.Annotations, m.Annotations)
+	}
+
+	if m.Owner == "" {
+		return
+	}
+	m.once.Do(func() {
+		owner, err := m.lookupOwner(ctx)
+		if err != nil {
+			log.Printf("Not setting an owner on credential secrets: %v", err)
+			return
+		}
+		m.owner = owner
+	})
+	if m.owner == nil {
+		return
+	}
+	for _, ref := range secret.OwnerReferences {
+		if ref.UID == m.owner.UID {
+			return
+		}
+	}
+	secret.OwnerReferences = append(secret.OwnerReferences, *m.owner)
+}
+
+func (m *secretMetadata) lookupOwner(ctx context.Context) (*metav1.OwnerReference, error) {
+	kind, name, err := ParseOwner(m.Owner)
+	if err != nil {
+		return nil, err
+	}
+	var apiVersion string
+	var uid types.UID
+	switch kind {
+	case "Deployment":
+		deployment, err := m.client.AppsV1().Deployments(m.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("getting owner %s: %w", m.Owner, err)
+		}
+		apiVersion, uid = "apps/v1", deployment.UID
+	case "ConfigMap":
+		configMap, err := m.client.CoreV1().ConfigMaps(m.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("getting owner %s: %w", m.Owner, err)
+		}
+		apiVersion, uid = "v1", configMap.UID
+	}
+	return &metav1.OwnerReference{APIVersion: apiVersion, Kind: kind, Name: name, UID: uid}, nil
+}
@@ -0,0 +1,69 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Migrate copies the credentials of all clusters from one backend to another
+// and reads each back from the target to verify it. Clusters the target
+// already holds unchanged are skipped, so a migration can be rerun to pick up
+// credentials renewed in the source meanwhile. Clusters whose target
+// credentials were issued after the source's, e.g. renewed by servers already
+// rolled to the target, are skipped too unless force is set, and returned as
+// newer. The source is left untouched.
+func Migrate(ctx context.Context, from, to Backend, force bool) (copied, newer []string, err error) {
+	stored, err := from.List(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing source credentials: %w", err)
+	}
+	existing, err := to.List(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing target credentials: %w", err)
+	}
+
+	clusters := make([]string, 0, len(stored))
+	for cluster := range stored {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+
+	for _, cluster := range clusters {
+		creds := stored[cluster]
+		if current, ok := existing[cluster]; ok {
+			if sameCredentials(current, creds) {
+				continue
+			}
+			if !force && issuedAt(current).After(issuedAt(creds)) {
+				newer = append(newer, cluster)
+				continue
+			}
+		}
+		if err := to.Set(ctx, cluster, creds); err != nil {
+			return copied, newer, fmt.Errorf("cluster %s: writing target: %w", cluster, err)
+		}
+		written, err := to.Get(ctx, cluster)
+		if err != nil {
+			return copied, newer, fmt.Errorf("cluster %s: reading back target: %w", cluster, err)
+		}
+		if !sameCredentials(written, creds) {
+			return copied, newer, fmt.Errorf("cluster %s: target credentials differ from the source after writing", cluster)
+		}
+		copied = append(copied, cluster)
+	}
+	return copied, newer, nil
+}
+
+// issuedAt is when credentials were issued: the token's iat claim, else the
+// time of their latest rotation, else zero
+func issuedAt(creds *Credentials) time.Time {
+	if iat, err := TokenIssuedAt(creds.Token); err == nil {
+		return iat
+	}
+	if n := len(creds.History); n > 0 {
+		return creds.History[n-1].At
+	}
+	return time.Time{}
+}
@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"strings"
 	"time"
 
@@ -18,6 +17,10 @@ import (
 	"k8s.io/client-go/rest"
 
 	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/egress"
+	"github.com/rophy/kube-federated-auth/internal/events"
+	"github.com/rophy/kube-federated-auth/internal/execcred"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
 )
 
 // VerifierInvalidator is an interface for invalidating cached verifiers
@@ -25,19 +28,27 @@ type VerifierInvalidator interface {
 	InvalidateVerifier(clusterName string)
 }
 
+// CredentialsValidator is implemented by verifiers that can check candidate
+// credentials end to end. Credentials that fail the check are not stored.
+type CredentialsValidator interface {
+	ProbeCredentials(ctx context.Context, clusterName string, creds *Credentials) error
+}
+
 // Renewer handles automatic credential renewal for remote clusters
 type Renewer struct {
 	config    *config.Config
 	credStore *Store
 	verifier  VerifierInvalidator
+	recorder  *events.Recorder
 }
 
-// NewRenewer creates a new credential renewer
-func NewRenewer(cfg *config.Config, store *Store, verifier VerifierInvalidator) *Renewer {
+// NewRenewer creates a new credential renewer. recorder may be nil.
+func NewRenewer(cfg *config.Config, store *Store, verifier VerifierInvalidator, recorder *events.Recorder) *Renewer {
 	return &Renewer{
 		config:    cfg,
 		credStore: store,
 		verifier:  verifier,
+		recorder:  recorder,
 	}
 }
 
@@ -55,9 +66,13 @@ func (r *Renewer) renewLoop(ctx context.Context, cluster string, cfg config.Clus
 	log.Printf("Starting credential renewal loop for cluster %s (interval: %s)", cluster, interval)
 
 	// Initial renewal
-	if err := r.renew(ctx, cluster, cfg); err != nil {
+	failures := 0
+	err := r.renew(ctx, cluster, cfg)
+	if err != nil {
 		log.Printf("Initial credential renewal failed for cluster %s: %v", cluster, err)
+		r.reportFailure(cluster, err)
 	}
+	r.recordCheck(cluster, err, &failures, interval)
 
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -65,9 +80,12 @@ func (r *Renewer) renewLoop(ctx context.Context, cluster string, cfg config.Clus
 	for {
 		select {
 		case <-ticker.C:
-			if err := r.renew(ctx, cluster, cfg); err != nil {
+			err = r.renew(ctx, cluster, cfg)
+			if err != nil {
 				log.Printf("Credential renewal failed for cluster %s: %v", cluster, err)
+				r.reportFailure(cluster, err)
 			}
+			r.recordCheck(cluster, err, &failures, interval)
 		case <-ctx.Done():
 			log.Printf("Stopping credential renewal loop for cluster %s", cluster)
 			return
@@ -80,8 +98,8 @@ func (r *Renewer) renew(ctx context.Context, cluster string, cfg config.ClusterC
 	creds, ok := r.credStore.Get(cluster)
 	if !ok {
 		// Try to load bootstrap credentials from files
-		if cfg.TokenPath != "" && cfg.CACert != "" {
-			if err := r.credStore.LoadFromFiles(cluster, cfg.TokenPath, cfg.CACert); err != nil {
+		if cfg.HasBootstrapCredentials() {
+			if err := r.credStore.LoadBootstrap(cluster, cfg); err != nil {
 				return fmt.Errorf("loading bootstrap credentials: %w", err)
 			}
 			creds, _ = r.credStore.Get(cluster)
@@ -90,11 +108,31 @@ func (r *Renewer) renew(ctx context.Context, cluster string, cfg config.ClusterC
 		}
 	}
 
+	// Without a dedicated ServiceAccount, TokenRequest renews the
+	// ServiceAccount token in use
+	dedicatedNamespace, dedicatedAccount := cfg.RenewalServiceAccountRef()
+	if creds.Token == "" && dedicatedAccount == "" {
+		log.Printf("Skipping renewal for cluster %s: authenticates with a client certificate", cluster)
+		return nil
+	}
+
+	// Extract namespace and service account from current token
+	namespace, serviceAccount, subjectErr := ServiceAccountFromToken(creds.Token)
+
 	// Check if token needs renewal based on expiration
 	renewBefore := r.config.GetRenewalRenewBefore()
-	if exp, err := getTokenExpiration(creds.Token); err == nil {
+	if dedicatedAccount != "" && (namespace != dedicatedNamespace || serviceAccount != dedicatedAccount) {
+		log.Printf("Renewing credentials for cluster %s: exchanging bootstrap credentials for service account %s", cluster, cfg.RenewalServiceAccount)
+		namespace, serviceAccount = dedicatedNamespace, dedicatedAccount
+	} else if pod := BoundPod(creds.Token); pod != "" {
+		// A projected token stops working with its pod, long before expiry
+		// is near; TokenRequest returns one bound to the ServiceAccount only
+		log.Printf("Renewing credentials for cluster %s: token is bound to pod %s", cluster, pod)
+	} else if exp, err := getTokenExpiration(creds.Token); err == nil {
 		timeUntilExpiry := time.Until(exp)
-		if timeUntilExpiry > renewBefore {
+		if r.nearingMaxAge(cluster, cfg, creds) {
+			log.Printf("Renewing credentials for cluster %s: approaching max_credential_age %s", cluster, cfg.MaxCredentialAge)
+		} else if timeUntilExpiry > renewBefore {
 			log.Printf("Skipping renewal for cluster %s: token expires in %s (threshold: %s)",
 				cluster, timeUntilExpiry.Round(time.Minute), renewBefore)
 			return nil
@@ -104,15 +142,12 @@ func (r *Renewer) renew(ctx context.Context, cluster string, cfg config.ClusterC
 	} else {
 		log.Printf("Renewing credentials for cluster %s: could not determine expiration (%v)", cluster, err)
 	}
-
-	// Extract namespace and service account from current token
-	namespace, serviceAccount, err := parseServiceAccountFromToken(creds.Token)
-	if err != nil {
-		return fmt.Errorf("parsing token subject: %w", err)
+	if dedicatedAccount == "" && subjectErr != nil {
+		return fmt.Errorf("parsing token subject: %w", subjectErr)
 	}
 
 	// Create K8s client for remote cluster
-	client, err := r.createClient(cfg, creds)
+	client, err := NewClient(cfg, creds)
 	if err != nil {
 		return fmt.Errorf("creating k8s client: %w", err)
 	}
@@ -138,8 +173,18 @@ func (r *Renewer) renew(ctx context.Context, cluster string, cfg config.ClusterC
 
 	// Store new credentials (CA cert doesn't change)
 	newCreds := &Credentials{
-		Token:  token.Status.Token,
-		CACert: creds.CACert,
+		Token:     token.Status.Token,
+		CACert:    creds.CACert,
+		Source:    SourceRenewed,
+		UpdatedAt: time.Now(),
+	}
+
+	// A token the cluster does not accept would only surface as TokenReview
+	// failures; keep the current credentials instead
+	if validator, ok := r.verifier.(CredentialsValidator); ok {
+		if err := validator.ProbeCredentials(ctx, cluster, newCreds); err != nil {
+			return fmt.Errorf("validating renewed credentials: %w", err)
+		}
 	}
 
 	if err := r.credStore.Set(ctx, cluster, newCreds); err != nil {
@@ -149,17 +194,86 @@ func (r *Renewer) renew(ctx context.Context, cluster string, cfg config.ClusterC
 	// Invalidate cached verifier to pick up new credentials
 	if r.verifier != nil {
 		r.verifier.InvalidateVerifier(cluster)
+		r.recorder.Normal(cluster, events.ReasonVerifierInvalidated, "cached verifier dropped to pick up renewed credentials")
 	}
 
+	// Schedule on the token's real expiry: the API server may issue shorter
+	// tokens than requested (--service-account-max-token-expiration)
+	exp := token.Status.ExpirationTimestamp.Time
+	if tokenExp, err := getTokenExpiration(newCreds.Token); err == nil {
+		exp = tokenExp
+	}
 	log.Printf("Successfully renewed credentials for cluster %s (expires: %s)",
-		cluster, token.Status.ExpirationTimestamp.Format(time.RFC3339))
+		cluster, exp.Format(time.RFC3339))
+	r.recorder.Normal(cluster, events.ReasonCredentialsRenewed, "token renewed, expires %s",
+		exp.Format(time.RFC3339))
+	if msg := shortenedLifetime(tokenDuration, time.Until(exp), renewBefore); msg != "" {
+		log.Printf("WARNING: cluster %s: %s", cluster, msg)
+		r.recorder.Warning(cluster, events.ReasonCredentialsShortened, "%s", msg)
+	}
 
 	return nil
 }
 
-// parseServiceAccountFromToken extracts namespace and service account name from JWT token
+// shortenedLifetime describes a renewed token issued for noticeably less
+// than the requested token_duration, or returns ""
+func shortenedLifetime(requested, granted, renewBefore time.Duration) string {
+	if granted >= requested*9/10 {
+		return ""
+	}
+	msg := fmt.Sprintf("requested a token valid for %s but the cluster issued one valid for %s",
+		requested, granted.Round(time.Minute))
+	if granted <= renewBefore {
+		msg += fmt.Sprintf("; it is within renew_before (%s), so it is renewed at every check", renewBefore)
+	}
+	return msg
+}
+
+// nearingMaxAge reports whether credentials would exceed the cluster's
+// max_credential_age before the next renewal check, and alerts if they already have
+func (r *Renewer) nearingMaxAge(cluster string, cfg config.ClusterConfig, creds *Credentials) bool {
+	if cfg.MaxCredentialAge <= 0 {
+		return false
+	}
+	if err := CheckFreshness(creds.Token, cfg.MaxCredentialAge); err != nil {
+		log.Printf("Warning: credentials for cluster %s are stale: %v", cluster, err)
+		r.recorder.Warning(cluster, events.ReasonCredentialsStale, "%v", err)
+		return true
+	}
+	threshold := cfg.MaxCredentialAge - r.config.GetRenewalInterval()
+	return threshold <= 0 || CheckFreshness(creds.Token, threshold) != nil
+}
+
+// recordCheck exports the outcome of a renewal check, so that renewals
+// failing silently for days can be alerted on
+func (r *Renewer) recordCheck(cluster string, err error, failures *int, interval time.Duration) {
+	if err != nil {
+		*failures++
+	} else {
+		*failures = 0
+		metrics.RenewalLastSuccess.WithLabelValues(cluster).SetToCurrentTime()
+	}
+	metrics.RenewalConsecutiveFailures.WithLabelValues(cluster).Set(float64(*failures))
+	metrics.RenewalNextCheck.WithLabelValues(cluster).Set(float64(time.Now().Add(interval).Unix()))
+}
+
+// reportFailure emits a renewal failure event, and an expiry event if the
+// stored token is no longer valid
+func (r *Renewer) reportFailure(cluster string, err error) {
+	r.recorder.Warning(cluster, events.ReasonCredentialsRenewalFailed, "%v", err)
+
+	creds, ok := r.credStore.Get(cluster)
+	if !ok {
+		return
+	}
+	if exp, err := getTokenExpiration(creds.Token); err == nil && time.Now().After(exp) {
+		r.recorder.Warning(cluster, events.ReasonCredentialsExpired, "token expired at %s", exp.Format(time.RFC3339))
+	}
+}
+
+// ServiceAccountFromToken extracts namespace and service account name from JWT token
 // The subject claim format is: system:serviceaccount:<namespace>:<name>
-func parseServiceAccountFromToken(token string) (namespace, serviceAccount string, err error) {
+func ServiceAccountFromToken(token string) (namespace, serviceAccount string, err error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
 		return "", "", fmt.Errorf("invalid JWT format")
@@ -212,16 +326,102 @@ func getTokenExpiration(token string) (time.Time, error) {
 	return time.Unix(claims.Exp, 0), nil
 }
 
-func (r *Renewer) createClient(cfg config.ClusterConfig, creds *Credentials) (*kubernetes.Clientset, error) {
+// TokenIssuedAt extracts the issued-at time from a JWT token
+func TokenIssuedAt(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("invalid JWT format")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decoding JWT payload: %w", err)
+	}
+
+	var claims struct {
+		Iat int64 `json:"iat"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("parsing JWT claims: %w", err)
+	}
+
+	if claims.Iat == 0 {
+		return time.Time{}, fmt.Errorf("token has no issued-at claim")
+	}
+
+	return time.Unix(claims.Iat, 0), nil
+}
+
+// CheckFreshness returns an error if token was issued more than maxAge ago.
+// A zero maxAge disables the check. Tokens without an iat claim fail the check
+// because their age cannot be established.
+func CheckFreshness(token string, maxAge time.Duration) error {
+	if maxAge <= 0 {
+		return nil
+	}
+	iat, err := TokenIssuedAt(token)
+	if err != nil {
+		return fmt.Errorf("cannot determine credential age: %w", err)
+	}
+	if age := time.Since(iat); age > maxAge {
+		return fmt.Errorf("credentials are %s old, exceeding max_credential_age %s", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
+
+// BoundPod returns the namespace/name of the pod a projected ServiceAccount
+// token is bound to, or "" if it is not bound to a pod
+func BoundPod(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Kubernetes struct {
+			Namespace string `json:"namespace"`
+			Pod       *struct {
+				Name string `json:"name"`
+			} `json:"pod"`
+		} `json:"kubernetes.io"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Kubernetes.Pod == nil {
+		return ""
+	}
+	return claims.Kubernetes.Namespace + "/" + claims.Kubernetes.Pod.Name
+}
+
+// RESTTLSConfig returns the client-go TLS settings for a cluster, with the
+// client certificate of creds if any. client-go rejects a CA alongside
+// Insecure, so the CA is dropped when verification is disabled.
+func RESTTLSConfig(cfg config.ClusterConfig, caCert []byte, creds *Credentials) rest.TLSClientConfig {
+	var tlsConfig rest.TLSClientConfig
+	if cfg.InsecureSkipTLSVerify {
+		tlsConfig.Insecure = true
+	} else {
+		tlsConfig.CAData = caCert
+	}
+	if creds != nil {
+		tlsConfig.CertData, tlsConfig.KeyData = creds.ClientCert, creds.ClientKey
+	}
+	return tlsConfig
+}
+
+// NewClient creates a Kubernetes client for a remote cluster's API server
+// using stored credentials, falling back to the configured files.
+func NewClient(cfg config.ClusterConfig, creds *Credentials) (*kubernetes.Clientset, error) {
 	// Load CA cert
 	var caCert []byte
 	if creds != nil && len(creds.CACert) > 0 {
 		caCert = creds.CACert
-	} else if cfg.CACert != "" {
+	} else {
 		var err error
-		caCert, err = os.ReadFile(cfg.CACert)
+		caCert, err = cfg.LoadCACert()
 		if err != nil {
-			return nil, fmt.Errorf("reading CA cert: %w", err)
+			return nil, err
 		}
 	}
 
@@ -239,21 +439,34 @@ func (r *Renewer) createClient(cfg config.ClusterConfig, creds *Credentials) (*k
 	var token string
 	if creds != nil && creds.Token != "" {
 		token = creds.Token
-	} else if cfg.TokenPath != "" {
-		tokenBytes, err := os.ReadFile(cfg.TokenPath)
+	} else {
+		tokenBytes, err := cfg.LoadToken()
 		if err != nil {
-			return nil, fmt.Errorf("reading token: %w", err)
+			return nil, err
 		}
 		token = string(tokenBytes)
 	}
 
+	tlsClientConfig := RESTTLSConfig(cfg, caCert, creds)
+	if len(tlsClientConfig.CertData) == 0 {
+		cert, key, err := cfg.LoadClientCert()
+		if err != nil {
+			return nil, err
+		}
+		tlsClientConfig.CertData, tlsClientConfig.KeyData = cert, key
+	}
+
 	// Create REST config
 	restConfig := &rest.Config{
-		Host:        cfg.APIServer,
-		BearerToken: token,
-		TLSClientConfig: rest.TLSClientConfig{
-			CAData: caCert,
-		},
+		Host:            cfg.APIServer,
+		BearerToken:     token,
+		TLSClientConfig: tlsClientConfig,
+	}
+	if err := egress.ApplyREST(cfg.Egress, restConfig); err != nil {
+		return nil, fmt.Errorf("configuring egress: %w", err)
+	}
+	if token == "" {
+		execcred.ApplyREST(cfg.Exec, restConfig)
 	}
 
 	return kubernetes.NewForConfig(restConfig)
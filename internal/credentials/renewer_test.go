@@ -0,0 +1,144 @@
+package credentials
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func tokenIssuedAt(iat time.Time) string {
+	payload := fmt.Sprintf(`{"sub":"system:serviceaccount:kube-federated-auth:reader","iat":%d}`, iat.Unix())
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+}
+
+// saToken returns a token of the ServiceAccount <namespace>:<name> expiring at exp
+func saToken(account string, exp time.Time) string {
+	payload := fmt.Sprintf(`{"sub":"system:serviceaccount:%s","exp":%d}`, account, exp.Unix())
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+}
+
+func TestCheckFreshness(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		maxAge  time.Duration
+		wantErr bool
+	}{
+		{"disabled", "not-a-jwt", 0, false},
+		{"fresh", tokenIssuedAt(time.Now().Add(-time.Hour)), 2 * time.Hour, false},
+		{"stale", tokenIssuedAt(time.Now().Add(-3 * time.Hour)), 2 * time.Hour, true},
+		{"no iat", "e30.e30.sig", time.Hour, true},
+		{"malformed", "not-a-jwt", time.Hour, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckFreshness(tt.token, tt.maxAge)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckFreshness() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// tokenRequestServer serves TokenRequests with fresh tokens of
+// kube-federated-auth:reader, recording the requested paths. It returns the
+// server and its CA.
+func tokenRequestServer(t *testing.T, requested *[]string) (*httptest.Server, []byte) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requested = append(*requested, r.Method+" "+r.URL.Path)
+		token := saToken("kube-federated-auth:reader", time.Now().Add(7*24*time.Hour))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"kind":"TokenRequest","apiVersion":"authentication.k8s.io/v1","status":{"token":%q,"expirationTimestamp":"2030-01-01T00:00:00Z"}}`, token)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+}
+
+func TestRenew_RenewalServiceAccount(t *testing.T) {
+	var requested []string
+	srv, ca := tokenRequestServer(t, &requested)
+
+	store, err := NewStore(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fresh bootstrap token of another ServiceAccount, e.g. an agent's
+	agent := saToken("agents:onboarder", time.Now().Add(7*24*time.Hour))
+	if err := store.Set(context.Background(), "cluster-b", &Credentials{Token: agent, CACert: ca}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.ClusterConfig{APIServer: srv.URL, RenewalServiceAccount: "kube-federated-auth/reader"}
+	r := NewRenewer(&config.Config{}, store, nil, nil)
+
+	if err := r.renew(context.Background(), "cluster-b", cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := "POST /api/v1/namespaces/kube-federated-auth/serviceaccounts/reader/token"
+	if len(requested) != 1 || requested[0] != want {
+		t.Fatalf("requests = %v, want [%s]", requested, want)
+	}
+	creds, _ := store.Get("cluster-b")
+	if tokenSubject(creds.Token) != "system:serviceaccount:kube-federated-auth:reader" || creds.Source != SourceRenewed {
+		t.Errorf("stored credentials = %+v", creds)
+	}
+
+	// Once exchanged, the dedicated token is only renewed before expiry
+	if err := r.renew(context.Background(), "cluster-b", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 1 {
+		t.Errorf("requests = %v, want no renewal of a fresh token", requested)
+	}
+}
+
+func TestRenew_PodBoundToken(t *testing.T) {
+	var requested []string
+	srv, ca := tokenRequestServer(t, &requested)
+
+	store, err := NewStore(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fresh projected token, as mounted into a pod
+	payload := fmt.Sprintf(`{"sub":"system:serviceaccount:kube-federated-auth:reader","exp":%d,"kubernetes.io":{"namespace":"kube-federated-auth","pod":{"name":"agent-x2k4p","uid":"u"}}}`, time.Now().Add(7*24*time.Hour).Unix())
+	projected := "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	if pod := BoundPod(projected); pod != "kube-federated-auth/agent-x2k4p" {
+		t.Errorf("BoundPod = %q", pod)
+	}
+	if err := store.Set(context.Background(), "cluster-b", &Credentials{Token: projected, CACert: ca}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRenewer(&config.Config{}, store, nil, nil)
+	if err := r.renew(context.Background(), "cluster-b", config.ClusterConfig{APIServer: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 1 {
+		t.Fatalf("requests = %v, want the pod-bound token replaced", requested)
+	}
+	if creds, _ := store.Get("cluster-b"); BoundPod(creds.Token) != "" {
+		t.Error("stored token is still bound to a pod")
+	}
+}
+
+func TestShortenedLifetime(t *testing.T) {
+	week, day := 7*24*time.Hour, 24*time.Hour
+	if msg := shortenedLifetime(week, week-time.Minute, 2*day); msg != "" {
+		t.Errorf("full lifetime reported as shortened: %s", msg)
+	}
+	if msg := shortenedLifetime(week, 3*day, 2*day); msg == "" || strings.Contains(msg, "renew_before") {
+		t.Errorf("3d of 7d: %q", msg)
+	}
+	if msg := shortenedLifetime(week, time.Hour, 2*day); !strings.Contains(msg, "renewed at every check") {
+		t.Errorf("1h of 7d: %q", msg)
+	}
+}
@@ -0,0 +1,157 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/rophy/kube-federated-auth/internal/tracing"
+)
+
+// SecretBackend stores the credentials of all clusters in one Kubernetes
+// Secret, under the keys TokenKey and CACertKey
+type SecretBackend struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	meta      *secretMetadata
+}
+
+// NewSecretBackend creates a backend for the Secret namespace/name
+func NewSecretBackend(client kubernetes.Interface, namespace, name string) *SecretBackend {
+	return &SecretBackend{client: client, namespace: namespace, name: name,
+		meta: newSecretMetadata(client, namespace, SecretMetadata{})}
+}
+
+// WithMetadata sets the annotations and owner applied to the Secret
+func (b *SecretBackend) WithMetadata(meta SecretMetadata) *SecretBackend {
+	b.meta = newSecretMetadata(b.client, b.namespace, meta)
+	return b
+}
+
+func (b *SecretBackend) Get(ctx context.Context, cluster string) (*Credentials, error) {
+	all, err := b.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	creds, ok := all[cluster]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return creds, nil
+}
+
+func (b *SecretBackend) List(ctx context.Context) (_ map[string]*Credentials, err error) {
+	ctx, span := tracing.Start(ctx, "credentials.secret.List")
+	defer func() { tracing.End(span, err) }()
+
+	secret, err := b.client.CoreV1().Secrets(b.namespace).Get(ctx, b.name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return map[string]*Credentials{}, nil
+		}
+		return nil, fmt.Errorf("getting secret: %w", err)
+	}
+	return parseCredentialData(secret.Data, SourceSecret), nil
+}
+
+func (b *SecretBackend) Set(ctx context.Context, cluster string, creds *Credentials) (err error) {
+	ctx, span := tracing.Start(ctx, "credentials.secret.Set", tracing.AttrCluster.String(cluster))
+	defer func() { tracing.End(span, err) }()
+
+	return b.update(ctx, func(data map[string][]byte) {
+		setCredentialData(data, cluster, creds)
+	})
+}
+
+func (b *SecretBackend) Delete(ctx context.Context, cluster string) (err error) {
+	ctx, span := tracing.Start(ctx, "credentials.secret.Delete", tracing.AttrCluster.String(cluster))
+	defer func() { tracing.End(span, err) }()
+
+	return b.update(ctx, func(data map[string][]byte) {
+		for _, key := range credentialKeys(cluster) {
+			delete(data, key)
+		}
+	})
+}
+
+// retryWrite retries a read-modify-write of a Secret when another writer,
+// e.g. another replica, updated or created it in between
+func retryWrite(fn func() error) error {
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, fn)
+}
+
+// update applies fn to the Secret's data, retrying on conflicting writes and
+// creating the Secret if it does not exist. Only the keys fn changes are
+// written; the update carries the resourceVersion read, so concurrent writers
+// never overwrite each other's keys.
+func (b *SecretBackend) update(ctx context.Context, fn func(data map[string][]byte)) error {
+	secrets := b.client.CoreV1().Secrets(b.namespace)
+	return retryWrite(func() error {
+		secret, err := secrets.Get(ctx, b.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			secret = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: b.name, Namespace: b.namespace}}
+			secret.Data = make(map[string][]byte)
+			fn(secret.Data)
+			b.meta.apply(ctx, secret)
+			if _, err := secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+				return fmt.Errorf("creating secret: %w", err)
+			}
+			log.Printf("Created credentials secret %s/%s", b.namespace, b.name)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("getting secret: %w", err)
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		fn(secret.Data)
+		b.meta.apply(ctx, secret)
+		if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		log.Printf("Updated credentials secret %s/%s", b.namespace, b.name)
+		return nil
+	})
+}
+
+// Watch follows the Secret with an informer. Deleting the Secret reports no
+// credentials.
+func (b *SecretBackend) Watch(ctx context.Context, onChange func(map[string]*Credentials)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(b.client, 0,
+		informers.WithNamespace(b.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", b.name).String()
+		}))
+	informer := factory.Core().V1().Secrets().Informer()
+
+	changed := func(obj any) {
+		if secret, ok := obj.(*corev1.Secret); ok && secret.Name == b.name {
+			onChange(parseCredentialData(secret.Data, SourceSecret))
+		}
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    changed,
+		UpdateFunc: func(_, obj any) { changed(obj) },
+		DeleteFunc: func(obj any) { onChange(map[string]*Credentials{}) },
+	}); err != nil {
+		return fmt.Errorf("watching secret: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+	return nil
+}
@@ -0,0 +1,242 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/rophy/kube-federated-auth/internal/tracing"
+)
+
+// Labels of the Secrets of SecretsBackend
+const (
+	// LabelCredentials marks a per-cluster credentials Secret, with the
+	// backend's name prefix as value so that instances sharing a namespace
+	// do not load each other's
+	LabelCredentials = "kfa.io/credentials"
+	// LabelCluster holds the cluster name
+	LabelCluster = "kfa.io/cluster"
+)
+
+// Data keys of a per-cluster credentials Secret
+const (
+	secretTokenKey      = "token"
+	secretCACertKey     = "ca.crt"
+	secretClientCertKey = "client.crt"
+	secretClientKeyKey  = "client.key"
+	secretHistoryKey    = "history.json"
+	secretMetadataKey   = "metadata.json"
+)
+
+// SecretsBackend stores each cluster's credentials in its own Kubernetes
+// Secret, <prefix>-cred-<cluster>, so that writes for different clusters do
+// not conflict and RBAC can be scoped to single clusters. The Secrets are
+// found by label.
+type SecretsBackend struct {
+	client    kubernetes.Interface
+	namespace string
+	prefix    string
+	meta      *secretMetadata
+}
+
+// NewSecretsBackend creates a backend for the per-cluster Secrets named after prefix
+func NewSecretsBackend(client kubernetes.Interface, namespace, prefix string) *SecretsBackend {
+	return &SecretsBackend{client: client, namespace: namespace, prefix: prefix,
+		meta: newSecretMetadata(client, namespace, SecretMetadata{})}
+}
+
+// WithMetadata sets the annotations and owner applied to the Secrets
+func (b *SecretsBackend) WithMetadata(meta SecretMetadata) *SecretsBackend {
+	b.meta = newSecretMetadata(b.client, b.namespace, meta)
+	return b
+}
+
+// SecretName returns the name of a cluster's credentials Secret
+func (b *SecretsBackend) SecretName(cluster string) string {
+	return b.prefix + "-cred-" + cluster
+}
+
+func (b *SecretsBackend) selector() string {
+	return LabelCredentials + "=" + b.prefix
+}
+
+func (b *SecretsBackend) validate(cluster string) error {
+	if errs := validation.IsDNS1123Subdomain(b.SecretName(cluster)); len(errs) > 0 {
+		return fmt.Errorf("cluster %q cannot be stored in a Secret: %s", cluster, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsValidLabelValue(cluster); len(errs) > 0 {
+		return fmt.Errorf("cluster %q cannot be stored in a Secret: %s", cluster, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (b *SecretsBackend) Get(ctx context.Context, cluster string) (_ *Credentials, err error) {
+	ctx, span := tracing.Start(ctx, "credentials.secrets.Get", tracing.AttrCluster.String(cluster))
+	defer func() { tracing.End(span, err) }()
+
+	secret, err := b.client.CoreV1().Secrets(b.namespace).Get(ctx, b.SecretName(cluster), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting secret: %w", err)
+	}
+	_, creds, ok := b.parse(secret)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return creds, nil
+}
+
+func (b *SecretsBackend) List(ctx context.Context) (_ map[string]*Credentials, err error) {
+	ctx, span := tracing.Start(ctx, "credentials.secrets.List")
+	defer func() { tracing.End(span, err) }()
+
+	list, err := b.client.CoreV1().Secrets(b.namespace).List(ctx, metav1.ListOptions{LabelSelector: b.selector()})
+	if err != nil {
+		return nil, fmt.Errorf("listing secrets: %w", err)
+	}
+	result := make(map[string]*Credentials, len(list.Items))
+	for i := range list.Items {
+		if cluster, creds, ok := b.parse(&list.Items[i]); ok {
+			result[cluster] = creds
+		}
+	}
+	return result, nil
+}
+
+// parse returns the cluster and credentials of one of the backend's Secrets
+func (b *SecretsBackend) parse(secret *corev1.Secret) (string, *Credentials, bool) {
+	cluster := secret.Labels[LabelCluster]
+	if cluster == "" || secret.Labels[LabelCredentials] != b.prefix {
+		return "", nil, false
+	}
+	// The shared Secret's layout, with the cluster's keys
+	data := map[string][]byte{}
+	for key, name := range map[string]string{
+		secretTokenKey:      TokenKey(cluster),
+		secretCACertKey:     CACertKey(cluster),
+		secretClientCertKey: ClientCertKey(cluster),
+		secretClientKeyKey:  ClientKeyKey(cluster),
+		secretHistoryKey:    HistoryKey(cluster),
+		secretMetadataKey:   ClusterMetadataKey(cluster),
+	} {
+		if value, ok := secret.Data[key]; ok {
+			data[name] = value
+		}
+	}
+	creds, ok := parseCredentialData(data, SourceSecret)[cluster]
+	return cluster, creds, ok
+}
+
+func (b *SecretsBackend) Set(ctx context.Context, cluster string, creds *Credentials) (err error) {
+	ctx, span := tracing.Start(ctx, "credentials.secrets.Set", tracing.AttrCluster.String(cluster))
+	defer func() { tracing.End(span, err) }()
+
+	if err := b.validate(cluster); err != nil {
+		return err
+	}
+	name := b.SecretName(cluster)
+	secrets := b.client.CoreV1().Secrets(b.namespace)
+	return retryWrite(func() error {
+		secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			secret = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: b.namespace}}
+			b.fill(ctx, secret, cluster, creds)
+			if _, err := secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+				return fmt.Errorf("creating secret: %w", err)
+			}
+			log.Printf("Created credentials secret %s/%s", b.namespace, name)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("getting secret: %w", err)
+		}
+		b.fill(ctx, secret, cluster, creds)
+		if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		log.Printf("Updated credentials secret %s/%s", b.namespace, name)
+		return nil
+	})
+}
+
+func (b *SecretsBackend) fill(ctx context.Context, secret *corev1.Secret, cluster string, creds *Credentials) {
+	b.meta.apply(ctx, secret)
+	secret.Labels[LabelCredentials] = b.prefix
+	secret.Labels[LabelCluster] = cluster
+	secret.Data = map[string][]byte{secretCACertKey: creds.CACert}
+	if creds.Token != "" {
+		secret.Data[secretTokenKey] = []byte(creds.Token)
+	}
+	if len(creds.ClientCert) > 0 {
+		secret.Data[secretClientCertKey] = creds.ClientCert
+		secret.Data[secretClientKeyKey] = creds.ClientKey
+	}
+	if len(creds.History) > 0 {
+		if history, err := json.Marshal(creds.History); err == nil {
+			secret.Data[secretHistoryKey] = history
+		}
+	}
+	if creds.Metadata != nil {
+		if metadata, err := json.Marshal(creds.Metadata); err == nil {
+			secret.Data[secretMetadataKey] = metadata
+		}
+	}
+}
+
+func (b *SecretsBackend) Delete(ctx context.Context, cluster string) (err error) {
+	ctx, span := tracing.Start(ctx, "credentials.secrets.Delete", tracing.AttrCluster.String(cluster))
+	defer func() { tracing.End(span, err) }()
+
+	err = b.client.CoreV1().Secrets(b.namespace).Delete(ctx, b.SecretName(cluster), metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("deleting secret: %w", err)
+	}
+	return nil
+}
+
+// Watch follows the labeled Secrets with an informer, reporting all
+// clusters' credentials on every change
+func (b *SecretsBackend) Watch(ctx context.Context, onChange func(map[string]*Credentials)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(b.client, 0,
+		informers.WithNamespace(b.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = b.selector()
+		}))
+	informer := factory.Core().V1().Secrets().Informer()
+
+	changed := func() {
+		result := make(map[string]*Credentials)
+		for _, obj := range informer.GetStore().List() {
+			if secret, ok := obj.(*corev1.Secret); ok {
+				if cluster, creds, ok := b.parse(secret); ok {
+					result[cluster] = creds
+				}
+			}
+		}
+		onChange(result)
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { changed() },
+		UpdateFunc: func(_, _ any) { changed() },
+		DeleteFunc: func(any) { changed() },
+	}); err != nil {
+		return fmt.Errorf("watching secrets: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+	return nil
+}
@@ -2,65 +2,113 @@ package credentials
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"strings"
+	"sort"
 	"sync"
+	"time"
 
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/errreport"
+	"github.com/rophy/kube-federated-auth/internal/tracing"
+)
+
+// Credential sources
+const (
+	SourceFile      = "file"      // bootstrap files (token_path, ca_cert)
+	SourceSecret    = "secret"    // loaded from the credentials Secret at startup
+	SourceDirectory = "directory" // loaded from the file backend's directory at startup
+	SourceRenewed   = "renewed"   // obtained via TokenRequest by this process
+	SourceOnboard   = "onboard"   // written by kfa onboard, recorded in History
+	SourceRestored  = "restored"  // imported from a backup Bundle
 )
 
 // Credentials holds the token and CA certificate for a cluster
 type Credentials struct {
 	Token  string
 	CACert []byte
+	// ClientCert and ClientKey are a PEM client certificate authenticating
+	// to the API server, used instead of or alongside Token
+	ClientCert []byte
+	ClientKey  []byte
+
+	// Source records where the credentials came from
+	Source string
+	// UpdatedAt is when this process stored the credentials
+	UpdatedAt time.Time
+	// ExpiresAt is the token's exp claim, or the client certificate's expiry
+	// if there is no token; zero if unknown
+	ExpiresAt time.Time
+	// History lists the most recent rotations, oldest first
+	History []Rotation
+	// Metadata describes the cluster, if it was reported when onboarding
+	Metadata *ClusterMetadata
 }
 
-// Store manages credentials for remote clusters
+// ErrReadOnly is returned when deleting credentials from a read-only Store
+var ErrReadOnly = errors.New("credential store is read-only")
+
+// Store manages credentials for remote clusters, persisting them to a Backend
 type Store struct {
 	mu          sync.RWMutex
 	credentials map[string]*Credentials
-	client      kubernetes.Interface
-	namespace   string
-	secretName  string
+	backend     Backend
+	reporter    *errreport.Tracker
+	// readOnly loads from and watches the backend but never writes to it
+	readOnly bool
+}
+
+// TokenKey returns the Secret data key holding a cluster's token
+func TokenKey(cluster string) string {
+	return fmt.Sprintf("%s-token", cluster)
+}
+
+// CACertKey returns the Secret data key holding a cluster's CA certificate
+func CACertKey(cluster string) string {
+	return fmt.Sprintf("%s-ca.crt", cluster)
+}
+
+// ClientCertKey returns the Secret data key holding a cluster's client certificate
+func ClientCertKey(cluster string) string {
+	return fmt.Sprintf("%s-client.crt", cluster)
 }
 
-// NewStore creates a new credential store
-// If running in-cluster, it will persist credentials to a Kubernetes Secret
-func NewStore(namespace, secretName string) (*Store, error) {
+// ClientKeyKey returns the Secret data key holding a cluster's client key
+func ClientKeyKey(cluster string) string {
+	return fmt.Sprintf("%s-client.key", cluster)
+}
+
+// NewStore creates a credential store that loads and persists credentials
+// through backend. A nil backend keeps credentials in memory only.
+func NewStore(backend Backend, reporter *errreport.Tracker) (*Store, error) {
 	s := &Store{
 		credentials: make(map[string]*Credentials),
-		namespace:   namespace,
-		secretName:  secretName,
-	}
-
-	// Try to create in-cluster client
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		log.Printf("Not running in cluster, credentials will not be persisted: %v", err)
-		return s, nil
+		backend:     backend,
+		reporter:    reporter,
 	}
 
-	client, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Printf("Failed to create Kubernetes client, credentials will not be persisted: %v", err)
-		return s, nil
+	// Load existing credentials from the backend
+	if err := s.load(context.Background()); err != nil {
+		log.Printf("Failed to load stored credentials: %v", err)
 	}
 
-	s.client = client
+	return s, nil
+}
 
-	// Load existing credentials from Secret
-	if err := s.loadFromSecret(context.Background()); err != nil {
-		log.Printf("Failed to load credentials from secret: %v", err)
-	}
+// SetReadOnly makes the store load from and watch its backend without ever
+// writing to it, e.g. for canary replicas. Renewed credentials are kept in
+// memory only; deletions fail with ErrReadOnly.
+func (s *Store) SetReadOnly(readOnly bool) {
+	s.readOnly = readOnly
+}
 
-	return s, nil
+// ReadOnly reports whether the store never writes to its backend
+func (s *Store) ReadOnly() bool {
+	return s.readOnly
 }
 
 // Get returns credentials for a cluster
@@ -71,131 +119,290 @@ func (s *Store) Get(cluster string) (*Credentials, bool) {
 	return creds, ok
 }
 
-// Set stores credentials for a cluster and persists to Secret
+// Set stores credentials for a cluster and persists them to the backend,
+// unless the store is read-only
 func (s *Store) Set(ctx context.Context, cluster string, creds *Credentials) error {
+	return s.set(ctx, cluster, creds, false)
+}
+
+// set stores creds, recording the rotation in the history of the current
+// credentials or, when restoring, in the history creds carry
+func (s *Store) set(ctx context.Context, cluster string, creds *Credentials, restore bool) error {
+	if creds.UpdatedAt.IsZero() {
+		creds.UpdatedAt = time.Now()
+	}
+	creds.ExpiresAt = expiresAt(creds)
+
 	s.mu.Lock()
+	var history []Rotation
+	if restore {
+		history = creds.History
+	} else if current, ok := s.credentials[cluster]; ok {
+		history = current.History
+		if creds.Metadata == nil {
+			creds.Metadata = current.Metadata
+		}
+	}
+	creds.History = AppendHistory(history, NewRotation(creds, writer, creds.Source, creds.UpdatedAt))
 	s.credentials[cluster] = creds
 	s.mu.Unlock()
 
-	// Persist to Secret if we have a client
-	if s.client != nil {
-		if err := s.saveToSecret(ctx); err != nil {
+	if s.backend != nil && !s.readOnly {
+		if err := s.backend.Set(ctx, cluster, creds); err != nil {
+			s.reporter.Failure(errreport.ComponentPersistence, cluster, err)
 			return fmt.Errorf("persisting credentials: %w", err)
 		}
+		s.reporter.Success(errreport.ComponentPersistence, cluster)
 	}
 
 	return nil
 }
 
-// loadFromSecret loads credentials from the Kubernetes Secret
-func (s *Store) loadFromSecret(ctx context.Context) error {
-	if s.client == nil {
-		return nil
+// Export returns a copy of all credentials in memory, for a backup Bundle
+func (s *Store) Export() map[string]*Credentials {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[string]*Credentials, len(s.credentials))
+	for cluster, creds := range s.credentials {
+		c := *creds
+		result[cluster] = &c
 	}
+	return result
+}
 
-	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.secretName, metav1.GetOptions{})
-	if err != nil {
-		if errors.IsNotFound(err) {
-			log.Printf("Credentials secret %s/%s not found, starting fresh", s.namespace, s.secretName)
-			return nil
+// Import stores restored credentials, e.g. from a backup Bundle, replacing
+// those of the same clusters, and returns the imported clusters. Their
+// histories are kept, with the restore recorded as a rotation.
+func (s *Store) Import(ctx context.Context, creds map[string]*Credentials) ([]string, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	clusters := make([]string, 0, len(creds))
+	for cluster := range creds {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	for i, cluster := range clusters {
+		c := *creds[cluster]
+		c.Source, c.UpdatedAt = SourceRestored, time.Time{}
+		if err := s.set(ctx, cluster, &c, true); err != nil {
+			return clusters[:i], fmt.Errorf("cluster %s: %w", cluster, err)
 		}
-		return fmt.Errorf("getting secret: %w", err)
+		log.Printf("Restored credentials for cluster %s", cluster)
 	}
+	return clusters, nil
+}
 
+// Delete removes a cluster's credentials from memory and the backend.
+// Deleting missing credentials is not an error.
+func (s *Store) Delete(ctx context.Context, cluster string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	delete(s.credentials, cluster)
+	s.mu.Unlock()
 
-	// Parse credentials from secret data
-	// Format: {name}-token, {name}-ca.crt
-	clusters := make(map[string]bool)
-	for key := range secret.Data {
-		if strings.HasSuffix(key, "-token") {
-			clusters[strings.TrimSuffix(key, "-token")] = true
-		} else if strings.HasSuffix(key, "-ca.crt") {
-			clusters[strings.TrimSuffix(key, "-ca.crt")] = true
+	if s.backend != nil {
+		if err := s.backend.Delete(ctx, cluster); err != nil {
+			s.reporter.Failure(errreport.ComponentPersistence, cluster, err)
+			return fmt.Errorf("deleting credentials: %w", err)
 		}
 	}
+	log.Printf("Deleted credentials for cluster %s", cluster)
+	return nil
+}
 
-	for cluster := range clusters {
-		tokenKey := fmt.Sprintf("%s-token", cluster)
-		caKey := fmt.Sprintf("%s-ca.crt", cluster)
-
-		token, hasToken := secret.Data[tokenKey]
-		ca, hasCA := secret.Data[caKey]
-
-		if hasToken && hasCA {
-			s.credentials[cluster] = &Credentials{
-				Token:  string(token),
-				CACert: ca,
-			}
-			log.Printf("Loaded credentials for cluster %s from secret", cluster)
+// Prune deletes the stored credentials of clusters that are not in clusters,
+// e.g. decommissioned ones removed from the config, and returns their names
+func (s *Store) Prune(ctx context.Context, clusters map[string]config.ClusterConfig) ([]string, error) {
+	if s.backend == nil {
+		return nil, nil
+	}
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	stored, err := s.backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for cluster := range stored {
+		if _, ok := clusters[cluster]; ok {
+			continue
 		}
+		if err := s.Delete(ctx, cluster); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, cluster)
 	}
-
-	return nil
+	sort.Strings(pruned)
+	return pruned, nil
 }
 
-// saveToSecret persists all credentials to the Kubernetes Secret
-func (s *Store) saveToSecret(ctx context.Context) error {
-	if s.client == nil {
+// load reads all stored credentials from the backend
+func (s *Store) load(ctx context.Context) (err error) {
+	if s.backend == nil {
 		return nil
 	}
 
-	s.mu.RLock()
-	data := make(map[string][]byte)
-	for cluster, creds := range s.credentials {
-		data[fmt.Sprintf("%s-token", cluster)] = []byte(creds.Token)
-		data[fmt.Sprintf("%s-ca.crt", cluster)] = creds.CACert
+	ctx, span := tracing.Start(ctx, "credentials.load")
+	defer func() { tracing.End(span, err) }()
+
+	stored, err := s.backend.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for cluster, creds := range stored {
+		creds.UpdatedAt = time.Now()
+		creds.ExpiresAt = expiresAt(creds)
+		s.credentials[cluster] = creds
+		log.Printf("Loaded credentials for cluster %s from %s", cluster, creds.Source)
 	}
-	s.mu.RUnlock()
+	return nil
+}
 
-	secret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      s.secretName,
-			Namespace: s.namespace,
-		},
-		Data: data,
+// Watch follows the backend until ctx is done, reloading credentials that are
+// changed by other writers, e.g. an operator rotating a token by patching the
+// Secret, and invalidating the verifiers of the changed clusters. If
+// invalidator is a CredentialsValidator, changed credentials that fail its
+// check are not loaded. Replicas sharing a backend thus converge on each
+// other's writes within a watch event (a poll interval for the file backend).
+// Credentials removed from the backend are dropped as well, unless memory
+// holds different ones such as bootstrap credentials.
+func (s *Store) Watch(ctx context.Context, invalidator VerifierInvalidator) error {
+	if s.backend == nil {
+		return nil
 	}
 
-	// Try to update first, create if not exists
-	_, err := s.client.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	// Changes are relative to the backend's last contents, so the current
+	// contents reported when the watch starts are not reloaded over
+	// bootstrap credentials
+	last, err := s.backend.List(ctx)
 	if err != nil {
-		if errors.IsNotFound(err) {
-			_, err = s.client.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
-			if err != nil {
-				return fmt.Errorf("creating secret: %w", err)
+		return err
+	}
+	return s.backend.Watch(ctx, func(stored map[string]*Credentials) {
+		for cluster, creds := range stored {
+			if prev, ok := last[cluster]; ok && sameCredentials(prev, creds) {
+				continue
+			}
+			if !s.changed(cluster, creds) {
+				continue
+			}
+			if validator, ok := invalidator.(CredentialsValidator); ok {
+				if err := validator.ProbeCredentials(ctx, cluster, creds); err != nil {
+					log.Printf("Ignoring changed credentials for cluster %s: %v", cluster, err)
+					continue
+				}
+			}
+			if s.reload(cluster, creds) {
+				log.Printf("Reloaded changed credentials for cluster %s from %s", cluster, creds.Source)
+				invalidator.InvalidateVerifier(cluster)
 			}
-			log.Printf("Created credentials secret %s/%s", s.namespace, s.secretName)
-			return nil
 		}
-		return fmt.Errorf("updating secret: %w", err)
-	}
+		for cluster, prev := range last {
+			if _, ok := stored[cluster]; ok {
+				continue
+			}
+			if s.forget(cluster, prev) {
+				// Deleted by another replica, e.g. a deregistration
+				log.Printf("Credentials for cluster %s were removed from the backend, dropping them", cluster)
+				invalidator.InvalidateVerifier(cluster)
+			} else {
+				log.Printf("Credentials for cluster %s were removed from the backend, keeping them in memory", cluster)
+			}
+		}
+		last = stored
+	})
+}
 
-	log.Printf("Updated credentials secret %s/%s", s.namespace, s.secretName)
-	return nil
+// changed reports whether stored credentials differ from those in memory;
+// this process's own writes do not
+func (s *Store) changed(cluster string, creds *Credentials) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	current, ok := s.credentials[cluster]
+	return !ok || !sameCredentials(current, creds)
 }
 
-// LoadFromFiles loads bootstrap credentials from files (for initial setup)
-func (s *Store) LoadFromFiles(cluster, tokenPath, caPath string) error {
-	token, err := os.ReadFile(tokenPath)
-	if err != nil {
-		return fmt.Errorf("reading token file: %w", err)
+// forget drops a cluster's credentials if they are the removed stored ones,
+// keeping others such as bootstrap credentials loaded from files
+func (s *Store) forget(cluster string, removed *Credentials) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.credentials[cluster]
+	if !ok || !sameCredentials(current, removed) {
+		return false
+	}
+	delete(s.credentials, cluster)
+	return true
+}
+
+// reload replaces a cluster's credentials with stored ones, reporting whether
+// they differ from those in memory
+func (s *Store) reload(cluster string, creds *Credentials) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.credentials[cluster]; ok && sameCredentials(current, creds) {
+		return false
 	}
+	creds.UpdatedAt = time.Now()
+	creds.ExpiresAt = expiresAt(creds)
+	s.credentials[cluster] = creds
+	return true
+}
 
-	ca, err := os.ReadFile(caPath)
+// LoadBootstrap loads bootstrap credentials (for initial setup) from the
+// cluster's token_path and/or client_cert and client_key, and its ca_cert file
+// or inline ca_cert_data, or from its kubeconfig
+func (s *Store) LoadBootstrap(cluster string, cfg config.ClusterConfig) error {
+	creds, err := readBootstrap(cfg)
 	if err != nil {
-		return fmt.Errorf("reading CA file: %w", err)
+		return err
 	}
+	s.setBootstrap(cluster, creds)
+	log.Printf("Loaded bootstrap credentials for cluster %s", cluster)
+	return nil
+}
+
+// setBootstrap stores bootstrap credentials in memory only
+func (s *Store) setBootstrap(cluster string, creds *Credentials) {
+	creds.UpdatedAt = time.Now()
+	creds.ExpiresAt = expiresAt(creds)
 
 	s.mu.Lock()
-	s.credentials[cluster] = &Credentials{
-		Token:  string(token),
-		CACert: ca,
+	// Keep the stored history for the next rotation
+	if current, ok := s.credentials[cluster]; ok {
+		creds.History = current.History
+		creds.Metadata = current.Metadata
 	}
+	s.credentials[cluster] = creds
 	s.mu.Unlock()
+}
 
-	log.Printf("Loaded bootstrap credentials for cluster %s from files", cluster)
-	return nil
+// expiresAt returns the token's exp claim, or without a token the client
+// certificate's expiry; zero if neither can be read
+func expiresAt(creds *Credentials) time.Time {
+	if creds.Token != "" {
+		exp, err := getTokenExpiration(creds.Token)
+		if err != nil {
+			return time.Time{}
+		}
+		return exp
+	}
+	block, _ := pem.Decode(creds.ClientCert)
+	if block == nil {
+		return time.Time{}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}
+	}
+	return cert.NotAfter
 }
 
 // ParseBase64CACert decodes a base64-encoded CA certificate
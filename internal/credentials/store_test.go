@@ -0,0 +1,327 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+type recordingInvalidator struct {
+	mu       sync.Mutex
+	clusters []string
+}
+
+func (r *recordingInvalidator) InvalidateVerifier(cluster string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clusters = append(r.clusters, cluster)
+}
+
+func (r *recordingInvalidator) invalidated() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.clusters...)
+}
+
+func TestStoreWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := NewSecretBackend(fake.NewSimpleClientset(), "kfa", "kfa")
+	if err := backend.Set(ctx, "cluster-b", &Credentials{Token: "old", CACert: []byte("ca")}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidator := &recordingInvalidator{}
+	go store.Watch(ctx, invalidator)
+
+	// This process's own writes do not invalidate
+	if err := store.Set(ctx, "cluster-c", &Credentials{Token: "renewed", CACert: []byte("ca"), Source: SourceRenewed}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewritten until seen, as the watch may start after the first write
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; ; i++ {
+		token := fmt.Sprintf("rotated-%d", i)
+		if err := backend.Set(ctx, "cluster-b", &Credentials{Token: token, CACert: []byte("ca")}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if creds, _ := store.Get("cluster-b"); strings.HasPrefix(creds.Token, "rotated-") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rotated token not reloaded")
+		}
+	}
+
+	got := invalidator.invalidated()
+	if len(got) == 0 {
+		t.Error("cluster-b verifier not invalidated")
+	}
+	for _, cluster := range got {
+		if cluster != "cluster-b" {
+			t.Errorf("invalidated %s, want only cluster-b", cluster)
+		}
+	}
+	if creds, _ := store.Get("cluster-c"); creds.Source != SourceRenewed {
+		t.Errorf("cluster-c source = %q, want own write kept", creds.Source)
+	}
+}
+
+func TestStoreWatch_Replicas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset()
+	a, err := NewStore(NewSecretsBackend(client, "kfa", "kfa"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewStore(NewSecretsBackend(client, "kfa", "kfa"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidator := &recordingInvalidator{}
+	go b.Watch(ctx, invalidator)
+
+	waitFor := func(what string, cond func() bool, write func(i int)) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for i := 0; !cond(); i++ {
+			if time.Now().After(deadline) {
+				t.Fatalf("replica b: %s not seen", what)
+			}
+			write(i)
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// Replica a registers credentials, rewritten until b's watch runs
+	waitFor("registration", func() bool {
+		creds, ok := b.Get("cluster-b")
+		return ok && strings.HasPrefix(creds.Token, "registered-")
+	}, func(i int) {
+		if err := a.Set(ctx, "cluster-b", &Credentials{Token: fmt.Sprintf("registered-%d", i), CACert: []byte("ca")}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Replica a deregisters the cluster
+	if err := a.Delete(ctx, "cluster-b"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("deregistration", func() bool {
+		_, ok := b.Get("cluster-b")
+		return !ok
+	}, func(int) {})
+
+	if got := invalidator.invalidated(); len(got) < 2 {
+		t.Errorf("invalidated %v, want cluster-b on registration and deregistration", got)
+	}
+}
+
+func TestStoreWatchBootstrap(t *testing.T) {
+	saved := bootstrapWatchInterval
+	bootstrapWatchInterval = 10 * time.Millisecond
+	defer func() { bootstrapWatchInterval = saved }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	tokenPath, caPath := filepath.Join(dir, "token"), filepath.Join(dir, "ca.crt")
+	for path, content := range map[string]string{tokenPath: "first", caPath: "ca"} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"cluster-b": {APIServer: "https://192.168.1.100:6443", TokenPath: tokenPath, CACert: caPath},
+	}}
+	store, err := NewStore(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LoadBootstrap("cluster-b", cfg.Clusters["cluster-b"]); err != nil {
+		t.Fatal(err)
+	}
+	invalidator := &recordingInvalidator{}
+	go store.WatchBootstrap(ctx, cfg, invalidator)
+
+	// Rewritten until seen, as the watch may start after the first write
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; ; i++ {
+		if err := os.WriteFile(tokenPath, []byte(fmt.Sprintf("rotated-%d", i)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if creds, _ := store.Get("cluster-b"); strings.HasPrefix(creds.Token, "rotated-") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rotated token file not reloaded")
+		}
+	}
+	if got := invalidator.invalidated(); len(got) == 0 || got[0] != "cluster-b" {
+		t.Errorf("invalidated %v, want cluster-b", got)
+	}
+}
+
+func TestStoreHistory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	backend, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range MaxHistory + 2 {
+		token := tokenIssuedAt(time.Now().Add(time.Duration(-i) * time.Minute))
+		if err := store.Set(ctx, "cluster-b", &Credentials{Token: token, CACert: []byte("ca"), Source: SourceRenewed}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The history survives a restart
+	restarted, err := NewStore(backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, ok := restarted.Get("cluster-b")
+	if !ok {
+		t.Fatal("credentials not reloaded")
+	}
+	if len(creds.History) != MaxHistory {
+		t.Fatalf("history has %d rotations, want %d", len(creds.History), MaxHistory)
+	}
+	last := creds.History[MaxHistory-1]
+	if last.By != writer || last.Source != SourceRenewed || last.Subject != "system:serviceaccount:kube-federated-auth:reader" || last.At.IsZero() {
+		t.Errorf("last rotation = %+v", last)
+	}
+
+	// Unreadable history does not hide the credentials
+	if err := os.WriteFile(filepath.Join(dir, HistoryKey("cluster-b")), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if creds, err := backend.Get(ctx, "cluster-b"); err != nil || creds.History != nil {
+		t.Errorf("Get with unreadable history = %+v, %v", creds, err)
+	}
+}
+
+func TestStoreClusterMetadata(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := &ClusterMetadata{KubernetesVersion: "v1.31.2", Region: "eu-west-1", Labels: map[string]string{"env": "prod"}}
+	if err := backend.Set(ctx, "cluster-b", &Credentials{Token: "onboarded", CACert: []byte("ca"), Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewals keep the metadata reported at onboarding
+	if err := store.Set(ctx, "cluster-b", &Credentials{Token: "renewed", CACert: []byte("ca"), Source: SourceRenewed}); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := backend.Get(ctx, "cluster-b")
+	if err != nil || creds.Token != "renewed" {
+		t.Fatalf("Get = %+v, %v", creds, err)
+	}
+	if got := creds.Metadata; got == nil || got.KubernetesVersion != "v1.31.2" || got.Region != "eu-west-1" || got.Labels["env"] != "prod" {
+		t.Errorf("metadata = %+v, want %+v", got, metadata)
+	}
+}
+
+func TestStoreReadOnly(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Set(ctx, "cluster-b", &Credentials{Token: "stored", CACert: []byte("ca")}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetReadOnly(true)
+
+	// Renewals are kept in memory only
+	if err := store.Set(ctx, "cluster-b", &Credentials{Token: "renewed", CACert: []byte("ca"), Source: SourceRenewed}); err != nil {
+		t.Fatal(err)
+	}
+	if creds, _ := store.Get("cluster-b"); creds.Token != "renewed" {
+		t.Errorf("memory token = %q, want renewed", creds.Token)
+	}
+	if creds, err := backend.Get(ctx, "cluster-b"); err != nil || creds.Token != "stored" {
+		t.Errorf("stored token = %+v, %v, want unchanged", creds, err)
+	}
+
+	if err := store.Delete(ctx, "cluster-b"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete err = %v, want ErrReadOnly", err)
+	}
+	if _, ok := store.Get("cluster-b"); !ok {
+		t.Error("rejected Delete removed the credentials from memory")
+	}
+	if _, err := store.Prune(ctx, nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Prune err = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestStorePrune(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cluster := range []string{"cluster-b", "decommissioned", "removed"} {
+		if err := backend.Set(ctx, cluster, &Credentials{Token: "t", CACert: []byte("ca")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := NewStore(backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := store.Prune(ctx, map[string]config.ClusterConfig{"cluster-b": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(pruned, []string{"decommissioned", "removed"}) {
+		t.Errorf("pruned = %v", pruned)
+	}
+	if _, ok := store.Get("removed"); ok {
+		t.Error("pruned credentials still in memory")
+	}
+	all, err := backend.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all["cluster-b"] == nil {
+		t.Errorf("stored = %v, want only cluster-b", all)
+	}
+}
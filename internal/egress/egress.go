@@ -0,0 +1,132 @@
+// Package egress builds outbound dialers for clusters that must be reached
+// from a specific local address, network interface, or through an egress proxy.
+package egress
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"k8s.io/client-go/rest"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// DialFunc matches net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Dialer returns a dial function bound to the configured local address or
+// interface, or nil when cfg does not constrain the source address.
+func Dialer(cfg *config.EgressSettings) (DialFunc, error) {
+	if cfg == nil || (cfg.LocalAddress == "" && cfg.Interface == "") {
+		return nil, nil
+	}
+
+	ip, err := sourceIP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: ip},
+	}
+	return d.DialContext, nil
+}
+
+func sourceIP(cfg *config.EgressSettings) (net.IP, error) {
+	if cfg.LocalAddress != "" {
+		ip := net.ParseIP(cfg.LocalAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local_address %q", cfg.LocalAddress)
+		}
+		return ip, nil
+	}
+
+	iface, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("interface %q: %w", cfg.Interface, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %q: %w", cfg.Interface, err)
+	}
+	// Prefer IPv4; fall back to the first global unicast IPv6 address
+	var v6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+	if v6 != nil {
+		return v6, nil
+	}
+	return nil, fmt.Errorf("interface %q has no usable address", cfg.Interface)
+}
+
+// Proxy returns the proxy function for cfg, or nil to use the environment default
+func Proxy(cfg *config.EgressSettings) (func(*http.Request) (*url.URL, error), error) {
+	if cfg == nil || cfg.ProxyURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_url: %w", err)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// Transport returns an HTTP transport using tlsConfig and the egress settings.
+// It clones http.DefaultTransport so timeouts and environment proxies still apply.
+func Transport(cfg *config.EgressSettings, tlsConfig *tls.Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	dial, err := Dialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if dial != nil {
+		transport.DialContext = dial
+	}
+
+	proxy, err := Proxy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		transport.Proxy = proxy
+	}
+	return transport, nil
+}
+
+// ApplyREST configures a client-go REST config with the egress settings
+func ApplyREST(cfg *config.EgressSettings, restConfig *rest.Config) error {
+	dial, err := Dialer(cfg)
+	if err != nil {
+		return err
+	}
+	if dial != nil {
+		restConfig.Dial = dial
+	}
+
+	proxy, err := Proxy(cfg)
+	if err != nil {
+		return err
+	}
+	if proxy != nil {
+		restConfig.Proxy = proxy
+	}
+	return nil
+}
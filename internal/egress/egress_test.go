@@ -0,0 +1,76 @@
+package egress
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func TestTransport_LocalAddress(t *testing.T) {
+	var remote string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}))
+	defer srv.Close()
+
+	transport, err := Transport(&config.EgressSettings{LocalAddress: "127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatalf("Transport: %v", err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+
+	if remote != "127.0.0.1" {
+		t.Errorf("server saw connection from %q, want 127.0.0.1", remote)
+	}
+}
+
+func TestTransport_Proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		io.WriteString(w, "ok")
+	}))
+	defer proxy.Close()
+
+	transport, err := Transport(&config.EgressSettings{ProxyURL: proxy.URL}, nil)
+	if err != nil {
+		t.Fatalf("Transport: %v", err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://spoke.example.invalid/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+
+	if proxied != "http://spoke.example.invalid/.well-known/openid-configuration" {
+		t.Errorf("proxy received %q", proxied)
+	}
+}
+
+func TestTransport_EnvironmentProxyFallback(t *testing.T) {
+	transport, err := Transport(nil, &tls.Config{})
+	if err != nil {
+		t.Fatalf("Transport: %v", err)
+	}
+	if transport.Proxy == nil {
+		t.Error("without proxy_url the transport should honor HTTPS_PROXY/NO_PROXY")
+	}
+}
+
+func TestDialer_Errors(t *testing.T) {
+	if d, err := Dialer(nil); d != nil || err != nil {
+		t.Errorf("Dialer(nil) = %v, %v; want nil, nil", d, err)
+	}
+	if _, err := Dialer(&config.EgressSettings{Interface: "does-not-exist0"}); err == nil {
+		t.Error("expected error for unknown interface")
+	}
+}
@@ -0,0 +1,240 @@
+// Package errreport pages an external error tracker (Sentry or a generic
+// webhook) when verifier creation or credential persistence keeps failing for
+// a cluster, before kube-apiservers start rejecting every request.
+package errreport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/notify"
+	"github.com/rophy/kube-federated-auth/internal/redact"
+	"github.com/rophy/kube-federated-auth/internal/version"
+)
+
+// Components whose failures are tracked
+const (
+	ComponentVerifier    = "verifier"
+	ComponentPersistence = "credential-persistence"
+)
+
+// Report describes a run of consecutive failures
+type Report struct {
+	Component string    `json:"component"`
+	Cluster   string    `json:"cluster"`
+	Message   string    `json:"message"`
+	Failures  int       `json:"failures"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Reporter delivers reports to an error tracker
+type Reporter interface {
+	Report(r Report) error
+}
+
+// Tracker counts consecutive failures per component and cluster and sends one
+// report to every reporter when a run reaches the threshold. A success ends
+// the run, so a later run is reported again. A nil *Tracker ignores calls.
+type Tracker struct {
+	threshold int
+	reporters []Reporter
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+// NewTracker returns a tracker reporting after threshold consecutive failures
+func NewTracker(threshold int, reporters ...Reporter) *Tracker {
+	return &Tracker{threshold: threshold, reporters: reporters, failures: map[string]int{}}
+}
+
+// New builds a tracker from settings. Verifier reports are also sent to
+// notifier as verifier_down notifications. Returns nil if neither error
+// reporting nor a verifier_down route is configured.
+func New(cfg *config.ErrorReportingSettings, notifier *notify.Router) (*Tracker, error) {
+	var reporters []Reporter
+	if notifier.Routes(config.NotifyVerifierDown) {
+		reporters = append(reporters, &notifyReporter{notifier: notifier})
+	}
+	if cfg == nil {
+		if len(reporters) == 0 {
+			return nil, nil
+		}
+		return NewTracker(config.DefaultErrorReportingThreshold, reporters...), nil
+	}
+	if cfg.WebhookURL != "" {
+		reporters = append(reporters, NewWebhookReporter(cfg.WebhookURL))
+	}
+	if cfg.SentryDSN != "" {
+		sentry, err := NewSentryReporter(cfg.SentryDSN)
+		if err != nil {
+			return nil, err
+		}
+		reporters = append(reporters, sentry)
+	}
+	return NewTracker(cfg.GetThreshold(), reporters...), nil
+}
+
+func key(component, cluster string) string {
+	return component + "/" + cluster
+}
+
+// Failure records a failure of component for cluster
+func (t *Tracker) Failure(component, cluster string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	k := key(component, cluster)
+	t.failures[k]++
+	n := t.failures[k]
+	t.mu.Unlock()
+
+	if n != t.threshold {
+		return
+	}
+	r := Report{
+		Component: component,
+		Cluster:   cluster,
+		Message:   redact.Error(err),
+		Failures:  n,
+		Timestamp: time.Now().UTC(),
+	}
+	for _, reporter := range t.reporters {
+		go func() {
+			if err := reporter.Report(r); err != nil {
+				log.Printf("Error reporting failed for %s %s: %v", component, cluster, err)
+			}
+		}()
+	}
+}
+
+// Success ends any run of failures of component for cluster
+func (t *Tracker) Success(component, cluster string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.failures, key(component, cluster))
+	t.mu.Unlock()
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func post(req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notifyReporter forwards verifier reports to the notification router
+type notifyReporter struct {
+	notifier *notify.Router
+}
+
+func (n *notifyReporter) Report(r Report) error {
+	if r.Component != ComponentVerifier {
+		return nil
+	}
+	n.notifier.Send(notify.Notification{
+		Type:      config.NotifyVerifierDown,
+		Severity:  notify.SeverityCritical,
+		Cluster:   r.Cluster,
+		Summary:   fmt.Sprintf("verifier failing (%d consecutive failures): %s", r.Failures, r.Message),
+		Timestamp: r.Timestamp,
+	})
+	return nil
+}
+
+// WebhookReporter POSTs each Report as JSON
+type WebhookReporter struct {
+	url string
+}
+
+// NewWebhookReporter returns a reporter posting to url
+func NewWebhookReporter(url string) *WebhookReporter {
+	return &WebhookReporter{url: url}
+}
+
+func (w *WebhookReporter) Report(r Report) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return post(req)
+}
+
+// SentryReporter sends each Report as a Sentry error event through the store
+// endpoint of the project identified by a DSN
+type SentryReporter struct {
+	endpoint  string
+	publicKey string
+}
+
+// NewSentryReporter parses a DSN of the form https://<key>@<host>/<project>
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parsing sentry_dsn: %w", err)
+	}
+	project := strings.TrimPrefix(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" || u.Host == "" {
+		return nil, fmt.Errorf("sentry_dsn must be of the form https://<key>@<host>/<project>")
+	}
+	prefix := ""
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	return &SentryReporter{
+		endpoint:  fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project),
+		publicKey: u.User.Username(),
+	}, nil
+}
+
+func (s *SentryReporter) Report(r Report) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := map[string]any{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   r.Timestamp.Format(time.RFC3339),
+		"level":       "error",
+		"logger":      r.Component,
+		"platform":    "go",
+		"release":     version.Version,
+		"message":     fmt.Sprintf("%s failing for cluster %s (%d consecutive failures): %s", r.Component, r.Cluster, r.Failures, r.Message),
+		"tags":        map[string]string{"component": r.Component, "cluster": r.Cluster},
+		"fingerprint": []string{r.Component, r.Cluster},
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=kube-federated-auth/%s, sentry_key=%s", version.Version, s.publicKey))
+	return post(req)
+}
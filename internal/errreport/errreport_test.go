@@ -0,0 +1,96 @@
+package errreport
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type chanReporter chan Report
+
+func (c chanReporter) Report(r Report) error {
+	c <- r
+	return nil
+}
+
+func expectReports(t *testing.T, reports chanReporter, want int) {
+	t.Helper()
+	for i := 0; i < want; i++ {
+		select {
+		case <-reports:
+		case <-time.After(time.Second):
+			t.Fatalf("got %d reports, want %d", i, want)
+		}
+	}
+	select {
+	case r := <-reports:
+		t.Fatalf("unexpected report: %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTracker_Threshold(t *testing.T) {
+	reports := make(chanReporter, 10)
+	tracker := NewTracker(3, reports)
+	err := errors.New("connection refused")
+
+	tracker.Failure(ComponentVerifier, "cluster-b", err)
+	tracker.Failure(ComponentVerifier, "cluster-b", err)
+	tracker.Failure(ComponentVerifier, "cluster-c", err)
+	expectReports(t, reports, 0)
+
+	// Third consecutive failure reports once; further failures in the run do not
+	tracker.Failure(ComponentVerifier, "cluster-b", err)
+	tracker.Failure(ComponentVerifier, "cluster-b", err)
+	expectReports(t, reports, 1)
+
+	// A success starts a new run
+	tracker.Success(ComponentVerifier, "cluster-b")
+	for range 3 {
+		tracker.Failure(ComponentVerifier, "cluster-b", err)
+	}
+	expectReports(t, reports, 1)
+}
+
+func TestTracker_Nil(t *testing.T) {
+	var tracker *Tracker
+	tracker.Failure(ComponentPersistence, "cluster-b", errors.New("boom"))
+	tracker.Success(ComponentPersistence, "cluster-b")
+}
+
+func TestSentryReporter(t *testing.T) {
+	var gotPath, gotAuth string
+	var event map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("X-Sentry-Auth")
+		json.NewDecoder(r.Body).Decode(&event)
+	}))
+	defer srv.Close()
+
+	dsn := "http://publickey@" + srv.Listener.Addr().String() + "/42"
+	reporter, err := NewSentryReporter(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reporter.Report(Report{Component: ComponentVerifier, Cluster: "cluster-b", Message: "boom", Failures: 3, Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if gotPath != "/api/42/store/" {
+		t.Errorf("path = %q, want /api/42/store/", gotPath)
+	}
+	if gotAuth == "" {
+		t.Error("missing X-Sentry-Auth header")
+	}
+	if event["level"] != "error" {
+		t.Errorf("level = %v, want error", event["level"])
+	}
+
+	if _, err := NewSentryReporter("https://sentry.example.com/42"); err == nil {
+		t.Error("DSN without key: expected error, got nil")
+	}
+}
@@ -0,0 +1,151 @@
+// Package events publishes cluster credential lifecycle changes as Kubernetes
+// Events on the credentials Secret, and optionally to a webhook, so operators
+// can follow them with kubectl describe instead of tailing logs.
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/notify"
+)
+
+// Event reasons
+const (
+	ReasonCredentialsRenewed       = "CredentialsRenewed"
+	ReasonCredentialsRenewalFailed = "CredentialsRenewalFailed"
+	ReasonCredentialsExpired       = "CredentialsExpired"
+	ReasonCredentialsExpiring      = "CredentialsExpiring"
+	ReasonCredentialsNotUpdated    = "CredentialsNotUpdated"
+	ReasonCredentialsStale         = "CredentialsStale"
+	ReasonVerifierInvalidated      = "VerifierInvalidated"
+	ReasonCredentialsRejected      = "CredentialsRejected"
+	ReasonCredentialsHealthy       = "CredentialsHealthy"
+	ReasonCredentialsShortened     = "CredentialsShortened"
+)
+
+const component = "kube-federated-auth"
+
+// expiringReasons are the warnings forwarded as credential_expiring notifications
+var expiringReasons = map[string]bool{
+	ReasonCredentialsRenewalFailed: true,
+	ReasonCredentialsExpired:       true,
+	ReasonCredentialsExpiring:      true,
+	ReasonCredentialsNotUpdated:    true,
+	ReasonCredentialsStale:         true,
+	ReasonCredentialsRejected:      true,
+}
+
+// Recorder emits lifecycle events. A nil *Recorder discards events.
+type Recorder struct {
+	recorder   record.EventRecorder
+	object     *corev1.ObjectReference
+	webhookURL string
+	client     *http.Client
+	notifier   *notify.Router
+}
+
+// NewRecorder creates a recorder that attaches events to the credentials Secret
+// namespace/secretName. Kubernetes Events are only emitted when running in-cluster;
+// webhookURL, if set, additionally receives every event as JSON, and notifier
+// receives renewal failures and expiring credentials.
+func NewRecorder(namespace, secretName, webhookURL string, notifier *notify.Router) *Recorder {
+	r := &Recorder{
+		object: &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Namespace:  namespace,
+			Name:       secretName,
+		},
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		notifier:   notifier,
+	}
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Printf("Not running in cluster, Kubernetes Events will not be emitted: %v", err)
+		return r
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Printf("Failed to create Kubernetes client, Kubernetes Events will not be emitted: %v", err)
+		return r
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(namespace)})
+	r.recorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component})
+	return r
+}
+
+// WebhookEvent is the JSON body posted to the events webhook
+type WebhookEvent struct {
+	Type      string    `json:"type"`
+	Reason    string    `json:"reason"`
+	Cluster   string    `json:"cluster"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Normal records an informational event for cluster
+func (r *Recorder) Normal(cluster, reason, messageFmt string, args ...any) {
+	r.emit(corev1.EventTypeNormal, cluster, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// Warning records a warning event for cluster
+func (r *Recorder) Warning(cluster, reason, messageFmt string, args ...any) {
+	r.emit(corev1.EventTypeWarning, cluster, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *Recorder) emit(eventType, cluster, reason, message string) {
+	if r == nil {
+		return
+	}
+	if r.recorder != nil {
+		r.recorder.Eventf(r.object, eventType, reason, "cluster %s: %s", cluster, message)
+	}
+	if r.webhookURL != "" {
+		go r.post(WebhookEvent{Type: eventType, Reason: reason, Cluster: cluster, Message: message, Timestamp: time.Now()})
+	}
+	if eventType == corev1.EventTypeWarning && expiringReasons[reason] {
+		severity := notify.SeverityWarning
+		if reason == ReasonCredentialsExpired || reason == ReasonCredentialsRejected {
+			severity = notify.SeverityCritical
+		}
+		r.notifier.Send(notify.Notification{
+			Type:     config.NotifyCredentialExpiring,
+			Severity: severity,
+			Cluster:  cluster,
+			Summary:  fmt.Sprintf("%s: %s", reason, message),
+		})
+	}
+}
+
+func (r *Recorder) post(event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	resp, err := r.client.Post(r.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Events webhook delivery failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Events webhook returned status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,36 @@
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecorder_Webhook(t *testing.T) {
+	received := make(chan WebhookEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev WebhookEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		received <- ev
+	}))
+	defer srv.Close()
+
+	r := NewRecorder("kube-federated-auth", "kube-federated-auth", srv.URL, nil)
+	r.Warning("cluster-b", ReasonCredentialsRenewalFailed, "requesting token: %s", "forbidden")
+
+	select {
+	case ev := <-received:
+		if ev.Type != "Warning" || ev.Reason != ReasonCredentialsRenewalFailed || ev.Cluster != "cluster-b" || ev.Message != "requesting token: forbidden" {
+			t.Errorf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook did not receive event")
+	}
+}
+
+func TestRecorder_Nil(t *testing.T) {
+	var r *Recorder
+	r.Normal("cluster-a", ReasonCredentialsRenewed, "ok") // must not panic
+}
@@ -0,0 +1,165 @@
+// Package execcred runs client-go exec credential plugins, such as
+// aws-iam-authenticator or aws eks get-token, for the bearer tokens of
+// clusters configured with exec, caching each token until it expires.
+package execcred
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/rest"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// expiryMargin renews a token this long before its expirationTimestamp, so
+// that it does not expire in flight
+const expiryMargin = 30 * time.Second
+
+// execCredential is the subset of client.authentication.k8s.io ExecCredential
+// read and written here, identical in v1 and v1beta1
+type execCredential struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Interactive bool `json:"interactive"`
+	} `json:"spec"`
+	Status *struct {
+		Token               string     `json:"token"`
+		ExpirationTimestamp *time.Time `json:"expirationTimestamp,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+// Provider obtains tokens from one exec plugin configuration
+type Provider struct {
+	settings config.ExecSettings
+	now      func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time // zero: until rejected
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = make(map[string]*Provider)
+)
+
+// For returns the provider of settings, shared by all clients with the same
+// settings so that the plugin's token is cached across them
+func For(settings *config.ExecSettings) *Provider {
+	key, _ := json.Marshal(settings)
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if p, ok := providers[string(key)]; ok {
+		return p
+	}
+	p := &Provider{settings: *settings, now: time.Now}
+	providers[string(key)] = p
+	return p
+}
+
+// Token returns the cached token, running the plugin if there is none or it
+// is about to expire
+func (p *Provider) Token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && (p.expiry.IsZero() || p.now().Before(p.expiry.Add(-expiryMargin))) {
+		return p.token, nil
+	}
+
+	token, expiry, err := p.run(ctx)
+	if err != nil {
+		return "", err
+	}
+	p.token, p.expiry = token, expiry
+	return token, nil
+}
+
+// Invalidate drops a token, e.g. one the API server rejected, so that the
+// plugin is run again on the next request
+func (p *Provider) Invalidate(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token == token {
+		p.token = ""
+	}
+}
+
+func (p *Provider) run(ctx context.Context) (string, time.Time, error) {
+	version := p.settings.GetAPIVersion()
+	info := execCredential{APIVersion: version, Kind: "ExecCredential"}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, p.settings.Command, p.settings.Args...)
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(infoJSON))
+	for name, value := range p.settings.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", time.Time{}, fmt.Errorf("exec plugin %s: %w: %s", p.settings.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var cred execCredential
+	if err := json.Unmarshal(stdout.Bytes(), &cred); err != nil {
+		return "", time.Time{}, fmt.Errorf("exec plugin %s: decoding ExecCredential: %w", p.settings.Command, err)
+	}
+	if cred.Kind != "ExecCredential" || cred.APIVersion != version {
+		return "", time.Time{}, fmt.Errorf("exec plugin %s: got %s %s, want ExecCredential %s", p.settings.Command, cred.APIVersion, cred.Kind, version)
+	}
+	if cred.Status == nil || cred.Status.Token == "" {
+		return "", time.Time{}, fmt.Errorf("exec plugin %s: ExecCredential has no token", p.settings.Command)
+	}
+	var expiry time.Time
+	if cred.Status.ExpirationTimestamp != nil {
+		expiry = *cred.Status.ExpirationTimestamp
+	}
+	return cred.Status.Token, expiry, nil
+}
+
+// RoundTripper authenticates requests with the provider's token, dropping
+// it when the server answers 401 Unauthorized
+func (p *Provider) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	return &roundTripper{provider: p, next: next}
+}
+
+type roundTripper struct {
+	provider *Provider
+	next     http.RoundTripper
+}
+
+func (t *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.provider.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.provider.Invalidate(token)
+	}
+	return resp, err
+}
+
+// ApplyREST configures a client-go REST config to authenticate with the exec
+// plugin of settings, if any
+func ApplyREST(settings *config.ExecSettings, restConfig *rest.Config) {
+	if settings == nil {
+		return
+	}
+	restConfig.WrapTransport = For(settings).RoundTripper
+}
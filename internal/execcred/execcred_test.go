@@ -0,0 +1,104 @@
+package execcred
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// plugin returns settings for a shell plugin that counts its runs in a file
+// and prints an ExecCredential expiring at expiry
+func plugin(t *testing.T, expiry string) (*config.ExecSettings, func() int) {
+	t.Helper()
+	runs := filepath.Join(t.TempDir(), "runs")
+	script := `echo run >> "$RUNS"
+case "$KUBERNETES_EXEC_INFO" in *'"apiVersion":"client.authentication.k8s.io/v1beta1"'*) ;; *) exit 1;; esac
+n=$(wc -l < "$RUNS" | tr -d ' ')
+printf '{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"token":"token-%s"%s}}' "$n" "$EXPIRY"`
+	settings := &config.ExecSettings{
+		Command: "sh",
+		Args:    []string{"-c", script},
+		Env:     map[string]string{"RUNS": runs},
+	}
+	if expiry != "" {
+		settings.Env["EXPIRY"] = `,"expirationTimestamp":"` + expiry + `"`
+	}
+	return settings, func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "run")
+	}
+}
+
+func TestProvider_CachesUntilExpiry(t *testing.T) {
+	ctx := context.Background()
+	settings, runs := plugin(t, "2030-01-01T00:00:00Z")
+	p := For(settings)
+	now := time.Date(2029, 12, 31, 23, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	for range 2 {
+		if token, err := p.Token(ctx); err != nil || token != "token-1" {
+			t.Fatalf("Token = %q, %v, want token-1", token, err)
+		}
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("plugin ran %d times, want the token cached", n)
+	}
+	if For(settings) != p {
+		t.Error("For returned a new provider for the same settings")
+	}
+
+	// Within the margin before expiry the plugin runs again
+	now = time.Date(2029, 12, 31, 23, 59, 40, 0, time.UTC)
+	if token, err := p.Token(ctx); err != nil || token != "token-2" {
+		t.Errorf("Token near expiry = %q, %v, want token-2", token, err)
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	settings, runs := plugin(t, "")
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: For(settings).RoundTripper(http.DefaultTransport)}
+	for range 3 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// The rejected token is replaced, the next one kept without an expiry
+	want := []string{"Bearer token-1", "Bearer token-2", "Bearer token-2"}
+	if strings.Join(seen, ",") != strings.Join(want, ",") || runs() != 2 {
+		t.Errorf("Authorization = %v after %d runs, want %v after 2", seen, runs(), want)
+	}
+}
+
+func TestProvider_Errors(t *testing.T) {
+	for name, script := range map[string]string{
+		"failure":       "echo denied >&2; exit 1",
+		"not json":      "echo token",
+		"wrong kind":    `echo '{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"Secret"}'`,
+		"no token":      `echo '{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{}}'`,
+		"wrong version": `echo '{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","status":{"token":"t"}}'`,
+	} {
+		p := For(&config.ExecSettings{Command: "sh", Args: []string{"-c", script}})
+		if token, err := p.Token(context.Background()); err == nil {
+			t.Errorf("%s: Token = %q, want error", name, token)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package expiry watches the expiry and age of each remote cluster's stored
+// credentials, so that operators are alerted while there is still time to
+// act, not once verification starts failing.
+package expiry
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/events"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+)
+
+// Monitor runs the expiry checks
+type Monitor struct {
+	config   *config.Config
+	store    *credentials.Store
+	recorder *events.Recorder
+	now      func() time.Time
+
+	mu sync.Mutex
+	// alerted records, per cluster and reason, the credentials last alerted
+	// on (by expiry or update time), so each is alerted on once
+	alerted map[string]map[string]time.Time
+}
+
+// New creates an expiry monitor. recorder may be nil.
+func New(cfg *config.Config, store *credentials.Store, recorder *events.Recorder) *Monitor {
+	return &Monitor{
+		config:   cfg,
+		store:    store,
+		recorder: recorder,
+		now:      time.Now,
+		alerted:  make(map[string]map[string]time.Time),
+	}
+}
+
+// Start begins checking all remote clusters every interval
+func (m *Monitor) Start(ctx context.Context) {
+	interval := m.config.ExpiryAlerts.GetInterval()
+	log.Printf("Starting credential expiry checks (interval: %s, warn before: %s)", interval, m.config.ExpiryAlerts.GetWarnBefore())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			m.checkAll()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (m *Monitor) checkAll() {
+	for cluster, cfg := range m.config.Clusters {
+		if cfg.IsRemote() {
+			m.check(cluster)
+		}
+	}
+}
+
+// check alerts on a cluster's credentials expiring within warn_before,
+// having expired, or not having been updated within max_update_age
+func (m *Monitor) check(cluster string) {
+	creds, ok := m.store.Get(cluster)
+	if !ok {
+		return
+	}
+	now := m.now()
+	settings := m.config.ExpiryAlerts
+
+	if !creds.ExpiresAt.IsZero() {
+		metrics.CredentialExpiry.WithLabelValues(cluster).Set(float64(creds.ExpiresAt.Unix()))
+		remaining := creds.ExpiresAt.Sub(now)
+		switch {
+		case remaining <= 0:
+			if m.first(cluster, events.ReasonCredentialsExpired, creds.ExpiresAt) {
+				m.recorder.Warning(cluster, events.ReasonCredentialsExpired, "token expired at %s", creds.ExpiresAt.Format(time.RFC3339))
+			}
+		case remaining <= settings.GetWarnBefore():
+			if m.first(cluster, events.ReasonCredentialsExpiring, creds.ExpiresAt) {
+				m.recorder.Warning(cluster, events.ReasonCredentialsExpiring, "token expires in %s, at %s",
+					remaining.Round(time.Minute), creds.ExpiresAt.Format(time.RFC3339))
+			}
+		}
+	}
+
+	if settings.MaxUpdateAge > 0 && !creds.UpdatedAt.IsZero() {
+		if age := now.Sub(creds.UpdatedAt); age > settings.MaxUpdateAge {
+			if m.first(cluster, events.ReasonCredentialsNotUpdated, creds.UpdatedAt) {
+				m.recorder.Warning(cluster, events.ReasonCredentialsNotUpdated, "credentials not updated for %s (max_update_age: %s)",
+					age.Round(time.Minute), settings.MaxUpdateAge)
+			}
+		}
+	}
+}
+
+// first reports whether the credentials identified by at have not been
+// alerted on for reason yet, recording that they now are
+func (m *Monitor) first(cluster, reason string, at time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.alerted[cluster] == nil {
+		m.alerted[cluster] = make(map[string]time.Time)
+	}
+	if m.alerted[cluster][reason].Equal(at) {
+		return false
+	}
+	m.alerted[cluster][reason] = at
+	return true
+}
@@ -0,0 +1,78 @@
+package expiry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/events"
+)
+
+func tokenExpiringAt(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"system:serviceaccount:kfa:reader","exp":%d}`, exp.Unix())))
+	return "eyJhbGciOiJSUzI1NiJ9." + payload + ".sig"
+}
+
+func TestCheck(t *testing.T) {
+	reasons := make(chan string, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event events.WebhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		reasons <- event.Reason
+	}))
+	defer webhook.Close()
+
+	store, err := credentials.NewStore(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	exp := start.Add(48 * time.Hour)
+	if err := store.Set(context.Background(), "remote", &credentials.Credentials{Token: tokenExpiringAt(exp), UpdatedAt: start}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Clusters:     map[string]config.ClusterConfig{"remote": {Issuer: "https://remote.example.com", APIServer: "https://remote:6443"}},
+		ExpiryAlerts: &config.ExpiryAlertSettings{WarnBefore: 24 * time.Hour, MaxUpdateAge: 36 * time.Hour},
+	}
+	m := New(cfg, store, events.NewRecorder("kfa", "kfa", webhook.URL, nil))
+
+	steps := []struct {
+		name  string
+		at    time.Duration
+		wants []string
+	}{
+		{"fresh", 0, nil},
+		{"within warn_before", 25 * time.Hour, []string{events.ReasonCredentialsExpiring}},
+		{"alerted once", 26 * time.Hour, nil},
+		{"not updated", 37 * time.Hour, []string{events.ReasonCredentialsNotUpdated}},
+		{"expired", 49 * time.Hour, []string{events.ReasonCredentialsExpired}},
+		{"expired alerted once", 50 * time.Hour, nil},
+	}
+	for _, step := range steps {
+		m.now = func() time.Time { return start.Add(step.at) }
+		m.check("remote")
+		for _, want := range step.wants {
+			select {
+			case got := <-reasons:
+				if got != want {
+					t.Errorf("%s: event %s, want %s", step.name, got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: no %s event", step.name, want)
+			}
+		}
+		select {
+		case got := <-reasons:
+			t.Errorf("%s: unexpected event %s", step.name, got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// rewriteAudiences translates the audiences requested by the caller into the
+// audiences sent to the remote cluster's TokenReview API.
+func rewriteAudiences(rw *config.AudienceRewrite, requested []string) []string {
+	if rw == nil || len(requested) == 0 {
+		return requested
+	}
+
+	var out []string
+	for _, aud := range requested {
+		if slices.Contains(rw.Strip, aud) {
+			continue
+		}
+		if remote, ok := rw.Map[aud]; ok {
+			aud = remote
+		} else if len(rw.PassThrough) > 0 && !slices.Contains(rw.PassThrough, aud) {
+			continue
+		}
+		if !slices.Contains(out, aud) {
+			out = append(out, aud)
+		}
+	}
+	return out
+}
+
+// restoreAudiences maps the audiences returned by the remote cluster back to
+// the caller's naming. Only audiences the caller asked for are reported.
+// Stripped audiences were not checked upstream and are left to
+// strippedAudiences.
+func restoreAudiences(rw *config.AudienceRewrite, requested, remote []string) []string {
+	if rw == nil || len(requested) == 0 {
+		return remote
+	}
+
+	var out []string
+	for _, aud := range requested {
+		if slices.Contains(rw.Strip, aud) {
+			continue
+		}
+		want := aud
+		if mapped, ok := rw.Map[aud]; ok {
+			want = mapped
+		}
+		if slices.Contains(remote, want) {
+			out = append(out, aud)
+		}
+	}
+	return out
+}
+
+// strippedAudiences returns the stripped audiences of requested that the
+// token's verified aud claim carries. They are never forwarded, so only this
+// local check vouches for them; a review without verified claims has none.
+func strippedAudiences(rw *config.AudienceRewrite, requested, tokenAudiences []string) []string {
+	if rw == nil {
+		return nil
+	}
+	var out []string
+	for _, aud := range requested {
+		if slices.Contains(rw.Strip, aud) && slices.Contains(tokenAudiences, aud) {
+			out = append(out, aud)
+		}
+	}
+	return out
+}
+
+// tokenAudience is the name a token carries for a requested audience: the
+// remote cluster's name if the audience is mapped, the audience itself
+// otherwise. A cluster's audiences use these names, as the verifier matches
+// them against the token's aud claim.
+func tokenAudience(rw *config.AudienceRewrite, aud string) string {
+	if rw != nil {
+		if remote, ok := rw.Map[aud]; ok {
+			return remote
+		}
+	}
+	return aud
+}
+
+// localAudience translates an audience of a cluster's audiences back to the
+// caller's naming: the first local name mapped to it, if any
+func localAudience(rw *config.AudienceRewrite, aud string) string {
+	if rw == nil {
+		return aud
+	}
+	for _, local := range slices.Sorted(maps.Keys(rw.Map)) {
+		if rw.Map[local] == aud {
+			return local
+		}
+	}
+	return aud
+}
+
+// effectiveAudiences limits the requested audiences to those a cluster
+// accepts, comparing them as the token carries them. With no audiences
+// requested, the cluster's own are checked, in the caller's naming.
+// It fails if none of the requested audiences are accepted.
+func effectiveAudiences(rw *config.AudienceRewrite, accepted, requested []string) ([]string, error) {
+	if len(accepted) == 0 {
+		return requested, nil
+	}
+	var out []string
+	if len(requested) == 0 {
+		for _, aud := range accepted {
+			out = append(out, localAudience(rw, aud))
+		}
+		return out, nil
+	}
+	for _, aud := range requested {
+		if slices.Contains(accepted, tokenAudience(rw, aud)) {
+			out = append(out, aud)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("requested audiences %v are not accepted for this cluster", requested)
+	}
+	return out, nil
+}
+
+// intersectAudiences returns the audiences of got that are also in want
+func intersectAudiences(got, want []string) []string {
+	var out []string
+	for _, aud := range got {
+		if slices.Contains(want, aud) {
+			out = append(out, aud)
+		}
+	}
+	return out
+}
+
+// checkTokenAudiences checks the verified aud claim of a token against the
+// requested audiences, so a token for another audience is rejected without
+// forwarding it: it must carry one of them as sent upstream, or one of the
+// stripped ones.
+func checkTokenAudiences(rw *config.AudienceRewrite, tokenAudiences, requested []string) error {
+	if len(requested) == 0 {
+		return nil
+	}
+	want := rewriteAudiences(rw, requested)
+	if rw != nil {
+		for _, aud := range requested {
+			if slices.Contains(rw.Strip, aud) {
+				want = append(want, aud)
+			}
+		}
+	}
+	if len(intersectAudiences(tokenAudiences, want)) > 0 {
+		return nil
+	}
+	return fmt.Errorf("token audiences %v do not include any of %v", tokenAudiences, want)
+}
+
+// limitToRequested enforces the webhook contract for audience-scoped reviews:
+// with spec.audiences set, an authenticated review reports a non-empty subset
+// of them in status.audiences, or is not authenticated.
+func limitToRequested(result *authv1.TokenReview, requested []string) {
+	if len(requested) == 0 || !result.Status.Authenticated {
+		return
+	}
+	result.Status.Audiences = intersectAudiences(result.Status.Audiences, requested)
+	if len(result.Status.Audiences) == 0 {
+		result.Status = authv1.TokenReviewStatus{
+			Error: fmt.Sprintf("token is not valid for any of the requested audiences %v", requested),
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+)
+
+// maxBundleSize bounds restore request bodies
+const maxBundleSize = 16 << 20
+
+// BackupHandler exports all stored credentials as an encrypted
+// credentials.Bundle (GET) and restores one (POST), for kfa backup and kfa
+// restore. It is only mounted on the admin listener.
+type BackupHandler struct {
+	store    *credentials.Store
+	key      []byte
+	verifier credentials.VerifierInvalidator
+}
+
+// NewBackupHandler creates a handler sealing bundles with key; without a key
+// backups are disabled
+func NewBackupHandler(store *credentials.Store, key []byte, verifier credentials.VerifierInvalidator) *BackupHandler {
+	return &BackupHandler{store: store, key: key, verifier: verifier}
+}
+
+func (h *BackupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case len(h.key) == 0:
+		writeBackupError(w, http.StatusNotFound, "backups are disabled: start the server with BACKUP_KEY or CREDENTIAL_ENCRYPTION_KEY")
+	case h.store == nil:
+		writeBackupError(w, http.StatusNotFound, "no credentials are stored: no remote clusters are configured")
+	case r.Method == http.MethodPost:
+		h.restore(w, r)
+	default:
+		bundle, err := credentials.SealBundle(h.store.Export(), h.key, time.Now())
+		if err != nil {
+			writeBackupError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Exported credentials of %d clusters", len(bundle.Clusters))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(bundle)
+	}
+}
+
+func (h *BackupHandler) restore(w http.ResponseWriter, r *http.Request) {
+	var bundle credentials.Bundle
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBundleSize)).Decode(&bundle); err != nil {
+		writeBackupError(w, http.StatusBadRequest, "parsing backup: "+err.Error())
+		return
+	}
+	creds, err := bundle.Open(h.key)
+	if err != nil {
+		writeBackupError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	restored, err := h.store.Import(r.Context(), creds)
+	for _, cluster := range restored {
+		h.verifier.InvalidateVerifier(cluster)
+	}
+	if errors.Is(err, credentials.ErrReadOnly) {
+		writeBackupError(w, http.StatusConflict, "this replica's credential store is read-only (READ_ONLY_CREDENTIALS); restore on a writable replica")
+		return
+	}
+	if err != nil {
+		writeBackupError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"restored": restored})
+}
+
+func writeBackupError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
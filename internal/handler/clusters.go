@@ -7,15 +7,25 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+
 	"github.com/rophy/kube-federated-auth/internal/config"
 	"github.com/rophy/kube-federated-auth/internal/credentials"
 )
 
 type ClusterInfo struct {
-	Name        string       `json:"name"`
-	Issuer      string       `json:"issuer"`
-	APIServer   string       `json:"api_server,omitempty"`
-	TokenStatus *TokenStatus `json:"token_status,omitempty"`
+	Name              string       `json:"name"`
+	Issuer            string       `json:"issuer"`
+	AdditionalIssuers []string     `json:"additional_issuers,omitempty"`
+	APIServer         string       `json:"api_server,omitempty"`
+	TokenStatus       *TokenStatus `json:"token_status,omitempty"`
+	// Metadata is the cluster's metadata reported by kfa onboard
+	Metadata *credentials.ClusterMetadata `json:"metadata,omitempty"`
+	// LastSeen is the time of the cluster's last POST /heartbeat
+	LastSeen time.Time `json:"last_seen,omitzero"`
+	// Silent flags a cluster whose last heartbeat is older than
+	// heartbeat.stale_after
+	Silent bool `json:"silent,omitempty"`
 }
 
 type TokenStatus struct {
@@ -28,37 +38,100 @@ type ClustersResponse struct {
 	Clusters []ClusterInfo `json:"clusters"`
 }
 
+// ClusterDetail is one cluster's info, with its stored credentials' rotation
+// history
+type ClusterDetail struct {
+	ClusterInfo
+	Credentials *CredentialsInfo `json:"credentials,omitempty"`
+}
+
+// CredentialsInfo describes a cluster's stored credentials, without them
+type CredentialsInfo struct {
+	Source    string                 `json:"source"`
+	UpdatedAt time.Time              `json:"updated_at,omitzero"`
+	ExpiresAt time.Time              `json:"expires_at,omitzero"`
+	History   []credentials.Rotation `json:"history,omitempty"`
+}
+
 type ClustersHandler struct {
-	config    *config.Config
-	credStore *credentials.Store
+	config     *config.Config
+	credStore  *credentials.Store
+	heartbeats *Heartbeats
 }
 
 func NewClustersHandler(cfg *config.Config, credStore *credentials.Store) *ClustersHandler {
 	return &ClustersHandler{config: cfg, credStore: credStore}
 }
 
+// WithHeartbeats adds the clusters' last heartbeats to their info
+func (h *ClustersHandler) WithHeartbeats(heartbeats *Heartbeats) *ClustersHandler {
+	h.heartbeats = heartbeats
+	return h
+}
+
+// ServeHTTP lists all clusters on /clusters, or describes one on
+// /clusters/{name}
 func (h *ClustersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	if name := chi.URLParam(r, "name"); name != "" {
+		h.serveCluster(w, name)
+		return
+	}
+
 	var clusters []ClusterInfo
 	for name, cfg := range h.config.Clusters {
-		info := ClusterInfo{
-			Name:      name,
-			Issuer:    cfg.Issuer,
-			APIServer: cfg.APIServer,
-		}
+		info, _ := h.info(name, cfg)
+		clusters = append(clusters, info)
+	}
 
-		// Add token status if we have credentials for this cluster
-		if h.credStore != nil {
-			if creds, ok := h.credStore.Get(name); ok {
-				info.TokenStatus = getTokenStatus(creds)
-			}
+	json.NewEncoder(w).Encode(ClustersResponse{Clusters: clusters})
+}
+
+func (h *ClustersHandler) serveCluster(w http.ResponseWriter, name string) {
+	cfg, ok := h.config.Clusters[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "cluster not found: " + name})
+		return
+	}
+	info, creds := h.info(name, cfg)
+	detail := ClusterDetail{ClusterInfo: info}
+	if creds != nil {
+		detail.Credentials = &CredentialsInfo{
+			Source:    creds.Source,
+			UpdatedAt: creds.UpdatedAt,
+			ExpiresAt: creds.ExpiresAt,
+			History:   creds.History,
 		}
+	}
+	json.NewEncoder(w).Encode(detail)
+}
 
-		clusters = append(clusters, info)
+// info returns a cluster's info and its stored credentials, if any
+func (h *ClustersHandler) info(name string, cfg config.ClusterConfig) (ClusterInfo, *credentials.Credentials) {
+	info := ClusterInfo{
+		Name:              name,
+		Issuer:            cfg.Issuer,
+		AdditionalIssuers: cfg.AdditionalIssuers,
+		APIServer:         cfg.APIServer,
 	}
 
-	json.NewEncoder(w).Encode(ClustersResponse{Clusters: clusters})
+	if at, ok := h.heartbeats.LastSeen(name); ok {
+		info.LastSeen = at.UTC()
+		info.Silent = time.Since(at) > h.config.GetHeartbeatStaleAfter()
+	}
+
+	// Add token status if we have credentials for this cluster
+	var creds *credentials.Credentials
+	if h.credStore != nil {
+		if stored, ok := h.credStore.Get(name); ok {
+			creds = stored
+			info.TokenStatus = getTokenStatus(creds)
+			info.Metadata = creds.Metadata
+		}
+	}
+	return info, creds
 }
 
 func getTokenStatus(creds *credentials.Credentials) *TokenStatus {
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+)
+
+// CredentialsHandler deregisters a cluster (DELETE), removing its stored
+// credentials and cached verifier. It is only mounted on the admin listener.
+type CredentialsHandler struct {
+	store    *credentials.Store
+	verifier credentials.VerifierInvalidator
+}
+
+func NewCredentialsHandler(store *credentials.Store, verifier credentials.VerifierInvalidator) *CredentialsHandler {
+	return &CredentialsHandler{store: store, verifier: verifier}
+}
+
+func (h *CredentialsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	cluster := chi.URLParam(r, "cluster")
+
+	if h.store == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no credentials are stored: no remote clusters are configured"})
+		return
+	}
+	if err := h.store.Delete(r.Context(), cluster); err != nil {
+		if errors.Is(err, credentials.ErrReadOnly) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "this replica's credential store is read-only (READ_ONLY_CREDENTIALS); deregister the cluster on a writable replica"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	h.verifier.InvalidateVerifier(cluster)
+	log.Printf("Deregistered cluster %s", cluster)
+
+	json.NewEncoder(w).Encode(map[string]string{"cluster": cluster, "status": "deleted"})
+}
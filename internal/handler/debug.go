@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+type CredentialState struct {
+	Source      string       `json:"source"` // "file", "secret", "renewed", or "config" when only files are configured
+	UpdatedAt   string       `json:"updated_at,omitempty"`
+	Age         string       `json:"age,omitempty"`
+	TokenStatus *TokenStatus `json:"token_status,omitempty"`
+}
+
+type ClusterState struct {
+	Verifier    oidc.VerifierStatus `json:"verifier"`
+	Credentials *CredentialState    `json:"credentials,omitempty"`
+}
+
+type DebugStateResponse struct {
+	Clusters map[string]ClusterState `json:"clusters"`
+}
+
+// DebugStateHandler dumps verifier and credential state. It exposes operational
+// detail and is only mounted on the admin listener.
+type DebugStateHandler struct {
+	config    *config.Config
+	verifier  *oidc.VerifierManager
+	credStore *credentials.Store
+}
+
+func NewDebugStateHandler(cfg *config.Config, verifier *oidc.VerifierManager, credStore *credentials.Store) *DebugStateHandler {
+	return &DebugStateHandler{config: cfg, verifier: verifier, credStore: credStore}
+}
+
+func (h *DebugStateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	verifiers := h.verifier.Status()
+	resp := DebugStateResponse{Clusters: make(map[string]ClusterState, len(h.config.Clusters))}
+	for name, cfg := range h.config.Clusters {
+		state := ClusterState{Verifier: verifiers[name]}
+
+		if h.credStore != nil {
+			if creds, ok := h.credStore.Get(name); ok {
+				state.Credentials = &CredentialState{
+					Source:      creds.Source,
+					TokenStatus: getTokenStatus(creds),
+				}
+				if !creds.UpdatedAt.IsZero() {
+					state.Credentials.UpdatedAt = creds.UpdatedAt.Format(time.RFC3339)
+					state.Credentials.Age = time.Since(creds.UpdatedAt).Round(time.Second).String()
+				}
+			}
+		}
+		if state.Credentials == nil && cfg.TokenPath != "" {
+			// Not in the store: the verifier reads token_path on every request
+			state.Credentials = &CredentialState{Source: "config"}
+		}
+
+		resp.Clusters[name] = state
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// EffectiveConfigHandler serves the merged, defaulted and sanitized runtime
+// configuration as YAML that can be loaded back with config.Load
+type EffectiveConfigHandler struct {
+	config *config.Config
+}
+
+func NewEffectiveConfigHandler(cfg *config.Config) *EffectiveConfigHandler {
+	return &EffectiveConfigHandler{config: cfg}
+}
+
+func (h *EffectiveConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := h.config.EffectiveYAML()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
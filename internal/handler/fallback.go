@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/claims"
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+// fallbackApplies reports whether a detection failure means the token could
+// not be verified as a JWT of any cluster, rather than being one that was
+// rejected (expired) or that could not be checked (upstream unavailable)
+func fallbackApplies(err error) bool {
+	return errors.Is(err, oidc.ErrSignature) || errors.Is(err, oidc.ErrIssuer) || errors.Is(err, oidc.ErrInvalidToken)
+}
+
+// fallbackReview sends a token that no cluster could verify to the TokenReview
+// API of each cluster with fallback: tokenreview, in name order, and returns
+// the first that authenticates it. User validation rules still apply; claim
+// rules and mappings cannot, since the token's claims are unverified.
+func (h *TokenReviewHandler) fallbackReview(ctx context.Context, tr *authv1.TokenReview, pinned string) (string, *authv1.TokenReview, bool) {
+	for _, cluster := range h.config.FallbackClusters() {
+		if pinned != "" && cluster != pinned {
+			continue
+		}
+		clusterCfg := h.config.Clusters[cluster]
+		audiences, err := effectiveAudiences(clusterCfg.AudienceRewrite, clusterCfg.Audiences, tr.Spec.Audiences)
+		if err != nil {
+			continue
+		}
+		forward := tr.DeepCopy()
+		forward.Spec.Audiences = audiences
+
+		result, err := h.forwardTokenReview(ctx, cluster, forward)
+		if err != nil {
+			log.Printf("Fallback TokenReview failed for cluster %s: %v", cluster, err)
+			continue
+		}
+		if !result.Status.Authenticated {
+			continue
+		}
+		claims.ApplyTemplates(h.config, cluster, nil, &result.Status.User)
+		if err := h.mappers[cluster].ValidateUser(result.Status.User); err != nil {
+			log.Printf("User validation failed for cluster %s: %v", cluster, err)
+			continue
+		}
+		result.Spec.Audiences = tr.Spec.Audiences
+		if len(clusterCfg.Audiences) > 0 {
+			result.Status.Audiences = intersectAudiences(result.Status.Audiences, audiences)
+		}
+		if limitToRequested(result, tr.Spec.Audiences); !result.Status.Authenticated {
+			continue
+		}
+		return cluster, result, true
+	}
+	return "", nil, false
+}
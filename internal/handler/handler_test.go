@@ -1,15 +1,35 @@
 package handler
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-jose/go-jose/v4"
 	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes/scheme"
 
+	"github.com/rophy/kube-federated-auth/internal/authz"
+	"github.com/rophy/kube-federated-auth/internal/claims"
 	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/oidc"
 )
 
 func TestHealth(t *testing.T) {
@@ -38,6 +58,273 @@ func TestHealth(t *testing.T) {
 	}
 }
 
+type fakeProber map[string]error
+
+func (f fakeProber) Probe(ctx context.Context, clusterName string) error {
+	return f[clusterName]
+}
+
+func TestReady(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: map[string]config.ClusterConfig{
+			"cluster-a": {Issuer: "https://a.example.com"},
+			"cluster-b": {Issuer: "https://b.example.com"},
+		},
+	}
+	prober := fakeProber{"cluster-b": errors.New("connection refused")}
+
+	two := 2
+	tests := []struct {
+		name      string
+		readiness *config.ReadinessSettings
+		wantCode  int
+	}{
+		{"default threshold", nil, http.StatusOK},
+		{"all required", &config.ReadinessSettings{MinHealthyClusters: &two}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Readiness = tt.readiness
+			w := httptest.NewRecorder()
+			NewReadyHandler(cfg, prober).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz/ready", nil))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			var resp ReadyResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response: %v", err)
+			}
+			if resp.Healthy != 1 {
+				t.Errorf("healthy = %d, want 1", resp.Healthy)
+			}
+			if got := resp.Clusters["cluster-b"]; got.Status != "error" || got.Error != "connection refused" {
+				t.Errorf("cluster-b = %+v", got)
+			}
+		})
+	}
+}
+
+func TestWebhookHealth(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: map[string]config.ClusterConfig{
+			"cluster-a": {Issuer: "https://a.example.com"},
+			"cluster-b": {Issuer: "https://b.example.com"},
+		},
+	}
+	r := chi.NewRouter()
+	r.Get("/healthz/webhook/{cluster}", NewWebhookHealthHandler(cfg, fakeProber{"cluster-b": errors.New("connection refused")}).ServeHTTP)
+
+	tests := []struct {
+		cluster  string
+		wantCode int
+	}{
+		{"cluster-a", http.StatusOK},
+		{"cluster-b", http.StatusServiceUnavailable},
+		{"cluster-c", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cluster, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz/webhook/"+tt.cluster, nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+type invalidated []string
+
+func (i *invalidated) InvalidateVerifier(cluster string) { *i = append(*i, cluster) }
+
+func TestDeleteCredentials(t *testing.T) {
+	backend, err := credentials.NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := credentials.NewStore(backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(context.Background(), "cluster-b", &credentials.Credentials{Token: "t", CACert: []byte("ca")}); err != nil {
+		t.Fatal(err)
+	}
+	var verifier invalidated
+	r := chi.NewRouter()
+	r.Delete("/admin/credentials/{cluster}", NewCredentialsHandler(store, &verifier).ServeHTTP)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/credentials/cluster-b", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if _, ok := store.Get("cluster-b"); ok {
+		t.Error("credentials still in the store")
+	}
+	if _, err := backend.Get(context.Background(), "cluster-b"); !errors.Is(err, credentials.ErrNotFound) {
+		t.Errorf("backend Get err = %v, want ErrNotFound", err)
+	}
+	if !slices.Equal(verifier, invalidated{"cluster-b"}) {
+		t.Errorf("invalidated = %v, want [cluster-b]", verifier)
+	}
+
+	r = chi.NewRouter()
+	r.Delete("/admin/credentials/{cluster}", NewCredentialsHandler(nil, &verifier).ServeHTTP)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/credentials/cluster-b", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("without a store: status = %d, want 404", w.Code)
+	}
+
+	store.SetReadOnly(true)
+	r = chi.NewRouter()
+	r.Delete("/admin/credentials/{cluster}", NewCredentialsHandler(store, &verifier).ServeHTTP)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/credentials/cluster-b", nil))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "read-only") {
+		t.Errorf("read-only store: status = %d, want 409: %s", w.Code, w.Body)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	source, err := credentials.NewStore(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Set(context.Background(), "cluster-b", &credentials.Credentials{Token: "secret-token", CACert: []byte("ca"), Source: credentials.SourceRenewed}); err != nil {
+		t.Fatal(err)
+	}
+	r := chi.NewRouter()
+	r.Get("/admin/backup", NewBackupHandler(source, key, nil).ServeHTTP)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("backup status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "secret-token") || !strings.Contains(w.Body.String(), `"cluster-b"`) {
+		t.Errorf("bundle leaks the token or misses the cluster: %s", w.Body)
+	}
+	bundle := w.Body.String()
+
+	// A fresh install restores the bundle
+	backend, err := credentials.NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := credentials.NewStore(backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verifier invalidated
+	r = chi.NewRouter()
+	r.Post("/admin/backup", NewBackupHandler(target, key, &verifier).ServeHTTP)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/backup", strings.NewReader(bundle)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("restore status = %d, want 200: %s", w.Code, w.Body)
+	}
+	stored, err := backend.Get(context.Background(), "cluster-b")
+	if err != nil || stored.Token != "secret-token" {
+		t.Fatalf("restored credentials = %+v, %v", stored, err)
+	}
+	if len(stored.History) != 2 || stored.History[1].Source != credentials.SourceRestored {
+		t.Errorf("restored history = %+v, want the renewal and the restore", stored.History)
+	}
+	if !slices.Equal(verifier, invalidated{"cluster-b"}) {
+		t.Errorf("invalidated = %v, want [cluster-b]", verifier)
+	}
+
+	// Restoring with another key fails
+	r = chi.NewRouter()
+	r.Post("/admin/backup", NewBackupHandler(target, []byte("fedcba9876543210fedcba9876543210"), &verifier).ServeHTTP)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/backup", strings.NewReader(bundle)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("restore with another key: status = %d, want 400", w.Code)
+	}
+
+	// Without a key backups are disabled
+	r = chi.NewRouter()
+	r.Get("/admin/backup", NewBackupHandler(source, nil, nil).ServeHTTP)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("without a key: status = %d, want 404", w.Code)
+	}
+}
+
+func TestClusterDetail(t *testing.T) {
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"cluster-b": {Issuer: "https://b.example.com", APIServer: "https://192.168.1.100:6443"},
+	}}
+	store, err := credentials.NewStore(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"first", "second"} {
+		if err := store.Set(context.Background(), "cluster-b", &credentials.Credentials{Token: token, CACert: []byte("ca"), Source: credentials.SourceRenewed}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := chi.NewRouter()
+	r.Get("/clusters/{name}", NewClustersHandler(cfg, store).ServeHTTP)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/clusters/cluster-b", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "second") {
+		t.Errorf("response contains the token: %s", w.Body)
+	}
+	var detail ClusterDetail
+	if err := json.Unmarshal(w.Body.Bytes(), &detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Name != "cluster-b" || detail.Credentials == nil || len(detail.Credentials.History) != 2 {
+		t.Fatalf("detail = %+v", detail)
+	}
+	if got := detail.Credentials.History[1]; got.Source != credentials.SourceRenewed || got.By == "" {
+		t.Errorf("last rotation = %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/clusters/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown cluster: status = %d, want 404", w.Code)
+	}
+}
+
+func TestDebugState(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: map[string]config.ClusterConfig{
+			"cluster-a": {Issuer: "https://a.example.com"},
+			"cluster-b": {Issuer: "https://b.example.com", APIServer: "https://192.168.1.100:6443", TokenPath: "/tmp/token"},
+		},
+	}
+
+	handler := NewDebugStateHandler(cfg, oidc.NewVerifierManager(cfg, nil, nil), nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+
+	var resp DebugStateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if len(resp.Clusters) != 2 {
+		t.Fatalf("clusters count = %d, want 2", len(resp.Clusters))
+	}
+	if resp.Clusters["cluster-a"].Verifier.Cached {
+		t.Error("cluster-a verifier reported as cached")
+	}
+	if creds := resp.Clusters["cluster-b"].Credentials; creds == nil || creds.Source != "config" {
+		t.Errorf("cluster-b credentials = %+v, want source config", creds)
+	}
+}
+
 func TestClusters(t *testing.T) {
 	cfg := &config.Config{
 		Clusters: map[string]config.ClusterConfig{
@@ -79,8 +366,140 @@ func TestClusters(t *testing.T) {
 	}
 }
 
+func TestHeartbeat(t *testing.T) {
+	cfg := &config.Config{
+		Heartbeat: &config.HeartbeatSettings{StaleAfter: time.Minute},
+		Clusters: map[string]config.ClusterConfig{
+			"cluster-a": {Issuer: "https://a.example.com"},
+			"cluster-b": {Issuer: "https://b.example.com"},
+			"cluster-c": {Issuer: "https://c.example.com"},
+		},
+	}
+	heartbeats := NewHeartbeats()
+	heartbeats.Record("cluster-a", time.Now())
+	heartbeats.Record("cluster-b", time.Now().Add(-time.Hour))
+
+	w := httptest.NewRecorder()
+	NewClustersHandler(cfg, nil).WithHeartbeats(heartbeats).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/clusters", nil))
+	var resp ClustersResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range resp.Clusters {
+		wantSeen, wantSilent := c.Name != "cluster-c", c.Name == "cluster-b"
+		if !c.LastSeen.IsZero() != wantSeen || c.Silent != wantSilent {
+			t.Errorf("%s: last_seen = %v, silent = %v", c.Name, c.LastSeen, c.Silent)
+		}
+	}
+
+	handler := NewHeartbeatHandler(NewTokenReviewHandler(oidc.NewVerifierManager(cfg, nil, nil), cfg, nil, nil, nil, nil), heartbeats)
+	for name, auth := range map[string]string{"no token": "", "not a JWT": "Bearer not-a-jwt"} {
+		req := httptest.NewRequest(http.MethodPost, "/heartbeat", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want 401", name, w.Code)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeConfig(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: config status = %d, want 401", name, w.Code)
+		}
+	}
+
+}
+
+// testSigningKey returns an RSA key and a jwks_file holding its public key,
+// so that tokens signed with it verify without network access
+func testSigningKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return key, keyFile
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, tokenClaims map[string]any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(tokenClaims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestHeartbeat_CallerChecks(t *testing.T) {
+	key, keyFile := testSigningKey(t)
+	cfg := &config.Config{
+		Heartbeat: &config.HeartbeatSettings{AllowedCallers: []string{"system:serviceaccount:kube-federated-auth:*"}},
+		Clusters: map[string]config.ClusterConfig{
+			"edge": {
+				Issuer:               "https://edge.invalid",
+				JWKSFile:             keyFile,
+				Audiences:            []string{"kube-federated-auth"},
+				ClaimValidationRules: []config.ClaimValidationRule{{Claim: "tier", RequiredValue: "edge"}},
+			},
+		},
+	}
+	mappers, err := claims.Compile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHeartbeatHandler(NewTokenReviewHandler(oidc.NewVerifierManager(cfg, nil, nil), cfg, nil, mappers, nil, nil), NewHeartbeats())
+
+	token := func(sub, aud, tier string) string {
+		return signTestToken(t, key, map[string]any{
+			"iss": "https://edge.invalid", "sub": sub, "aud": []string{aud}, "tier": tier,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}
+	agent := "system:serviceaccount:kube-federated-auth:heartbeat"
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"accepted", token(agent, "kube-federated-auth", "edge"), http.StatusOK},
+		{"fails claim rules", token(agent, "kube-federated-auth", "core"), http.StatusForbidden},
+		{"other audience", token(agent, "other", "edge"), http.StatusUnauthorized},
+		{"caller not allowed", token("system:serviceaccount:default:app", "kube-federated-auth", "edge"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/heartbeat", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeConfig(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: config status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
 func TestTokenReview_InvalidJSON(t *testing.T) {
-	handler := NewTokenReviewHandler(nil, nil, nil)
+	handler := NewTokenReviewHandler(nil, nil, nil, nil, nil, nil)
 
 	req := httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", strings.NewReader("not json"))
 	w := httptest.NewRecorder()
@@ -105,7 +524,7 @@ func TestTokenReview_InvalidJSON(t *testing.T) {
 }
 
 func TestTokenReview_MissingToken(t *testing.T) {
-	handler := NewTokenReviewHandler(nil, nil, nil)
+	handler := NewTokenReviewHandler(nil, nil, nil, nil, nil, nil)
 
 	body := `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{}}`
 	req := httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", strings.NewReader(body))
@@ -131,7 +550,7 @@ func TestTokenReview_MissingToken(t *testing.T) {
 }
 
 func TestTokenReview_NotConfigured(t *testing.T) {
-	handler := NewTokenReviewHandler(nil, nil, nil)
+	handler := NewTokenReviewHandler(nil, nil, nil, nil, nil, nil)
 
 	body := `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"test-token"}}`
 	req := httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", strings.NewReader(body))
@@ -158,7 +577,7 @@ func TestTokenReview_NotConfigured(t *testing.T) {
 }
 
 func TestTokenReview_ResponseFormat(t *testing.T) {
-	handler := NewTokenReviewHandler(nil, nil, nil)
+	handler := NewTokenReviewHandler(nil, nil, nil, nil, nil, nil)
 
 	body := `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"invalid-token"}}`
 	req := httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", strings.NewReader(body))
@@ -180,6 +599,51 @@ func TestTokenReview_ResponseFormat(t *testing.T) {
 	}
 }
 
+func TestTokenReview_V1beta1(t *testing.T) {
+	handler := NewTokenReviewHandler(nil, nil, nil, nil, nil, nil)
+
+	tests := []struct {
+		reqVersion string
+		token      string
+		want       string
+	}{
+		{"authentication.k8s.io/v1beta1", "test-token", "authentication.k8s.io/v1beta1"},
+		{"authentication.k8s.io/v1beta1", "", "authentication.k8s.io/v1beta1"},
+		{"authentication.k8s.io/v1", "test-token", "authentication.k8s.io/v1"},
+		{"", "test-token", "authentication.k8s.io/v1"},
+	}
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"apiVersion":%q,"kind":"TokenReview","spec":{"token":%q}}`, tt.reqVersion, tt.token)
+		req := httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1beta1/tokenreviews", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var resp authv1.TokenReview
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+		if resp.APIVersion != tt.want {
+			t.Errorf("request %q token %q: apiVersion = %q, want %q", tt.reqVersion, tt.token, resp.APIVersion, tt.want)
+		}
+	}
+}
+
+func TestTokenReview_ErrorRedacted(t *testing.T) {
+	handler := NewTokenReviewHandler(nil, nil, nil, nil, nil, nil)
+	token := "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJzeXN0ZW06c2VydmljZWFjY291bnQ6ZGVmYXVsdDp0ZXN0In0.c2ln"
+
+	w := httptest.NewRecorder()
+	handler.writeUnauthenticated(w, &authv1.TokenReview{}, "failed to validate token: malformed jwt "+token)
+	w2 := httptest.NewRecorder()
+	handler.writeError(w2, nil, http.StatusBadRequest, "bad token "+token)
+
+	for _, body := range []string{w.Body.String(), w2.Body.String()} {
+		if strings.Contains(body, "eyJ") {
+			t.Errorf("response leaked token: %s", body)
+		}
+	}
+}
+
 func TestExtraKeyClusterName(t *testing.T) {
 	// Verify the constant follows Kubernetes naming convention
 	expected := "authentication.kubernetes.io/cluster-name"
@@ -187,3 +651,442 @@ func TestExtraKeyClusterName(t *testing.T) {
 		t.Errorf("ExtraKeyClusterName = %q, want %q", ExtraKeyClusterName, expected)
 	}
 }
+
+func TestRewriteAudiences(t *testing.T) {
+	rw := &config.AudienceRewrite{
+		PassThrough: []string{"shared"},
+		Strip:       []string{"local-only"},
+		Map:         map[string]string{"kube-fed": "https://kubernetes.default.svc"},
+	}
+
+	got := rewriteAudiences(rw, []string{"shared", "local-only", "kube-fed", "unknown"})
+	want := []string{"shared", "https://kubernetes.default.svc"}
+	if !slices.Equal(got, want) {
+		t.Errorf("rewriteAudiences = %v, want %v", got, want)
+	}
+
+	// No rewrite config forwards audiences unchanged
+	if got := rewriteAudiences(nil, []string{"a", "b"}); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("rewriteAudiences(nil) = %v, want [a b]", got)
+	}
+}
+
+func TestRestoreAudiences(t *testing.T) {
+	rw := &config.AudienceRewrite{
+		Strip: []string{"local-only"},
+		Map:   map[string]string{"kube-fed": "https://kubernetes.default.svc"},
+	}
+
+	requested := []string{"kube-fed", "local-only", "other"}
+	remote := []string{"https://kubernetes.default.svc"}
+
+	got := restoreAudiences(rw, requested, remote)
+	want := []string{"kube-fed"}
+	if !slices.Equal(got, want) {
+		t.Errorf("restoreAudiences = %v, want %v", got, want)
+	}
+
+	// Stripped audiences are only reported if the token carries them
+	if got := strippedAudiences(rw, requested, []string{"local-only"}); !slices.Equal(got, []string{"local-only"}) {
+		t.Errorf("strippedAudiences = %v, want [local-only]", got)
+	}
+	if got := strippedAudiences(rw, requested, []string{"https://kubernetes.default.svc"}); len(got) != 0 {
+		t.Errorf("strippedAudiences of a token without them = %v, want none", got)
+	}
+}
+
+func TestEffectiveAudiences(t *testing.T) {
+	accepted := []string{"kube-fed", "vault"}
+
+	tests := []struct {
+		name      string
+		accepted  []string
+		requested []string
+		want      []string
+		wantErr   bool
+	}{
+		{"unrestricted", nil, []string{"anything"}, []string{"anything"}, false},
+		{"none requested", accepted, nil, accepted, false},
+		{"intersected", accepted, []string{"vault", "other"}, []string{"vault"}, false},
+		{"none accepted", accepted, []string{"other"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := effectiveAudiences(nil, tt.accepted, tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("effectiveAudiences = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// audiences are the token's names; mapped requests are compared as the
+	// token carries them, and the defaults are reported in the caller's names
+	rw := &config.AudienceRewrite{Strip: []string{"kube-fed"}, Map: map[string]string{"my-service": "https://kubernetes.default.svc"}}
+	remote := []string{"kube-fed", "https://kubernetes.default.svc"}
+	if got, err := effectiveAudiences(rw, remote, []string{"my-service", "kube-fed"}); err != nil || !slices.Equal(got, []string{"my-service", "kube-fed"}) {
+		t.Errorf("mapped request: %v, %v", got, err)
+	}
+	if _, err := effectiveAudiences(rw, remote, []string{"https://other.example.com"}); err == nil {
+		t.Error("expected error for an audience not accepted")
+	}
+	if got, _ := effectiveAudiences(rw, remote, nil); !slices.Equal(got, []string{"kube-fed", "my-service"}) {
+		t.Errorf("defaults = %v, want [kube-fed my-service]", got)
+	}
+}
+
+func TestRequestedAudiences(t *testing.T) {
+	if err := checkTokenAudiences(nil, []string{"kube", "vault"}, []string{"vault"}); err != nil {
+		t.Errorf("matching aud: %v", err)
+	}
+	if err := checkTokenAudiences(nil, []string{"kube"}, nil); err != nil {
+		t.Errorf("nothing requested: %v", err)
+	}
+	if err := checkTokenAudiences(nil, []string{"kube"}, []string{"vault"}); err == nil {
+		t.Error("expected error for a token of another audience")
+	}
+	strip := &config.AudienceRewrite{Strip: []string{"kube-fed"}}
+	if err := checkTokenAudiences(strip, []string{"kube-fed"}, []string{"kube-fed"}); err != nil {
+		t.Errorf("stripped aud carried by the token: %v", err)
+	}
+	if err := checkTokenAudiences(strip, []string{"kube"}, []string{"kube-fed"}); err == nil {
+		t.Error("expected error for a token without the stripped audience")
+	}
+
+	// A remote cluster reporting more audiences than asked for is limited to
+	// the requested ones; reporting none of them fails the review
+	result := &authv1.TokenReview{Status: authv1.TokenReviewStatus{Authenticated: true, Audiences: []string{"kube", "vault"}}}
+	limitToRequested(result, []string{"vault"})
+	if !result.Status.Authenticated || !slices.Equal(result.Status.Audiences, []string{"vault"}) {
+		t.Errorf("requested vault: status = %+v", result.Status)
+	}
+	result = &authv1.TokenReview{Status: authv1.TokenReviewStatus{Authenticated: true, Audiences: []string{"kube"}}}
+	limitToRequested(result, []string{"vault"})
+	if result.Status.Authenticated || result.Status.Error == "" {
+		t.Errorf("requested vault of a kube token: status = %+v", result.Status)
+	}
+}
+
+func TestDetectionFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&oidc.Error{Kind: oidc.ErrUpstream, Err: errors.New("creating verifier: connection refused")}, "cluster API server unavailable"},
+		{&oidc.Error{Kind: oidc.ErrUpstream, Err: fmt.Errorf("creating verifier: %w", oidc.ErrCircuitOpen)}, "cluster API server unavailable (circuit open)"},
+		{fmt.Errorf("cluster a: %w", &oidc.Error{Kind: oidc.ErrExpired, Err: errors.New("oidc: token is expired")}), "token is expired"},
+		{&oidc.Error{Kind: oidc.ErrSignature, Err: errors.New("token signature does not match any configured cluster")}, "token not valid for any configured cluster"},
+	}
+	for _, tt := range tests {
+		if got := detectionFailure(tt.err); got != tt.want {
+			t.Errorf("detectionFailure(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestReviewFromClaims(t *testing.T) {
+	tokenClaims := &oidc.Claims{Audience: []string{"kube", "other"}}
+
+	tr := &authv1.TokenReview{}
+	result := reviewFromClaims(tr, tokenClaims, nil)
+	if !result.Status.Authenticated || !slices.Equal(result.Status.Audiences, []string{"kube", "other"}) {
+		t.Errorf("no requested audiences: status = %+v", result.Status)
+	}
+
+	tr.Spec.Audiences = []string{"kube"}
+	result = reviewFromClaims(tr, tokenClaims, nil)
+	if !result.Status.Authenticated || !slices.Equal(result.Status.Audiences, []string{"kube"}) {
+		t.Errorf("requested kube: status = %+v", result.Status)
+	}
+
+	tr.Spec.Audiences = []string{"api"}
+	if result := reviewFromClaims(tr, tokenClaims, nil); result.Status.Authenticated {
+		t.Error("expected unauthenticated for unrelated requested audience")
+	}
+
+	// A mapped audience is matched by the name the token carries
+	rw := &config.AudienceRewrite{Map: map[string]string{"api": "kube"}}
+	if result := reviewFromClaims(tr, tokenClaims, rw); !result.Status.Authenticated || !slices.Equal(result.Status.Audiences, []string{"api"}) {
+		t.Errorf("mapped audience: status = %+v", result.Status)
+	}
+}
+
+func TestTokenReview_Fallback(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// client-go may send protobuf; JSON responses are accepted
+		body, _ := io.ReadAll(r.Body)
+		var tr authv1.TokenReview
+		if _, _, err := scheme.Codecs.UniversalDeserializer().Decode(body, nil, &tr); err != nil {
+			t.Errorf("decoding forwarded TokenReview: %v", err)
+		}
+		tr.Status = authv1.TokenReviewStatus{Authenticated: tr.Spec.Token == "legacy-token"}
+		if tr.Status.Authenticated {
+			tr.Status.User = authv1.UserInfo{Username: "system:serviceaccount:default:legacy"}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tr)
+	}))
+	defer apiServer.Close()
+
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"legacy": {Issuer: "https://legacy.example.com", APIServer: apiServer.URL, Fallback: config.FallbackTokenReview},
+	}}
+	handler := NewTokenReviewHandler(oidc.NewVerifierManager(cfg, nil, nil), cfg, nil, nil, nil, nil)
+
+	review := func(token string) authv1.TokenReview {
+		body := `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"` + token + `"}}`
+		req := httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var resp authv1.TokenReview
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+		return resp
+	}
+
+	resp := review("legacy-token")
+	if !resp.Status.Authenticated || resp.Status.User.Username != "system:serviceaccount:default:legacy" {
+		t.Fatalf("legacy token: status = %+v", resp.Status)
+	}
+	if got := resp.Status.User.Extra[ExtraKeyClusterName]; !slices.Equal(got, []string{"legacy"}) {
+		t.Errorf("cluster name extra = %v", got)
+	}
+
+	if resp := review("unknown-token"); resp.Status.Authenticated {
+		t.Error("token rejected by the fallback cluster was authenticated")
+	}
+}
+
+func TestTokenReview_StrippedAudience(t *testing.T) {
+	forwarded := 0
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		body, _ := io.ReadAll(r.Body)
+		var tr authv1.TokenReview
+		if _, _, err := scheme.Codecs.UniversalDeserializer().Decode(body, nil, &tr); err != nil {
+			t.Errorf("decoding forwarded TokenReview: %v", err)
+		}
+		if slices.Contains(tr.Spec.Audiences, "kube-fed") {
+			t.Errorf("stripped audience forwarded: %v", tr.Spec.Audiences)
+		}
+		tr.Status = authv1.TokenReviewStatus{Authenticated: true, User: authv1.UserInfo{Username: "system:serviceaccount:default:app"}}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tr)
+	}))
+	defer apiServer.Close()
+
+	key, keyFile := testSigningKey(t)
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"b": {Issuer: "https://b.invalid", APIServer: apiServer.URL, JWKSFile: keyFile,
+			AudienceRewrite: &config.AudienceRewrite{Strip: []string{"kube-fed"}}},
+	}}
+	handler := NewTokenReviewHandler(oidc.NewVerifierManager(cfg, nil, nil), cfg, nil, nil, nil, nil)
+
+	review := func(aud string) authv1.TokenReview {
+		token := signTestToken(t, key, map[string]any{
+			"iss": "https://b.invalid", "sub": "system:serviceaccount:default:app", "aud": []string{aud},
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		body := `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"` + token + `","audiences":["kube-fed"]}}`
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", strings.NewReader(body)))
+		var resp authv1.TokenReview
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+		return resp
+	}
+
+	if resp := review("kube-fed"); !resp.Status.Authenticated || !slices.Equal(resp.Status.Audiences, []string{"kube-fed"}) {
+		t.Errorf("token for the stripped audience: status = %+v", resp.Status)
+	}
+	// Any other token of the cluster must not pass for the stripped audience
+	forwarded = 0
+	if resp := review("https://kubernetes.default.svc"); resp.Status.Authenticated {
+		t.Errorf("token without the stripped audience authenticated: %+v", resp.Status)
+	}
+	if forwarded != 0 {
+		t.Errorf("token without the stripped audience was forwarded")
+	}
+}
+
+func TestTokenReview_MappedAudience(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var tr authv1.TokenReview
+		if _, _, err := scheme.Codecs.UniversalDeserializer().Decode(body, nil, &tr); err != nil {
+			t.Errorf("decoding forwarded TokenReview: %v", err)
+		}
+		tr.Status = authv1.TokenReviewStatus{Authenticated: true, Audiences: tr.Spec.Audiences,
+			User: authv1.UserInfo{Username: "system:serviceaccount:default:app"}}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tr)
+	}))
+	defer apiServer.Close()
+
+	// The audiences and audience_rewrite of the README example
+	remote := "https://kubernetes.default.svc.cluster.local"
+	key, keyFile := testSigningKey(t)
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"b": {Issuer: "https://b.invalid", APIServer: apiServer.URL, JWKSFile: keyFile,
+			Audiences: []string{"kube-fed", remote},
+			AudienceRewrite: &config.AudienceRewrite{
+				PassThrough: []string{"shared-aud"},
+				Strip:       []string{"kube-fed"},
+				Map:         map[string]string{"my-service": remote},
+			}},
+	}}
+	handler := NewTokenReviewHandler(oidc.NewVerifierManager(cfg, nil, nil), cfg, nil, nil, nil, nil)
+	token := signTestToken(t, key, map[string]any{
+		"iss": "https://b.invalid", "sub": "system:serviceaccount:default:app", "aud": []string{remote},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	for requested, want := range map[string][]string{`["my-service"]`: {"my-service"}, `[]`: {"my-service"}} {
+		body := `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"` + token + `","audiences":` + requested + `}}`
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", strings.NewReader(body)))
+		var resp authv1.TokenReview
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+		if !resp.Status.Authenticated || !slices.Equal(resp.Status.Audiences, want) {
+			t.Errorf("requested %s: status = %+v, want audiences %v", requested, resp.Status, want)
+		}
+	}
+}
+
+func TestTokenReview_PathRouting(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var tr authv1.TokenReview
+		if _, _, err := scheme.Codecs.UniversalDeserializer().Decode(body, nil, &tr); err != nil {
+			t.Errorf("decoding forwarded TokenReview: %v", err)
+		}
+		tr.Status = authv1.TokenReviewStatus{Authenticated: true, User: authv1.UserInfo{Username: "system:serviceaccount:default:app"}}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tr)
+	}))
+	defer apiServer.Close()
+
+	// Both clusters accept any token; unpinned, "a" is tried first. The user
+	// rules of "b" see the user with its templates applied.
+	cfg := &config.Config{GroupTemplates: []string{"federated:cluster:{cluster}", "federated:namespace:{namespace}"}, Clusters: map[string]config.ClusterConfig{
+		"a": {Issuer: "https://a.example.com", APIServer: apiServer.URL, Fallback: config.FallbackTokenReview},
+		"b": {Issuer: "https://b.example.com", APIServer: apiServer.URL, Fallback: config.FallbackTokenReview, UsernameTemplate: "fed:{cluster}:{subject}",
+			UserValidationRules: []config.UserValidationRule{{Expression: "user.username.startsWith('fed:b:') && 'federated:cluster:b' in user.groups"}}},
+	}}
+	mappers, err := claims.Compile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewTokenReviewHandler(oidc.NewVerifierManager(cfg, nil, nil), cfg, nil, mappers, nil, nil)
+	r := chi.NewRouter()
+	r.Post("/tokenreview/{cluster}", handler.ServeHTTP)
+	r.Post("/apis/authentication.k8s.io/v1/tokenreviews", handler.ServeHTTP)
+
+	review := func(path string, host ...string) (int, authv1.TokenReview) {
+		body := `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"opaque-token"}}`
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if len(host) > 0 {
+			req.Host = host[0]
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp authv1.TokenReview
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+		return w.Code, resp
+	}
+
+	code, resp := review("/tokenreview/b")
+	if code != http.StatusOK || !resp.Status.Authenticated {
+		t.Fatalf("pinned to b: %d %+v", code, resp.Status)
+	}
+	if got := resp.Status.User.Extra[ExtraKeyClusterName]; !slices.Equal(got, []string{"b"}) {
+		t.Errorf("cluster name extra = %v, want [b]", got)
+	}
+	if want := "fed:b:system:serviceaccount:default:app"; resp.Status.User.Username != want {
+		t.Errorf("username = %q, want %q", resp.Status.User.Username, want)
+	}
+	if want := []string{"federated:cluster:b", "federated:namespace:default"}; !slices.Equal(resp.Status.User.Groups, want) {
+		t.Errorf("groups = %v, want %v", resp.Status.User.Groups, want)
+	}
+
+	if code, resp := review("/tokenreview/missing"); code != http.StatusNotFound || resp.Status.Authenticated {
+		t.Errorf("unknown cluster: %d %+v", code, resp.Status)
+	}
+
+	routes := func(hosts map[string]string) {
+		t.Helper()
+		for host, want := range hosts {
+			_, resp := review("/apis/authentication.k8s.io/v1/tokenreviews", host)
+			if got := resp.Status.User.Extra[ExtraKeyClusterName]; !slices.Equal(got, []string{want}) {
+				t.Errorf("pattern %q, host %s: cluster name extra = %v, want [%s]", cfg.HostPattern, host, got, want)
+			}
+		}
+	}
+
+	// Without a host pattern the Host is ignored
+	routes(map[string]string{"api.b.kube-fed": "a", "b.auth.example.com": "a"})
+
+	// A Host of the host pattern pins the standard path; one naming an
+	// unconfigured cluster, or with more labels, leaves detection to the token
+	cfg.HostPattern = "{cluster}.auth.example.com"
+	routes(map[string]string{
+		"b.auth.example.com":           "b",
+		"b.auth.example.com:443":       "b",
+		"b.auth.example.com.other.net": "a",
+		"missing.auth.example.com":     "a",
+		"example.com":                  "a",
+	})
+}
+
+func TestSubjectAccessReview(t *testing.T) {
+	handler := NewSubjectAccessReviewHandler(authz.NewRulePolicy(&config.AuthorizationSettings{Rules: []config.AuthorizationRule{
+		{Clusters: []string{"b"}, Verbs: []string{"get"}, Resources: []string{"pods"}},
+	}}))
+
+	review := func(body string) (int, authzv1.SubjectAccessReview) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/sar", strings.NewReader(body)))
+		var resp authzv1.SubjectAccessReview
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	// The cluster is the cluster-name extra of our TokenReviews
+	code, resp := review(`{"apiVersion":"authorization.k8s.io/v1","kind":"SubjectAccessReview","spec":{` +
+		`"user":"system:serviceaccount:default:app","extra":{"` + ExtraKeyClusterName + `":["b"]},` +
+		`"resourceAttributes":{"verb":"get","resource":"pods","namespace":"default"}}}`)
+	if code != http.StatusOK || !resp.Status.Allowed || resp.APIVersion != "authorization.k8s.io/v1" {
+		t.Errorf("cluster b: %d %+v", code, resp)
+	}
+
+	_, resp = review(`{"apiVersion":"authorization.k8s.io/v1","kind":"SubjectAccessReview","spec":{` +
+		`"user":"system:serviceaccount:default:app","resourceAttributes":{"verb":"get","resource":"pods"}}}`)
+	if resp.Status.Allowed || resp.Status.Denied || resp.Status.Reason == "" {
+		t.Errorf("no cluster: want no opinion with a reason, status = %+v", resp.Status)
+	}
+
+	if code, _ := review("not json"); code != http.StatusBadRequest {
+		t.Errorf("invalid body: status = %d, want 400", code)
+	}
+}
+
+func TestPolicyDenied(t *testing.T) {
+	m, err := claims.NewMapper(config.ClusterConfig{
+		ClaimValidationRules: []config.ClaimValidationRule{{Claim: "hd", RequiredValue: "example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := policyDenied("a", "claim", m.ValidateClaims(map[string]any{"hd": "other.com"}))
+	if want := `policy_denied: claim validation failed: claim "hd" must be "example.com"`; got != want {
+		t.Errorf("policyDenied = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+// Heartbeats records when each cluster last sent a heartbeat. They are kept
+// in memory per replica and start empty after a restart.
+type Heartbeats struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewHeartbeats() *Heartbeats {
+	return &Heartbeats{seen: make(map[string]time.Time)}
+}
+
+// Record notes a heartbeat of cluster at the given time
+func (h *Heartbeats) Record(cluster string, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seen[cluster] = at
+}
+
+// LastSeen returns the time of cluster's last heartbeat, if any
+func (h *Heartbeats) LastSeen(cluster string) (time.Time, bool) {
+	if h == nil {
+		return time.Time{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	at, ok := h.seen[cluster]
+	return at, ok
+}
+
+// HeartbeatHandler serves POST /heartbeat: a remote cluster presents one of
+// its ServiceAccount tokens as a bearer token, which is verified against the
+// cluster's keys like a TokenReview but not forwarded to its API server, and
+// its heartbeat is recorded for /clusters. GET /heartbeat/config, with the
+// same authentication, returns the settings its clients should follow.
+type HeartbeatHandler struct {
+	reviews    *TokenReviewHandler
+	heartbeats *Heartbeats
+}
+
+// HeartbeatConfig is the response of GET /heartbeat/config
+type HeartbeatConfig struct {
+	Cluster string `json:"cluster"`
+	// Interval is how often to send heartbeats, as a Go duration
+	Interval   string `json:"interval"`
+	StaleAfter string `json:"stale_after"`
+	// Audiences are the audiences the cluster's tokens must carry, if any
+	Audiences []string        `json:"audiences,omitempty"`
+	Features  map[string]bool `json:"features,omitempty"`
+}
+
+func NewHeartbeatHandler(reviews *TokenReviewHandler, heartbeats *Heartbeats) *HeartbeatHandler {
+	return &HeartbeatHandler{reviews: reviews, heartbeats: heartbeats}
+}
+
+func (h *HeartbeatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	cluster, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	h.heartbeats.Record(cluster, now)
+	json.NewEncoder(w).Encode(map[string]any{"cluster": cluster, "last_seen": now.UTC()})
+}
+
+// ServeConfig serves GET /heartbeat/config
+func (h *HeartbeatHandler) ServeConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	cluster, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	cfg := h.reviews.config
+	resp := HeartbeatConfig{
+		Cluster:    cluster,
+		Interval:   cfg.GetHeartbeatInterval().String(),
+		StaleAfter: cfg.GetHeartbeatStaleAfter().String(),
+		Audiences:  cfg.Clusters[cluster].Audiences,
+	}
+	if cfg.Heartbeat != nil {
+		resp.Features = cfg.Heartbeat.Features
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// authenticate returns the cluster of the request's bearer token, or writes
+// an error response. The token must pass the cluster's claim validation rules
+// and audiences, and its subject the heartbeat allowlist, as a valid
+// signature alone would let any workload of the cluster keep it alive.
+func (h *HeartbeatHandler) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a bearer ServiceAccount token is required"})
+		return "", false
+	}
+	if h.reviews.verifier == nil || h.reviews.config == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "server not configured"})
+		return "", false
+	}
+	cluster, tokenClaims, err := h.reviews.detectCluster(r.Context(), token, "")
+	if err != nil {
+		log.Printf("Rejected heartbeat: %v", err)
+		status := http.StatusUnauthorized
+		if errors.Is(err, oidc.ErrUpstream) || errors.Is(err, oidc.ErrCircuitOpen) {
+			status = http.StatusServiceUnavailable
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": detectionFailure(err)})
+		return "", false
+	}
+
+	cfg := h.reviews.config
+	if err := h.reviews.mappers[cluster].ValidateClaims(tokenClaims.Raw); err != nil {
+		return h.forbidden(w, cluster, tokenClaims.Subject, fmt.Errorf("claim validation failed: %w", err))
+	}
+	if err := checkTokenAudiences(nil, tokenClaims.Audience, cfg.Clusters[cluster].Audiences); err != nil {
+		return h.forbidden(w, cluster, tokenClaims.Subject, err)
+	}
+	if !cfg.Heartbeat.IsAllowedCaller(tokenClaims.Subject) {
+		return h.forbidden(w, cluster, tokenClaims.Subject, errors.New("caller not allowed"))
+	}
+	return cluster, true
+}
+
+func (h *HeartbeatHandler) forbidden(w http.ResponseWriter, cluster, subject string, err error) (string, bool) {
+	log.Printf("Rejected heartbeat of %s for cluster %s: %v", subject, cluster, err)
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	return "", false
+}
@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+// KeysHandler exports every cluster's current JWKS as an oidc.KeySnapshot,
+// for kfa export-keys. It is only mounted on the admin listener.
+type KeysHandler struct {
+	verifier *oidc.VerifierManager
+}
+
+func NewKeysHandler(verifier *oidc.VerifierManager) *KeysHandler {
+	return &KeysHandler{verifier: verifier}
+}
+
+func (h *KeysHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	snapshot := h.verifier.ExportKeys(r.Context())
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(snapshot)
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/logging"
+)
+
+type LogLevelRequest struct {
+	Level string `json:"level"` // "info" or "debug"
+	// Cluster limits the change to one cluster's debug logging
+	Cluster string `json:"cluster,omitempty"`
+	// Duration bounds the change, e.g. "10m". Per-cluster debug defaults to 15m.
+	Duration string `json:"duration,omitempty"`
+}
+
+// LogLevelHandler reads (GET) and changes (PUT) log verbosity at runtime
+type LogLevelHandler struct {
+	config *config.Config
+}
+
+func NewLogLevelHandler(cfg *config.Config) *LogLevelHandler {
+	return &LogLevelHandler{config: cfg}
+}
+
+func (h *LogLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPut {
+		if err := h.apply(r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(logging.CurrentState())
+}
+
+func (h *LogLevelHandler) apply(r *http.Request) error {
+	var req LogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+
+	level, err := logging.ParseLevel(req.Level)
+	if err != nil {
+		return err
+	}
+
+	var duration time.Duration
+	if req.Duration != "" {
+		if duration, err = time.ParseDuration(req.Duration); err != nil || duration < 0 {
+			return fmt.Errorf("invalid duration %q", req.Duration)
+		}
+	}
+
+	if req.Cluster == "" {
+		logging.SetLevel(level, duration)
+		log.Printf("Log level set to %s (duration: %s)", level, durationOrForever(duration))
+		return nil
+	}
+
+	if _, ok := h.config.Clusters[req.Cluster]; !ok {
+		return fmt.Errorf("cluster not found: %s", req.Cluster)
+	}
+	logging.SetClusterDebug(req.Cluster, level == logging.LevelDebug, duration)
+	log.Printf("Debug logging for cluster %s set to %t", req.Cluster, level == logging.LevelDebug)
+	return nil
+}
+
+func durationOrForever(d time.Duration) string {
+	if d == 0 {
+		return "until changed"
+	}
+	return d.String()
+}
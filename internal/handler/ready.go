@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// ClusterProber checks that a cluster's discovery and JWKS endpoints are reachable
+type ClusterProber interface {
+	Probe(ctx context.Context, clusterName string) error
+}
+
+type ClusterReadiness struct {
+	Status string `json:"status"` // "ok" or "error"
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadyResponse struct {
+	Status   string                      `json:"status"` // "ready" or "not_ready"
+	Healthy  int                         `json:"healthy"`
+	Required int                         `json:"required"`
+	Clusters map[string]ClusterReadiness `json:"clusters"`
+}
+
+type ReadyHandler struct {
+	config *config.Config
+	prober ClusterProber
+}
+
+func NewReadyHandler(cfg *config.Config, prober ClusterProber) *ReadyHandler {
+	return &ReadyHandler{config: cfg, prober: prober}
+}
+
+func (h *ReadyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.config.GetProbeTimeout())
+	defer cancel()
+
+	// Probe all clusters concurrently so one slow cluster doesn't delay the rest
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	resp := ReadyResponse{
+		Required: h.config.GetMinHealthyClusters(),
+		Clusters: make(map[string]ClusterReadiness, len(h.config.Clusters)),
+	}
+	for name := range h.config.Clusters {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			status := ClusterReadiness{Status: "ok"}
+			if err := h.prober.Probe(ctx, name); err != nil {
+				status = ClusterReadiness{Status: "error", Error: err.Error()}
+			}
+			mu.Lock()
+			resp.Clusters[name] = status
+			if status.Status == "ok" {
+				resp.Healthy++
+			}
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	resp.Status = "ready"
+	code := http.StatusOK
+	if resp.Healthy < resp.Required {
+		resp.Status = "not_ready"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// WebhookHealthHandler serves /healthz/webhook/{cluster}: 200 only if that
+// cluster's discovery and JWKS can currently be fetched with its credentials,
+// for kube-apiservers (or their load balancers) that depend on a single cluster.
+type WebhookHealthHandler struct {
+	config *config.Config
+	prober ClusterProber
+}
+
+func NewWebhookHealthHandler(cfg *config.Config, prober ClusterProber) *WebhookHealthHandler {
+	return &WebhookHealthHandler{config: cfg, prober: prober}
+}
+
+func (h *WebhookHealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := chi.URLParam(r, "cluster")
+	if _, ok := h.config.Clusters[name]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ClusterReadiness{Status: "error", Error: "unknown cluster"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.config.GetProbeTimeout())
+	defer cancel()
+
+	if err := h.prober.Probe(ctx, name); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ClusterReadiness{Status: "error", Error: err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(ClusterReadiness{Status: "ok"})
+}
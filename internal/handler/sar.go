@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	authzv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/authz"
+	"github.com/rophy/kube-federated-auth/internal/logging"
+)
+
+// SubjectAccessReviewHandler serves POST /sar, the authorization.k8s.io/v1
+// SubjectAccessReview webhook. The user's cluster is the cluster-name extra
+// our TokenReviews add, which the consuming API server passes back in the
+// review.
+type SubjectAccessReviewHandler struct {
+	policy authz.Policy
+}
+
+func NewSubjectAccessReviewHandler(policy authz.Policy) *SubjectAccessReviewHandler {
+	return &SubjectAccessReviewHandler{policy: policy}
+}
+
+func (h *SubjectAccessReviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var sar authzv1.SubjectAccessReview
+	if err := json.NewDecoder(r.Body).Decode(&sar); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request body"})
+		return
+	}
+
+	cluster := ""
+	if values := sar.Spec.Extra[ExtraKeyClusterName]; len(values) > 0 {
+		cluster = values[0]
+	}
+	resp := authzv1.SubjectAccessReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "authorization.k8s.io/v1", Kind: "SubjectAccessReview"},
+	}
+
+	// A policy error is a failed evaluation: the webhook has no opinion, and
+	// evaluationError tells the API server why
+	decision, reason, err := h.policy.Authorize(r.Context(), cluster, sar.Spec)
+	switch {
+	case err != nil:
+		log.Printf("Authorization policy failed for %s of cluster %q: %v", sar.Spec.User, cluster, err)
+		resp.Status.EvaluationError = err.Error()
+	case decision == authz.Allow:
+		resp.Status = authzv1.SubjectAccessReviewStatus{Allowed: true, Reason: reason}
+	case decision == authz.Deny:
+		resp.Status = authzv1.SubjectAccessReviewStatus{Denied: true, Reason: reason}
+	default:
+		resp.Status.Reason = reason
+	}
+	logging.Debugf(cluster, "SubjectAccessReview of %s: allowed=%v denied=%v (%s)", sar.Spec.User, resp.Status.Allowed, resp.Status.Denied, resp.Status.Reason)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// SchemaHandler serves the JSON Schema of the config file
+type SchemaHandler struct {
+	schema []byte
+}
+
+func NewSchemaHandler() *SchemaHandler {
+	schema, _ := json.MarshalIndent(config.Schema(), "", "  ")
+	return &SchemaHandler{schema: schema}
+}
+
+func (h *SchemaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(h.schema)
+}
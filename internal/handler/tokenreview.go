@@ -3,105 +3,323 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	authv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
+	"github.com/rophy/kube-federated-auth/internal/audit"
+	"github.com/rophy/kube-federated-auth/internal/claims"
 	"github.com/rophy/kube-federated-auth/internal/config"
 	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/egress"
+	"github.com/rophy/kube-federated-auth/internal/execcred"
+	"github.com/rophy/kube-federated-auth/internal/logging"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
 	"github.com/rophy/kube-federated-auth/internal/oidc"
+	"github.com/rophy/kube-federated-auth/internal/redact"
+	"github.com/rophy/kube-federated-auth/internal/replay"
+	"github.com/rophy/kube-federated-auth/internal/tracing"
 )
 
 // ExtraKeyClusterName is the key used in TokenReview response extra field
 // to indicate which cluster the token was validated against.
 const ExtraKeyClusterName = "authentication.kubernetes.io/cluster-name"
 
+// TokenReview API versions served. Older webhook clients still send v1beta1.
+const (
+	APIVersionV1      = "authentication.k8s.io/v1"
+	APIVersionV1beta1 = "authentication.k8s.io/v1beta1"
+)
+
 type TokenReviewHandler struct {
 	verifier  *oidc.VerifierManager
 	config    *config.Config
 	credStore *credentials.Store
+	mappers   map[string]*claims.Mapper
+	auditor   *audit.Logger
+	replay    *replay.Recorder
 }
 
-func NewTokenReviewHandler(v *oidc.VerifierManager, cfg *config.Config, store *credentials.Store) *TokenReviewHandler {
+func NewTokenReviewHandler(v *oidc.VerifierManager, cfg *config.Config, store *credentials.Store, mappers map[string]*claims.Mapper, auditor *audit.Logger, replayer *replay.Recorder) *TokenReviewHandler {
 	return &TokenReviewHandler{
 		verifier:  v,
 		config:    cfg,
 		credStore: store,
+		mappers:   mappers,
+		auditor:   auditor,
+		replay:    replayer,
 	}
 }
 
 func (h *TokenReviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	ev := audit.NewEvent(r, middleware.GetReqID(r.Context()))
+	defer h.auditor.Log(ev)
+
 	// Parse TokenReview request
 	var tr authv1.TokenReview
 	if err := json.NewDecoder(r.Body).Decode(&tr); err != nil {
-		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		ev.Deny("", "", "invalid request body", http.StatusBadRequest)
+		h.writeError(w, nil, http.StatusBadRequest, "invalid request body")
 		return
 	}
 
 	if tr.Spec.Token == "" {
-		h.writeError(w, http.StatusBadRequest, "token is required")
+		ev.Deny("", "", "token is required", http.StatusBadRequest)
+		h.writeError(w, &tr, http.StatusBadRequest, "token is required")
 		return
 	}
 
 	if h.verifier == nil || h.config == nil {
+		ev.Deny("", "", "server not configured", http.StatusOK)
 		h.writeUnauthenticated(w, &tr, "server not configured")
 		return
 	}
 
+	// POST /tokenreview/{cluster} pins the review to one cluster, as does a
+	// Host matching the host pattern for a configured cluster
+	pinned := chi.URLParam(r, "cluster")
+	if pinned == "" {
+		if cluster, ok := h.config.ClusterFromHost(r.Host); ok {
+			if _, configured := h.config.Clusters[cluster]; configured {
+				pinned = cluster
+			}
+		}
+	} else if _, ok := h.config.Clusters[pinned]; !ok {
+		msg := fmt.Sprintf("cluster %q is not configured", pinned)
+		ev.Deny("", "", msg, http.StatusNotFound)
+		h.writeError(w, &tr, http.StatusNotFound, msg)
+		return
+	}
+
 	// Step 1: Detect cluster via JWKS (local, no token leakage)
-	cluster, err := h.detectCluster(r.Context(), tr.Spec.Token)
+	cluster, tokenClaims, err := h.detectCluster(r.Context(), tr.Spec.Token, pinned)
 	if err != nil {
 		log.Printf("Cluster detection failed: %v", err)
-		h.writeUnauthenticated(w, &tr, "token not valid for any configured cluster")
+		if fallbackApplies(err) {
+			if cluster, result, ok := h.fallbackReview(r.Context(), &tr, pinned); ok {
+				log.Printf("Token authenticated by fallback TokenReview of cluster %s", cluster)
+				h.writeAuthenticated(w, &tr, ev, cluster, result)
+				return
+			}
+		}
+		msg := detectionFailure(err)
+		ev.Deny("", "", msg, http.StatusOK)
+		h.writeUnauthenticated(w, &tr, msg)
 		return
 	}
 
 	log.Printf("Detected cluster: %s", cluster)
+	logging.Debugf(cluster, "Token claims: sub=%s aud=%v exp=%d", tokenClaims.Subject, tokenClaims.Audience, tokenClaims.Expiry)
+
+	subject := tokenClaims.Subject
+	rec := h.replay.Start(cluster, tokenClaims.Raw)
+	defer func() { h.replay.Record(rec) }()
+
+	mapper := h.mappers[cluster]
+	if err := mapper.ValidateClaims(tokenClaims.Raw); err != nil {
+		log.Printf("Claim validation failed for cluster %s: %v", cluster, err)
+		msg := policyDenied(cluster, "claim", err)
+		ev.Deny(cluster, subject, msg, http.StatusOK)
+		rec.Deny(msg)
+		h.writeUnauthenticated(w, &tr, msg)
+		return
+	}
 
-	// Step 2: Forward TokenReview to detected cluster
-	result, err := h.forwardTokenReview(r.Context(), cluster, &tr)
+	clusterCfg := h.config.Clusters[cluster]
+	audiences, err := effectiveAudiences(clusterCfg.AudienceRewrite, clusterCfg.Audiences, tr.Spec.Audiences)
+	if err != nil {
+		log.Printf("Audience check failed for cluster %s: %v", cluster, err)
+		ev.Deny(cluster, subject, err.Error(), http.StatusOK)
+		rec.Deny(err.Error())
+		h.writeUnauthenticated(w, &tr, err.Error())
+		return
+	}
+	forward := tr.DeepCopy()
+	forward.Spec.Audiences = audiences
+
+	// Step 2: Forward TokenReview to detected cluster. Generic OIDC issuers,
+	// public managed clusters and key_snapshot clusters have no TokenReview
+	// API we can call; their verified claims are the review.
+	var result *authv1.TokenReview
+	if !clusterCfg.HasTokenReviewAPI() {
+		result = reviewFromClaims(forward, tokenClaims, clusterCfg.AudienceRewrite)
+	} else {
+		if err := checkTokenAudiences(clusterCfg.AudienceRewrite, tokenClaims.Audience, audiences); err != nil {
+			log.Printf("Audience check failed for cluster %s: %v", cluster, err)
+			ev.Deny(cluster, subject, err.Error(), http.StatusOK)
+			rec.Deny(err.Error())
+			h.writeUnauthenticated(w, &tr, err.Error())
+			return
+		}
+		result, err = h.forwardTokenReview(r.Context(), cluster, forward)
+		if err == nil && result.Status.Authenticated {
+			result.Status.Audiences = append(result.Status.Audiences, strippedAudiences(clusterCfg.AudienceRewrite, audiences, tokenClaims.Audience)...)
+		}
+	}
 	if err != nil {
 		log.Printf("TokenReview forwarding failed for cluster %s: %v", cluster, err)
-		h.writeUnauthenticated(w, &tr, fmt.Sprintf("failed to validate token: %v", err))
+		msg := fmt.Sprintf("failed to validate token: %v", err)
+		ev.Deny(cluster, subject, msg, http.StatusOK)
+		h.writeUnauthenticated(w, &tr, msg)
+		rec = nil // not a policy decision
 		return
 	}
+	result.Spec.Audiences = tr.Spec.Audiences
+	if len(clusterCfg.Audiences) > 0 && result.Status.Authenticated {
+		result.Status.Audiences = intersectAudiences(result.Status.Audiences, audiences)
+	}
+	limitToRequested(result, tr.Spec.Audiences)
+	if result.Status.Authenticated {
+		rec.Forward(&result.Status.User)
+	} else {
+		rec.Forward(nil)
+	}
+
+	// Compute user info from claims when the cluster configures claimMappings
+	if result.Status.Authenticated && mapper.HasMappings() {
+		user, err := mapper.MapUser(tokenClaims.Raw)
+		if err != nil {
+			log.Printf("Claim mapping failed for cluster %s: %v", cluster, err)
+			msg := fmt.Sprintf("claim mapping failed: %v", err)
+			ev.Deny(cluster, subject, msg, http.StatusOK)
+			rec.Deny(msg)
+			h.writeUnauthenticated(w, &tr, msg)
+			return
+		}
+		result.Status.User = *user
+	}
 
-	// Add cluster name to extra field for client awareness
 	if result.Status.Authenticated {
-		if result.Status.User.Extra == nil {
-			result.Status.User.Extra = make(map[string]authv1.ExtraValue)
+		claims.ApplyTemplates(h.config, cluster, tokenClaims.Raw, &result.Status.User)
+		if err := mapper.ValidateUser(result.Status.User); err != nil {
+			log.Printf("User validation failed for cluster %s: %v", cluster, err)
+			msg := policyDenied(cluster, "user", err)
+			ev.Deny(cluster, subject, msg, http.StatusOK)
+			rec.Deny(msg)
+			h.writeUnauthenticated(w, &tr, msg)
+			return
 		}
-		result.Status.User.Extra[ExtraKeyClusterName] = authv1.ExtraValue{cluster}
 	}
 
+	if result.Status.Authenticated {
+		rec.Allow()
+		h.writeAuthenticated(w, &tr, ev, cluster, result)
+		return
+	}
+	ev.Deny(cluster, subject, result.Status.Error, http.StatusOK)
+	rec.Deny(result.Status.Error)
+
 	// Return the response from the remote cluster
+	result.APIVersion = responseAPIVersion(&tr)
+	result.Status.Error = redact.String(result.Status.Error)
 	json.NewEncoder(w).Encode(result)
 }
 
-// detectCluster tries to verify the token against all configured clusters using JWKS.
-// This is done locally without sending the token anywhere.
-// Returns the cluster name that successfully verified the token signature.
-func (h *TokenReviewHandler) detectCluster(ctx context.Context, token string) (string, error) {
-	for clusterName := range h.config.Clusters {
-		_, err := h.verifier.Verify(ctx, clusterName, token)
+// responseAPIVersion is the apiVersion a review is answered in: the one of
+// the request for authentication.k8s.io/v1beta1, whose TokenReview has the
+// same fields, and v1 otherwise
+func responseAPIVersion(req *authv1.TokenReview) string {
+	if req != nil && req.APIVersion == APIVersionV1beta1 {
+		return APIVersionV1beta1
+	}
+	return APIVersionV1
+}
+
+// policyDenied is the status error of a token rejected by the claim or user
+// validation rules of a cluster. It starts with the policy_denied code so that
+// clients can tell policy rejections from invalid tokens.
+func policyDenied(cluster, stage string, err error) string {
+	msg := fmt.Sprintf("%s validation failed: %v", stage, err)
+	if !errors.Is(err, claims.ErrPolicyDenied) {
+		return msg
+	}
+	metrics.PolicyDenials.WithLabelValues(cluster, stage).Inc()
+	return fmt.Sprintf("%v: %s", claims.ErrPolicyDenied, msg)
+}
+
+// writeAuthenticated returns an authenticated review, adding the cluster name
+// to the extra field for client awareness
+func (h *TokenReviewHandler) writeAuthenticated(w http.ResponseWriter, req *authv1.TokenReview, ev *audit.Event, cluster string, result *authv1.TokenReview) {
+	result.APIVersion = responseAPIVersion(req)
+	user := &result.Status.User
+	if user.Extra == nil {
+		user.Extra = make(map[string]authv1.ExtraValue)
+	}
+	user.Extra[ExtraKeyClusterName] = authv1.ExtraValue{cluster}
+	ev.Allow(cluster, *user)
+	json.NewEncoder(w).Encode(result)
+}
+
+// detectCluster verifies the token using JWKS against the clusters configured
+// with its (unverified) iss claim, so callers only submit the token. This is
+// done locally without sending the token anywhere. A pinned cluster is the
+// only candidate.
+// Returns the cluster name that successfully verified the token signature and its claims.
+func (h *TokenReviewHandler) detectCluster(ctx context.Context, token, pinned string) (string, *oidc.Claims, error) {
+	issuer, err := oidc.UnverifiedIssuer(token)
+	if err != nil {
+		return "", nil, &oidc.Error{Kind: oidc.ErrInvalidToken, Err: err}
+	}
+	candidates := h.config.ClustersForIssuer(issuer)
+	if len(candidates) == 0 {
+		return "", nil, &oidc.Error{Kind: oidc.ErrIssuer, Err: fmt.Errorf("token issuer %q is not configured for any cluster", issuer)}
+	}
+	if pinned != "" {
+		if !slices.Contains(candidates, pinned) {
+			return "", nil, &oidc.Error{Kind: oidc.ErrIssuer, Err: fmt.Errorf("token issuer %q is not configured for cluster %s", issuer, pinned)}
+		}
+		candidates = []string{pinned}
+	}
+
+	// failure is the last error other than a signature or issuer mismatch,
+	// i.e. of a cluster the token may belong to
+	var failure error
+	for _, clusterName := range candidates {
+		tokenClaims, err := h.verifier.Verify(ctx, clusterName, token)
 		if err == nil {
-			return clusterName, nil
+			return clusterName, tokenClaims, nil
+		}
+		logging.Debugf(clusterName, "Token not valid for cluster: %v", err)
+		if !errors.Is(err, oidc.ErrSignature) && !errors.Is(err, oidc.ErrIssuer) {
+			failure = fmt.Errorf("cluster %s: %w", clusterName, err)
 		}
-		// Signature didn't match - try next cluster
-		log.Printf("Token not valid for cluster %s: %v", clusterName, err)
 	}
-	return "", fmt.Errorf("token signature does not match any configured cluster")
+	if failure != nil {
+		return "", nil, failure
+	}
+	return "", nil, &oidc.Error{Kind: oidc.ErrSignature, Err: fmt.Errorf("token signature does not match any configured cluster")}
+}
+
+// detectionFailure is the TokenReview status error for a failed cluster
+// detection. Only failures callers can act on are told apart.
+func detectionFailure(err error) string {
+	switch {
+	case errors.Is(err, oidc.ErrCircuitOpen):
+		return "cluster API server unavailable (circuit open)"
+	case errors.Is(err, oidc.ErrUpstream):
+		return "cluster API server unavailable"
+	case errors.Is(err, oidc.ErrExpired):
+		return "token is expired"
+	}
+	return "token not valid for any configured cluster"
 }
 
 // forwardTokenReview sends the TokenReview request to the detected cluster's API server.
-func (h *TokenReviewHandler) forwardTokenReview(ctx context.Context, clusterName string, tr *authv1.TokenReview) (*authv1.TokenReview, error) {
+func (h *TokenReviewHandler) forwardTokenReview(ctx context.Context, clusterName string, tr *authv1.TokenReview) (_ *authv1.TokenReview, err error) {
+	ctx, span := tracing.Start(ctx, "tokenreview.forward", tracing.AttrCluster.String(clusterName))
+	defer func() { tracing.End(span, err) }()
+
 	clusterCfg, ok := h.config.Clusters[clusterName]
 	if !ok {
 		return nil, fmt.Errorf("cluster not found: %s", clusterName)
@@ -119,40 +337,92 @@ func (h *TokenReviewHandler) forwardTokenReview(ctx context.Context, clusterName
 		return nil, fmt.Errorf("creating kubernetes client: %w", err)
 	}
 
+	// Translate requested audiences to the remote cluster's conventions
+	remoteReq := tr.DeepCopy()
+	remoteReq.Spec.Audiences = rewriteAudiences(clusterCfg.AudienceRewrite, tr.Spec.Audiences)
+
 	// Forward TokenReview request
-	result, err := client.AuthenticationV1().TokenReviews().Create(ctx, tr, metav1.CreateOptions{})
+	result, err := client.AuthenticationV1().TokenReviews().Create(ctx, remoteReq, metav1.CreateOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("calling TokenReview API: %w", err)
 	}
 
+	result.Spec.Audiences = tr.Spec.Audiences
+	if result.Status.Authenticated {
+		result.Status.Audiences = restoreAudiences(clusterCfg.AudienceRewrite, tr.Spec.Audiences, result.Status.Audiences)
+	}
+
 	// Ensure TypeMeta is set (k8s client doesn't populate this on responses)
-	result.APIVersion = "authentication.k8s.io/v1"
+	result.APIVersion = APIVersionV1
 	result.Kind = "TokenReview"
 
 	return result, nil
 }
 
+// reviewFromClaims answers a TokenReview from the verified claims of a token
+// of a cluster without a TokenReview API we can call: a generic OIDC issuer, a
+// public managed cluster or a key_snapshot cluster. Signature, issuer, times
+// and the cluster's audiences were verified, and the client_id of an OIDC
+// issuer. A key_snapshot token is only checked against the snapshot's keys:
+// it has no client_id, and no API server tells whether its ServiceAccount
+// still exists. The user is mapped from the claims by the caller. Requested
+// audiences are matched as the token carries them, after audience_rewrite.map.
+func reviewFromClaims(tr *authv1.TokenReview, tokenClaims *oidc.Claims, rw *config.AudienceRewrite) *authv1.TokenReview {
+	result := &authv1.TokenReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: APIVersionV1, Kind: "TokenReview"},
+		Spec:     tr.Spec,
+	}
+	audiences := tokenClaims.Audience
+	if len(tr.Spec.Audiences) > 0 {
+		audiences = nil
+		for _, aud := range tr.Spec.Audiences {
+			if slices.Contains(tokenClaims.Audience, tokenAudience(rw, aud)) {
+				audiences = append(audiences, aud)
+			}
+		}
+		if len(audiences) == 0 {
+			result.Status.Error = fmt.Sprintf("token audiences %v do not include any of %v", tokenClaims.Audience, tr.Spec.Audiences)
+			return result
+		}
+	}
+	result.Status.Authenticated = true
+	result.Status.Audiences = audiences
+	return result
+}
+
 // buildRESTConfig creates a REST config for the target cluster
 func (h *TokenReviewHandler) buildRESTConfig(clusterName string, clusterCfg config.ClusterConfig) (*rest.Config, error) {
 	// For clusters with api_server, use remote credentials
 	if clusterCfg.APIServer != "" {
 		var bearerToken string
 		var caCert []byte
+		var creds *credentials.Credentials
 
 		if h.credStore != nil {
-			if creds, ok := h.credStore.Get(clusterName); ok {
+			if stored, ok := h.credStore.Get(clusterName); ok {
+				creds = stored
 				bearerToken = creds.Token
 				caCert = creds.CACert
 			}
 		}
+		if bearerToken != "" {
+			if err := credentials.CheckFreshness(bearerToken, clusterCfg.MaxCredentialAge); err != nil {
+				return nil, err
+			}
+		}
 
-		return &rest.Config{
-			Host:        clusterCfg.APIServer,
-			BearerToken: bearerToken,
-			TLSClientConfig: rest.TLSClientConfig{
-				CAData: caCert,
-			},
-		}, nil
+		restConfig := &rest.Config{
+			Host:            clusterCfg.APIServer,
+			BearerToken:     bearerToken,
+			TLSClientConfig: credentials.RESTTLSConfig(clusterCfg, caCert, creds),
+		}
+		if err := egress.ApplyREST(clusterCfg.Egress, restConfig); err != nil {
+			return nil, fmt.Errorf("configuring egress: %w", err)
+		}
+		if bearerToken == "" {
+			execcred.ApplyREST(clusterCfg.Exec, restConfig)
+		}
+		return restConfig, nil
 	}
 
 	// For local clusters, try in-cluster config first
@@ -170,28 +440,28 @@ func (h *TokenReviewHandler) buildRESTConfig(clusterName string, clusterCfg conf
 func (h *TokenReviewHandler) writeUnauthenticated(w http.ResponseWriter, req *authv1.TokenReview, errMsg string) {
 	resp := &authv1.TokenReview{
 		TypeMeta: metav1.TypeMeta{
-			APIVersion: "authentication.k8s.io/v1",
+			APIVersion: responseAPIVersion(req),
 			Kind:       "TokenReview",
 		},
 		Status: authv1.TokenReviewStatus{
 			Authenticated: false,
-			Error:         errMsg,
+			Error:         redact.String(errMsg),
 		},
 	}
 
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (h *TokenReviewHandler) writeError(w http.ResponseWriter, code int, msg string) {
+func (h *TokenReviewHandler) writeError(w http.ResponseWriter, req *authv1.TokenReview, code int, msg string) {
 	w.WriteHeader(code)
 	resp := &authv1.TokenReview{
 		TypeMeta: metav1.TypeMeta{
-			APIVersion: "authentication.k8s.io/v1",
+			APIVersion: responseAPIVersion(req),
 			Kind:       "TokenReview",
 		},
 		Status: authv1.TokenReviewStatus{
 			Authenticated: false,
-			Error:         msg,
+			Error:         redact.String(msg),
 		},
 	}
 	json.NewEncoder(w).Encode(resp)
@@ -0,0 +1,21 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rophy/kube-federated-auth/internal/version"
+)
+
+type VersionHandler struct {
+	info version.Info
+}
+
+func NewVersionHandler() *VersionHandler {
+	return &VersionHandler{info: version.Get()}
+}
+
+func (h *VersionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.info)
+}
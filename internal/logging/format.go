@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// ParseFormat parses "text" or "json"
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatText, FormatJSON:
+		return Format(s), nil
+	}
+	return "", fmt.Errorf("unknown log format %q (valid: text, json)", s)
+}
+
+// jsonRecord is one line of JSON log output
+type jsonRecord struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Cluster string    `json:"cluster,omitempty"`
+	Msg     string    `json:"msg"`
+}
+
+// JSONWriter writes each message of the standard logger as a JSON object on
+// its own line, for log aggregation. Use it with log.SetFlags(0); the time is
+// added to each record. Debugf messages get level debug and their cluster as
+// a field, messages starting with "WARNING" or "Warning" level warn.
+type JSONWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{w: w}
+}
+
+func (w *JSONWriter) Write(p []byte) (int, error) {
+	rec := jsonRecord{Time: time.Now().UTC(), Level: "info", Msg: strings.TrimSuffix(string(p), "\n")}
+	if msg, ok := strings.CutPrefix(rec.Msg, "[debug] "); ok {
+		rec.Level, rec.Msg = "debug", msg
+		if strings.HasPrefix(msg, "[") {
+			if cluster, rest, ok := strings.Cut(msg[1:], "] "); ok {
+				rec.Cluster, rec.Msg = cluster, rest
+			}
+		}
+	} else if strings.HasPrefix(rec.Msg, "WARNING") || strings.HasPrefix(rec.Msg, "Warning") {
+		rec.Level = "warn"
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.w.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,137 @@
+// Package logging adds a runtime-adjustable debug level on top of the standard
+// logger, globally or for a single cluster for a bounded duration.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type Level string
+
+const (
+	LevelInfo  Level = "info"
+	LevelDebug Level = "debug"
+)
+
+// DefaultClusterDebugDuration bounds per-cluster debug logging when no duration is given
+const DefaultClusterDebugDuration = 15 * time.Minute
+
+var (
+	mu sync.RWMutex
+	// global level and when it reverts to info (zero = never)
+	level      = LevelInfo
+	levelUntil time.Time
+	// clusters with debug logging enabled, and until when
+	clusters = map[string]time.Time{}
+)
+
+// ParseLevel parses "info" or "debug"
+func ParseLevel(s string) (Level, error) {
+	switch Level(s) {
+	case LevelInfo, LevelDebug:
+		return Level(s), nil
+	}
+	return "", fmt.Errorf("unknown log level %q (valid: info, debug)", s)
+}
+
+// SetLevel sets the global level. A positive duration reverts it to info afterwards.
+func SetLevel(l Level, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+	levelUntil = time.Time{}
+	if d > 0 && l != LevelInfo {
+		levelUntil = time.Now().Add(d)
+	}
+}
+
+// ToggleLevel switches the global level between info and debug and returns the new level
+func ToggleLevel() Level {
+	next := LevelDebug
+	if currentLevel() == LevelDebug {
+		next = LevelInfo
+	}
+	SetLevel(next, 0)
+	return next
+}
+
+// SetClusterDebug enables debug logging for cluster for d (DefaultClusterDebugDuration if zero),
+// or disables it when enabled is false
+func SetClusterDebug(cluster string, enabled bool, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !enabled {
+		delete(clusters, cluster)
+		return
+	}
+	if d <= 0 {
+		d = DefaultClusterDebugDuration
+	}
+	clusters[cluster] = time.Now().Add(d)
+}
+
+// State describes the current log configuration
+type State struct {
+	Level      Level                `json:"level"`
+	LevelUntil *time.Time           `json:"level_until,omitempty"`
+	Clusters   map[string]time.Time `json:"debug_clusters,omitempty"` // cluster -> debug until
+}
+
+// CurrentState returns the active configuration, dropping expired entries
+func CurrentState() State {
+	st := State{Level: currentLevel(), Clusters: map[string]time.Time{}}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	if st.Level == LevelDebug && !levelUntil.IsZero() {
+		until := levelUntil
+		st.LevelUntil = &until
+	}
+	now := time.Now()
+	for cluster, until := range clusters {
+		if now.Before(until) {
+			st.Clusters[cluster] = until
+		}
+	}
+	return st
+}
+
+func currentLevel() Level {
+	mu.RLock()
+	defer mu.RUnlock()
+	if level == LevelDebug && !levelUntil.IsZero() && time.Now().After(levelUntil) {
+		return LevelInfo
+	}
+	return level
+}
+
+// DebugEnabled reports whether debug messages for cluster are logged.
+// An empty cluster only checks the global level.
+func DebugEnabled(cluster string) bool {
+	if currentLevel() == LevelDebug {
+		return true
+	}
+	if cluster == "" {
+		return false
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	until, ok := clusters[cluster]
+	return ok && time.Now().Before(until)
+}
+
+// Debugf logs a message if debug logging is enabled globally or for cluster
+func Debugf(cluster, format string, args ...any) {
+	if !DebugEnabled(cluster) {
+		return
+	}
+	if cluster != "" {
+		format = "[debug] [" + cluster + "] " + format
+	} else {
+		format = "[debug] " + format
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevels(t *testing.T) {
+	t.Cleanup(func() {
+		SetLevel(LevelInfo, 0)
+		SetClusterDebug("cluster-a", false, 0)
+	})
+
+	if DebugEnabled("cluster-a") {
+		t.Fatal("debug enabled by default")
+	}
+
+	SetClusterDebug("cluster-a", true, time.Minute)
+	if !DebugEnabled("cluster-a") || DebugEnabled("cluster-b") || DebugEnabled("") {
+		t.Error("cluster debug should only apply to cluster-a")
+	}
+
+	SetClusterDebug("cluster-a", true, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if DebugEnabled("cluster-a") {
+		t.Error("cluster debug did not expire")
+	}
+
+	if got := ToggleLevel(); got != LevelDebug || !DebugEnabled("cluster-b") {
+		t.Errorf("ToggleLevel = %s, want global debug", got)
+	}
+	if got := ToggleLevel(); got != LevelInfo {
+		t.Errorf("ToggleLevel = %s, want info", got)
+	}
+
+	SetLevel(LevelDebug, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if st := CurrentState(); st.Level != LevelInfo {
+		t.Errorf("level = %s after expiry, want info", st.Level)
+	}
+
+	if _, err := ParseLevel("trace"); err == nil {
+		t.Error("ParseLevel(trace): expected error")
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(NewJSONWriter(&buf), "", 0)
+	logger.Printf("Loaded 2 cluster(s)")
+	logger.Printf("[debug] [cluster-b] Token claims: sub=%s", "system:serviceaccount:default:app")
+	logger.Printf("Warning: no clusters configured")
+
+	var records []jsonRecord
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec jsonRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	want := []jsonRecord{
+		{Level: "info", Msg: "Loaded 2 cluster(s)"},
+		{Level: "debug", Cluster: "cluster-b", Msg: "Token claims: sub=system:serviceaccount:default:app"},
+		{Level: "warn", Msg: "Warning: no clusters configured"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %s", len(records), len(want), buf.String())
+	}
+	for i, rec := range records {
+		if rec.Time.IsZero() {
+			t.Errorf("record %d has no time", i)
+		}
+		rec.Time = time.Time{}
+		if rec != want[i] {
+			t.Errorf("record %d = %+v, want %+v", i, rec, want[i])
+		}
+	}
+
+	if _, err := ParseFormat("yaml"); err == nil {
+		t.Error("ParseFormat accepted yaml")
+	}
+}
@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rophy/kube-federated-auth/internal/version"
+)
+
+const namespace = "kfa"
+
+func init() {
+	// Replace the default Go collector with one that also exports the
+	// runtime/metrics GC, memory and scheduler series
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(
+			collectors.MetricsGC,
+			collectors.MetricsMemory,
+			collectors.MetricsScheduler,
+		),
+	))
+	prometheus.MustRegister(jwksAge)
+}
+
+var (
+	// BuildInfo is always 1, labeled with the running build
+	BuildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "build_info",
+		Help:      "Build information of the running binary; always 1.",
+	}, []string{"version", "revision", "go_version"})
+
+	// InFlightRequests tracks requests currently being served per endpoint
+	InFlightRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "in_flight_requests",
+		Help:      "Number of requests currently being served.",
+	}, []string{"endpoint"})
+
+	// RejectedRequests counts requests shed because the in-flight limit was reached
+	RejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_requests_total",
+		Help:      "Requests rejected because the endpoint's in-flight limit was reached.",
+	}, []string{"endpoint"})
+
+	// CanaryProbes counts canary authentication probes per cluster and result
+	CanaryProbes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "canary_probes_total",
+		Help:      "Synthetic end-to-end authentication probes by result.",
+	}, []string{"cluster", "result"})
+
+	// CanarySuccess is 1 if the last canary probe for a cluster succeeded
+	CanarySuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "canary_success",
+		Help:      "Whether the last canary probe for the cluster succeeded (1) or failed (0).",
+	}, []string{"cluster"})
+
+	// CanaryLastSuccess records when a cluster's canary last succeeded
+	CanaryLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "canary_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful canary probe for the cluster.",
+	}, []string{"cluster"})
+
+	// CanaryDuration observes end-to-end canary probe latency
+	CanaryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "canary_duration_seconds",
+		Help:      "Latency of canary probes, from token minting to TokenReview response.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"cluster"})
+)
+
+// JWKSRefreshes counts JWKS fetches per cluster and result, whether
+// triggered in the background or by an unknown key ID
+var JWKSRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "jwks_refreshes_total",
+	Help:      "JWKS fetches by cluster and result.",
+}, []string{"cluster", "result"})
+
+// CredentialsHealthy is 0 once a cluster has rejected its stored credentials,
+// until a later credential check succeeds
+var CredentialsHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "credentials_healthy",
+	Help:      "Whether the cluster accepted its stored credentials at the last check (1) or rejected them (0).",
+}, []string{"cluster"})
+
+// CredentialExpiry is when each remote cluster's stored token expires
+var CredentialExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "credential_expiry_timestamp_seconds",
+	Help:      "Unix time at which the cluster's stored token expires.",
+}, []string{"cluster"})
+
+// RenewalLastSuccess records when a cluster's renewal check last completed
+// without error, whether or not the token needed renewing
+var RenewalLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "renewal_last_success_timestamp_seconds",
+	Help:      "Unix time of the last renewal check of the cluster that completed without error.",
+}, []string{"cluster"})
+
+// RenewalConsecutiveFailures counts a cluster's renewal checks failed in a row
+var RenewalConsecutiveFailures = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "renewal_consecutive_failures",
+	Help:      "Renewal checks of the cluster that failed since the last successful one.",
+}, []string{"cluster"})
+
+// RenewalNextCheck is when a cluster's next renewal check is due
+var RenewalNextCheck = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "renewal_next_check_timestamp_seconds",
+	Help:      "Unix time at which the cluster's next renewal check is due.",
+}, []string{"cluster"})
+
+// CredentialChecks counts credential checks per cluster and result
+var CredentialChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "credential_checks_total",
+	Help:      "Periodic checks of stored credentials by result (ok, rejected, error).",
+}, []string{"cluster", "result"})
+
+// CircuitState reports each cluster's upstream circuit: 0 closed, 1 half-open, 2 open
+var CircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "circuit_state",
+	Help:      "Upstream circuit breaker state by cluster (0 closed, 1 half-open, 2 open).",
+}, []string{"cluster"})
+
+// CircuitRejections counts discovery and JWKS requests failed fast by an open circuit
+var CircuitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "circuit_rejections_total",
+	Help:      "Upstream requests rejected by an open circuit breaker, by cluster.",
+}, []string{"cluster"})
+
+// NegativeCacheHits counts token validations answered from the negative cache
+var NegativeCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "negative_cache_hits_total",
+	Help:      "Token validations rejected from the negative cache, by cluster.",
+}, []string{"cluster"})
+
+// PolicyDenials counts tokens rejected by a cluster's claim or user validation rules
+var PolicyDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "policy_denials_total",
+	Help:      "Tokens rejected by validation rules, by cluster and stage (claim or user).",
+}, []string{"cluster", "stage"})
+
+// StorageBytes reports the on-disk size of persisted histories (audit, replay)
+var StorageBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "storage_bytes",
+	Help:      "On-disk size of a persisted history.",
+}, []string{"store"})
+
+// RetentionDropped counts records removed by retention compaction
+var RetentionDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "retention_dropped_records_total",
+	Help:      "Records dropped from a persisted history by retention policies.",
+}, []string{"store"})
+
+// MirroredRequests counts TokenReviews mirrored to the shadow instance by
+// result: match, diverged, error (shadow unreachable or unparseable) or
+// dropped (too many mirrored requests in flight)
+var MirroredRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "mirror_requests_total",
+	Help:      "TokenReviews mirrored to the shadow instance by result.",
+}, []string{"result"})
+
+// MirrorDivergences counts mirrored decisions that differ, by the first differing field
+var MirrorDivergences = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "mirror_divergences_total",
+	Help:      "Mirrored TokenReview decisions differing from the primary, by field.",
+}, []string{"cluster", "field"})
+
+// ageCollector exports kfa_jwks_age_seconds, computed at scrape time
+type ageCollector struct {
+	desc *prometheus.Desc
+
+	mu     sync.RWMutex
+	source func() map[string]time.Duration
+}
+
+var jwksAge = &ageCollector{
+	desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "jwks_age_seconds"),
+		"Time since the cluster's JWKS was last fetched successfully.", []string{"cluster"}, nil),
+}
+
+func (c *ageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *ageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	source := c.source
+	c.mu.RUnlock()
+	if source == nil {
+		return
+	}
+	for cluster, age := range source() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, age.Seconds(), cluster)
+	}
+}
+
+// SetJWKSAgeSource sets the function reporting per-cluster key set age at scrape time
+func SetJWKSAgeSource(source func() map[string]time.Duration) {
+	jwksAge.mu.Lock()
+	jwksAge.source = source
+	jwksAge.mu.Unlock()
+}
+
+// SetBuildInfo publishes kfa_build_info for the running build
+func SetBuildInfo(info version.Info) {
+	BuildInfo.WithLabelValues(info.Version, info.Commit, info.GoVersion).Set(1)
+}
+
+// Handler returns the Prometheus scrape handler
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,207 @@
+// Package mirror duplicates a sample of TokenReview traffic to a shadow
+// instance and compares its decisions with the primary's, so an upgrade can
+// be validated against production traffic before cutover. Mirroring is
+// asynchronous and never affects the primary response.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/handler"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+)
+
+// tokenReviewPath is where both instances serve TokenReviews
+const tokenReviewPath = "/apis/authentication.k8s.io/v1/tokenreviews"
+
+// maxInFlight bounds concurrent mirrored requests; beyond it samples are dropped
+const maxInFlight = 64
+
+// maxBody bounds the request and response bodies buffered for comparison
+const maxBody = 1 << 20
+
+// Mirror sends sampled TokenReviews to a shadow instance
+type Mirror struct {
+	url      string
+	percent  float64
+	client   *http.Client
+	inFlight chan struct{}
+}
+
+// New builds a mirror from settings. Returns nil if mirroring is not configured.
+func New(cfg *config.MirrorSettings) (*Mirror, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading mirror CA cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &Mirror{
+		url:      strings.TrimSuffix(cfg.URL, "/") + tokenReviewPath,
+		percent:  cfg.Percent,
+		client:   &http.Client{Transport: transport, Timeout: cfg.GetTimeout()},
+		inFlight: make(chan struct{}, maxInFlight),
+	}, nil
+}
+
+// Wrap returns next, mirroring the sampled share of its requests. A nil
+// *Mirror returns next unchanged.
+func (m *Mirror) Wrap(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64()*100 >= m.percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+		if err != nil {
+			http.Error(w, "reading request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		select {
+		case m.inFlight <- struct{}{}:
+		default:
+			metrics.MirroredRequests.WithLabelValues("dropped").Inc()
+			return
+		}
+		go func() {
+			defer func() { <-m.inFlight }()
+			m.compare(body, rec.status, rec.body.Bytes())
+		}()
+	})
+}
+
+// recorder passes the primary response through while keeping a copy
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.body.Len() < maxBody {
+		r.body.Write(p)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (m *Mirror) compare(request []byte, primaryStatus int, primaryBody []byte) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, m.url, bytes.NewReader(request))
+	if err != nil {
+		metrics.MirroredRequests.WithLabelValues("error").Inc()
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Printf("Mirror: shadow request failed: %v", err)
+		metrics.MirroredRequests.WithLabelValues("error").Inc()
+		return
+	}
+	defer resp.Body.Close()
+	shadowBody, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		metrics.MirroredRequests.WithLabelValues("error").Inc()
+		return
+	}
+
+	cluster, field := Diverges(primaryStatus, primaryBody, resp.StatusCode, shadowBody)
+	if field == "" {
+		metrics.MirroredRequests.WithLabelValues("match").Inc()
+		return
+	}
+	metrics.MirroredRequests.WithLabelValues("diverged").Inc()
+	metrics.MirrorDivergences.WithLabelValues(cluster, field).Inc()
+	log.Printf("Mirror: shadow decision diverged for cluster %q on %s", cluster, field)
+}
+
+// Diverges compares two TokenReview responses and returns the cluster the
+// primary attributed the token to, and the first field that differs (status,
+// authenticated, username, uid, groups or cluster), or "" if the decisions
+// match. Error messages are not compared since their wording may change
+// between versions.
+func Diverges(primaryStatus int, primaryBody []byte, shadowStatus int, shadowBody []byte) (cluster, field string) {
+	var primary, shadow authv1.TokenReview
+	primaryErr := json.Unmarshal(primaryBody, &primary)
+	shadowErr := json.Unmarshal(shadowBody, &shadow)
+	cluster = clusterOf(primary.Status.User)
+
+	switch {
+	case primaryStatus != shadowStatus:
+		return cluster, "status"
+	case primaryErr != nil || shadowErr != nil:
+		// Non-TokenReview bodies (e.g. 400 errors) only compare by status
+		if (primaryErr == nil) != (shadowErr == nil) {
+			return cluster, "status"
+		}
+		return cluster, ""
+	}
+
+	p, s := primary.Status, shadow.Status
+	switch {
+	case p.Authenticated != s.Authenticated:
+		return cluster, "authenticated"
+	case !p.Authenticated:
+		return cluster, ""
+	case p.User.Username != s.User.Username:
+		return cluster, "username"
+	case p.User.UID != s.User.UID:
+		return cluster, "uid"
+	case !sameSet(p.User.Groups, s.User.Groups):
+		return cluster, "groups"
+	case cluster != clusterOf(s.User):
+		return cluster, "cluster"
+	}
+	return cluster, ""
+}
+
+func clusterOf(user authv1.UserInfo) string {
+	if v := user.Extra[handler.ExtraKeyClusterName]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func sameSet(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
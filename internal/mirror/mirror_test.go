@@ -0,0 +1,99 @@
+package mirror
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/handler"
+)
+
+func review(authenticated bool, username string, groups ...string) []byte {
+	tr := authv1.TokenReview{Status: authv1.TokenReviewStatus{Authenticated: authenticated}}
+	if authenticated {
+		tr.Status.User = authv1.UserInfo{
+			Username: username,
+			Groups:   groups,
+			Extra:    map[string]authv1.ExtraValue{handler.ExtraKeyClusterName: {"cluster-a"}},
+		}
+	} else {
+		tr.Status.Error = "denied"
+	}
+	data, _ := json.Marshal(tr)
+	return data
+}
+
+func TestDiverges(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryStatus int
+		primary       []byte
+		shadowStatus  int
+		shadow        []byte
+		want          string
+	}{
+		{"same user", 200, review(true, "alice", "a", "b"), 200, review(true, "alice", "b", "a"), ""},
+		{"both denied", 200, review(false, ""), 200, review(false, ""), ""},
+		{"newly denied", 200, review(true, "alice"), 200, review(false, ""), "authenticated"},
+		{"different user", 200, review(true, "alice"), 200, review(true, "bob"), "username"},
+		{"different groups", 200, review(true, "alice", "a"), 200, review(true, "alice", "a", "b"), "groups"},
+		{"status", 400, []byte("bad request"), 200, review(false, ""), "status"},
+		{"both bad request", 400, []byte("bad request"), 400, []byte("invalid request body"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := Diverges(tt.primaryStatus, tt.primary, tt.shadowStatus, tt.shadow); got != tt.want {
+				t.Errorf("Diverges() field = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	received := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.URL.Path + " " + string(body)
+		w.Write(review(true, "alice"))
+	}))
+	defer shadow.Close()
+
+	m, err := New(&config.MirrorSettings{URL: shadow.URL, Percent: 100})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"spec":{"token":"t"}}` {
+			t.Errorf("primary body = %q", body)
+		}
+		w.Write(review(true, "alice"))
+	})
+
+	w := httptest.NewRecorder()
+	m.Wrap(primary).ServeHTTP(w, httptest.NewRequest(http.MethodPost, tokenReviewPath, strings.NewReader(`{"spec":{"token":"t"}}`)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "alice") {
+		t.Errorf("primary response = %d %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case got := <-received:
+		if got != tokenReviewPath+` {"spec":{"token":"t"}}` {
+			t.Errorf("shadow received %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow did not receive mirrored request")
+	}
+
+	var nilMirror *Mirror
+	if nilMirror.Wrap(primary) == nil {
+		t.Error("nil mirror should return next")
+	}
+}
@@ -0,0 +1,254 @@
+// Package notify routes operational events (credentials about to expire, a
+// verifier that keeps failing, a rejected registration) to on-call tooling:
+// Slack, PagerDuty Events v2, email, or any HTTP endpoint.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// Severities, in PagerDuty's vocabulary
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Notification is one operational event
+type Notification struct {
+	// Type is one of config.NotifyEventTypes
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	Cluster   string    `json:"cluster,omitempty"`
+	Summary   string    `json:"summary"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Notifier delivers notifications to one channel
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// sendTimeout bounds each delivery
+const sendTimeout = 10 * time.Second
+
+type route struct {
+	name     string
+	notifier Notifier
+}
+
+// Router fans notifications out to the channels configured for their type.
+// A nil *Router drops notifications.
+type Router struct {
+	routes map[string][]route
+}
+
+// New builds a router from settings. Returns nil if notifications are not configured.
+func New(cfg *config.NotificationSettings) (*Router, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	channels := make(map[string]Notifier, len(cfg.Channels))
+	for name, ch := range cfg.Channels {
+		n, err := newNotifier(ch)
+		if err != nil {
+			return nil, fmt.Errorf("channel %q: %w", name, err)
+		}
+		channels[name] = n
+	}
+
+	r := &Router{routes: map[string][]route{}}
+	for event, names := range cfg.Routes {
+		for _, name := range names {
+			r.routes[event] = append(r.routes[event], route{name: name, notifier: channels[name]})
+		}
+	}
+	return r, nil
+}
+
+func newNotifier(ch config.ChannelSettings) (Notifier, error) {
+	switch ch.Type {
+	case config.ChannelSlack:
+		return &Slack{URL: ch.URL}, nil
+	case config.ChannelHTTP:
+		return &HTTP{URL: ch.URL}, nil
+	case config.ChannelPagerDuty:
+		return &PagerDuty{RoutingKey: ch.RoutingKey}, nil
+	case config.ChannelSMTP:
+		return NewSMTP(ch.SMTP)
+	}
+	return nil, fmt.Errorf("unknown type %q", ch.Type)
+}
+
+// Routes reports whether any channel receives events of type eventType
+func (r *Router) Routes(eventType string) bool {
+	return r != nil && len(r.routes[eventType]) > 0
+}
+
+// Send delivers n to its channels in the background. Failures are logged.
+func (r *Router) Send(n Notification) {
+	if r == nil {
+		return
+	}
+	if n.Timestamp.IsZero() {
+		n.Timestamp = time.Now().UTC()
+	}
+	for _, rt := range r.routes[n.Type] {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+			defer cancel()
+			if err := rt.notifier.Notify(ctx, n); err != nil {
+				log.Printf("Notification %s to channel %s failed: %v", n.Type, rt.name, err)
+			}
+		}()
+	}
+}
+
+func postJSON(ctx context.Context, url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n Notification) title() string {
+	if n.Cluster == "" {
+		return fmt.Sprintf("[kube-federated-auth] %s", n.Type)
+	}
+	return fmt.Sprintf("[kube-federated-auth] %s: %s", n.Type, n.Cluster)
+}
+
+// HTTP posts the Notification as JSON
+type HTTP struct {
+	URL string
+}
+
+func (h *HTTP) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, h.URL, n)
+}
+
+// Slack posts to an incoming webhook
+type Slack struct {
+	URL string
+}
+
+func (s *Slack) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, s.URL, map[string]string{
+		"text": fmt.Sprintf("*%s* (%s)\n%s", n.title(), n.Severity, n.Summary),
+	})
+}
+
+// pagerDutyURL is the Events API v2 enqueue endpoint
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty triggers Events API v2 alerts. Alerts are deduplicated per event
+// type and cluster, so a flapping condition updates one incident.
+type PagerDuty struct {
+	RoutingKey string
+	// URL overrides the Events API endpoint (for tests)
+	URL string
+}
+
+func (p *PagerDuty) Notify(ctx context.Context, n Notification) error {
+	url := p.URL
+	if url == "" {
+		url = pagerDutyURL
+	}
+	return postJSON(ctx, url, map[string]any{
+		"routing_key":  p.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    "kube-federated-auth/" + n.Type + "/" + n.Cluster,
+		"payload": map[string]any{
+			"summary":        n.title() + ": " + n.Summary,
+			"source":         "kube-federated-auth",
+			"severity":       n.Severity,
+			"timestamp":      n.Timestamp.Format(time.RFC3339),
+			"component":      n.Cluster,
+			"class":          n.Type,
+			"custom_details": n,
+		},
+	})
+}
+
+// SMTP sends plain-text email
+type SMTP struct {
+	addr string
+	host string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+// NewSMTP reads the password file, if any, and returns an email notifier
+func NewSMTP(cfg *config.SMTPSettings) (*SMTP, error) {
+	port := cfg.Port
+	if port == 0 {
+		port = config.DefaultSMTPPort
+	}
+	s := &SMTP{
+		addr: net.JoinHostPort(cfg.Host, strconv.Itoa(port)),
+		host: cfg.Host,
+		from: cfg.From,
+		to:   cfg.To,
+	}
+	if cfg.Username != "" {
+		var password string
+		if cfg.PasswordFile != "" {
+			data, err := os.ReadFile(cfg.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading SMTP password: %w", err)
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		s.auth = smtp.PlainAuth("", cfg.Username, password, cfg.Host)
+	}
+	return s, nil
+}
+
+func (s *SMTP) Notify(ctx context.Context, n Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.title())
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Timestamp.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nSeverity: %s\r\nCluster: %s\r\nTime: %s\r\n",
+		n.Summary, n.Severity, n.Cluster, n.Timestamp.Format(time.RFC3339))
+
+	// net/smtp has no context support; bound the whole exchange instead
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.addr, s.auth, s.from, s.to, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func capture(t *testing.T) (*httptest.Server, chan map[string]any) {
+	t.Helper()
+	received := make(chan map[string]any, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func TestPagerDuty(t *testing.T) {
+	srv, received := capture(t)
+	p := &PagerDuty{RoutingKey: "key", URL: srv.URL}
+	err := p.Notify(context.Background(), Notification{
+		Type:      config.NotifyVerifierDown,
+		Severity:  SeverityCritical,
+		Cluster:   "cluster-b",
+		Summary:   "discovery failing",
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	body := <-received
+	if body["routing_key"] != "key" || body["event_action"] != "trigger" {
+		t.Errorf("unexpected event: %v", body)
+	}
+	if body["dedup_key"] != "kube-federated-auth/verifier_down/cluster-b" {
+		t.Errorf("dedup_key = %v", body["dedup_key"])
+	}
+	payload, _ := body["payload"].(map[string]any)
+	if payload["severity"] != SeverityCritical || !strings.Contains(payload["summary"].(string), "discovery failing") {
+		t.Errorf("unexpected payload: %v", payload)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	slack, slackReceived := capture(t)
+	hook, hookReceived := capture(t)
+
+	r, err := New(&config.NotificationSettings{
+		Channels: map[string]config.ChannelSettings{
+			"chat": {Type: config.ChannelSlack, URL: slack.URL},
+			"hook": {Type: config.ChannelHTTP, URL: hook.URL},
+		},
+		Routes: map[string][]string{
+			config.NotifyCredentialExpiring: {"chat", "hook"},
+			config.NotifyVerifierDown:       {"hook"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if r.Routes(config.NotifyRegistrationRejected) {
+		t.Error("registration_rejected should not be routed")
+	}
+
+	r.Send(Notification{Type: config.NotifyCredentialExpiring, Severity: SeverityWarning, Cluster: "cluster-b", Summary: "token expires in 5m"})
+
+	for name, ch := range map[string]chan map[string]any{"slack": slackReceived, "http": hookReceived} {
+		select {
+		case body := <-ch:
+			if name == "slack" && !strings.Contains(body["text"].(string), "token expires in 5m") {
+				t.Errorf("slack text = %v", body["text"])
+			}
+			if name == "http" && (body["type"] != config.NotifyCredentialExpiring || body["cluster"] != "cluster-b") {
+				t.Errorf("http body = %v", body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s channel did not receive notification", name)
+		}
+	}
+
+	var nilRouter *Router
+	nilRouter.Send(Notification{Type: config.NotifyVerifierDown})
+}
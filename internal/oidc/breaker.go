@@ -0,0 +1,157 @@
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+)
+
+// ErrCircuitOpen is returned, wrapped, for discovery and JWKS requests to a
+// cluster whose circuit breaker is open
+var ErrCircuitOpen = errors.New("upstream circuit open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// breaker is a per-cluster circuit breaker. After threshold consecutive
+// failures it opens and rejects requests for openFor, then lets a single probe
+// through (half-open): success closes the circuit, failure reopens it.
+// A nil *breaker allows everything.
+type breaker struct {
+	cluster   string
+	threshold int
+	openFor   time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func newBreaker(cluster string, cfg *config.CircuitBreakerSettings) *breaker {
+	if cfg == nil {
+		return nil
+	}
+	metrics.CircuitState.WithLabelValues(cluster).Set(float64(circuitClosed))
+	return &breaker{
+		cluster:   cluster,
+		threshold: cfg.GetFailureThreshold(),
+		openFor:   cfg.GetOpenDuration(),
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a request may proceed, moving an open circuit to
+// half-open once openFor has elapsed
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.openFor {
+			break
+		}
+		b.setState(circuitHalfOpen)
+		return nil
+	case circuitHalfOpen:
+		// Only the probe is let through
+	default:
+		return nil
+	}
+	metrics.CircuitRejections.WithLabelValues(b.cluster).Inc()
+	return fmt.Errorf("cluster %s: %w", b.cluster, ErrCircuitOpen)
+}
+
+// record updates the circuit with the outcome of an allowed request
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(circuitOpen)
+	}
+}
+
+// abandon gives up a request that ended without an outcome, so that a
+// half-open circuit lets the next request probe instead
+func (b *breaker) abandon() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.setState(circuitOpen)
+	}
+}
+
+func (b *breaker) setState(state circuitState) {
+	if b.state == state {
+		return
+	}
+	log.Printf("Circuit for cluster %s: %s -> %s", b.cluster, b.state, state)
+	b.state = state
+	metrics.CircuitState.WithLabelValues(b.cluster).Set(float64(state))
+}
+
+// breakerTransport guards a cluster's discovery and JWKS requests. Transport
+// errors and 5xx responses count as failures; other responses (including 401
+// from expired credentials) show the API server is up.
+type breakerTransport struct {
+	breaker *breaker
+	next    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		// A canceled caller says nothing about the upstream
+		if req.Context().Err() != nil {
+			t.breaker.abandon()
+		} else {
+			t.breaker.record(true)
+		}
+		return nil, err
+	}
+	t.breaker.record(resp.StatusCode >= http.StatusInternalServerError)
+	return resp, nil
+}
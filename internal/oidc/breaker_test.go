@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("cluster-b", &config.CircuitBreakerSettings{FailureThreshold: 2, OpenDuration: time.Minute})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	b.record(true)
+	if err := b.allow(); err != nil {
+		t.Fatalf("below threshold: %v", err)
+	}
+	b.record(true)
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("at threshold: err = %v, want ErrCircuitOpen", err)
+	}
+
+	// After the open duration a single probe is let through
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second request while half-open: err = %v, want ErrCircuitOpen", err)
+	}
+
+	// A failed probe reopens immediately
+	b.record(true)
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("after failed probe: err = %v, want ErrCircuitOpen", err)
+	}
+
+	// A successful probe closes the circuit
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	b.record(false)
+	if err := b.allow(); err != nil {
+		t.Errorf("after successful probe: %v", err)
+	}
+
+	var disabled *breaker
+	if err := disabled.allow(); err != nil {
+		t.Errorf("nil breaker: %v", err)
+	}
+}
+
+func TestBreakerTransport(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	b := newBreaker("cluster-b", &config.CircuitBreakerSettings{FailureThreshold: 1, OpenDuration: time.Hour})
+	client := &http.Client{Transport: &breakerTransport{breaker: b, next: http.DefaultTransport}}
+
+	// 5xx counts as a failure
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := client.Get(srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("after 503: err = %v, want ErrCircuitOpen", err)
+	}
+
+	// 401 shows the API server is up
+	b = newBreaker("cluster-c", &config.CircuitBreakerSettings{FailureThreshold: 1, OpenDuration: time.Hour})
+	client.Transport = &breakerTransport{breaker: b, next: http.DefaultTransport}
+	status = http.StatusUnauthorized
+	for range 2 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("after 401: %v", err)
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,91 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// Verification failure kinds. Errors returned by VerifierManager.Verify match
+// one of them with errors.Is.
+var (
+	// ErrClusterNotFound: the cluster is not configured
+	ErrClusterNotFound = errors.New("cluster not found")
+	// ErrExpired: the token is past its exp
+	ErrExpired = errors.New("token is expired")
+	// ErrSignature: the token is not signed by any of the cluster's keys
+	ErrSignature = errors.New("token signature not valid for cluster")
+	// ErrIssuer: the token's iss is not one of the cluster's issuers
+	ErrIssuer = errors.New("token issuer not accepted by cluster")
+	// ErrInvalidToken: the token is malformed or fails another check
+	// (audience, nbf, iat, claims)
+	ErrInvalidToken = errors.New("token is invalid")
+	// ErrUpstream: the cluster's discovery or JWKS could not be fetched
+	ErrUpstream = errors.New("cluster upstream unavailable")
+)
+
+// ErrCredentialsRejected is wrapped by discovery and JWKS errors when the API
+// server answers 401 or 403, i.e. the cluster's credentials are not accepted
+var ErrCredentialsRejected = errors.New("credentials rejected by cluster")
+
+// statusError describes a non-200 response, marking rejected credentials
+func statusError(what string, code int, body string) error {
+	err := fmt.Errorf("%s returned status %d", what, code)
+	if body != "" {
+		err = fmt.Errorf("%w: %s", err, body)
+	}
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		return fmt.Errorf("%w: %w", ErrCredentialsRejected, err)
+	}
+	return err
+}
+
+// Error classifies a verification failure. Its message is that of Err, and
+// errors.Is matches both Kind and the errors wrapped by Err.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() []error { return []error{e.Kind, e.Err} }
+
+func classified(kind, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+// signatureResultKey carries a *error through go-oidc's Verify, so that
+// tracedKeySet can report the key set's own error: go-oidc formats it with
+// %v, which drops its type
+type signatureResultKey struct{}
+
+func withSignatureResult(ctx context.Context, result *error) context.Context {
+	return context.WithValue(ctx, signatureResultKey{}, result)
+}
+
+func setSignatureResult(ctx context.Context, err error) {
+	if result, ok := ctx.Value(signatureResultKey{}).(*error); ok {
+		*result = err
+	}
+}
+
+// classifyTokenError maps an error of go-oidc's IDTokenVerifier.Verify to a
+// failure kind. sigErr is the key set's error, if signature verification ran.
+func classifyTokenError(err, sigErr error, issuerAccepted bool) error {
+	var expired *oidc.TokenExpiredError
+	switch {
+	case sigErr != nil && errors.Is(sigErr, ErrUpstream):
+		return classified(ErrUpstream, err)
+	case sigErr != nil:
+		return classified(ErrSignature, err)
+	case !issuerAccepted:
+		return classified(ErrIssuer, err)
+	case errors.As(err, &expired):
+		return classified(ErrExpired, err)
+	}
+	return classified(ErrInvalidToken, err)
+}
@@ -0,0 +1,62 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func TestVerify_ErrorKinds(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"edge": {Issuer: "https://edge.invalid", JWKSFile: path},
+		"down": {Issuer: "https://down.invalid", APIServer: down.URL},
+	}}
+	m := NewVerifierManager(cfg, nil, nil)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	valid := map[string]any{"iss": "https://edge.invalid", "exp": time.Now().Add(time.Hour).Unix()}
+
+	tests := []struct {
+		name    string
+		cluster string
+		token   string
+		want    error
+	}{
+		{"unknown cluster", "missing", signTestToken(t, key, valid), ErrClusterNotFound},
+		{"expired", "edge", signTestToken(t, key, map[string]any{"iss": "https://edge.invalid", "exp": time.Now().Add(-time.Hour).Unix()}), ErrExpired},
+		{"other key", "edge", signTestToken(t, other, valid), ErrSignature},
+		{"other issuer", "edge", signTestToken(t, key, map[string]any{"iss": "https://other.invalid", "exp": time.Now().Add(time.Hour).Unix()}), ErrIssuer},
+		{"malformed", "edge", "not-a-jwt", ErrInvalidToken},
+		{"unreachable", "down", signTestToken(t, key, valid), ErrUpstream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.Verify(context.Background(), tt.cluster, tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
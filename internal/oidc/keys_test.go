@@ -0,0 +1,207 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		t.Fatalf("creating signer: %v", err)
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatalf("serializing token: %v", err)
+	}
+	return token
+}
+
+func TestVerifyOffline(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	jwks, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: "RS256", Use: "sig"}}})
+	keys, err := ParseKeySet(jwks)
+	if err != nil {
+		t.Fatalf("ParseKeySet(JWKS): %v", err)
+	}
+
+	token := signTestToken(t, key, map[string]any{
+		"iss": "https://issuer.example.com",
+		"sub": "system:serviceaccount:default:app",
+		"aud": []string{"api"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"kubernetes.io": map[string]any{
+			"namespace": "default",
+		},
+	})
+
+	claims, err := VerifyOffline(context.Background(), token, keys, OfflineOptions{Issuer: "https://issuer.example.com", Audience: "api"})
+	if err != nil {
+		t.Fatalf("VerifyOffline: %v", err)
+	}
+	if claims.Subject != "system:serviceaccount:default:app" {
+		t.Errorf("subject = %q", claims.Subject)
+	}
+	if claims.Kubernetes["namespace"] != "default" {
+		t.Errorf("kubernetes.io = %v", claims.Kubernetes)
+	}
+
+	if _, err := VerifyOffline(context.Background(), token, keys, OfflineOptions{Issuer: "https://other.example.com"}); err == nil {
+		t.Error("expected issuer mismatch error")
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&other.PublicKey)
+	pemKeys, err := ParseKeySet(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("ParseKeySet(PEM): %v", err)
+	}
+	if _, err := VerifyOffline(context.Background(), token, pemKeys, OfflineOptions{}); err == nil {
+		t.Error("expected signature error with unrelated key")
+	}
+}
+
+func TestVerify_JWKSFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "edge.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// No api_server and an unreachable issuer: verification must not touch the network
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"edge": {Issuer: "https://edge.invalid", JWKSFile: path},
+	}}
+	m := NewVerifierManager(cfg, nil, nil)
+
+	token := signTestToken(t, key, map[string]any{
+		"iss": "https://edge.invalid",
+		"sub": "system:serviceaccount:default:app",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	claims, err := m.Verify(context.Background(), "edge", token)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.Subject != "system:serviceaccount:default:app" {
+		t.Errorf("subject = %q", claims.Subject)
+	}
+	if err := m.Probe(context.Background(), "edge"); err != nil {
+		t.Errorf("Probe: %v", err)
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = m.Verify(context.Background(), "edge", signTestToken(t, other, map[string]any{
+		"iss": "https://edge.invalid",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+	if err == nil || !isClusterMismatch(err) {
+		t.Errorf("token signed by another key: err = %v, want signature mismatch", err)
+	}
+}
+
+func TestVerify_AdditionalIssuers(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"migrating": {
+			Issuer:            "https://new.example.com",
+			AdditionalIssuers: []string{"https://kubernetes.default.svc.cluster.local"},
+			JWKSFile:          path,
+		},
+	}}
+	m := NewVerifierManager(cfg, nil, nil)
+
+	for _, iss := range []string{"https://new.example.com", "https://kubernetes.default.svc.cluster.local"} {
+		token := signTestToken(t, key, map[string]any{"iss": iss, "sub": "app", "exp": time.Now().Add(time.Hour).Unix()})
+		claims, err := m.Verify(context.Background(), "migrating", token)
+		if err != nil {
+			t.Errorf("issuer %s: Verify: %v", iss, err)
+			continue
+		}
+		if claims.Issuer != iss {
+			t.Errorf("claims issuer = %q, want %q", claims.Issuer, iss)
+		}
+	}
+
+	token := signTestToken(t, key, map[string]any{"iss": "https://other.example.com", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := m.Verify(context.Background(), "migrating", token); err == nil || !isClusterMismatch(err) {
+		t.Errorf("unlisted issuer: err = %v, want issuer mismatch", err)
+	}
+}
+
+func TestVerify_OIDCCluster(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "dex.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"dex": {Type: config.ClusterTypeOIDC, Issuer: "https://dex.invalid", ClientID: "kube", JWKSFile: path},
+	}}
+	m := NewVerifierManager(cfg, nil, nil)
+
+	claims, err := m.Verify(context.Background(), "dex", signTestToken(t, key, map[string]any{
+		"iss":           "https://dex.invalid",
+		"sub":           "alice",
+		"aud":           "kube",
+		"exp":           time.Now().Add(time.Hour).Unix(),
+		"kubernetes.io": map[string]any{"namespace": "default"},
+	}))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.Kubernetes != nil {
+		t.Errorf("kubernetes.io extracted for an oidc cluster: %v", claims.Kubernetes)
+	}
+
+	_, err = m.Verify(context.Background(), "dex", signTestToken(t, key, map[string]any{
+		"iss": "https://dex.invalid",
+		"sub": "alice",
+		"aud": "other-client",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+	if err == nil {
+		t.Error("expected error for a token of another client_id")
+	}
+}
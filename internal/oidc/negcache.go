@@ -0,0 +1,92 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+)
+
+// negativeCache remembers recent validation failures per cluster and token,
+// keyed on a hash so that tokens are not kept in memory. A nil *negativeCache
+// caches nothing.
+type negativeCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]negativeEntry
+	now     func() time.Time
+}
+
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+func newNegativeCache(cfg *config.NegativeCacheSettings) *negativeCache {
+	if cfg == nil {
+		return nil
+	}
+	return &negativeCache{
+		ttl:        cfg.GetTTL(),
+		maxEntries: cfg.GetMaxEntries(),
+		entries:    make(map[[sha256.Size]byte]negativeEntry),
+		now:        time.Now,
+	}
+}
+
+func negativeKey(cluster, token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(cluster + "\x00" + token))
+}
+
+// get returns the remembered failure for the token, or nil
+func (c *negativeCache) get(cluster, token string) error {
+	if c == nil {
+		return nil
+	}
+	key := negativeKey(cluster, token)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	metrics.NegativeCacheHits.WithLabelValues(cluster).Inc()
+	return entry.err
+}
+
+// put remembers a failure unless it may resolve on its own: a signature or
+// issuer mismatch (a token of another cluster, or signed by a key not yet
+// fetched) or an upstream error while fetching keys
+func (c *negativeCache) put(cluster, token string, err error) {
+	if c == nil || !negativeCacheable(err) {
+		return
+	}
+	key := negativeKey(cluster, token)
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			return
+		}
+	}
+	c.entries[key] = negativeEntry{err: err, expires: now.Add(c.ttl)}
+}
+
+func negativeCacheable(err error) bool {
+	return !isClusterMismatch(err) && !errors.Is(err, ErrUpstream)
+}
@@ -0,0 +1,93 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func TestNegativeCache(t *testing.T) {
+	c := newNegativeCache(&config.NegativeCacheSettings{TTL: time.Minute, MaxEntries: 2})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	expired := classified(ErrExpired, errors.New("verifying token: oidc: token is expired"))
+	c.put("a", "token-1", expired)
+	if err := c.get("a", "token-1"); err != expired {
+		t.Errorf("get = %v, want cached error", err)
+	}
+	if err := c.get("b", "token-1"); err != nil {
+		t.Errorf("other cluster: get = %v, want nil", err)
+	}
+
+	// Failures that may resolve after a key refresh are not cached
+	c.put("a", "token-2", classified(ErrSignature, errors.New("verifying token: failed to verify signature: failed to verify id token signature")))
+	c.put("a", "token-3", classified(ErrUpstream, errors.New("verifying token: failed to verify signature: fetching keys: connection refused")))
+	if c.get("a", "token-2") != nil || c.get("a", "token-3") != nil {
+		t.Error("signature and key fetch failures must not be cached")
+	}
+
+	// Bounded, with expired entries evicted first
+	c.put("a", "token-4", expired)
+	c.put("a", "token-5", expired)
+	if c.get("a", "token-5") != nil {
+		t.Error("entry stored beyond max_entries")
+	}
+	now = now.Add(time.Minute)
+	if c.get("a", "token-1") != nil {
+		t.Error("entry not expired after ttl")
+	}
+	c.put("a", "token-5", expired)
+	if c.get("a", "token-5") == nil {
+		t.Error("entry not stored after expired entries were evicted")
+	}
+
+	var disabled *negativeCache
+	disabled.put("a", "token-1", expired)
+	if disabled.get("a", "token-1") != nil {
+		t.Error("nil cache returned an entry")
+	}
+}
+
+func TestVerify_NegativeCache(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		NegativeCache: &config.NegativeCacheSettings{},
+		Clusters: map[string]config.ClusterConfig{
+			"edge": {Issuer: "https://edge.invalid", JWKSFile: path},
+		},
+	}
+	m := NewVerifierManager(cfg, nil, nil)
+	token := signTestToken(t, key, map[string]any{
+		"iss": "https://edge.invalid",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+	if _, err := m.Verify(context.Background(), "edge", token); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Verify = %v, want ErrExpired", err)
+	}
+
+	// With the keys gone, only the cache can still answer
+	os.Remove(path)
+	m.InvalidateVerifier("edge")
+	if _, err := m.Verify(context.Background(), "edge", token); !errors.Is(err, ErrExpired) {
+		t.Errorf("repeated Verify = %v, want cached ErrExpired", err)
+	}
+}
@@ -0,0 +1,200 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+)
+
+// signatureAlgorithms are the JWS algorithms accepted when parsing tokens.
+// The IDTokenVerifier enforces its own allow-list before calling the key set.
+var signatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.EdDSA,
+}
+
+// errSignatureMismatch keeps the go-oidc wording for a token signed by none of
+// the keys; Verify classifies it as ErrSignature
+var errSignatureMismatch = errors.New("failed to verify id token signature")
+
+// refreshingKeySet is a JWKS-backed key set that, like oidc.RemoteKeySet,
+// fetches keys when it sees an unknown kid, and additionally refetches them in
+// the background so a control-plane key rotation is picked up without waiting
+// for a token to miss the cache.
+type refreshingKeySet struct {
+	cluster string
+	url     string
+
+	mu        sync.RWMutex
+	keys      []jose.JSONWebKey
+	fetchedAt time.Time
+	// client is replaced when a cluster sharing the key set renews credentials
+	client *http.Client
+
+	// fetchMu serializes fetches; concurrent misses share one request
+	fetchMu sync.Mutex
+
+	cancel context.CancelFunc
+}
+
+func newRefreshingKeySet(cluster, url string, client *http.Client) *refreshingKeySet {
+	return &refreshingKeySet{cluster: cluster, url: url, client: client}
+}
+
+// start refreshes the keys every interval, offset by up to jitter so that
+// replicas and clusters do not all fetch at once. A zero interval disables it.
+func (k *refreshingKeySet) start(interval, jitter time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k.cancel = cancel
+
+	go func() {
+		for {
+			wait := interval
+			if jitter > 0 {
+				wait += rand.N(jitter)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			if err := k.refresh(ctx, time.Time{}); err != nil && ctx.Err() == nil {
+				log.Printf("JWKS refresh failed for cluster %s: %v", k.cluster, err)
+			}
+		}
+	}()
+}
+
+// setClient replaces the client used for subsequent fetches
+func (k *refreshingKeySet) setClient(client *http.Client) {
+	k.mu.Lock()
+	k.client = client
+	k.mu.Unlock()
+}
+
+// stop ends background refreshing
+func (k *refreshingKeySet) stop() {
+	if k.cancel != nil {
+		k.cancel()
+	}
+}
+
+// age reports how long ago the keys were fetched, and false if they never were
+func (k *refreshingKeySet) age() (time.Duration, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.fetchedAt.IsZero() {
+		return 0, false
+	}
+	return time.Since(k.fetchedAt), true
+}
+
+func (k *refreshingKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt, signatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	keyID := ""
+	if len(jws.Signatures) > 0 {
+		keyID = jws.Signatures[0].Header.KeyID
+	}
+
+	k.mu.RLock()
+	keys := k.keys
+	k.mu.RUnlock()
+	if payload, ok := verifyWith(jws, keyID, keys); ok {
+		return payload, nil
+	}
+
+	// Unknown kid: fetch the current keys, as recommended by
+	// https://openid.net/specs/openid-connect-core-1_0.html#RotateSigKeys
+	if err := k.refresh(ctx, time.Now()); err != nil {
+		return nil, classified(ErrUpstream, fmt.Errorf("fetching keys: %w", err))
+	}
+	k.mu.RLock()
+	keys = k.keys
+	k.mu.RUnlock()
+	if payload, ok := verifyWith(jws, keyID, keys); ok {
+		return payload, nil
+	}
+	return nil, errSignatureMismatch
+}
+
+func verifyWith(jws *jose.JSONWebSignature, keyID string, keys []jose.JSONWebKey) ([]byte, bool) {
+	for _, key := range keys {
+		if keyID == "" || key.KeyID == keyID {
+			if payload, err := jws.Verify(&key); err == nil {
+				return payload, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// refresh fetches the key set. If the keys were already fetched after
+// notBefore (by a concurrent caller), it returns without fetching again.
+func (k *refreshingKeySet) refresh(ctx context.Context, notBefore time.Time) error {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+
+	k.mu.RLock()
+	fresh := !notBefore.IsZero() && k.fetchedAt.After(notBefore)
+	k.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	keys, err := k.fetch(ctx)
+	if err != nil {
+		metrics.JWKSRefreshes.WithLabelValues(k.cluster, "failure").Inc()
+		return err
+	}
+	metrics.JWKSRefreshes.WithLabelValues(k.cluster, "success").Inc()
+
+	k.mu.Lock()
+	k.keys = keys
+	k.fetchedAt = time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *refreshingKeySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	k.mu.RLock()
+	client := k.client
+	k.mu.RUnlock()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, statusError("JWKS", resp.StatusCode, string(body))
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("decoding JWKS: %w", err)
+	}
+	return jwks.Keys, nil
+}
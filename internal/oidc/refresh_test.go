@@ -0,0 +1,268 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+type testSigner struct {
+	key *rsa.PrivateKey
+	kid string
+}
+
+func newTestSigner(t *testing.T, kid string) testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{key: key, kid: kid}
+}
+
+func (s testSigner) sign(t *testing.T, payload string) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: s.key},
+		(&jose.SignerOptions{}).WithHeader("kid", s.kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func (s testSigner) jwk() jose.JSONWebKey {
+	return jose.JSONWebKey{Key: &s.key.PublicKey, KeyID: s.kid, Algorithm: "RS256", Use: "sig"}
+}
+
+// jwksServer serves the current signer's public key and counts fetches
+type jwksServer struct {
+	mu      sync.Mutex
+	current testSigner
+	fetches int
+}
+
+func (j *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fetches++
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{j.current.jwk()}})
+}
+
+func (j *jwksServer) rotate(s testSigner) {
+	j.mu.Lock()
+	j.current = s
+	j.mu.Unlock()
+}
+
+func (j *jwksServer) count() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fetches
+}
+
+func TestRefreshingKeySet(t *testing.T) {
+	first := newTestSigner(t, "key-1")
+	jwks := &jwksServer{current: first}
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	ks := newRefreshingKeySet("cluster-b", srv.URL, srv.Client())
+	ctx := context.Background()
+
+	// First use fetches on the unknown kid
+	if _, err := ks.VerifySignature(ctx, first.sign(t, `{"sub":"a"}`)); err != nil {
+		t.Fatalf("verify with first key: %v", err)
+	}
+	if _, ok := ks.age(); !ok {
+		t.Error("age not recorded after fetch")
+	}
+
+	// Cached keys do not refetch
+	if _, err := ks.VerifySignature(ctx, first.sign(t, `{"sub":"b"}`)); err != nil {
+		t.Fatalf("verify with cached key: %v", err)
+	}
+	if got := jwks.count(); got != 1 {
+		t.Errorf("fetches = %d, want 1", got)
+	}
+
+	// Background refresh picks up a rotated key set before any token needs it
+	second := newTestSigner(t, "key-2")
+	jwks.rotate(second)
+	ks.start(10*time.Millisecond, 0)
+	defer ks.stop()
+
+	currentKeyID := func() string {
+		ks.mu.RLock()
+		defer ks.mu.RUnlock()
+		if len(ks.keys) != 1 {
+			return ""
+		}
+		return ks.keys[0].KeyID
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for currentKeyID() != "key-2" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := currentKeyID(); got != "key-2" {
+		t.Fatalf("key after background refresh = %q, want key-2", got)
+	}
+
+	// A token from an unrelated key is reported as a signature mismatch
+	other := newTestSigner(t, "key-2")
+	_, err := ks.VerifySignature(ctx, other.sign(t, `{"sub":"c"}`))
+	if !errors.Is(err, errSignatureMismatch) {
+		t.Errorf("foreign token error = %v, want signature mismatch", err)
+	}
+}
+
+func TestVerify_SharedCreation(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	jwks := &jwksServer{current: signer}
+	var mu sync.Mutex
+	discoveries := 0
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		discoveries++
+		mu.Unlock()
+		// Slow discovery so that concurrent requests overlap
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]string{"issuer": "https://cold.example.com", "jwks_uri": srv.URL + "/openid/v1/jwks"})
+	})
+	mux.Handle("/openid/v1/jwks", jwks)
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"cold": {Issuer: "https://cold.example.com", APIServer: srv.URL},
+	}}
+	m := NewVerifierManager(cfg, nil, nil)
+	defer m.InvalidateVerifier("cold")
+
+	token := signer.sign(t, fmt.Sprintf(`{"iss":"https://cold.example.com","sub":"app","exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.Verify(context.Background(), "cold", token)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if discoveries != 1 {
+		t.Errorf("discovery fetches = %d, want 1", discoveries)
+	}
+}
+
+func TestVerify_SharedKeySet(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	jwks := &jwksServer{current: signer}
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": "https://shared.example.com", "jwks_uri": srv.URL + "/openid/v1/jwks"})
+	})
+	mux.Handle("/openid/v1/jwks", jwks)
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"blue":  {Issuer: "https://shared.example.com", APIServer: srv.URL},
+		"green": {Issuer: "https://shared.example.com", APIServer: srv.URL},
+	}}
+	m := NewVerifierManager(cfg, nil, nil)
+	defer m.InvalidateVerifier("green")
+
+	token := signer.sign(t, fmt.Sprintf(`{"iss":"https://shared.example.com","sub":"app","exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	for _, cluster := range []string{"blue", "green"} {
+		if _, err := m.Verify(context.Background(), cluster, token); err != nil {
+			t.Fatalf("Verify(%s): %v", cluster, err)
+		}
+	}
+	if got := jwks.count(); got != 1 {
+		t.Errorf("JWKS fetches = %d, want 1", got)
+	}
+
+	// Invalidating one cluster keeps the key set for the other
+	m.InvalidateVerifier("blue")
+	if _, err := m.Verify(context.Background(), "green", token); err != nil {
+		t.Fatalf("Verify(green) after invalidating blue: %v", err)
+	}
+	if got := jwks.count(); got != 1 {
+		t.Errorf("JWKS fetches after invalidating blue = %d, want 1", got)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	jwks := &jwksServer{current: signer}
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": "https://warm.example.com", "jwks_uri": srv.URL + "/openid/v1/jwks"})
+	})
+	mux.Handle("/openid/v1/jwks", jwks)
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"warm": {Issuer: "https://warm.example.com", APIServer: srv.URL},
+		"down": {Issuer: "https://down.example.com", APIServer: down.URL},
+	}}
+	m := NewVerifierManager(cfg, nil, nil)
+	defer m.InvalidateVerifier("warm")
+
+	if failed := m.WarmUp(context.Background()); failed != 1 {
+		t.Errorf("failed = %d, want 1", failed)
+	}
+	if _, ok := m.KeySetAges()["warm"]; !ok {
+		t.Error("warm cluster's JWKS not fetched")
+	}
+	if _, ok := m.KeySetAges()["down"]; ok {
+		t.Error("unreachable cluster has a cached key set")
+	}
+
+	// The first request is served from the warmed caches
+	token := signer.sign(t, fmt.Sprintf(`{"iss":"https://warm.example.com","sub":"app","exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	if _, err := m.Verify(context.Background(), "warm", token); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got := jwks.count(); got != 1 {
+		t.Errorf("JWKS fetches = %d, want 1", got)
+	}
+}
@@ -0,0 +1,152 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+// KeySnapshot is a point-in-time export of clusters' signing keys, written by
+// kfa export-keys. Clusters configured with key_snapshot verify tokens against
+// it alone, e.g. in a DR environment that cannot reach the source clusters.
+type KeySnapshot struct {
+	ExportedAt time.Time              `json:"exported_at"`
+	Clusters   map[string]ClusterKeys `json:"clusters"`
+	// Errors lists clusters whose keys could not be exported
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// ClusterKeys are a cluster's keys in a snapshot
+type ClusterKeys struct {
+	Issuers []string           `json:"issuers"`
+	JWKS    jose.JSONWebKeySet `json:"jwks"`
+}
+
+// LoadKeySnapshot reads a snapshot file
+func LoadKeySnapshot(path string) (*KeySnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key snapshot: %w", err)
+	}
+	var snapshot KeySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("parsing key snapshot: %w", err)
+	}
+	if snapshot.ExportedAt.IsZero() {
+		return nil, fmt.Errorf("key snapshot has no exported_at")
+	}
+	return &snapshot, nil
+}
+
+// ExportKeys fetches the current JWKS of every cluster verified through
+// discovery, creating verifiers as needed, all clusters in parallel. Clusters
+// whose keys come from jwks_file or key_snapshot are left out.
+func (m *VerifierManager) ExportKeys(ctx context.Context) *KeySnapshot {
+	snapshot := &KeySnapshot{
+		ExportedAt: time.Now().UTC(),
+		Clusters:   make(map[string]ClusterKeys),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, cfg := range m.config.Clusters {
+		if cfg.JWKSFile != "" || cfg.KeySnapshot != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, cfg config.ClusterConfig) {
+			defer wg.Done()
+			keys, err := m.exportKeys(ctx, name, cfg)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if snapshot.Errors == nil {
+					snapshot.Errors = make(map[string]string)
+				}
+				snapshot.Errors[name] = err.Error()
+				return
+			}
+			snapshot.Clusters[name] = ClusterKeys{Issuers: cfg.Issuers(), JWKS: jose.JSONWebKeySet{Keys: keys}}
+		}(name, cfg)
+	}
+	wg.Wait()
+	return snapshot
+}
+
+func (m *VerifierManager) exportKeys(ctx context.Context, name string, cfg config.ClusterConfig) ([]jose.JSONWebKey, error) {
+	if _, err := m.getOrCreateVerifier(ctx, name, cfg); err != nil {
+		return nil, fmt.Errorf("creating verifier: %w", err)
+	}
+	m.mu.RLock()
+	keySet := m.keySets[name]
+	m.mu.RUnlock()
+	if keySet == nil {
+		return nil, fmt.Errorf("verifier was invalidated, retry")
+	}
+	if err := keySet.refresh(ctx, time.Time{}); err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	keySet.mu.RLock()
+	defer keySet.mu.RUnlock()
+	return keySet.keys, nil
+}
+
+// snapshotKeySet verifies signatures against a cluster's keys in a snapshot,
+// and refuses to once the snapshot is older than maxAge
+type snapshotKeySet struct {
+	keys       []jose.JSONWebKey
+	exportedAt time.Time
+	maxAge     time.Duration
+	now        func() time.Time
+}
+
+// loadSnapshotKeySet reads the cluster's keys from its key_snapshot
+func loadSnapshotKeySet(name string, cfg *config.KeySnapshotSettings) (*snapshotKeySet, error) {
+	snapshot, err := LoadKeySnapshot(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	keys, ok := snapshot.Clusters[name]
+	if !ok || len(keys.JWKS.Keys) == 0 {
+		return nil, fmt.Errorf("key snapshot %s has no keys for cluster %s", cfg.Path, name)
+	}
+	ks := &snapshotKeySet{keys: keys.JWKS.Keys, exportedAt: snapshot.ExportedAt, maxAge: cfg.MaxAge, now: time.Now}
+	if err := ks.checkAge(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (s *snapshotKeySet) checkAge() error {
+	if s.maxAge <= 0 {
+		return nil
+	}
+	if age := s.now().Sub(s.exportedAt); age > s.maxAge {
+		return fmt.Errorf("key snapshot exported %s ago exceeds max_age %s", age.Round(time.Second), s.maxAge)
+	}
+	return nil
+}
+
+func (s *snapshotKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	if err := s.checkAge(); err != nil {
+		return nil, classified(ErrUpstream, err)
+	}
+	jws, err := jose.ParseSigned(jwt, signatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	keyID := ""
+	if len(jws.Signatures) > 0 {
+		keyID = jws.Signatures[0].Header.KeyID
+	}
+	if payload, ok := verifyWith(jws, keyID, s.keys); ok {
+		return payload, nil
+	}
+	return nil, errSignatureMismatch
+}
@@ -0,0 +1,98 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func TestKeySnapshot(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	jwks := &jwksServer{current: signer}
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": "https://source.example.com", "jwks_uri": srv.URL + "/openid/v1/jwks"})
+	})
+	mux.Handle("/openid/v1/jwks", jwks)
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	source := NewVerifierManager(&config.Config{Clusters: map[string]config.ClusterConfig{
+		"source": {Issuer: "https://source.example.com", APIServer: srv.URL},
+		"down":   {Issuer: "https://down.example.com", APIServer: down.URL},
+	}}, nil, nil)
+	defer source.InvalidateVerifier("source")
+
+	snapshot := source.ExportKeys(context.Background())
+	if len(snapshot.Clusters["source"].JWKS.Keys) != 1 {
+		t.Fatalf("exported keys = %+v", snapshot.Clusters)
+	}
+	if _, ok := snapshot.Errors["down"]; !ok {
+		t.Errorf("errors = %v, want an entry for down", snapshot.Errors)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verification from the snapshot never contacts the cluster
+	srv.Close()
+	dr := NewVerifierManager(&config.Config{Clusters: map[string]config.ClusterConfig{
+		"source": {Issuer: "https://source.example.com", KeySnapshot: &config.KeySnapshotSettings{Path: path, MaxAge: time.Hour}},
+	}}, nil, nil)
+	token := signer.sign(t, fmt.Sprintf(`{"iss":"https://source.example.com","sub":"app","exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	if _, err := dr.Verify(context.Background(), "source", token); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := dr.Probe(context.Background(), "source"); err != nil {
+		t.Errorf("Probe: %v", err)
+	}
+
+	other := newTestSigner(t, "key-2")
+	otherToken := other.sign(t, fmt.Sprintf(`{"iss":"https://source.example.com","sub":"app","exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	if _, err := dr.Verify(context.Background(), "source", otherToken); !errors.Is(err, ErrSignature) {
+		t.Errorf("Verify with unknown key: err = %v, want ErrSignature", err)
+	}
+
+	// Past max_age the snapshot is no longer trusted, whether already loaded
+	// or not
+	ks, err := loadSnapshotKeySet("source", &config.KeySnapshotSettings{Path: path, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("loadSnapshotKeySet: %v", err)
+	}
+	ks.now = func() time.Time { return snapshot.ExportedAt.Add(2 * time.Hour) }
+	if _, err := ks.VerifySignature(context.Background(), token); !errors.Is(err, ErrUpstream) {
+		t.Errorf("VerifySignature of stale snapshot: err = %v, want ErrUpstream", err)
+	}
+
+	snapshot.ExportedAt = time.Now().Add(-2 * time.Hour)
+	data, err = json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stale := NewVerifierManager(dr.config, nil, nil)
+	if _, err := stale.Verify(context.Background(), "source", token); !errors.Is(err, ErrUpstream) {
+		t.Errorf("Verify with stale snapshot: err = %v, want ErrUpstream", err)
+	}
+}
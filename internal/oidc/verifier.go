@@ -4,17 +4,30 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/sync/singleflight"
+
 	"github.com/rophy/kube-federated-auth/internal/config"
 	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/egress"
+	"github.com/rophy/kube-federated-auth/internal/errreport"
+	"github.com/rophy/kube-federated-auth/internal/execcred"
+	"github.com/rophy/kube-federated-auth/internal/logging"
+	"github.com/rophy/kube-federated-auth/internal/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 type Claims struct {
@@ -26,21 +39,115 @@ type Claims struct {
 	IssuedAt   int64          `json:"iat"`
 	NotBefore  int64          `json:"nbf,omitempty"`
 	Kubernetes map[string]any `json:"kubernetes.io,omitempty"`
+
+	// Raw holds all token claims for claim mappings and validation rules
+	Raw map[string]any `json:"-"`
 }
 
 type VerifierManager struct {
 	mu        sync.RWMutex
-	verifiers map[string]*oidc.IDTokenVerifier
+	verifiers map[string]issuerVerifiers
+	// keySets holds each cluster's key set. Clusters with the same issuer and
+	// JWKS URL (e.g. one cluster registered under two names) share one, found
+	// in shared by the key recorded in keySetKeys.
+	keySets    map[string]*refreshingKeySet
+	keySetKeys map[string]keySetKey
+	shared     map[keySetKey]*sharedKeySet
+	// generation counts invalidations per cluster, so that a creation that
+	// raced with one is not cached
+	generation map[string]uint64
+	creating   singleflight.Group
+	// breakers guard each cluster's discovery and JWKS requests; nil
+	// entries unless circuit_breaker is configured
+	breakers  map[string]*breaker
+	negative  *negativeCache
 	config    *config.Config
 	credStore *credentials.Store
+	reporter  *errreport.Tracker
+
+	statusMu sync.Mutex
+	status   map[string]*VerifierStatus
 }
 
-func NewVerifierManager(cfg *config.Config, credStore *credentials.Store) *VerifierManager {
+// VerifierStatus records the outcome of recent verifications for a cluster
+type VerifierStatus struct {
+	Cached      bool      `json:"cached"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	// LastError is the most recent failure other than a token simply not
+	// belonging to the cluster (signature or issuer mismatch during detection)
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitzero"`
+}
+
+func NewVerifierManager(cfg *config.Config, credStore *credentials.Store, reporter *errreport.Tracker) *VerifierManager {
+	breakers := make(map[string]*breaker, len(cfg.Clusters))
+	for name := range cfg.Clusters {
+		breakers[name] = newBreaker(name, cfg.CircuitBreaker)
+	}
 	return &VerifierManager{
-		verifiers: make(map[string]*oidc.IDTokenVerifier),
-		config:    cfg,
-		credStore: credStore,
+		breakers:   breakers,
+		negative:   newNegativeCache(cfg.NegativeCache),
+		verifiers:  make(map[string]issuerVerifiers),
+		keySets:    make(map[string]*refreshingKeySet),
+		keySetKeys: make(map[string]keySetKey),
+		shared:     make(map[keySetKey]*sharedKeySet),
+		generation: make(map[string]uint64),
+		config:     cfg,
+		credStore:  credStore,
+		reporter:   reporter,
+		status:     make(map[string]*VerifierStatus),
+	}
+}
+
+// Status returns a snapshot of verifier state for every configured cluster
+func (m *VerifierManager) Status() map[string]VerifierStatus {
+	m.mu.RLock()
+	cached := make(map[string]bool, len(m.verifiers))
+	for name := range m.verifiers {
+		cached[name] = true
+	}
+	m.mu.RUnlock()
+
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+
+	result := make(map[string]VerifierStatus, len(m.config.Clusters))
+	for name := range m.config.Clusters {
+		var st VerifierStatus
+		if recorded, ok := m.status[name]; ok {
+			st = *recorded
+		}
+		st.Cached = cached[name]
+		result[name] = st
 	}
+	return result
+}
+
+func (m *VerifierManager) recordResult(clusterName string, err error) {
+	if err != nil && isClusterMismatch(err) {
+		return
+	}
+
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+
+	st, ok := m.status[clusterName]
+	if !ok {
+		st = &VerifierStatus{}
+		m.status[clusterName] = st
+	}
+	if err != nil {
+		st.LastError = err.Error()
+		st.LastErrorAt = time.Now()
+		return
+	}
+	st.LastSuccess = time.Now()
+}
+
+// isClusterMismatch reports whether a verification error only means the token
+// was issued by another cluster, which is expected while detecting the cluster
+func isClusterMismatch(err error) bool {
+	return errors.Is(err, ErrSignature) || errors.Is(err, ErrIssuer)
 }
 
 // InvalidateVerifier removes a cached verifier, forcing recreation with new credentials
@@ -48,24 +155,190 @@ func (m *VerifierManager) InvalidateVerifier(clusterName string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	delete(m.verifiers, clusterName)
+	m.generation[clusterName]++
+	if key, ok := m.keySetKeys[clusterName]; ok {
+		m.releaseKeySet(key)
+		delete(m.keySets, clusterName)
+		delete(m.keySetKeys, clusterName)
+	}
+}
+
+// keySetKey identifies key sets that can be shared between clusters
+type keySetKey struct {
+	issuer  string
+	jwksURL string
 }
 
-func (m *VerifierManager) Verify(ctx context.Context, clusterName, rawToken string) (*Claims, error) {
+type sharedKeySet struct {
+	keySet *refreshingKeySet
+	refs   int
+}
+
+// acquireKeySet returns the key set for key, creating and starting it if no
+// cluster uses it yet. An existing key set switches to client, so that it
+// fetches with the most recently renewed credentials.
+func (m *VerifierManager) acquireKeySet(cluster string, key keySetKey, client *http.Client) *refreshingKeySet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.shared[key]; ok {
+		s.refs++
+		s.keySet.setClient(client)
+		logging.Debugf(cluster, "Sharing JWKS key set for %s", key.jwksURL)
+		return s.keySet
+	}
+	ks := newRefreshingKeySet(cluster, key.jwksURL, client)
+	ks.start(m.config.GetJWKSRefreshInterval(), m.config.GetJWKSJitter())
+	m.shared[key] = &sharedKeySet{keySet: ks, refs: 1}
+	return ks
+}
+
+// releaseKeySet drops a cluster's reference to a key set, stopping it when
+// unused. The caller holds m.mu.
+func (m *VerifierManager) releaseKeySet(key keySetKey) {
+	s, ok := m.shared[key]
+	if !ok {
+		return
+	}
+	if s.refs--; s.refs == 0 {
+		s.keySet.stop()
+		delete(m.shared, key)
+	}
+}
+
+// KeySetAges reports, per cluster with a cached verifier, how long ago its
+// JWKS was last fetched
+func (m *VerifierManager) KeySetAges() map[string]time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ages := make(map[string]time.Duration, len(m.keySets))
+	for name, ks := range m.keySets {
+		if age, ok := ks.age(); ok {
+			ages[name] = age
+		}
+	}
+	return ages
+}
+
+// WarmUp creates the verifier of every configured cluster and fetches its
+// JWKS, all clusters in parallel, so the first TokenReview after a restart
+// does not pay for discovery. Failures are logged and not fatal: the cluster's
+// first request retries. Returns the number of clusters that failed.
+func (m *VerifierManager) WarmUp(ctx context.Context) int {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := 0
+	for name, cfg := range m.config.Clusters {
+		wg.Add(1)
+		go func(name string, cfg config.ClusterConfig) {
+			defer wg.Done()
+			if err := m.warmUp(ctx, name, cfg); err != nil {
+				log.Printf("Warm-up failed for cluster %s: %v", name, err)
+				m.reporter.Failure(errreport.ComponentVerifier, name, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			m.reporter.Success(errreport.ComponentVerifier, name)
+		}(name, cfg)
+	}
+	wg.Wait()
+	return failed
+}
+
+func (m *VerifierManager) warmUp(ctx context.Context, name string, cfg config.ClusterConfig) error {
+	if _, err := m.getOrCreateVerifier(ctx, name, cfg); err != nil {
+		return fmt.Errorf("creating verifier: %w", err)
+	}
+	m.mu.RLock()
+	keySet := m.keySets[name]
+	m.mu.RUnlock()
+	if keySet == nil {
+		// Keys from jwks_file or key_snapshot are already loaded
+		return nil
+	}
+	if err := keySet.refresh(ctx, time.Time{}); err != nil {
+		return fmt.Errorf("fetching JWKS: %w", err)
+	}
+	return nil
+}
+
+func (m *VerifierManager) Verify(ctx context.Context, clusterName, rawToken string) (_ *Claims, err error) {
+	ctx, span := tracing.Start(ctx, "oidc.Verify", tracing.AttrCluster.String(clusterName))
+	defer func() {
+		tracing.End(span, err)
+		m.recordResult(clusterName, err)
+	}()
+
 	clusterCfg, ok := m.config.Clusters[clusterName]
 	if !ok {
-		return nil, fmt.Errorf("cluster not found: %s", clusterName)
+		return nil, fmt.Errorf("%w: %s", ErrClusterNotFound, clusterName)
 	}
 
-	verifier, err := m.getOrCreateVerifier(ctx, clusterName, clusterCfg)
+	if err := m.negative.get(clusterName, rawToken); err != nil {
+		return nil, err
+	}
+
+	verifiers, err := m.getOrCreateVerifier(ctx, clusterName, clusterCfg)
 	if err != nil {
-		return nil, fmt.Errorf("creating verifier: %w", err)
+		m.reporter.Failure(errreport.ComponentVerifier, clusterName, err)
+		return nil, classified(ErrUpstream, fmt.Errorf("creating verifier: %w", err))
 	}
+	m.reporter.Success(errreport.ComponentVerifier, clusterName)
+
+	// Only failures of the token itself are remembered, not verifier creation
+	defer func() {
+		if err != nil {
+			m.negative.put(clusterName, rawToken, err)
+		}
+	}()
 
-	token, err := verifier.Verify(ctx, rawToken)
+	var sigErr error
+	token, err := verifiers.forToken(clusterCfg, rawToken).Verify(withSignatureResult(ctx, &sigErr), rawToken)
 	if err != nil {
-		return nil, fmt.Errorf("verifying token: %w", err)
+		// An unreadable iss is reported by go-oidc as a malformed token
+		issuer, issErr := UnverifiedIssuer(rawToken)
+		issuerAccepted := issErr != nil || slices.Contains(clusterCfg.Issuers(), issuer)
+		return nil, classifyTokenError(fmt.Errorf("verifying token: %w", err), sigErr, issuerAccepted)
 	}
 
+	// go-oidc checks a single client ID; clusters may accept several audiences
+	if len(clusterCfg.Audiences) > 0 && !slices.ContainsFunc(token.Audience, func(aud string) bool {
+		return slices.Contains(clusterCfg.Audiences, aud)
+	}) {
+		return nil, classified(ErrInvalidToken, fmt.Errorf("token audience %v not accepted for cluster %s", token.Audience, clusterName))
+	}
+
+	claims, err := claimsFromToken(clusterName, token, !clusterCfg.IsOIDC())
+	if err != nil {
+		return nil, classified(ErrInvalidToken, err)
+	}
+	if skew := m.config.GetClockSkew(clusterName); skew > 0 {
+		if err := checkTimes(claims, time.Now(), skew); err != nil {
+			return nil, fmt.Errorf("verifying token: %w", err)
+		}
+	}
+	return claims, nil
+}
+
+// checkTimes validates exp, nbf and iat allowing for skew between our clock
+// and the issuing cluster's
+func checkTimes(claims *Claims, now time.Time, skew time.Duration) error {
+	if claims.Expiry != 0 && now.Add(-skew).After(time.Unix(claims.Expiry, 0)) {
+		return classified(ErrExpired, fmt.Errorf("token is expired (exp %s)", time.Unix(claims.Expiry, 0).UTC().Format(time.RFC3339)))
+	}
+	if claims.NotBefore != 0 && now.Add(skew).Before(time.Unix(claims.NotBefore, 0)) {
+		return classified(ErrInvalidToken, fmt.Errorf("token is not valid yet (nbf %s)", time.Unix(claims.NotBefore, 0).UTC().Format(time.RFC3339)))
+	}
+	if claims.IssuedAt != 0 && now.Add(skew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return classified(ErrInvalidToken, fmt.Errorf("token used before issued (iat %s)", time.Unix(claims.IssuedAt, 0).UTC().Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// claimsFromToken extracts normalized claims from a verified token, including
+// the kubernetes.io claim of ServiceAccount tokens if kubernetes is set
+func claimsFromToken(clusterName string, token *oidc.IDToken, kubernetes bool) (*Claims, error) {
 	var rawClaims struct {
 		Issuer     string         `json:"iss"`
 		Subject    string         `json:"sub"`
@@ -78,6 +351,16 @@ func (m *VerifierManager) Verify(ctx context.Context, clusterName, rawToken stri
 		return nil, fmt.Errorf("parsing claims: %w", err)
 	}
 
+	var raw map[string]any
+	if err := token.Claims(&raw); err != nil {
+		return nil, fmt.Errorf("parsing claims: %w", err)
+	}
+
+	var kubernetesClaim map[string]any
+	if kubernetes {
+		kubernetesClaim = rawClaims.Kubernetes
+	}
+
 	return &Claims{
 		Cluster:    clusterName,
 		Issuer:     rawClaims.Issuer,
@@ -86,35 +369,138 @@ func (m *VerifierManager) Verify(ctx context.Context, clusterName, rawToken stri
 		Expiry:     rawClaims.Expiry,
 		IssuedAt:   rawClaims.IssuedAt,
 		NotBefore:  rawClaims.NotBefore,
-		Kubernetes: rawClaims.Kubernetes,
+		Kubernetes: kubernetesClaim,
+		Raw:        raw,
 	}, nil
 }
 
+// UnverifiedIssuer returns the iss claim of a JWT without verifying it. It is
+// only fit for choosing which verifiers to try.
+func UnverifiedIssuer(rawToken string) (string, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed jwt: expected 3 parts, got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed jwt payload: %w", err)
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("malformed jwt claims: %w", err)
+	}
+	if claims.Issuer == "" {
+		return "", fmt.Errorf("token has no iss claim")
+	}
+	return claims.Issuer, nil
+}
+
 // oidcDiscovery represents the OIDC discovery document
 type oidcDiscovery struct {
 	Issuer  string `json:"issuer"`
 	JWKSURL string `json:"jwks_uri"`
 }
 
-func (m *VerifierManager) getOrCreateVerifier(ctx context.Context, name string, cfg config.ClusterConfig) (*oidc.IDTokenVerifier, error) {
+// issuerVerifiers holds one verifier per accepted issuer of a cluster, all
+// sharing the cluster's key set
+type issuerVerifiers map[string]*oidc.IDTokenVerifier
+
+// forToken returns the verifier for the token's issuer. Unknown or unreadable
+// issuers get the primary issuer's verifier, which rejects them.
+func (v issuerVerifiers) forToken(cfg config.ClusterConfig, rawToken string) *oidc.IDTokenVerifier {
+	if issuer, err := UnverifiedIssuer(rawToken); err == nil {
+		if verifier, ok := v[issuer]; ok {
+			return verifier
+		}
+	}
+	return v[cfg.Issuer]
+}
+
+// verifierCreateTimeout bounds discovery for a shared verifier creation,
+// which outlives the request that started it
+const verifierCreateTimeout = 30 * time.Second
+
+func (m *VerifierManager) getOrCreateVerifier(ctx context.Context, name string, cfg config.ClusterConfig) (issuerVerifiers, error) {
 	m.mu.RLock()
-	if v, ok := m.verifiers[name]; ok {
-		m.mu.RUnlock()
+	v, ok := m.verifiers[name]
+	m.mu.RUnlock()
+	if ok {
 		return v, nil
 	}
-	m.mu.RUnlock()
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	// Concurrent requests on a cold cache share one creation, which runs
+	// without holding m.mu so other clusters are not blocked on its I/O. It
+	// is detached from the caller's cancellation since others wait on it.
+	ch := m.creating.DoChan(name, func() (any, error) {
+		m.mu.RLock()
+		v, ok := m.verifiers[name]
+		generation := m.generation[name]
+		m.mu.RUnlock()
+		if ok {
+			return v, nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), verifierCreateTimeout)
+		defer cancel()
+		v, keySet, key, err := m.createVerifier(ctx, name, cfg)
+		if err != nil {
+			return nil, err
+		}
 
-	// Double-check after acquiring write lock
-	if v, ok := m.verifiers[name]; ok {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.generation[name] != generation {
+			// Invalidated while creating, e.g. credentials were renewed:
+			// serve this verifier to the waiters but do not cache it
+			if keySet != nil {
+				m.releaseKeySet(key)
+			}
+			return v, nil
+		}
+		m.verifiers[name] = v
+		if keySet != nil {
+			m.keySets[name] = keySet
+			m.keySetKeys[name] = key
+		}
 		return v, nil
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(issuerVerifiers), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// createVerifier builds a cluster's verifiers, and acquires its refreshing
+// key set unless the keys come from jwks_file or key_snapshot
+func (m *VerifierManager) createVerifier(ctx context.Context, name string, cfg config.ClusterConfig) (issuerVerifiers, *refreshingKeySet, keySetKey, error) {
+	if cfg.JWKSFile != "" {
+		keys, err := LoadKeySetFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, nil, keySetKey{}, err
+		}
+		logging.Debugf(name, "Creating verifier: jwks_file=%s (%d keys) issuers=%v", cfg.JWKSFile, len(keys), cfg.Issuers())
+		return m.newVerifier(name, cfg, &tracedKeySet{cluster: name, keySet: &staticKeySet{keys: keys}}), nil, keySetKey{}, nil
+	}
+	if cfg.KeySnapshot != nil {
+		keySet, err := loadSnapshotKeySet(name, cfg.KeySnapshot)
+		if err != nil {
+			return nil, nil, keySetKey{}, err
+		}
+		logging.Debugf(name, "Creating verifier: key_snapshot=%s (%d keys, exported %s) issuers=%v", cfg.KeySnapshot.Path, len(keySet.keys), keySet.exportedAt.Format(time.RFC3339), cfg.Issuers())
+		return m.newVerifier(name, cfg, &tracedKeySet{cluster: name, keySet: keySet}), nil, keySetKey{}, nil
 	}
 
 	httpClient, err := m.createHTTPClient(name, cfg)
 	if err != nil {
-		return nil, err
+		return nil, nil, keySetKey{}, err
 	}
 
 	// For remote clusters, the discovery URL (api_server) differs from the issuer
@@ -124,7 +510,7 @@ func (m *VerifierManager) getOrCreateVerifier(ctx context.Context, name string,
 	// Fetch OIDC discovery document from the discovery URL
 	discovery, err := m.fetchDiscovery(ctx, httpClient, discoveryURL)
 	if err != nil {
-		return nil, fmt.Errorf("fetching OIDC discovery from %s: %w", discoveryURL, err)
+		return nil, nil, keySetKey{}, fmt.Errorf("fetching OIDC discovery from %s: %w", discoveryURL, err)
 	}
 
 	// Create a remote key set that fetches JWKS from the discovery URL's JWKS endpoint
@@ -135,44 +521,188 @@ func (m *VerifierManager) getOrCreateVerifier(ctx context.Context, name string,
 		jwksURL = rewriteJWKSURL(discovery.JWKSURL, cfg.APIServer)
 	}
 
-	ctx = oidc.ClientContext(ctx, httpClient)
-	keySet := oidc.NewRemoteKeySet(ctx, jwksURL)
+	logging.Debugf(name, "Creating verifier: discovery=%s jwks=%s issuers=%v", discoveryURL, jwksURL, cfg.Issuers())
 
-	// Create verifier with the actual issuer from the token (not the discovery URL)
-	verifier := oidc.NewVerifier(cfg.Issuer, keySet, &oidc.Config{
-		SkipClientIDCheck: true,
-	})
+	key := keySetKey{issuer: cfg.Issuer, jwksURL: jwksURL}
+	remote := m.acquireKeySet(name, key, httpClient)
+	return m.newVerifier(name, cfg, &tracedKeySet{cluster: name, keySet: remote}), remote, key, nil
+}
 
-	m.verifiers[name] = verifier
-	return verifier, nil
+// newVerifier creates verifiers for the actual issuers of the tokens (not the discovery URL)
+func (m *VerifierManager) newVerifier(name string, cfg config.ClusterConfig, keySet oidc.KeySet) issuerVerifiers {
+	verifiers := make(issuerVerifiers)
+	for _, issuer := range cfg.Issuers() {
+		verifiers[issuer] = oidc.NewVerifier(issuer, keySet, &oidc.Config{
+			ClientID:          cfg.ClientID,
+			SkipClientIDCheck: cfg.ClientID == "",
+			// With a clock skew leeway, time claims are checked in Verify instead
+			SkipExpiryCheck: m.config.GetClockSkew(name) > 0,
+		})
+	}
+	return verifiers
+}
+
+// Probe checks that a cluster's OIDC discovery document and JWKS are reachable
+// with its current credentials, or that its jwks_file or key_snapshot holds
+// valid (and for key_snapshot, recent enough) keys. It
+// does not use or populate the verifier cache.
+func (m *VerifierManager) Probe(ctx context.Context, clusterName string) (err error) {
+	ctx, span := tracing.Start(ctx, "oidc.Probe", tracing.AttrCluster.String(clusterName))
+	defer func() { tracing.End(span, err) }()
+
+	cfg, ok := m.config.Clusters[clusterName]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrClusterNotFound, clusterName)
+	}
+
+	if cfg.JWKSFile != "" {
+		_, err := LoadKeySetFile(cfg.JWKSFile)
+		return err
+	}
+	if cfg.KeySnapshot != nil {
+		_, err := loadSnapshotKeySet(clusterName, cfg.KeySnapshot)
+		return err
+	}
+
+	httpClient, err := m.createHTTPClient(clusterName, cfg)
+	if err != nil {
+		return err
+	}
+	return m.probe(ctx, cfg, httpClient)
+}
+
+// ProbeCredentials checks candidate credentials end to end before they are
+// stored, fetching the cluster's discovery document and JWKS with them
+func (m *VerifierManager) ProbeCredentials(ctx context.Context, clusterName string, creds *credentials.Credentials) (err error) {
+	ctx, span := tracing.Start(ctx, "oidc.ProbeCredentials", tracing.AttrCluster.String(clusterName))
+	defer func() { tracing.End(span, err) }()
+
+	cfg, ok := m.config.Clusters[clusterName]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrClusterNotFound, clusterName)
+	}
+	if cfg.JWKSFile != "" || cfg.KeySnapshot != nil {
+		// Keys are not fetched with credentials
+		return nil
+	}
+	httpClient, err := m.httpClient(clusterName, cfg, creds)
+	if err != nil {
+		return err
+	}
+	return m.probe(ctx, cfg, httpClient)
+}
+
+// probe fetches the discovery document and JWKS with httpClient
+func (m *VerifierManager) probe(ctx context.Context, cfg config.ClusterConfig, httpClient *http.Client) error {
+	discovery, err := m.fetchDiscovery(ctx, httpClient, cfg.DiscoveryURL())
+	if err != nil {
+		return fmt.Errorf("fetching OIDC discovery: %w", err)
+	}
+
+	jwksURL := discovery.JWKSURL
+	if cfg.APIServer != "" {
+		jwksURL = rewriteJWKSURL(discovery.JWKSURL, cfg.APIServer)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", jwksURL, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError("JWKS", resp.StatusCode, "")
+	}
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("decoding JWKS: %w", err)
+	}
+	if len(jwks.Keys) == 0 {
+		return fmt.Errorf("JWKS has no keys")
+	}
+	return nil
 }
 
 // fetchDiscovery fetches the OIDC discovery document from the given URL
-func (m *VerifierManager) fetchDiscovery(ctx context.Context, client *http.Client, baseURL string) (*oidcDiscovery, error) {
+// discoveryAttempts bounds fetches of a discovery document on transient errors
+const discoveryAttempts = 3
+
+// discoveryBackoff is the delay before the first retry, doubled for each next one
+var discoveryBackoff = 250 * time.Millisecond
+
+// fetchDiscovery fetches the discovery document, retrying transport errors
+// and 5xx responses with exponential backoff so that a brief blip of the
+// remote API server does not fail verification
+func (m *VerifierManager) fetchDiscovery(ctx context.Context, client *http.Client, baseURL string) (_ *oidcDiscovery, err error) {
+	ctx, span := tracing.Start(ctx, "oidc.fetchDiscovery", semconv.URLFull(baseURL))
+	defer func() { tracing.End(span, err) }()
+
 	wellKnownURL := strings.TrimSuffix(baseURL, "/") + "/.well-known/openid-configuration"
 
+	backoff := discoveryBackoff
+	for attempt := 1; ; attempt++ {
+		discovery, retry, err := fetchDiscoveryOnce(ctx, client, wellKnownURL)
+		if err == nil || !retry || attempt == discoveryAttempts {
+			return discovery, err
+		}
+		log.Printf("OIDC discovery from %s failed, retrying in %s: %v", baseURL, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// fetchDiscoveryOnce makes a single discovery request, and reports whether a
+// failure is transient
+func fetchDiscoveryOnce(ctx context.Context, client *http.Client, wellKnownURL string) (_ *oidcDiscovery, retry bool, _ error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", wellKnownURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
+		return nil, false, fmt.Errorf("creating request: %w", err)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("fetching discovery: %w", err)
+		retry := ctx.Err() == nil && !errors.Is(err, ErrCircuitOpen)
+		return nil, retry, fmt.Errorf("fetching discovery: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("discovery returned status %d: %s", resp.StatusCode, string(body))
+		return nil, resp.StatusCode >= http.StatusInternalServerError, statusError("discovery", resp.StatusCode, string(body))
 	}
 
 	var discovery oidcDiscovery
 	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
-		return nil, fmt.Errorf("decoding discovery: %w", err)
+		return nil, false, fmt.Errorf("decoding discovery: %w", err)
 	}
 
-	return &discovery, nil
+	return &discovery, false, nil
+}
+
+// tracedKeySet wraps a remote key set so signature verification, including
+// any JWKS fetch it triggers, shows up as a span in the caller's trace
+type tracedKeySet struct {
+	cluster string
+	keySet  oidc.KeySet
+}
+
+func (k *tracedKeySet) VerifySignature(ctx context.Context, jwt string) (_ []byte, err error) {
+	ctx, span := tracing.Start(ctx, "oidc.jwks.VerifySignature", tracing.AttrCluster.String(k.cluster))
+	defer func() {
+		tracing.End(span, err)
+		setSignatureResult(ctx, err)
+	}()
+	return k.keySet.VerifySignature(ctx, jwt)
 }
 
 // rewriteJWKSURL rewrites the JWKS URL to use the API server host instead of the internal issuer host
@@ -193,60 +723,114 @@ func rewriteJWKSURL(jwksURL, apiServer string) string {
 }
 
 func (m *VerifierManager) createHTTPClient(clusterName string, cfg config.ClusterConfig) (*http.Client, error) {
+	// Check for dynamic credentials first
+	var creds *credentials.Credentials
+	if m.credStore != nil {
+		creds, _ = m.credStore.Get(clusterName)
+	}
+	return m.httpClient(clusterName, cfg, creds)
+}
+
+// httpClient creates a client authenticating with creds, or with the
+// cluster's configured files if creds is nil
+func (m *VerifierManager) httpClient(clusterName string, cfg config.ClusterConfig, creds *credentials.Credentials) (*http.Client, error) {
 	var transport http.RoundTripper = http.DefaultTransport
 
-	// Check for dynamic credentials first
-	var caCert []byte
+	var caCert, clientCert, clientKey []byte
 	var token string
+	if creds != nil {
+		caCert = creds.CACert
+		token = creds.Token
+		clientCert, clientKey = creds.ClientCert, creds.ClientKey
+	}
 
-	if m.credStore != nil {
-		if creds, ok := m.credStore.Get(clusterName); ok {
-			caCert = creds.CACert
-			token = creds.Token
+	// Fall back to file-based credentials if no dynamic credentials
+	if caCert == nil {
+		var err error
+		caCert, err = cfg.LoadCACert()
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	// Fall back to file-based credentials if no dynamic credentials
-	if caCert == nil && cfg.CACert != "" {
+	if clientCert == nil {
 		var err error
-		caCert, err = os.ReadFile(cfg.CACert)
+		clientCert, clientKey, err = cfg.LoadClientCert()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// An inline kubeconfig token; token_path is reread per request below
+	if token == "" && cfg.TokenPath == "" {
+		inline, err := cfg.LoadToken()
 		if err != nil {
-			return nil, fmt.Errorf("reading CA cert: %w", err)
+			return nil, err
 		}
+		token = string(inline)
 	}
 
-	if caCert != nil {
+	var tlsConfig *tls.Config
+	if cfg.InsecureSkipTLSVerify {
+		// Allowed only with --allow-insecure, and warned about at startup
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	} else if caCert != nil {
 		caCertPool := x509.NewCertPool()
 		if !caCertPool.AppendCertsFromPEM(caCert) {
 			return nil, fmt.Errorf("failed to parse CA cert")
 		}
+		tlsConfig = &tls.Config{
+			RootCAs: caCertPool,
+		}
+	}
+	if clientCert != nil {
+		cert, err := tls.X509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
-		transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: caCertPool,
-			},
+	// Always derive from http.DefaultTransport, so that without an
+	// egress.proxy_url the HTTPS_PROXY/NO_PROXY environment still applies
+	if cfg.Egress != nil || tlsConfig != nil {
+		egressTransport, err := egress.Transport(cfg.Egress, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("configuring egress: %w", err)
 		}
+		transport = egressTransport
+	}
+	if b := m.breakers[clusterName]; b != nil {
+		transport = &breakerTransport{breaker: b, next: transport}
 	}
 
-	// Use dynamic token if available, otherwise use token file
+	// Use dynamic token if available, otherwise use token file or exec plugin
 	if token != "" {
 		transport = &staticTokenRoundTripper{
 			transport: transport,
 			token:     token,
+			maxAge:    cfg.MaxCredentialAge,
 		}
 	} else if cfg.TokenPath != "" {
 		transport = &tokenRoundTripper{
 			transport: transport,
 			tokenPath: cfg.TokenPath,
+			maxAge:    cfg.MaxCredentialAge,
 		}
+	} else if cfg.Exec != nil {
+		transport = execcred.For(cfg.Exec).RoundTripper(transport)
 	}
 
-	return &http.Client{Transport: transport}, nil
+	return &http.Client{Transport: transport, Timeout: cfg.GetUpstreamTimeout()}, nil
 }
 
 type tokenRoundTripper struct {
 	transport http.RoundTripper
 	tokenPath string
+	maxAge    time.Duration
 }
 
 func (t *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -254,6 +838,9 @@ func (t *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	if err != nil {
 		return nil, fmt.Errorf("reading token: %w", err)
 	}
+	if err := credentials.CheckFreshness(string(token), t.maxAge); err != nil {
+		return nil, err
+	}
 
 	req = req.Clone(req.Context())
 	req.Header.Set("Authorization", "Bearer "+string(token))
@@ -264,9 +851,13 @@ func (t *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 type staticTokenRoundTripper struct {
 	transport http.RoundTripper
 	token     string
+	maxAge    time.Duration
 }
 
 func (t *staticTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := credentials.CheckFreshness(t.token, t.maxAge); err != nil {
+		return nil, err
+	}
 	req = req.Clone(req.Context())
 	req.Header.Set("Authorization", "Bearer "+t.token)
 	return t.transport.RoundTrip(req)
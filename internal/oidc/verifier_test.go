@@ -0,0 +1,215 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/credentials"
+)
+
+func TestVerifierStatus(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: map[string]config.ClusterConfig{
+			"cluster-a": {Issuer: "https://a.example.com"},
+			"cluster-b": {Issuer: "https://b.example.com"},
+		},
+	}
+	m := NewVerifierManager(cfg, nil, nil)
+
+	m.recordResult("cluster-a", nil)
+	m.recordResult("cluster-b", classified(ErrSignature, errors.New("verifying token: failed to verify signature: failed to verify id token signature")))
+	m.recordResult("cluster-b", classified(ErrUpstream, errors.New("creating verifier: fetching OIDC discovery: connection refused")))
+
+	status := m.Status()
+	if status["cluster-a"].LastSuccess.IsZero() || status["cluster-a"].LastError != "" {
+		t.Errorf("cluster-a = %+v, want success only", status["cluster-a"])
+	}
+	if got := status["cluster-b"].LastError; got != "creating verifier: fetching OIDC discovery: connection refused" {
+		t.Errorf("cluster-b last error = %q", got)
+	}
+}
+
+func TestProbeCredentials(t *testing.T) {
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"issuer": "https://b.example.com", "jwks_uri": srv.URL + "/openid/v1/jwks"})
+	})
+	mux.Handle("/openid/v1/jwks", &jwksServer{current: newTestSigner(t, "key-1")})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	m := NewVerifierManager(&config.Config{Clusters: map[string]config.ClusterConfig{
+		"cluster-b": {Issuer: "https://b.example.com", APIServer: srv.URL},
+	}}, nil, nil)
+
+	if err := m.ProbeCredentials(context.Background(), "cluster-b", &credentials.Credentials{Token: "good"}); err != nil {
+		t.Errorf("valid credentials: %v", err)
+	}
+	if err := m.ProbeCredentials(context.Background(), "cluster-b", &credentials.Credentials{Token: "stale"}); !errors.Is(err, ErrCredentialsRejected) {
+		t.Errorf("rejected credentials: err = %v, want ErrCredentialsRejected", err)
+	}
+	if err := m.ProbeCredentials(context.Background(), "cluster-b", &credentials.Credentials{Token: "good", CACert: []byte("not a certificate")}); err == nil {
+		t.Error("expected error for a bad CA certificate")
+	}
+}
+
+func TestProbeCredentials_ClientCert(t *testing.T) {
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kube-federated-auth"},
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &clientKey.PublicKey, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	clientKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"issuer": "https://b.example.com", "jwks_uri": srv.URL + "/openid/v1/jwks"})
+	})
+	mux.Handle("/openid/v1/jwks", &jwksServer{current: newTestSigner(t, "key-1")})
+	srv = httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	m := NewVerifierManager(&config.Config{Clusters: map[string]config.ClusterConfig{
+		"cluster-b": {Issuer: "https://b.example.com", APIServer: srv.URL},
+	}}, nil, nil)
+
+	withCert := &credentials.Credentials{CACert: serverCA, ClientCert: clientCert, ClientKey: clientKeyPEM}
+	if err := m.ProbeCredentials(context.Background(), "cluster-b", withCert); err != nil {
+		t.Errorf("client certificate: %v", err)
+	}
+	if err := m.ProbeCredentials(context.Background(), "cluster-b", &credentials.Credentials{CACert: serverCA}); !errors.Is(err, ErrCredentialsRejected) {
+		t.Errorf("without client certificate: err = %v, want ErrCredentialsRejected", err)
+	}
+}
+
+func TestCheckTimes(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	skew := 30 * time.Second
+
+	tests := []struct {
+		name    string
+		claims  Claims
+		wantErr bool
+	}{
+		{"valid", Claims{IssuedAt: now.Unix() - 60, Expiry: now.Unix() + 60}, false},
+		{"expired within skew", Claims{Expiry: now.Unix() - 20}, false},
+		{"expired beyond skew", Claims{Expiry: now.Unix() - 40}, true},
+		{"issued slightly in the future", Claims{IssuedAt: now.Unix() + 20}, false},
+		{"issued far in the future", Claims{IssuedAt: now.Unix() + 40}, true},
+		{"not yet valid beyond skew", Claims{NotBefore: now.Unix() + 40}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTimes(&tt.claims, now, skew)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkTimes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnverifiedIssuer(t *testing.T) {
+	// {"alg":"none"}.{"iss":"https://b.example.com","sub":"x"}.
+	token := "eyJhbGciOiJub25lIn0.eyJpc3MiOiJodHRwczovL2IuZXhhbXBsZS5jb20iLCJzdWIiOiJ4In0.sig"
+	iss, err := UnverifiedIssuer(token)
+	if err != nil || iss != "https://b.example.com" {
+		t.Errorf("UnverifiedIssuer() = %q, %v; want https://b.example.com", iss, err)
+	}
+
+	for _, bad := range []string{"not-a-jwt", "a.!!!.c", "eyJhbGciOiJub25lIn0.eyJzdWIiOiJ4In0.sig"} {
+		if _, err := UnverifiedIssuer(bad); err == nil {
+			t.Errorf("UnverifiedIssuer(%q): expected error", bad)
+		}
+	}
+}
+
+func TestFetchDiscovery_Retries(t *testing.T) {
+	defer func(d time.Duration) { discoveryBackoff = d }(discoveryBackoff)
+	discoveryBackoff = time.Millisecond
+
+	var requests atomic.Int32
+	failures := int32(2)
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(`{"issuer":"https://a.example.com","jwks_uri":"https://a.example.com/openid/v1/jwks"}`))
+	}))
+	defer srv.Close()
+
+	m := NewVerifierManager(&config.Config{}, nil, nil)
+	discovery, err := m.fetchDiscovery(context.Background(), srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatalf("fetchDiscovery after transient 503s: %v", err)
+	}
+	if discovery.JWKSURL != "https://a.example.com/openid/v1/jwks" {
+		t.Errorf("jwks_uri = %q", discovery.JWKSURL)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("requests = %d, want 3", got)
+	}
+
+	// Attempts are bounded
+	requests.Store(0)
+	failures = discoveryAttempts
+	if _, err := m.fetchDiscovery(context.Background(), srv.Client(), srv.URL); err == nil {
+		t.Error("expected error after exhausting attempts")
+	}
+	if got := requests.Load(); got != discoveryAttempts {
+		t.Errorf("requests = %d, want %d", got, discoveryAttempts)
+	}
+
+	// Client errors are not retried
+	requests.Store(0)
+	status = http.StatusNotFound
+	if _, err := m.fetchDiscovery(context.Background(), srv.Client(), srv.URL); err == nil {
+		t.Error("expected error for 404")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+}
@@ -0,0 +1,58 @@
+// Package redact scrubs bearer tokens from strings before they are logged or
+// returned to callers. Verification errors from JWT libraries can echo parts of
+// the token they failed to parse; nothing JWT-shaped should survive into logs,
+// audit events, or TokenReviewStatus.Error.
+package redact
+
+import (
+	"io"
+	"regexp"
+)
+
+// Placeholder replaces every redacted token
+const Placeholder = "[REDACTED]"
+
+// A JOSE header and JWT claims are JSON objects, so their base64url encoding
+// starts with "eyJ" (`{"`). Matching on that prefix catches whole tokens as
+// well as lone header or payload segments without touching hostnames, issuer
+// URLs or hashes.
+var patterns = []*regexp.Regexp{
+	// Compact JWS (3 segments) or JWE (5 segments)
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]*(\.[A-Za-z0-9_-]*){2,4}`),
+	// A single header or claims segment
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]{5,}`),
+}
+
+// String returns s with anything that looks like a JWT or a fragment of one replaced
+func String(s string) string {
+	for _, p := range patterns {
+		s = p.ReplaceAllString(s, Placeholder)
+	}
+	return s
+}
+
+// Error returns the redacted message of err, or "" if err is nil
+func Error(err error) string {
+	if err == nil {
+		return ""
+	}
+	return String(err.Error())
+}
+
+// Writer redacts everything written through it. The standard logger writes one
+// line per call, so tokens are never split across writes.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter wraps w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
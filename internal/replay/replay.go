@@ -0,0 +1,414 @@
+// Package replay keeps a rolling window of TokenReview decision inputs and
+// re-evaluates them against a proposed configuration, so the impact of a
+// claim or user validation change can be measured before it is deployed.
+//
+// Records omit the token, request ID and client address. Claims are stored
+// without jti, since CEL rules need claim values to be re-evaluated; the
+// file is created with 0600 permissions accordingly.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/claims"
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/retention"
+)
+
+// Record is one decision as seen by the policy layer
+type Record struct {
+	Time    time.Time `json:"time"`
+	Cluster string    `json:"cluster"`
+	// ClaimsDigest is the SHA-256 of the stored claims, identifying repeated
+	// authentications of the same token contents
+	ClaimsDigest string         `json:"claimsDigest"`
+	Claims       map[string]any `json:"claims"`
+	// Forwarded is set when the TokenReview reached the remote cluster;
+	// RemoteUser is what it returned if it authenticated the token
+	Forwarded  bool              `json:"forwarded"`
+	RemoteUser *authnv1.UserInfo `json:"remoteUser,omitempty"`
+	Allowed    bool              `json:"allowed"`
+	Reason     string            `json:"reason,omitempty"`
+}
+
+// NewRecord starts a record for a token whose claims verified for cluster
+func NewRecord(cluster string, tokenClaims map[string]any) *Record {
+	stored := make(map[string]any, len(tokenClaims))
+	for k, v := range tokenClaims {
+		if k != "jti" {
+			stored[k] = v
+		}
+	}
+	data, _ := json.Marshal(stored) // map keys are marshaled in sorted order
+	sum := sha256.Sum256(data)
+	return &Record{
+		Time:         time.Now().UTC(),
+		Cluster:      cluster,
+		ClaimsDigest: hex.EncodeToString(sum[:]),
+		Claims:       stored,
+	}
+}
+
+// Forward notes the remote cluster's answer. user is nil if it did not authenticate the token.
+func (r *Record) Forward(user *authnv1.UserInfo) {
+	if r == nil {
+		return
+	}
+	r.Forwarded = true
+	if user != nil {
+		r.RemoteUser = user.DeepCopy()
+	}
+}
+
+// Allow marks the record as allowed
+func (r *Record) Allow() {
+	if r != nil {
+		r.Allowed = true
+	}
+}
+
+// Deny marks the record as denied for reason
+func (r *Record) Deny(reason string) {
+	if r != nil {
+		r.Allowed = false
+		r.Reason = reason
+	}
+}
+
+// Recorder appends records to a file, keeping roughly the last max records.
+// A nil *Recorder discards records.
+type Recorder struct {
+	mu   sync.Mutex
+	path string
+	max  int
+	f    *os.File
+	n    int
+}
+
+// New opens the replay file from settings. Returns nil if replay is not configured.
+func New(cfg *config.ReplaySettings) (*Recorder, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	r := &Recorder{path: cfg.Path, max: cfg.GetMaxRecords()}
+
+	records, err := Load(cfg.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	r.n = len(records)
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Start returns a new record for cluster, or nil if r is nil so that callers
+// skip the claims digest when replay is disabled
+func (r *Recorder) Start(cluster string, tokenClaims map[string]any) *Record {
+	if r == nil {
+		return nil
+	}
+	return NewRecord(cluster, tokenClaims)
+}
+
+func (r *Recorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening replay file: %w", err)
+	}
+	r.f = f
+	return nil
+}
+
+// Record appends rec. Once the file holds twice the window it is compacted
+// to the most recent max records, so rewrites are amortized across appends.
+// Failures are logged, not returned, so that replay recording never changes
+// authentication results.
+func (r *Recorder) Record(rec *Record) {
+	if r == nil || rec == nil {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Replay: encoding record: %v", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.f.Write(append(data, '\n')); err != nil {
+		log.Printf("Replay: writing record: %v", err)
+		return
+	}
+	r.n++
+	if r.n >= 2*r.max {
+		if err := r.compact(); err != nil {
+			log.Printf("Replay: compacting %s: %v", r.path, err)
+		}
+	}
+}
+
+func (r *Recorder) compact() error {
+	records, err := Load(r.path)
+	if err != nil {
+		return err
+	}
+	if len(records) > r.max {
+		records = records[len(records)-r.max:]
+	}
+
+	tmp := r.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return err
+	}
+
+	r.f.Close()
+	r.n = len(records)
+	return r.open()
+}
+
+// Compact drops the oldest records outside settings
+func (r *Recorder) Compact(settings config.RetentionSettings) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dropped, err := retention.CompactFile(r.path, settings, recordTime)
+	if err != nil || dropped == 0 {
+		return dropped, err
+	}
+	r.f.Close()
+	r.n -= dropped
+	return dropped, r.open()
+}
+
+// Size returns the size of the replay file
+func (r *Recorder) Size() (int64, error) {
+	return retention.FileSize(r.path)
+}
+
+func recordTime(line []byte) (time.Time, error) {
+	var rec struct {
+		Time time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return time.Time{}, err
+	}
+	return rec.Time, nil
+}
+
+// Load reads all records from a replay file
+func Load(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read parses records from JSON lines
+func Read(rd io.Reader) ([]Record, error) {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var records []Record
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// Outcome of re-evaluating one record
+type Outcome int
+
+const (
+	// Unchanged means the proposed policy reaches the recorded decision
+	Unchanged Outcome = iota
+	// NewlyDenied means a recorded allow would be denied
+	NewlyDenied
+	// NewlyAllowed means a recorded policy denial would pass
+	NewlyAllowed
+	// Undetermined means the proposed policy passes a record that was denied
+	// before forwarding, so the remote cluster's answer is unknown
+	Undetermined
+)
+
+// Policy is the claim and user validation of a proposed configuration
+type Policy struct {
+	config   *config.Config
+	clusters map[string]bool
+	mappers  map[string]*claims.Mapper
+}
+
+// NewPolicy compiles the policy of cfg
+func NewPolicy(cfg *config.Config) (*Policy, error) {
+	mappers, err := claims.Compile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{config: cfg, clusters: map[string]bool{}, mappers: mappers}
+	for name := range cfg.Clusters {
+		p.clusters[name] = true
+	}
+	return p, nil
+}
+
+// Evaluate re-runs the policy on rec. A cluster missing from the proposed
+// configuration denies everything.
+func (p *Policy) Evaluate(rec Record) (Outcome, error) {
+	allowed, err := p.evaluate(rec)
+	switch {
+	case allowed && rec.Allowed:
+		return Unchanged, nil
+	case !allowed && rec.Allowed:
+		return NewlyDenied, err
+	case allowed && !rec.Forwarded:
+		return Undetermined, nil
+	case allowed:
+		return NewlyAllowed, nil
+	}
+	return Unchanged, err
+}
+
+func (p *Policy) evaluate(rec Record) (bool, error) {
+	if !p.clusters[rec.Cluster] {
+		return false, fmt.Errorf("cluster %q is not configured", rec.Cluster)
+	}
+	mapper := p.mappers[rec.Cluster]
+	if err := mapper.ValidateClaims(rec.Claims); err != nil {
+		return false, err
+	}
+	if !rec.Forwarded {
+		return true, nil
+	}
+	if rec.RemoteUser == nil {
+		// The remote cluster rejected the token; policy cannot change that
+		return false, fmt.Errorf("rejected by remote cluster")
+	}
+
+	user := *rec.RemoteUser.DeepCopy()
+	if mapper.HasMappings() {
+		mapped, err := mapper.MapUser(rec.Claims)
+		if err != nil {
+			return false, err
+		}
+		user = *mapped
+	}
+	claims.ApplyTemplates(p.config, rec.Cluster, rec.Claims, &user)
+	if err := mapper.ValidateUser(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ClusterReport summarizes a replay for one cluster
+type ClusterReport struct {
+	Records       int `json:"records"`
+	Allowed       int `json:"allowed"`
+	NewlyDenied   int `json:"newlyDenied"`
+	NewlyAllowed  int `json:"newlyAllowed"`
+	Undetermined  int `json:"undetermined"`
+	UniqueDenials int `json:"uniqueDenials"`
+}
+
+// Report summarizes a replay
+type Report struct {
+	ClusterReport
+	Clusters map[string]*ClusterReport `json:"clusters"`
+	// DenialReasons counts why newly denied records would fail
+	DenialReasons map[string]int `json:"denialReasons,omitempty"`
+}
+
+// Run evaluates records against the policy
+func (p *Policy) Run(records []Record) *Report {
+	report := &Report{Clusters: map[string]*ClusterReport{}, DenialReasons: map[string]int{}}
+	denied := map[string]map[string]bool{}
+
+	for _, rec := range records {
+		cr := report.Clusters[rec.Cluster]
+		if cr == nil {
+			cr = &ClusterReport{}
+			report.Clusters[rec.Cluster] = cr
+			denied[rec.Cluster] = map[string]bool{}
+		}
+
+		outcome, err := p.Evaluate(rec)
+		for _, r := range []*ClusterReport{cr, &report.ClusterReport} {
+			r.Records++
+			if rec.Allowed {
+				r.Allowed++
+			}
+			switch outcome {
+			case NewlyDenied:
+				r.NewlyDenied++
+			case NewlyAllowed:
+				r.NewlyAllowed++
+			case Undetermined:
+				r.Undetermined++
+			}
+		}
+		if outcome == NewlyDenied {
+			if err != nil {
+				report.DenialReasons[err.Error()]++
+			}
+			if !denied[rec.Cluster][rec.ClaimsDigest] {
+				denied[rec.Cluster][rec.ClaimsDigest] = true
+				cr.UniqueDenials++
+				report.UniqueDenials++
+			}
+		}
+	}
+	return report
+}
+
+// ClusterNames returns the clusters in the report, sorted
+func (r *Report) ClusterNames() []string {
+	names := make([]string, 0, len(r.Clusters))
+	for name := range r.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
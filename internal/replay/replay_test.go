@@ -0,0 +1,111 @@
+package replay
+
+import (
+	"path/filepath"
+	"testing"
+
+	authnv1 "k8s.io/api/authentication/v1"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func record(cluster, namespace string, allowed bool) *Record {
+	rec := NewRecord(cluster, map[string]any{
+		"sub":           "system:serviceaccount:" + namespace + ":app",
+		"jti":           "unique-" + namespace,
+		"kubernetes.io": map[string]any{"namespace": namespace},
+	})
+	rec.Forward(&authnv1.UserInfo{Username: "system:serviceaccount:" + namespace + ":app"})
+	if allowed {
+		rec.Allow()
+	} else {
+		rec.Deny("denied")
+	}
+	return rec
+}
+
+func TestRecorder_RollingWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.jsonl")
+	r, err := New(&config.ReplaySettings{Path: path, MaxRecords: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 7 {
+		r.Record(record("cluster-b", "default", true))
+	}
+
+	records, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compacted to 3 after the 6th record, then one more appended
+	if len(records) != 4 {
+		t.Errorf("records = %d, want 4", len(records))
+	}
+	if _, ok := records[0].Claims["jti"]; ok {
+		t.Error("jti was persisted")
+	}
+	if records[0].ClaimsDigest == "" {
+		t.Error("claims digest is empty")
+	}
+}
+
+func TestRecorder_Nil(t *testing.T) {
+	var r *Recorder
+	rec := r.Start("cluster-b", map[string]any{"sub": "x"})
+	if rec != nil {
+		t.Fatalf("Start on nil recorder = %v, want nil", rec)
+	}
+	rec.Allow()
+	r.Record(rec)
+}
+
+func TestPolicy_Run(t *testing.T) {
+	cfg := &config.Config{Clusters: map[string]config.ClusterConfig{
+		"cluster-b": {
+			Issuer: "https://kubernetes.default.svc",
+			ClaimValidationRules: []config.ClaimValidationRule{{
+				Expression: `claims["kubernetes.io"].namespace != "kube-system"`,
+				Message:    "kube-system tokens are not accepted",
+			}},
+		},
+	}}
+	policy, err := NewPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	neverForwarded := NewRecord("cluster-b", map[string]any{"kubernetes.io": map[string]any{"namespace": "default"}})
+	neverForwarded.Deny("claim validation failed")
+
+	records := []Record{
+		*record("cluster-b", "default", true),
+		*record("cluster-b", "kube-system", true),
+		*record("cluster-b", "kube-system", true),
+		*record("cluster-b", "default", false),
+		*neverForwarded,
+		*record("cluster-c", "default", true),
+	}
+	report := policy.Run(records)
+
+	if report.Records != 6 || report.Allowed != 4 {
+		t.Errorf("records/allowed = %d/%d, want 6/4", report.Records, report.Allowed)
+	}
+	// Two kube-system allows plus the removed cluster-c
+	if report.NewlyDenied != 3 {
+		t.Errorf("newly denied = %d, want 3", report.NewlyDenied)
+	}
+	if report.UniqueDenials != 2 {
+		t.Errorf("unique denials = %d, want 2", report.UniqueDenials)
+	}
+	if report.NewlyAllowed != 1 {
+		t.Errorf("newly allowed = %d, want 1", report.NewlyAllowed)
+	}
+	if report.Undetermined != 1 {
+		t.Errorf("undetermined = %d, want 1", report.Undetermined)
+	}
+	if got := report.Clusters["cluster-c"].NewlyDenied; got != 1 {
+		t.Errorf("cluster-c newly denied = %d, want 1", got)
+	}
+}
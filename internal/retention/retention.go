@@ -0,0 +1,150 @@
+// Package retention bounds the on-disk history kept by the audit log and the
+// decision replay window, dropping the oldest records by age and total size.
+package retention
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+)
+
+// DefaultInterval is how often stores are compacted
+const DefaultInterval = 10 * time.Minute
+
+// Store is a JSON lines file that can be compacted in place
+type Store interface {
+	// Compact drops records outside settings and returns how many were dropped
+	Compact(settings config.RetentionSettings) (int, error)
+	// Size returns the store's current size in bytes
+	Size() (int64, error)
+}
+
+// TimestampFunc extracts a record's time from one JSON line
+type TimestampFunc func(line []byte) (time.Time, error)
+
+// CompactFile rewrites path keeping only the lines within settings, and
+// returns how many lines were dropped. Lines are assumed to be in
+// chronological order; the oldest are dropped first. The caller must hold
+// off appends to path, and reopen it afterwards since the file is replaced.
+func CompactFile(path string, settings config.RetentionSettings, timestamp TimestampFunc) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	start := 0
+	if settings.MaxAge > 0 {
+		cutoff := time.Now().Add(-settings.MaxAge)
+		for start < len(lines) {
+			ts, err := timestamp(bytes.TrimSpace(lines[start]))
+			if err == nil && !ts.Before(cutoff) {
+				break
+			}
+			// Unparseable lines at the head are dropped with the expired ones
+			start++
+		}
+	}
+	if maxBytes := settings.MaxBytes(); maxBytes > 0 {
+		size := int64(0)
+		for _, line := range lines[start:] {
+			size += int64(len(line))
+		}
+		for start < len(lines) && size > maxBytes {
+			size -= int64(len(lines[start]))
+			start++
+		}
+	}
+	if start == 0 {
+		return 0, nil
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines[start:] {
+		w.Write(line)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+	return start, nil
+}
+
+// FileSize returns the size of path, or 0 if it does not exist
+func FileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Target is a named store and the retention applied to it
+type Target struct {
+	Name     string
+	Store    Store
+	Settings config.RetentionSettings
+}
+
+// Run compacts every target each interval until ctx is done, and publishes
+// kfa_storage_bytes after each pass. It runs a first pass immediately.
+func Run(ctx context.Context, interval time.Duration, targets []Target) {
+	for {
+		for _, t := range targets {
+			if err := compact(t); err != nil {
+				log.Printf("Retention: %s: %v", t.Name, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func compact(t Target) error {
+	if t.Settings.MaxAge > 0 || t.Settings.MaxBytes() > 0 {
+		dropped, err := t.Store.Compact(t.Settings)
+		if err != nil {
+			return fmt.Errorf("compacting: %w", err)
+		}
+		if dropped > 0 {
+			log.Printf("Retention: dropped %d record(s) from %s", dropped, t.Name)
+			metrics.RetentionDropped.WithLabelValues(t.Name).Add(float64(dropped))
+		}
+	}
+	size, err := t.Store.Size()
+	if err != nil {
+		return fmt.Errorf("measuring size: %w", err)
+	}
+	metrics.StorageBytes.WithLabelValues(t.Name).Set(float64(size))
+	return nil
+}
@@ -0,0 +1,81 @@
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func lineTime(line []byte) (time.Time, error) {
+	var rec struct {
+		Time time.Time `json:"time"`
+	}
+	err := json.Unmarshal(line, &rec)
+	return rec.Time, err
+}
+
+func writeLines(t *testing.T, path string, ages ...time.Duration) {
+	t.Helper()
+	var b strings.Builder
+	for i, age := range ages {
+		fmt.Fprintf(&b, `{"time":%q,"n":%d,"pad":%q}`+"\n", time.Now().Add(-age).Format(time.RFC3339Nano), i, strings.Repeat("x", 400<<10))
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	tests := []struct {
+		name        string
+		settings    config.RetentionSettings
+		wantDropped int
+	}{
+		{"unlimited", config.RetentionSettings{}, 0},
+		{"by age", config.RetentionSettings{MaxAge: 90 * time.Minute}, 2},
+		// four lines of ~400KiB; 1MiB keeps the last two
+		{"by size", config.RetentionSettings{MaxSizeMB: 1}, 2},
+		{"age then size", config.RetentionSettings{MaxAge: 150 * time.Minute, MaxSizeMB: 1}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeLines(t, path, 3*time.Hour, 2*time.Hour, time.Hour, 0)
+
+			dropped, err := CompactFile(path, tt.settings, lineTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dropped != tt.wantDropped {
+				t.Errorf("dropped = %d, want %d", dropped, tt.wantDropped)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(lines) != 4-tt.wantDropped {
+				t.Fatalf("lines = %d, want %d", len(lines), 4-tt.wantDropped)
+			}
+			// The newest record is always kept
+			if !strings.Contains(lines[len(lines)-1], `"n":3`) {
+				t.Errorf("last line = %.40s, want record 3", lines[len(lines)-1])
+			}
+		})
+	}
+}
+
+func TestCompactFile_Missing(t *testing.T) {
+	dropped, err := CompactFile(filepath.Join(t.TempDir(), "missing"), config.RetentionSettings{MaxAge: time.Hour}, lineTime)
+	if err != nil || dropped != 0 {
+		t.Errorf("CompactFile on missing file = %d, %v; want 0, nil", dropped, err)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/oidc"
+)
+
+type authError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// requireCaller rejects requests without a bearer token that verifies against
+// the configured cluster and matches the caller allowlist.
+func requireCaller(verifier *oidc.VerifierManager, settings *config.ReadAuthSettings, next http.Handler) http.Handler {
+	if settings == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || strings.TrimSpace(token) == "" {
+			writeAuthError(w, http.StatusUnauthorized, "unauthorized", "bearer token required")
+			return
+		}
+
+		claims, err := verifier.Verify(r.Context(), settings.Cluster, strings.TrimSpace(token))
+		if err != nil {
+			log.Printf("Caller authentication failed for %s: %v", r.URL.Path, err)
+			writeAuthError(w, http.StatusUnauthorized, "unauthorized", "invalid bearer token")
+			return
+		}
+
+		if !settings.IsAllowedCaller(claims.Subject) {
+			log.Printf("Caller %s not allowed to access %s", claims.Subject, r.URL.Path)
+			writeAuthError(w, http.StatusForbidden, "forbidden", "caller not allowed")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAuthError(w http.ResponseWriter, code int, errCode, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(authError{Error: errCode, Message: msg})
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+)
+
+// limitInFlight bounds the number of concurrent requests served by next.
+// Requests over the limit are rejected immediately instead of queueing,
+// so slow upstream discovery cannot pile up unbounded goroutines.
+func limitInFlight(endpoint string, limit config.LimitSettings, next http.Handler) http.Handler {
+	inFlight := metrics.InFlightRequests.WithLabelValues(endpoint)
+	rejected := metrics.RejectedRequests.WithLabelValues(endpoint)
+
+	if limit.MaxInFlight <= 0 {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inFlight.Inc()
+			defer inFlight.Dec()
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	sem := make(chan struct{}, limit.MaxInFlight)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+		default:
+			rejected.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(1))
+			http.Error(w, "too many requests in flight", limit.RejectStatus)
+			return
+		}
+		defer func() { <-sem }()
+
+		inFlight.Inc()
+		defer inFlight.Dec()
+		next.ServeHTTP(w, r)
+	})
+}
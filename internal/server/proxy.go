@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// realClientIP rewrites r.RemoteAddr to the originating client address when
+// the request arrives through a trusted proxy. X-Forwarded-For is walked from
+// the right so that entries appended by untrusted hops cannot spoof the client.
+func realClientIP(trusted []netip.Prefix, next http.Handler) http.Handler {
+	if len(trusted) == 0 {
+		return next
+	}
+
+	isTrusted := func(addr netip.Addr) bool {
+		addr = addr.Unmap()
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := parseRemoteAddr(r.RemoteAddr)
+		if !ok || !isTrusted(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+		if len(hops) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr
+			if !isTrusted(addr) {
+				break
+			}
+		}
+
+		r.RemoteAddr = client.Unmap().String()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func parseRemoteAddr(remoteAddr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
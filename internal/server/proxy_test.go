@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func TestRealClientIP(t *testing.T) {
+	trusted, err := config.ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"untrusted peer ignores header", "203.0.113.5:1234", "198.51.100.1", "203.0.113.5:1234"},
+		{"trusted peer uses client", "10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		{"skips trusted hops", "10.1.2.3:1234", "198.51.100.1, 192.168.1.1, 10.9.9.9", "198.51.100.1"},
+		{"spoofed leftmost entry", "10.1.2.3:1234", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"no header keeps peer", "10.1.2.3:1234", "", "10.1.2.3:1234"},
+		{"garbage stops walk", "10.1.2.3:1234", "198.51.100.1, not-an-ip", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := realClientIP(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,37 +1,147 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rophy/kube-federated-auth/internal/audit"
+	"github.com/rophy/kube-federated-auth/internal/authz"
+	"github.com/rophy/kube-federated-auth/internal/claims"
 	"github.com/rophy/kube-federated-auth/internal/config"
 	"github.com/rophy/kube-federated-auth/internal/credentials"
+	"github.com/rophy/kube-federated-auth/internal/errreport"
 	"github.com/rophy/kube-federated-auth/internal/handler"
+	"github.com/rophy/kube-federated-auth/internal/metrics"
+	"github.com/rophy/kube-federated-auth/internal/mirror"
 	"github.com/rophy/kube-federated-auth/internal/oidc"
+	"github.com/rophy/kube-federated-auth/internal/replay"
+	"github.com/rophy/kube-federated-auth/internal/retention"
+	"github.com/rophy/kube-federated-auth/internal/tracing"
+	"github.com/rophy/kube-federated-auth/internal/version"
 )
 
-// Server holds the HTTP handler and verifier manager
+// Server holds the HTTP handlers and verifier manager
 type Server struct {
-	Handler  http.Handler
+	Handler http.Handler
+	// Admin serves operator-only endpoints and must not be exposed publicly
+	Admin    http.Handler
 	Verifier *oidc.VerifierManager
 }
 
-func New(cfg *config.Config, credStore *credentials.Store, version string) *Server {
+// Options toggles optional server features
+type Options struct {
+	// EnablePprof mounts net/http/pprof under /debug/pprof/ on the admin handler
+	EnablePprof bool
+	// ErrorReporter is notified of verifier creation failures
+	ErrorReporter *errreport.Tracker
+	// BackupKey seals the credential backups of /admin/backup; nil disables
+	// backups
+	BackupKey []byte
+}
+
+func New(cfg *config.Config, credStore *credentials.Store, opts Options) (*Server, error) {
+	mappers, err := claims.Compile(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("compiling claim rules: %w", err)
+	}
+
+	trustedProxies, err := config.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	auditor, err := audit.New(cfg.Audit)
+	if err != nil {
+		return nil, fmt.Errorf("setting up audit log: %w", err)
+	}
+
+	replayer, err := replay.New(cfg.Replay)
+	if err != nil {
+		return nil, fmt.Errorf("setting up decision replay: %w", err)
+	}
+
+	shadow, err := mirror.New(cfg.Mirror)
+	if err != nil {
+		return nil, fmt.Errorf("setting up mirroring: %w", err)
+	}
+
+	var targets []retention.Target
+	if file := auditor.File(); file != nil {
+		targets = append(targets, retention.Target{Name: "audit", Store: file, Settings: retentionOf(cfg.Audit.Retention)})
+	}
+	if replayer != nil {
+		targets = append(targets, retention.Target{Name: "replay", Store: replayer, Settings: retentionOf(cfg.Replay.Retention)})
+	}
+	if len(targets) > 0 {
+		go retention.Run(context.Background(), retention.DefaultInterval, targets)
+	}
+
+	metrics.SetBuildInfo(version.Get())
+
 	r := chi.NewRouter()
 
+	r.Use(func(next http.Handler) http.Handler { return realClientIP(trustedProxies, next) })
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
+	r.Use(tracing.Middleware)
 
-	verifier := oidc.NewVerifierManager(cfg, credStore)
+	verifier := oidc.NewVerifierManager(cfg, credStore, opts.ErrorReporter)
+	metrics.SetJWKSAgeSource(verifier.KeySetAges)
 
-	r.Get("/health", handler.NewHealthHandler(version).ServeHTTP)
-	r.Get("/clusters", handler.NewClustersHandler(cfg, credStore).ServeHTTP)
-	r.Post("/apis/authentication.k8s.io/v1/tokenreviews", handler.NewTokenReviewHandler(verifier, cfg, credStore).ServeHTTP)
+	heartbeats := handler.NewHeartbeats()
+	clustersHandler := handler.NewClustersHandler(cfg, credStore).WithHeartbeats(heartbeats)
+	tokenReviewHandler := handler.NewTokenReviewHandler(verifier, cfg, credStore, mappers, auditor, replayer)
+
+	r.Get("/health", handler.NewHealthHandler(version.Version).ServeHTTP)
+	r.Get("/healthz/ready", handler.NewReadyHandler(cfg, verifier).ServeHTTP)
+	r.Get("/healthz/webhook/{cluster}", handler.NewWebhookHealthHandler(cfg, verifier).ServeHTTP)
+	r.Get("/version", handler.NewVersionHandler().ServeHTTP)
+	r.Get("/metrics", metrics.Handler().ServeHTTP)
+	r.Get("/config/schema", handler.NewSchemaHandler().ServeHTTP)
+	clusters := limitInFlight("clusters", cfg.GetLimit("clusters"), requireCaller(verifier, cfg.ReadAuth, clustersHandler))
+	r.Method(http.MethodGet, "/clusters", clusters)
+	r.Method(http.MethodGet, "/clusters/{name}", clusters)
+	heartbeat := handler.NewHeartbeatHandler(tokenReviewHandler, heartbeats)
+	r.Post("/heartbeat", heartbeat.ServeHTTP)
+	r.Get("/heartbeat/config", heartbeat.ServeConfig)
+	tokenReview := limitInFlight("tokenreview", cfg.GetLimit("tokenreview"), shadow.Wrap(tokenReviewHandler))
+	r.Method(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", tokenReview)
+	r.Method(http.MethodPost, "/apis/authentication.k8s.io/v1beta1/tokenreviews", tokenReview)
+	r.Method(http.MethodPost, "/tokenreview/{cluster}", tokenReview)
+	r.Method(http.MethodPost, "/sar", limitInFlight("sar", cfg.GetLimit("sar"), handler.NewSubjectAccessReviewHandler(authz.NewRulePolicy(cfg.Authorization))))
+
+	admin := chi.NewRouter()
+	admin.Use(middleware.Logger)
+	admin.Use(middleware.Recoverer)
+	admin.Get("/debug/state", handler.NewDebugStateHandler(cfg, verifier, credStore).ServeHTTP)
+	logLevel := handler.NewLogLevelHandler(cfg)
+	admin.Get("/admin/loglevel", logLevel.ServeHTTP)
+	admin.Put("/admin/loglevel", logLevel.ServeHTTP)
+	admin.Get("/admin/effective-config", handler.NewEffectiveConfigHandler(cfg).ServeHTTP)
+	admin.Get("/admin/keys", handler.NewKeysHandler(verifier).ServeHTTP)
+	admin.Delete("/admin/credentials/{cluster}", handler.NewCredentialsHandler(credStore, verifier).ServeHTTP)
+	backup := handler.NewBackupHandler(credStore, opts.BackupKey, verifier)
+	admin.Get("/admin/backup", backup.ServeHTTP)
+	admin.Post("/admin/backup", backup.ServeHTTP)
+	if opts.EnablePprof {
+		// Serves /debug/pprof/* and /debug/vars
+		admin.Mount("/debug", middleware.Profiler())
+	}
 
 	return &Server{
 		Handler:  r,
+		Admin:    admin,
 		Verifier: verifier,
+	}, nil
+}
+
+func retentionOf(settings *config.RetentionSettings) config.RetentionSettings {
+	if settings == nil {
+		return config.RetentionSettings{}
 	}
+	return *settings
 }
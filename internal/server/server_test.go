@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rophy/kube-federated-auth/internal/config"
+)
+
+func TestPprofOnlyOnAdmin(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: map[string]config.ClusterConfig{
+			"cluster-a": {Issuer: "https://a.example.com"},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		enabled   bool
+		wantAdmin int
+	}{
+		{"enabled", true, http.StatusOK},
+		{"disabled", false, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := New(cfg, nil, Options{EnablePprof: tt.enabled})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			srv.Admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/pprof/goroutine?debug=1", nil))
+			if w.Code != tt.wantAdmin {
+				t.Errorf("admin status = %d, want %d", w.Code, tt.wantAdmin)
+			}
+
+			w = httptest.NewRecorder()
+			srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/pprof/goroutine?debug=1", nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("public status = %d, want %d", w.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Package version holds build information embedded at link time:
+//
+//	go build -ldflags "-X github.com/rophy/kube-federated-auth/internal/version.Version=v1.2.3 \
+//	  -X github.com/rophy/kube-federated-auth/internal/version.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/rophy/kube-federated-auth/internal/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time via -ldflags "-X ..."
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build info. Commit and BuildDate fall back to the VCS
+// stamp recorded by the Go toolchain when not set via ldflags.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	return info
+}
+
+// String formats the info for -version output
+func (i Info) String() string {
+	s := fmt.Sprintf("%s (commit %s, %s", i.Version, i.Commit, i.GoVersion)
+	if i.BuildDate != "" {
+		s += ", built " + i.BuildDate
+	}
+	return s + ")"
+}
@@ -3,12 +3,16 @@ set -e
 
 # Get version from git
 VERSION=$(git describe --tags --always)
+COMMIT=$(git rev-parse HEAD)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
 IMAGE="rophy/kube-federated-auth:${VERSION}"
 
 echo "Building ${IMAGE} with VERSION=${VERSION}"
 
 docker build \
   --build-arg VERSION="${VERSION}" \
+  --build-arg COMMIT="${COMMIT}" \
+  --build-arg BUILD_DATE="${BUILD_DATE}" \
   -t "${IMAGE}" \
   .
 